@@ -17,13 +17,28 @@
 package main
 
 import (
+	"fmt"
 	"github.com/AletheiaWareLLC/conveygo"
 	"html/template"
 	"log"
 	"net/http"
 )
 
-func AccountHandler(sessions SessionStore, ledger *conveygo.Ledger, template *template.Template) func(w http.ResponseWriter, r *http.Request) {
+const (
+	ERROR_UNRECOGNIZED_ACTION = "Unrecognized action: %s"
+)
+
+type AccountTemplate struct {
+	Error         string
+	Alias         string
+	Balance       int64
+	Owed          int64
+	Frozen        bool
+	Flagged       bool
+	PaymentMethod []*PaymentMethod
+}
+
+func AccountHandler(sessions SessionStore, users conveygo.UserStore, payments PaymentProcessor, ledger *conveygo.Ledger, clawbacks *Clawbacks, flags FraudFlags, template *template.Template) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		log.Println(r.RemoteAddr, r.Proto, r.Method, r.Host, r.URL.Path, r.Header)
 		// If not signed in, redirect to sign in page
@@ -35,15 +50,32 @@ func AccountHandler(sessions SessionStore, ledger *conveygo.Ledger, template *te
 				if err == nil {
 					http.SetCookie(w, CreateSignInSessionCookie(id, sessions.GetSignInSessionTimeout()))
 				}
+				if session.Account == nil {
+					session.Account = &AccountSession{}
+				}
+				s := session.Account
+				registration, err := users.GetRegistration(session.Alias)
+				if err != nil {
+					log.Println(err)
+				}
 				switch r.Method {
 				case "GET":
 					// Show account page
-					data := struct {
-						Alias   string
-						Balance int64
-					}{
+					data := &AccountTemplate{
+						Error:   s.Error,
 						Alias:   session.Alias,
 						Balance: ledger.GetBalance(session.Alias),
+						Owed:    clawbacks.Outstanding(session.Alias),
+						Frozen:  clawbacks.IsFrozen(session.Alias),
+						Flagged: IsFlagged(flags, session.Alias),
+					}
+					if registration != nil && payments != nil {
+						data.PaymentMethod, err = payments.GetPaymentMethods(registration.CustomerId)
+						if err != nil {
+							log.Println(err)
+							http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+							return
+						}
 					}
 
 					if err := template.Execute(w, data); err != nil {
@@ -52,7 +84,28 @@ func AccountHandler(sessions SessionStore, ledger *conveygo.Ledger, template *te
 					}
 					return
 				case "POST":
-					// TODO
+					s.Error = ""
+					action := r.FormValue("action")
+					paymentMethodId := r.FormValue("payment-method")
+					if registration == nil || payments == nil {
+						http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+						return
+					}
+					switch action {
+					case "default":
+						if err := payments.SetDefaultPaymentMethod(registration.CustomerId, paymentMethodId); err != nil {
+							log.Println(err)
+							s.Error = err.Error()
+						}
+					case "detach":
+						if err := payments.DetachPaymentMethod(registration.CustomerId, paymentMethodId); err != nil {
+							log.Println(err)
+							s.Error = err.Error()
+						}
+					default:
+						s.Error = fmt.Sprintf(ERROR_UNRECOGNIZED_ACTION, action)
+					}
+					RedirectAccount(w, r)
 					return
 				default:
 					log.Println("Unsupported method", r.Method)
@@ -22,21 +22,48 @@ import (
 	"github.com/AletheiaWareLLC/bcgo"
 	"github.com/AletheiaWareLLC/conveygo"
 	"github.com/AletheiaWareLLC/conveyservergo"
+	"github.com/AletheiaWareLLC/financego"
 	"github.com/AletheiaWareLLC/testinggo"
 	"html/template"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 	"time"
 )
 
 func makeAccountTemplate(t *testing.T) *template.Template {
 	t.Helper()
-	tmplt, err := template.New("").Parse(`{{ .Alias }}{{ .Balance }}`)
+	tmplt, err := template.New("").Parse(`{{ .Alias }}{{ .Balance }}{{ range .PaymentMethod }}{{ .ID }}{{ if .Default }}*{{ end }}{{ end }}`)
 	testinggo.AssertNoError(t, err)
 	return tmplt
 }
 
+func makeMockUserStore(t *testing.T, customerId string) *MockUserStore {
+	t.Helper()
+	return &MockUserStore{
+		MemoryStore: conveygo.NewMemoryStore(),
+		CustomerId:  customerId,
+	}
+}
+
+// MockUserStore is a MemoryStore with a registration for every alias
+type MockUserStore struct {
+	*conveygo.MemoryStore
+	CustomerId string
+}
+
+func (m *MockUserStore) GetRegistration(alias string) (*financego.Registration, error) {
+	if m.CustomerId == "" {
+		return nil, nil
+	}
+	return &financego.Registration{
+		CustomerAlias: alias,
+		CustomerId:    m.CustomerId,
+	}, nil
+}
+
 func TestAccountHandler(t *testing.T) {
 	alias := "Alice"
 	key, err := rsa.GenerateKey(rand.Reader, 4096)
@@ -56,7 +83,7 @@ func TestAccountHandler(t *testing.T) {
 		request.AddCookie(main.CreateSignInSessionCookie(session, time.Hour))
 		response := httptest.NewRecorder()
 
-		handler := main.AccountHandler(sessionstore, ledger, makeAccountTemplate(t))
+		handler := main.AccountHandler(sessionstore, makeMockUserStore(t, ""), makeMockPaymentProcessor(t), ledger, makeClawbacks(t, ledger), MockFraudFlags{}, makeAccountTemplate(t))
 		handler(response, request)
 
 		if response.Code != http.StatusOK {
@@ -70,6 +97,79 @@ func TestAccountHandler(t *testing.T) {
 			t.Errorf("Wrong response; expected '%s', got '%s'", expected, actual)
 		}
 	})
+	t.Run("GETPaymentMethods", func(t *testing.T) {
+		// Show Payment Methods
+		sessionstore := main.NewMemorySessionStore()
+		session, err := sessionstore.CreateSignInSession(alias, key)
+		testinggo.AssertNoError(t, err)
+
+		ledger := conveygo.NewLedger(&bcgo.Node{})
+		payments := &MockPaymentProcessor{
+			PaymentMethods: []*main.PaymentMethod{
+				{ID: "pm_1"},
+				{ID: "pm_2", Default: true},
+			},
+		}
+
+		request := makeGetAccountRequest(t)
+		request.AddCookie(main.CreateSignInSessionCookie(session, time.Hour))
+		response := httptest.NewRecorder()
+
+		handler := main.AccountHandler(sessionstore, makeMockUserStore(t, "cus_1"), payments, ledger, makeClawbacks(t, ledger), MockFraudFlags{}, makeAccountTemplate(t))
+		handler(response, request)
+
+		if response.Code != http.StatusOK {
+			t.Errorf("Wrong response code; expected '%d', got '%d'", http.StatusOK, response.Code)
+		}
+
+		actual := response.Body.String()
+		expected := "Alice0pm_1pm_2*"
+
+		if actual != expected {
+			t.Errorf("Wrong response; expected '%s', got '%s'", expected, actual)
+		}
+	})
+	for name, tt := range map[string]struct {
+		action        string
+		detached, def string
+		expectedError string
+	}{
+		"POSTDefault": {"default", "", "pm_1", ""},
+		"POSTDetach":  {"detach", "pm_1", "", ""},
+		"POSTUnknown": {"foo", "", "", "Unrecognized action: foo"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			sessionstore := main.NewMemorySessionStore()
+			session, err := sessionstore.CreateSignInSession(alias, key)
+			testinggo.AssertNoError(t, err)
+
+			ledger := conveygo.NewLedger(&bcgo.Node{})
+			payments := makeMockPaymentProcessor(t).(*MockPaymentProcessor)
+
+			request := makePostAccountRequest(t, &url.Values{
+				"action":         {tt.action},
+				"payment-method": {"pm_1"},
+			})
+			request.AddCookie(main.CreateSignInSessionCookie(session, time.Hour))
+			response := httptest.NewRecorder()
+
+			handler := main.AccountHandler(sessionstore, makeMockUserStore(t, "cus_1"), payments, ledger, makeClawbacks(t, ledger), MockFraudFlags{}, makeAccountTemplate(t))
+			handler(response, request)
+
+			if response.Code != http.StatusFound {
+				t.Errorf("Wrong response code; expected '%d', got '%d'", http.StatusFound, response.Code)
+			}
+			if payments.Detached != tt.detached {
+				t.Errorf("Wrong detached; expected '%s', got '%s'", tt.detached, payments.Detached)
+			}
+			if payments.Default != tt.def {
+				t.Errorf("Wrong default; expected '%s', got '%s'", tt.def, payments.Default)
+			}
+			if e := sessionstore.GetSignInSession(session).Account.Error; e != tt.expectedError {
+				t.Errorf("Wrong error; expected '%s', got '%s'", tt.expectedError, e)
+			}
+		})
+	}
 	t.Run("GETNotSignedIn", func(t *testing.T) {
 		// Redirect to Sign In page
 		sessionstore := main.NewMemorySessionStore()
@@ -79,7 +179,7 @@ func TestAccountHandler(t *testing.T) {
 		request := makeGetAccountRequest(t)
 		response := httptest.NewRecorder()
 
-		handler := main.AccountHandler(sessionstore, ledger, makeAccountTemplate(t))
+		handler := main.AccountHandler(sessionstore, makeMockUserStore(t, ""), makeMockPaymentProcessor(t), ledger, makeClawbacks(t, ledger), MockFraudFlags{}, makeAccountTemplate(t))
 		handler(response, request)
 
 		if response.Code != http.StatusFound {
@@ -102,3 +202,10 @@ func makeGetAccountRequest(t *testing.T) *http.Request {
 	testinggo.AssertNoError(t, err)
 	return request
 }
+
+func makePostAccountRequest(t *testing.T, data *url.Values) *http.Request {
+	request, err := http.NewRequest(http.MethodPost, "/account", strings.NewReader(data.Encode()))
+	testinggo.AssertNoError(t, err)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return request
+}
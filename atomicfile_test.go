@@ -0,0 +1,44 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main_test
+
+import (
+	"github.com/AletheiaWareLLC/conveyservergo"
+	"github.com/AletheiaWareLLC/testinggo"
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+func TestWriteFileAtomically(t *testing.T) {
+	dir := testinggo.MakeTempDir(t, "atomic")
+	defer testinggo.UnmakeTempDir(t, dir)
+	p := path.Join(dir, "data.json")
+	testinggo.AssertNoError(t, main.WriteFileAtomically(p, []byte("first"), 0600))
+	testinggo.AssertNoError(t, main.WriteFileAtomically(p, []byte("second"), 0600))
+	data, err := ioutil.ReadFile(p)
+	testinggo.AssertNoError(t, err)
+	if string(data) != "second" {
+		t.Errorf("Wrong data; expected '%s', got '%s'", "second", string(data))
+	}
+	// No temporary files are left behind
+	files, err := ioutil.ReadDir(dir)
+	testinggo.AssertNoError(t, err)
+	if len(files) != 1 {
+		t.Errorf("Wrong files; expected '%d', got '%d'", 1, len(files))
+	}
+}
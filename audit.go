@@ -0,0 +1,239 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/AletheiaWareLLC/bcgo"
+	"github.com/AletheiaWareLLC/conveygo"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const (
+	ERROR_LEDGER_MISMATCH = "Ledger does not match chains: %d discrepancies"
+
+	LEDGER_AUDIT_LIVE    = "live"    // Compared with the ledger of a running server
+	LEDGER_AUDIT_LIBRARY = "library" // Compared with conveygo.Ledger updated from the same chains, a cross-check of the library rather than an audit of a server
+)
+
+// LedgerDiscrepancy is a column of an alias in the live ledger which differs from that recomputed from the chains.
+type LedgerDiscrepancy struct {
+	Alias    string
+	Column   string
+	Live     int64
+	Replayed int64
+}
+
+// LedgerAudit is the result of comparing the live ledger with one recomputed from the chains.
+type LedgerAudit struct {
+	Aliases       int
+	Discrepancies []*LedgerDiscrepancy
+	Negative      []*LedgerEntryTemplate // Recomputed entries with a negative balance
+}
+
+// LoadLedgerChannels adds every channel counted by the ledger to the node, with their heads loaded from the cache.
+func LoadLedgerChannels(node *bcgo.Node) error {
+	load := func(channel *bcgo.Channel) {
+		// Channels without a cached head are empty
+		if err := channel.LoadCachedHead(node.Cache); err == nil {
+			node.AddChannel(channel)
+		}
+	}
+	conversations := conveygo.OpenConversationChannel()
+	for _, c := range []*bcgo.Channel{
+		conveygo.OpenHourChannel(),
+		conveygo.OpenDayChannel(),
+		conveygo.OpenWeekChannel(),
+		conveygo.OpenYearChannel(),
+		conveygo.OpenDecadeChannel(),
+		conveygo.OpenCenturyChannel(),
+		conversations,
+		conveygo.OpenTransactionChannel(),
+	} {
+		load(c)
+	}
+	if conversations.Head == nil {
+		return nil
+	}
+	// Load all message channels listed in conversation channel
+	return bcgo.Iterate(conversations.Name, conversations.Head, nil, node.Cache, nil, func(h []byte, b *bcgo.Block) error {
+		for _, entry := range b.Entry {
+			load(conveygo.OpenMessageChannel(base64.RawURLEncoding.EncodeToString(entry.RecordHash)))
+		}
+		return nil
+	})
+}
+
+// ReplayLedger recomputes every balance from scratch by walking the channels of the node, independently of conveygo.Ledger.Update.
+func ReplayLedger(node *bcgo.Node) (*conveygo.Ledger, error) {
+	entries, err := getHistory(node, func(string) bool {
+		return true
+	}, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	ledger := conveygo.NewLedger(node)
+	for _, e := range entries {
+		amount := uint64(e.Amount)
+		if e.Amount < 0 {
+			amount = uint64(-e.Amount)
+		}
+		switch e.Type {
+		case HISTORY_MINTED:
+			ledger.RecordMinted(e.Alias, amount)
+		case HISTORY_BURNED:
+			ledger.RecordBurned(e.Alias, amount)
+		case HISTORY_BOUGHT:
+			ledger.RecordBought(e.Alias, amount)
+		case HISTORY_SOLD:
+			ledger.RecordSold(e.Alias, amount)
+		case HISTORY_EARNED:
+			ledger.RecordEarned(e.Alias, amount)
+		case HISTORY_SPENT:
+			ledger.RecordSpent(e.Alias, amount)
+		}
+	}
+	return ledger, nil
+}
+
+// FetchLedger returns the live ledger served by a running server at the given URL.
+func FetchLedger(client *http.Client, url string) (*conveygo.Ledger, error) {
+	response, err := client.Get(strings.TrimSuffix(url, "/") + "/ledger.json")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.New(response.Status)
+	}
+	snapshot := &LedgerSnapshot{}
+	if err := json.NewDecoder(response.Body).Decode(snapshot); err != nil {
+		return nil, err
+	}
+	ledger := conveygo.NewLedger(nil)
+	for _, e := range snapshot.Entries {
+		ledger.Aliases[e.Alias] = true
+		ledger.Minted[e.Alias] = e.Minted
+		ledger.Burned[e.Alias] = e.Burned
+		ledger.Bought[e.Alias] = e.Bought
+		ledger.Sold[e.Alias] = e.Sold
+		ledger.Earned[e.Alias] = e.Earned
+		ledger.Spent[e.Alias] = e.Spent
+	}
+	return ledger, nil
+}
+
+// AuditLedger compares each column of every alias in either ledger, and lists the aliases whose recomputed balance is negative.
+func AuditLedger(live, replayed *conveygo.Ledger) *LedgerAudit {
+	aliases := make(map[string]bool)
+	for a := range live.Aliases {
+		aliases[a] = true
+	}
+	for a := range replayed.Aliases {
+		aliases[a] = true
+	}
+	var sorted []string
+	for a := range aliases {
+		sorted = append(sorted, a)
+	}
+	sort.Strings(sorted)
+
+	audit := &LedgerAudit{
+		Aliases: len(sorted),
+	}
+	for _, alias := range sorted {
+		l := NewLedgerEntryTemplate(live, alias)
+		r := NewLedgerEntryTemplate(replayed, alias)
+		for _, c := range []struct {
+			column         string
+			live, replayed int64
+		}{
+			{"minted", int64(l.Minted), int64(r.Minted)},
+			{"burned", int64(l.Burned), int64(r.Burned)},
+			{"bought", int64(l.Bought), int64(r.Bought)},
+			{"sold", int64(l.Sold), int64(r.Sold)},
+			{"earned", int64(l.Earned), int64(r.Earned)},
+			{"spent", int64(l.Spent), int64(r.Spent)},
+			{"balance", l.Balance, r.Balance},
+		} {
+			if c.live != c.replayed {
+				audit.Discrepancies = append(audit.Discrepancies, &LedgerDiscrepancy{
+					Alias:    alias,
+					Column:   c.column,
+					Live:     c.live,
+					Replayed: c.replayed,
+				})
+			}
+		}
+		if r.Balance < 0 {
+			audit.Negative = append(audit.Negative, r)
+		}
+	}
+	return audit
+}
+
+// WriteLedgerAudit writes a report of the audit, labelling the ledger compared with the replay as the given source.
+func WriteLedgerAudit(output io.Writer, audit *LedgerAudit, source string) {
+	fmt.Fprintln(output, "Audited", audit.Aliases, "aliases against the", source, "ledger")
+	for _, d := range audit.Discrepancies {
+		fmt.Fprintln(output, "Discrepancy", d.Alias, d.Column, source, d.Live, "replayed", d.Replayed)
+	}
+	for _, e := range audit.Negative {
+		fmt.Fprintln(output, "Negative balance", e.Alias, e.Balance)
+	}
+	fmt.Fprintln(output, len(audit.Discrepancies), "discrepancies,", len(audit.Negative), "negative balances")
+}
+
+// HandleAudit recomputes the ledger from the chains in the cache and compares it with the live ledger fetched from the running server at the URL given in the args.
+// Without a URL it only cross-checks the replay against conveygo.Ledger updated from the same chains, which finds bugs in either but says nothing about a running server.
+// An error is returned if they don't match.
+func HandleAudit(node *bcgo.Node, args []string, output io.Writer) error {
+	if err := LoadLedgerChannels(node); err != nil {
+		return err
+	}
+	replayed, err := ReplayLedger(node)
+	if err != nil {
+		return err
+	}
+	var live *conveygo.Ledger
+	source := LEDGER_AUDIT_LIVE
+	if len(args) > 0 {
+		live, err = FetchLedger(http.DefaultClient, args[0])
+		if err != nil {
+			return err
+		}
+	} else {
+		fmt.Fprintln(output, "No server URL given, cross-checking the replay against the ledger library only")
+		source = LEDGER_AUDIT_LIBRARY
+		live = conveygo.NewLedger(node)
+		if err := live.UpdateAll(); err != nil {
+			return err
+		}
+	}
+	audit := AuditLedger(live, replayed)
+	WriteLedgerAudit(output, audit, source)
+	if len(audit.Discrepancies) > 0 {
+		return errors.New(fmt.Sprintf(ERROR_LEDGER_MISMATCH, len(audit.Discrepancies)))
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"github.com/AletheiaWareLLC/bcgo"
+	"github.com/AletheiaWareLLC/conveygo"
+	"github.com/AletheiaWareLLC/conveyservergo"
+	"github.com/AletheiaWareLLC/testinggo"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// makeAuditChains mines chains in which the merchant mints, Alice buys tokens and posts, Bob replies, and Charlie transfers tokens he doesn't have.
+func makeAuditChains(t *testing.T) *bcgo.Node {
+	t.Helper()
+	merchantKey := makeKey(t)
+	aliceKey := makeKey(t)
+	bobKey := makeKey(t)
+	charlieKey := makeKey(t)
+	node := makeNode(t, "Merchant", merchantKey)
+	miner := main.NewChannelMiner()
+	hours := bcgo.OpenPoWChannel(conveygo.CONVEY_HOUR, bcgo.THRESHOLD_G)
+	conversations := conveygo.OpenConversationChannel()
+	transactions := conveygo.OpenTransactionChannel()
+	for _, c := range []*bcgo.Channel{hours, conversations, transactions} {
+		node.AddChannel(c)
+	}
+	_, err := main.MineRecord(node, miner, nil, hours, node.Alias, merchantKey, nil, nil, nil, &conveygo.Message{})
+	testinggo.AssertNoError(t, err)
+	testinggo.AssertNoError(t, main.MineTransaction(node, miner, nil, transactions, node.Alias, merchantKey, "Alice", 1000, nil))
+	testinggo.AssertNoError(t, main.MineTransaction(node, miner, nil, transactions, node.Alias, merchantKey, "Bob", 500, nil))
+	testinggo.AssertNoError(t, main.MineTransaction(node, miner, nil, transactions, "Charlie", charlieKey, "Bob", 5, nil))
+	conversation, err := main.MineRecord(node, miner, nil, conversations, "Alice", aliceKey, nil, nil, nil, &conveygo.Conversation{Topic: "Hello"})
+	testinggo.AssertNoError(t, err)
+	messages := conveygo.OpenMessageChannel(base64.RawURLEncoding.EncodeToString(conversation.RecordHash))
+	node.AddChannel(messages)
+	first, err := main.MineRecord(node, miner, nil, messages, "Alice", aliceKey, nil, nil, nil, &conveygo.Message{Content: []byte("Hello World"), Type: conveygo.MediaType_TEXT_PLAIN})
+	testinggo.AssertNoError(t, err)
+	_, err = main.MineRecord(node, miner, nil, messages, "Bob", bobKey, nil, nil, nil, &conveygo.Message{Previous: first.RecordHash, Content: []byte("Hi Alice, this is a reply long enough to earn a few tokens"), Type: conveygo.MediaType_TEXT_PLAIN})
+	testinggo.AssertNoError(t, err)
+	return node
+}
+
+func TestReplayLedger(t *testing.T) {
+	node := makeAuditChains(t)
+	replayed, err := main.ReplayLedger(node)
+	testinggo.AssertNoError(t, err)
+	live := conveygo.NewLedger(node)
+	testinggo.AssertNoError(t, live.UpdateAll())
+	for _, alias := range []string{"Merchant", "Alice", "Bob", "Charlie"} {
+		if !replayed.Aliases[alias] {
+			t.Errorf("Expected alias '%s'", alias)
+		}
+		expected := main.NewLedgerEntryTemplate(live, alias)
+		actual := main.NewLedgerEntryTemplate(replayed, alias)
+		if *actual != *expected {
+			t.Errorf("Wrong entry; expected '%v', got '%v'", expected, actual)
+		}
+	}
+}
+
+func TestAuditLedger(t *testing.T) {
+	node := makeAuditChains(t)
+	replayed, err := main.ReplayLedger(node)
+	testinggo.AssertNoError(t, err)
+	t.Run("Match", func(t *testing.T) {
+		live := conveygo.NewLedger(node)
+		testinggo.AssertNoError(t, live.UpdateAll())
+		audit := main.AuditLedger(live, replayed)
+		if audit.Aliases != 4 {
+			t.Errorf("Wrong number of aliases; expected '%d', got '%d'", 4, audit.Aliases)
+		}
+		if len(audit.Discrepancies) != 0 {
+			t.Errorf("Wrong number of discrepancies; expected '%d', got '%d'", 0, len(audit.Discrepancies))
+		}
+		if len(audit.Negative) != 1 {
+			t.Fatalf("Wrong number of negative balances; expected '%d', got '%d'", 1, len(audit.Negative))
+		}
+		if n := audit.Negative[0]; n.Alias != "Charlie" || n.Balance != -5 {
+			t.Errorf("Wrong negative balance; got '%v'", n)
+		}
+	})
+	t.Run("Mismatch", func(t *testing.T) {
+		live := conveygo.NewLedger(node)
+		testinggo.AssertNoError(t, live.UpdateAll())
+		live.Bought["Bob"] += 5
+		live.RecordMinted("Dan", 10)
+		audit := main.AuditLedger(live, replayed)
+		var actual []string
+		for _, d := range audit.Discrepancies {
+			actual = append(actual, d.Alias+":"+d.Column)
+		}
+		if expected := "Bob:bought,Bob:balance,Dan:minted,Dan:balance"; strings.Join(actual, ",") != expected {
+			t.Errorf("Wrong discrepancies; expected '%s', got '%s'", expected, strings.Join(actual, ","))
+		}
+		if d := audit.Discrepancies[0]; d.Live != d.Replayed+5 {
+			t.Errorf("Wrong discrepancy; got '%v'", d)
+		}
+	})
+}
+
+func TestFetchLedger(t *testing.T) {
+	expected := makeLedger(t)
+	server := httptest.NewServer(http.HandlerFunc(main.LedgerJSONHandler(expected)))
+	defer server.Close()
+	live, err := main.FetchLedger(server.Client(), server.URL+"/")
+	testinggo.AssertNoError(t, err)
+	audit := main.AuditLedger(live, expected)
+	if audit.Aliases != 3 {
+		t.Errorf("Wrong number of aliases; expected '%d', got '%d'", 3, audit.Aliases)
+	}
+	if len(audit.Discrepancies) != 0 {
+		t.Errorf("Wrong number of discrepancies; expected '%d', got '%d'", 0, len(audit.Discrepancies))
+	}
+}
+
+func TestHandleAudit(t *testing.T) {
+	mined := makeAuditChains(t)
+	// A node with no channels open loads them from the cache
+	node := &bcgo.Node{
+		Alias:    mined.Alias,
+		Cache:    mined.Cache,
+		Channels: make(map[string]*bcgo.Channel),
+	}
+	var output bytes.Buffer
+	testinggo.AssertNoError(t, main.HandleAudit(node, nil, &output))
+	if len(node.Channels) != 4 {
+		t.Errorf("Wrong number of channels; expected '%d', got '%d'", 4, len(node.Channels))
+	}
+	for _, expected := range []string{"cross-checking the replay against the ledger library only", "Audited 4 aliases against the library ledger", "Negative balance Charlie -5", "0 discrepancies, 1 negative balances"} {
+		if !strings.Contains(output.String(), expected) {
+			t.Errorf("Wrong output; expected '%s' in '%s'", expected, output.String())
+		}
+	}
+
+	t.Run("Mismatch", func(t *testing.T) {
+		live := conveygo.NewLedger(mined)
+		testinggo.AssertNoError(t, live.UpdateAll())
+		live.Spent["Alice"] += 1
+		server := httptest.NewServer(http.HandlerFunc(main.LedgerJSONHandler(live)))
+		defer server.Close()
+		var output bytes.Buffer
+		testinggo.AssertError(t, "Ledger does not match chains: 2 discrepancies", main.HandleAudit(node, []string{server.URL}, &output))
+		if !strings.Contains(output.String(), "Discrepancy Alice spent live") {
+			t.Errorf("Wrong output; got '%s'", output.String())
+		}
+	})
+}
@@ -0,0 +1,360 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/AletheiaWareLLC/aliasgo"
+	"github.com/AletheiaWareLLC/bcgo"
+	"github.com/AletheiaWareLLC/cryptogo"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	ERROR_BULK_TRANSFER_EMPTY    = "No transfers found"
+	ERROR_BULK_TRANSFER_TOO_MANY = "Too many transfers: %d, maximum %d"
+	ERROR_BULK_TRANSFER_COLUMNS  = "Expected alias,amount, got %d columns"
+	ERROR_BULK_TRANSFER_INVALID  = "%d of %d transfers are invalid"
+
+	MAXIMUM_BULK_TRANSFER_ROWS = 1000
+)
+
+// BulkTransferRow is a single line of a bulk transfer, once mined it holds the hash of its transaction record.
+type BulkTransferRow struct {
+	Number    int
+	Recipient string
+	Quantity  int64
+	Error     string
+	Hash      string
+}
+
+// ParseBulkTransfer reads rows of alias,amount from the given CSV, an optional header row is skipped.
+// Rows which can't be parsed are returned with an error so they can be reported alongside the rest.
+func ParseBulkTransfer(reader io.Reader) ([]*BulkTransferRow, error) {
+	r := csv.NewReader(reader)
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	var rows []*BulkTransferRow
+	for number := 1; ; number++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if number == 1 && len(record) == 2 && strings.EqualFold(strings.TrimSpace(record[0]), "alias") {
+			// Header
+			continue
+		}
+		row := &BulkTransferRow{
+			Number: number,
+		}
+		rows = append(rows, row)
+		if len(record) != 2 {
+			row.Error = fmt.Sprintf(ERROR_BULK_TRANSFER_COLUMNS, len(record))
+			continue
+		}
+		row.Recipient = strings.TrimSpace(record[0])
+		q, err := strconv.ParseInt(strings.TrimSpace(record[1]), 10, 64)
+		if err != nil {
+			row.Error = err.Error()
+			continue
+		}
+		row.Quantity = q
+	}
+	return rows, nil
+}
+
+// CheckBulkTransfer validates the recipient and quantity of every row, and returns the total if the sender can transfer it.
+func CheckBulkTransfer(clawbacks *Clawbacks, flags FraudFlags, aliases *bcgo.Channel, node *bcgo.Node, sender string, rows []*BulkTransferRow) (int64, error) {
+	available := clawbacks.Balance(sender)
+	if IsFlagged(flags, sender) {
+		return 0, errors.New(ERROR_ACCOUNT_FLAGGED)
+	}
+	if available < 0 {
+		return 0, errors.New(fmt.Sprintf(ERROR_ACCOUNT_FROZEN, available))
+	}
+	if len(rows) == 0 {
+		return 0, errors.New(ERROR_BULK_TRANSFER_EMPTY)
+	}
+	if len(rows) > MAXIMUM_BULK_TRANSFER_ROWS {
+		return 0, errors.New(fmt.Sprintf(ERROR_BULK_TRANSFER_TOO_MANY, len(rows), MAXIMUM_BULK_TRANSFER_ROWS))
+	}
+	var total int64
+	invalid := 0
+	for _, row := range rows {
+		if row.Error == "" {
+			if row.Quantity <= 0 {
+				row.Error = fmt.Sprintf(ERROR_INVALID_TOKEN_QUANTITY, row.Quantity)
+			} else if _, err := aliasgo.GetPublicKey(aliases, node.Cache, node.Network, row.Recipient); err != nil {
+				row.Error = fmt.Sprintf(ERROR_NO_SUCH_ALIAS, row.Recipient)
+			}
+		}
+		if row.Error != "" {
+			invalid++
+			continue
+		}
+		total += row.Quantity
+	}
+	if invalid > 0 {
+		return 0, errors.New(fmt.Sprintf(ERROR_BULK_TRANSFER_INVALID, invalid, len(rows)))
+	}
+	if total > available {
+		return 0, errors.New(fmt.Sprintf(ERROR_NOT_ENOUGH_TOKENS_AVAILABLE, total, available))
+	}
+	return total, nil
+}
+
+// MineBulkTransfer writes a transaction for every row and mines them together into a single block, setting the hash of each row's record.
+func MineBulkTransfer(node *bcgo.Node, miner *ChannelMiner, listener bcgo.MiningListener, transactions *bcgo.Channel, senderAlias string, senderKey *rsa.PrivateKey, rows []*BulkTransferRow) error {
+	var entries []*bcgo.BlockEntry
+	for _, row := range rows {
+		record, err := SignTransaction(bcgo.Timestamp(), senderAlias, senderKey, row.Recipient, uint64(row.Quantity), nil)
+		if err != nil {
+			return err
+		}
+		hash, err := cryptogo.HashProtobuf(record)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, &bcgo.BlockEntry{
+			RecordHash: hash,
+			Record:     record,
+		})
+		row.Hash = base64.RawURLEncoding.EncodeToString(hash)
+	}
+
+	if _, err := miner.Mine(node, listener, transactions, entries); err != nil {
+		return err
+	}
+	return nil
+}
+
+// bulkTransferJob returns any reclaimed tokens, then mines a copy of the given rows, so the worker doesn't share them with the session, and reports the hash of each row's record.
+func bulkTransferJob(clawbacks *Clawbacks, miner *ChannelMiner, listener bcgo.MiningListener, transactions *bcgo.Channel, session *SignInSession, rows []*BulkTransferRow) JobFunc {
+	alias, key := session.Alias, session.Key
+	var copied []*BulkTransferRow
+	for _, r := range rows {
+		c := *r
+		copied = append(copied, &c)
+	}
+	return func(node *bcgo.Node) ([]*bcgo.Channel, []string, error) {
+		if err := clawbacks.Settle(node, alias, key); err != nil {
+			return nil, nil, err
+		}
+		if err := MineBulkTransfer(node, miner, listener, transactions, alias, key, copied); err != nil {
+			return nil, nil, err
+		}
+		var hashes []string
+		for _, r := range copied {
+			hashes = append(hashes, r.Hash)
+		}
+		return []*bcgo.Channel{transactions}, hashes, nil
+	}
+}
+
+// bulkTransferJobStatus returns the status of the job mining the bulk transfer held in the session, and the hashes of its records once mined.
+// The status is empty if the transfer hasn't been queued, and a job which the queue has since forgotten is assumed to be done.
+func bulkTransferJobStatus(queue *MiningQueue, s *BulkTransferSession) (string, []string) {
+	if s.Job == "" {
+		return "", nil
+	}
+	job, err := queue.GetJob(s.Job)
+	if err != nil {
+		return JOB_DONE, nil
+	}
+	return job.Status, job.Records
+}
+
+// bulkTransferMined returns true if the job with the given status has mined the transfer.
+func bulkTransferMined(status string) bool {
+	return status == JOB_DONE || status == JOB_PROPAGATING
+}
+
+type BulkTransferTemplate struct {
+	Error     string
+	Available int64
+	Maximum   int
+	Transfers string
+	Row       []*BulkTransferRow
+}
+
+// BulkTransferHandler accepts a CSV of alias,amount, either uploaded or pasted, and validates every row before the transfer can be confirmed.
+func BulkTransferHandler(sessions SessionStore, clawbacks *Clawbacks, flags FraudFlags, aliases *bcgo.Channel, node *bcgo.Node, queue *MiningQueue, template *template.Template) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println(r.RemoteAddr, r.Proto, r.Method, r.Host, r.URL.Path, r.Header)
+		// If not signed in, redirect to sign in page
+		cookie, err := GetSignInSessionCookie(r)
+		if err == nil {
+			session := sessions.GetSignInSession(cookie.Value)
+			if session != nil {
+				id, err := sessions.RefreshSignInSession(session)
+				if err == nil {
+					http.SetCookie(w, CreateSignInSessionCookie(id, sessions.GetSignInSessionTimeout()))
+				}
+				if s := session.BulkTransfer; s == nil {
+					session.BulkTransfer = &BulkTransferSession{}
+				} else if status, _ := bulkTransferJobStatus(queue, s); bulkTransferMined(status) || (r.Method == "POST" && status != "") {
+					// Start a new transfer once the last has been queued, keeping the rows of one which failed so they can be corrected
+					session.BulkTransfer = &BulkTransferSession{}
+				}
+				s := session.BulkTransfer
+				switch r.Method {
+				case "GET":
+					data := &BulkTransferTemplate{
+						Error:     s.Error,
+						Available: clawbacks.Balance(session.Alias),
+						Maximum:   MAXIMUM_BULK_TRANSFER_ROWS,
+						Transfers: s.Transfers,
+						Row:       s.Rows,
+					}
+					if err := template.Execute(w, data); err != nil {
+						log.Println(err)
+						http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+					}
+					return
+				case "POST":
+					s.Error = ""
+					s.Rows = nil
+					s.Transfers = r.FormValue("transfers")
+					var reader io.Reader = strings.NewReader(s.Transfers)
+					if file, _, err := r.FormFile("file"); err == nil {
+						defer file.Close()
+						reader = file
+						s.Transfers = ""
+					}
+					rows, err := ParseBulkTransfer(reader)
+					if err != nil {
+						s.Error = err.Error()
+					} else {
+						s.Rows = rows
+						if total, err := CheckBulkTransfer(clawbacks, flags, aliases, node, session.Alias, rows); err != nil {
+							s.Error = err.Error()
+						} else {
+							s.Total = total
+							RedirectTokenTransferBulkConfirmation(w, r)
+							return
+						}
+					}
+					RedirectTokenTransferBulk(w, r)
+					return
+				default:
+					log.Println("Unsupported method", r.Method)
+				}
+			}
+		}
+		RedirectSignIn(w, r)
+	}
+}
+
+type BulkTransferConfirmationTemplate struct {
+	Error     string
+	Available int64
+	Remaining int64
+	Total     int64
+	Mined     bool
+	Row       []*BulkTransferRow
+}
+
+// BulkTransferConfirmationHandler shows the rows of the bulk transfer held in the session, and mines them once the user confirms, after which it shows the result of each row.
+func BulkTransferConfirmationHandler(sessions SessionStore, clawbacks *Clawbacks, flags FraudFlags, aliases, transactions *bcgo.Channel, node *bcgo.Node, miner *ChannelMiner, listener bcgo.MiningListener, queue *MiningQueue, template *template.Template) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println(r.RemoteAddr, r.Proto, r.Method, r.Host, r.URL.Path, r.Header)
+		// If not signed in, redirect to sign in page
+		cookie, err := GetSignInSessionCookie(r)
+		if err == nil {
+			session := sessions.GetSignInSession(cookie.Value)
+			if session != nil {
+				id, err := sessions.RefreshSignInSession(session)
+				if err == nil {
+					http.SetCookie(w, CreateSignInSessionCookie(id, sessions.GetSignInSessionTimeout()))
+				}
+				s := session.BulkTransfer
+				if s == nil || len(s.Rows) == 0 {
+					// Nothing to confirm
+					RedirectTokenTransferBulk(w, r)
+					return
+				}
+				status, hashes := bulkTransferJobStatus(queue, s)
+				switch r.Method {
+				case "GET":
+					available := clawbacks.Balance(session.Alias)
+					data := &BulkTransferConfirmationTemplate{
+						Error:     s.Error,
+						Available: available,
+						Remaining: available - s.Total,
+						Total:     s.Total,
+						Mined:     bulkTransferMined(status),
+						Row:       s.Rows,
+					}
+					if len(hashes) == len(s.Rows) {
+						// Show the hashes recorded by the job without writing them to the session
+						data.Row = nil
+						for i, row := range s.Rows {
+							c := *row
+							c.Hash = hashes[i]
+							data.Row = append(data.Row, &c)
+						}
+					}
+					if err := template.Execute(w, data); err != nil {
+						log.Println(err)
+						http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+					}
+					return
+				case "POST":
+					if bulkTransferMined(status) {
+						// Already transferred
+						RedirectTokenTransferBulkConfirmation(w, r)
+						return
+					}
+					if status != "" && status != JOB_FAILED {
+						// Already queued
+						RedirectJob(w, r, s.Job)
+						return
+					}
+					s.Error = ""
+					// Check again as the balance may have changed since the transfer was entered
+					if total, err := CheckBulkTransfer(clawbacks, flags, aliases, node, session.Alias, s.Rows); err != nil {
+						s.Error = err.Error()
+					} else if job, err := queue.Enqueue(session.Alias, fmt.Sprintf("Transfer %d tokens to %d aliases", total, len(s.Rows)), "/token-transfer-bulk-confirmation", bulkTransferJob(clawbacks, miner, listener, transactions, session, s.Rows)); err != nil {
+						s.Error = err.Error()
+					} else {
+						s.Total = total
+						s.Job = job.ID
+						RedirectJob(w, r, job.ID)
+						return
+					}
+					RedirectTokenTransferBulk(w, r)
+					return
+				default:
+					log.Println("Unsupported method", r.Method)
+				}
+			}
+		}
+		RedirectSignIn(w, r)
+	}
+}
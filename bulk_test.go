@@ -0,0 +1,283 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"github.com/AletheiaWareLLC/bcgo"
+	"github.com/AletheiaWareLLC/conveygo"
+	"github.com/AletheiaWareLLC/conveyservergo"
+	"github.com/AletheiaWareLLC/testinggo"
+	"html/template"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func formatBulkTransferRows(rows []*main.BulkTransferRow) string {
+	var results []string
+	for _, r := range rows {
+		results = append(results, fmt.Sprintf("%d:%s:%d:%s", r.Number, r.Recipient, r.Quantity, r.Error))
+	}
+	return strings.Join(results, ";")
+}
+
+func TestParseBulkTransfer(t *testing.T) {
+	for name, tt := range map[string]struct {
+		csv      string
+		expected string
+	}{
+		"Empty":      {"", ""},
+		"Single":     {"Bob,10\n", "1:Bob:10:"},
+		"Multiple":   {"Bob,10\nCharlie, 20\n", "1:Bob:10:;2:Charlie:20:"},
+		"Header":     {"alias,amount\nBob,10\n", "2:Bob:10:"},
+		"NoNewline":  {"Bob,10", "1:Bob:10:"},
+		"Columns":    {"Bob\nCharlie,20,Thanks\n", "1::0:Expected alias,amount, got 1 columns;2::0:Expected alias,amount, got 3 columns"},
+		"NotANumber": {"Bob,ten\n", `1:Bob:0:strconv.ParseInt: parsing "ten": invalid syntax`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			rows, err := main.ParseBulkTransfer(strings.NewReader(tt.csv))
+			testinggo.AssertNoError(t, err)
+			if actual := formatBulkTransferRows(rows); actual != tt.expected {
+				t.Errorf("Wrong rows; expected '%s', got '%s'", tt.expected, actual)
+			}
+		})
+	}
+}
+
+func TestCheckBulkTransfer(t *testing.T) {
+	node := makeNode(t, "Merchant", makeKey(t))
+	clawbacks := makeClawbacks(t, conveygo.NewLedger(node))
+	makeAlias(t, node, clawbacks.Aliases, "Bob", makeKey(t))
+	makeAlias(t, node, clawbacks.Aliases, "Charlie", makeKey(t))
+	clawbacks.Ledger.Earned["Alice"] = 100
+
+	for name, tt := range map[string]struct {
+		csv           string
+		flags         MockFraudFlags
+		expectedTotal int64
+		expectedError string
+		expectedRows  string
+	}{
+		"Valid":        {"Bob,10\nCharlie,20\n", MockFraudFlags{}, 30, "", "1:Bob:10:;2:Charlie:20:"},
+		"Empty":        {"", MockFraudFlags{}, 0, main.ERROR_BULK_TRANSFER_EMPTY, ""},
+		"TooMany":      {"Bob,60\nCharlie,50\n", MockFraudFlags{}, 0, "Not enough tokens available: 110 requested, 100 available", "1:Bob:60:;2:Charlie:50:"},
+		"Zero":         {"Bob,0\nCharlie,20\n", MockFraudFlags{}, 0, "1 of 2 transfers are invalid", "1:Bob:0:Invalid token quantity: 0;2:Charlie:20:"},
+		"UnknownAlias": {"Bobb,10\nCharlie,20\nDave,5\n", MockFraudFlags{}, 0, "2 of 3 transfers are invalid", "1:Bobb:10:No such alias: Bobb;2:Charlie:20:;3:Dave:5:No such alias: Dave"},
+		"Unparsable":   {"Bob,ten\n", MockFraudFlags{}, 0, "1 of 1 transfers are invalid", `1:Bob:0:strconv.ParseInt: parsing "ten": invalid syntax`},
+		"Flagged":      {"Bob,10\n", MockFraudFlags{"Alice": &main.FraudFlag{Alias: "Alice"}}, 0, main.ERROR_ACCOUNT_FLAGGED, "1:Bob:10:"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			rows, err := main.ParseBulkTransfer(strings.NewReader(tt.csv))
+			testinggo.AssertNoError(t, err)
+			total, err := main.CheckBulkTransfer(clawbacks, tt.flags, clawbacks.Aliases, node, "Alice", rows)
+			if tt.expectedError == "" {
+				testinggo.AssertNoError(t, err)
+			} else {
+				testinggo.AssertError(t, tt.expectedError, err)
+			}
+			if total != tt.expectedTotal {
+				t.Errorf("Wrong total; expected '%d', got '%d'", tt.expectedTotal, total)
+			}
+			if actual := formatBulkTransferRows(rows); actual != tt.expectedRows {
+				t.Errorf("Wrong rows; expected '%s', got '%s'", tt.expectedRows, actual)
+			}
+		})
+	}
+}
+
+func TestMineBulkTransfer(t *testing.T) {
+	aliceKey := makeKey(t)
+	node := makeNode(t, "Merchant", makeKey(t))
+	clawbacks := makeClawbacks(t, conveygo.NewLedger(node))
+
+	rows, err := main.ParseBulkTransfer(strings.NewReader("Bob,10\nCharlie,20\nDave,30\n"))
+	testinggo.AssertNoError(t, err)
+	testinggo.AssertNoError(t, main.MineBulkTransfer(node, clawbacks.Miner, nil, clawbacks.Transactions, "Alice", aliceKey, rows))
+
+	blocks := 0
+	entries := make(map[string]bool)
+	testinggo.AssertNoError(t, bcgo.Iterate(clawbacks.Transactions.Name, clawbacks.Transactions.Head, nil, node.Cache, node.Network, func(h []byte, b *bcgo.Block) error {
+		blocks++
+		for _, e := range b.Entry {
+			entries[base64.RawURLEncoding.EncodeToString(e.RecordHash)] = true
+		}
+		return nil
+	}))
+	if blocks != 1 {
+		t.Errorf("Wrong number of blocks; expected '%d', got '%d'", 1, blocks)
+	}
+	for _, r := range rows {
+		if !entries[r.Hash] {
+			t.Errorf("Expected record '%s' for row %d to be mined", r.Hash, r.Number)
+		}
+	}
+
+	updateLedger(t, clawbacks)
+	for alias, expected := range map[string]uint64{
+		"Bob":     10,
+		"Charlie": 20,
+		"Dave":    30,
+	} {
+		if b := clawbacks.Ledger.Bought[alias]; b != expected {
+			t.Errorf("Wrong bought for %s; expected '%d', got '%d'", alias, expected, b)
+		}
+	}
+	if s := clawbacks.Ledger.Sold["Alice"]; s != 60 {
+		t.Errorf("Wrong sold; expected '%d', got '%d'", 60, s)
+	}
+}
+
+func TestBulkTransferHandler(t *testing.T) {
+	aliceKey := makeKey(t)
+	node := makeNode(t, "Merchant", makeKey(t))
+	clawbacks := makeClawbacks(t, conveygo.NewLedger(node))
+	makeAlias(t, node, clawbacks.Aliases, "Bob", makeKey(t))
+	makeAlias(t, node, clawbacks.Aliases, "Charlie", makeKey(t))
+	clawbacks.Ledger.Earned["Alice"] = 100
+
+	for name, tt := range map[string]struct {
+		transfers        string
+		file             string
+		expectedLocation string
+		expectedError    string
+		expectedRows     string
+	}{
+		"Text":    {"Bob,10\nCharlie,20", "", "/token-transfer-bulk-confirmation", "", "1:Bob:10:;2:Charlie:20:"},
+		"File":    {"", "alias,amount\nBob,10\n", "/token-transfer-bulk-confirmation", "", "2:Bob:10:"},
+		"Invalid": {"Bob,10\nBobb,20", "", "/token-transfer-bulk", "1 of 2 transfers are invalid", "1:Bob:10:;2:Bobb:20:No such alias: Bobb"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			sessionstore := main.NewMemorySessionStore()
+			session, err := sessionstore.CreateSignInSession("Alice", aliceKey)
+			testinggo.AssertNoError(t, err)
+
+			body := &bytes.Buffer{}
+			writer := multipart.NewWriter(body)
+			testinggo.AssertNoError(t, writer.WriteField("transfers", tt.transfers))
+			if tt.file != "" {
+				part, err := writer.CreateFormFile("file", "payouts.csv")
+				testinggo.AssertNoError(t, err)
+				_, err = part.Write([]byte(tt.file))
+				testinggo.AssertNoError(t, err)
+			}
+			testinggo.AssertNoError(t, writer.Close())
+			request, err := http.NewRequest("POST", "/token-transfer-bulk", body)
+			testinggo.AssertNoError(t, err)
+			request.Header.Add("Content-Type", writer.FormDataContentType())
+			request.AddCookie(main.CreateSignInSessionCookie(session, time.Hour))
+			response := httptest.NewRecorder()
+
+			queue := makeMiningQueue(t, node)
+			defer queue.Stop()
+			main.BulkTransferHandler(sessionstore, clawbacks, MockFraudFlags{}, clawbacks.Aliases, node, queue, nil)(response, request)
+
+			if l := response.Header().Get("Location"); l != tt.expectedLocation {
+				t.Errorf("Wrong location; expected '%s', got '%s'", tt.expectedLocation, l)
+			}
+			s := sessionstore.GetSignInSession(session).BulkTransfer
+			if s.Error != tt.expectedError {
+				t.Errorf("Wrong error; expected '%s', got '%s'", tt.expectedError, s.Error)
+			}
+			if actual := formatBulkTransferRows(s.Rows); actual != tt.expectedRows {
+				t.Errorf("Wrong rows; expected '%s', got '%s'", tt.expectedRows, actual)
+			}
+		})
+	}
+}
+
+func TestBulkTransferConfirmationHandler(t *testing.T) {
+	aliceKey := makeKey(t)
+	node := makeNode(t, "Merchant", makeKey(t))
+	clawbacks := makeClawbacks(t, conveygo.NewLedger(node))
+	makeAlias(t, node, clawbacks.Aliases, "Bob", makeKey(t))
+	makeAlias(t, node, clawbacks.Aliases, "Charlie", makeKey(t))
+	clawbacks.Ledger.Earned["Alice"] = 100
+	tmplt, err := template.New("").Parse(`{{ .Mined }}:{{ .Total }}:{{ .Remaining }}:{{ range .Row }}{{ .Recipient }}={{ .Quantity }}{{ if .Hash }}#{{ end }};{{ end }}`)
+	testinggo.AssertNoError(t, err)
+
+	sessionstore := main.NewMemorySessionStore()
+	session, err := sessionstore.CreateSignInSession("Alice", aliceKey)
+	testinggo.AssertNoError(t, err)
+	cookie := main.CreateSignInSessionCookie(session, time.Hour)
+	rows, err := main.ParseBulkTransfer(strings.NewReader("Bob,10\nCharlie,20\n"))
+	testinggo.AssertNoError(t, err)
+	sessionstore.GetSignInSession(session).BulkTransfer = &main.BulkTransferSession{
+		Rows:  rows,
+		Total: 30,
+	}
+	queue := makeMiningQueue(t, node)
+	defer queue.Stop()
+	handler := main.BulkTransferConfirmationHandler(sessionstore, clawbacks, MockFraudFlags{}, clawbacks.Aliases, clawbacks.Transactions, node, clawbacks.Miner, nil, queue, tmplt)
+
+	request, err := http.NewRequest("GET", "/token-transfer-bulk-confirmation", nil)
+	testinggo.AssertNoError(t, err)
+	request.AddCookie(cookie)
+	response := httptest.NewRecorder()
+	handler(response, request)
+	if expected := "false:30:70:Bob=10;Charlie=20;"; response.Body.String() != expected {
+		t.Errorf("Wrong response; expected '%s', got '%s'", expected, response.Body.String())
+	}
+
+	request, err = http.NewRequest("POST", "/token-transfer-bulk-confirmation", nil)
+	testinggo.AssertNoError(t, err)
+	request.AddCookie(cookie)
+	response = httptest.NewRecorder()
+	handler(response, request)
+	if l := followJob(t, queue, response.Header().Get("Location")); l != "/token-transfer-bulk-confirmation" {
+		t.Errorf("Wrong location; expected '%s', got '%s'", "/token-transfer-bulk-confirmation", l)
+	}
+	s := sessionstore.GetSignInSession(session).BulkTransfer
+	if s.Error != "" {
+		t.Fatalf("Expected no error, got '%s'", s.Error)
+	}
+	for _, r := range s.Rows {
+		if r.Hash != "" {
+			t.Errorf("Expected row %d in the session to be left unchanged, got hash '%s'", r.Number, r.Hash)
+		}
+	}
+
+	updateLedger(t, clawbacks)
+	if b := clawbacks.Balance("Alice"); b != 70 {
+		t.Errorf("Wrong balance; expected '%d', got '%d'", 70, b)
+	}
+
+	// Mined rows are shown with the hashes recorded by the job
+	request, err = http.NewRequest("GET", "/token-transfer-bulk-confirmation", nil)
+	testinggo.AssertNoError(t, err)
+	request.AddCookie(cookie)
+	response = httptest.NewRecorder()
+	handler(response, request)
+	if expected := "true:30:40:Bob=10#;Charlie=20#;"; response.Body.String() != expected {
+		t.Errorf("Wrong response; expected '%s', got '%s'", expected, response.Body.String())
+	}
+
+	// Confirming again doesn't transfer twice
+	request, err = http.NewRequest("POST", "/token-transfer-bulk-confirmation", nil)
+	testinggo.AssertNoError(t, err)
+	request.AddCookie(cookie)
+	response = httptest.NewRecorder()
+	handler(response, request)
+	if l := response.Header().Get("Location"); l != "/token-transfer-bulk-confirmation" {
+		t.Errorf("Wrong location; expected '%s', got '%s'", "/token-transfer-bulk-confirmation", l)
+	}
+}
@@ -0,0 +1,207 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	BUNDLE_CATALOGUE_VERSION = 2
+
+	// Offered when there is no catalogue file
+	DEFAULT_BUNDLE_ID         = "1"
+	DEFAULT_BUNDLE_PRODUCT_ID = "convey-token"
+	DEFAULT_BUNDLE_NAME       = "Token"
+	DEFAULT_BUNDLE_CURRENCY   = "usd"
+	DEFAULT_BUNDLE_PRICE      = 50 // The smallest charge Stripe accepts in USD
+
+	ERROR_DUPLICATE_BUNDLE              = "Duplicate bundle: %s"
+	ERROR_INVALID_BUNDLE                = "Invalid bundle %s: %s"
+	ERROR_UNSUPPORTED_CATALOGUE_VERSION = "Unsupported catalogue version: %d"
+	ERROR_UNSUPPORTED_CURRENCY          = "Unsupported currency: %s"
+)
+
+// Bundle is a quantity of tokens offered for a price in each currency, and the product it is sold as by the payment processor.
+// Prices are in the smallest unit of the currency.
+// A bundle is only offered between Start and End, a zero time leaves that end of the window open.
+type Bundle struct {
+	ID        string
+	ProductId string
+	Name      string
+	Quantity  uint64
+	Prices    map[string]uint64 // Currency -> Price
+	Price     uint64            // Version 1 catalogues have a single price
+	Currency  string            // Version 1 catalogues have a single currency
+	Start     time.Time
+	End       time.Time
+}
+
+// IsActive returns true if the bundle is offered at the given time.
+func (b *Bundle) IsActive(now time.Time) bool {
+	if !b.Start.IsZero() && now.Before(b.Start) {
+		return false
+	}
+	if !b.End.IsZero() && !now.Before(b.End) {
+		return false
+	}
+	return true
+}
+
+// BundleCatalogue is the versioned list of token bundles offered by the server.
+type BundleCatalogue struct {
+	Version int
+	Bundle  []*Bundle
+}
+
+// DefaultBundleCatalogue returns a catalogue offering a single token.
+func DefaultBundleCatalogue() *BundleCatalogue {
+	return &BundleCatalogue{
+		Version: BUNDLE_CATALOGUE_VERSION,
+		Bundle: []*Bundle{
+			{
+				ID:        DEFAULT_BUNDLE_ID,
+				ProductId: DEFAULT_BUNDLE_PRODUCT_ID,
+				Name:      DEFAULT_BUNDLE_NAME,
+				Quantity:  1,
+				Prices: map[string]uint64{
+					DEFAULT_BUNDLE_CURRENCY: DEFAULT_BUNDLE_PRICE,
+				},
+			},
+		},
+	}
+}
+
+// ReadBundleCatalogue reads and validates the catalogue in the given file.
+// If the file doesn't exist the default catalogue is returned, so only a malformed or invalid catalogue is an error.
+func ReadBundleCatalogue(path string) (*BundleCatalogue, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Println("No bundle catalogue at", path, "offering single tokens")
+			return DefaultBundleCatalogue(), nil
+		}
+		return nil, err
+	}
+	catalogue := &BundleCatalogue{}
+	if err := json.Unmarshal(data, catalogue); err != nil {
+		return nil, err
+	}
+	if catalogue.Version == 1 {
+		// Upgrade single price to price per currency
+		for _, b := range catalogue.Bundle {
+			b.Prices = map[string]uint64{
+				b.Currency: b.Price,
+			}
+			b.Price = 0
+			b.Currency = ""
+		}
+		catalogue.Version = BUNDLE_CATALOGUE_VERSION
+	}
+	if err := catalogue.Validate(); err != nil {
+		return nil, err
+	}
+	return catalogue, nil
+}
+
+// Validate returns an error describing the first problem found in the catalogue.
+func (c *BundleCatalogue) Validate() error {
+	if c.Version != BUNDLE_CATALOGUE_VERSION {
+		return errors.New(fmt.Sprintf(ERROR_UNSUPPORTED_CATALOGUE_VERSION, c.Version))
+	}
+	ids := make(map[string]bool)
+	for _, b := range c.Bundle {
+		if b.ID == "" {
+			return errors.New(fmt.Sprintf(ERROR_INVALID_BUNDLE, b.ID, "missing ID"))
+		}
+		if ids[b.ID] {
+			return errors.New(fmt.Sprintf(ERROR_DUPLICATE_BUNDLE, b.ID))
+		}
+		ids[b.ID] = true
+		if b.ProductId == "" {
+			return errors.New(fmt.Sprintf(ERROR_INVALID_BUNDLE, b.ID, "missing product ID"))
+		}
+		if b.Name == "" {
+			return errors.New(fmt.Sprintf(ERROR_INVALID_BUNDLE, b.ID, "missing name"))
+		}
+		if b.Quantity == 0 {
+			return errors.New(fmt.Sprintf(ERROR_INVALID_BUNDLE, b.ID, "zero quantity"))
+		}
+		if len(b.Prices) == 0 {
+			return errors.New(fmt.Sprintf(ERROR_INVALID_BUNDLE, b.ID, "missing prices"))
+		}
+		for currency, price := range b.Prices {
+			if _, ok := Currencies[currency]; !ok {
+				return errors.New(fmt.Sprintf(ERROR_INVALID_BUNDLE, b.ID, fmt.Sprintf(ERROR_UNSUPPORTED_CURRENCY, currency)))
+			}
+			if price == 0 {
+				return errors.New(fmt.Sprintf(ERROR_INVALID_BUNDLE, b.ID, "zero price"))
+			}
+		}
+		if !b.Start.IsZero() && !b.End.IsZero() && !b.Start.Before(b.End) {
+			return errors.New(fmt.Sprintf(ERROR_INVALID_BUNDLE, b.ID, "end before start"))
+		}
+	}
+	return nil
+}
+
+// GetActiveBundles returns the bundles offered at the given time, smallest first.
+func (c *BundleCatalogue) GetActiveBundles(now time.Time) []*Bundle {
+	var bundles []*Bundle
+	for _, b := range c.Bundle {
+		if b.IsActive(now) {
+			bundles = append(bundles, b)
+		}
+	}
+	sort.Slice(bundles, func(i, j int) bool {
+		return bundles[i].Quantity < bundles[j].Quantity
+	})
+	return bundles
+}
+
+// GetActiveCurrencies returns the currencies of the bundles offered at the given time, sorted by code.
+func (c *BundleCatalogue) GetActiveCurrencies(now time.Time) []string {
+	set := make(map[string]bool)
+	for _, b := range c.GetActiveBundles(now) {
+		for currency := range b.Prices {
+			set[currency] = true
+		}
+	}
+	var currencies []string
+	for currency := range set {
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+	return currencies
+}
+
+// GetBundle returns the bundle with the given ID if it is offered at the given time.
+func (c *BundleCatalogue) GetBundle(id string, now time.Time) (*Bundle, error) {
+	for _, b := range c.Bundle {
+		if b.ID == id && b.IsActive(now) {
+			return b, nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf(ERROR_NO_SUCH_PRODUCT, id))
+}
@@ -0,0 +1,156 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main_test
+
+import (
+	"github.com/AletheiaWareLLC/conveyservergo"
+	"github.com/AletheiaWareLLC/testinggo"
+	"io/ioutil"
+	"path"
+	"testing"
+	"time"
+)
+
+func makeBundleCatalogue(t *testing.T, dir, content string) string {
+	t.Helper()
+	p := path.Join(dir, "bundles.json")
+	testinggo.AssertNoError(t, ioutil.WriteFile(p, []byte(content), 0600))
+	return p
+}
+
+func TestReadBundleCatalogue(t *testing.T) {
+	for name, tt := range map[string]struct {
+		content       string
+		expectedError string
+	}{
+		"Valid":               {`{"Version":2,"Bundle":[{"ID":"b1","ProductId":"prod_1","Name":"Starter","Quantity":100,"Prices":{"usd":100}}]}`, ""},
+		"Version1":            {`{"Version":1,"Bundle":[{"ID":"b1","ProductId":"prod_1","Name":"Starter","Quantity":100,"Price":100,"Currency":"usd"}]}`, ""},
+		"MissingPrices":       {`{"Version":2,"Bundle":[{"ID":"b1","ProductId":"prod_1","Name":"Starter","Quantity":100}]}`, "Invalid bundle b1: missing prices"},
+		"Empty":               {`{"Version":2}`, ""},
+		"Malformed":           {`{"Version":2,"Bundle":[`, "unexpected end of JSON input"},
+		"UnsupportedVersion":  {`{"Version":3}`, "Unsupported catalogue version: 3"},
+		"MissingID":           {`{"Version":2,"Bundle":[{"ProductId":"prod_1","Name":"Starter","Quantity":100,"Prices":{"usd":100}}]}`, "Invalid bundle : missing ID"},
+		"Duplicate":           {`{"Version":2,"Bundle":[{"ID":"b1","ProductId":"prod_1","Name":"Starter","Quantity":100,"Prices":{"usd":100}},{"ID":"b1","ProductId":"prod_2","Name":"Starter","Quantity":100,"Prices":{"usd":100}}]}`, "Duplicate bundle: b1"},
+		"MissingProduct":      {`{"Version":2,"Bundle":[{"ID":"b1","Name":"Starter","Quantity":100,"Prices":{"usd":100}}]}`, "Invalid bundle b1: missing product ID"},
+		"MissingName":         {`{"Version":2,"Bundle":[{"ID":"b1","ProductId":"prod_1","Quantity":100,"Prices":{"usd":100}}]}`, "Invalid bundle b1: missing name"},
+		"ZeroQuantity":        {`{"Version":2,"Bundle":[{"ID":"b1","ProductId":"prod_1","Name":"Starter","Prices":{"usd":100}}]}`, "Invalid bundle b1: zero quantity"},
+		"ZeroPrice":           {`{"Version":2,"Bundle":[{"ID":"b1","ProductId":"prod_1","Name":"Starter","Quantity":100,"Prices":{"usd":0}}]}`, "Invalid bundle b1: zero price"},
+		"UnsupportedCurrency": {`{"Version":2,"Bundle":[{"ID":"b1","ProductId":"prod_1","Name":"Starter","Quantity":100,"Prices":{"xyz":100}}]}`, "Invalid bundle b1: Unsupported currency: xyz"},
+		"EndBeforeStart":      {`{"Version":2,"Bundle":[{"ID":"b1","ProductId":"prod_1","Name":"Starter","Quantity":100,"Prices":{"usd":100},"Start":"2020-02-01T00:00:00Z","End":"2020-01-01T00:00:00Z"}]}`, "Invalid bundle b1: end before start"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := testinggo.MakeTempDir(t, "bundle")
+			defer testinggo.UnmakeTempDir(t, dir)
+			catalogue, err := main.ReadBundleCatalogue(makeBundleCatalogue(t, dir, tt.content))
+			if tt.expectedError == "" {
+				testinggo.AssertNoError(t, err)
+				if catalogue.Version != main.BUNDLE_CATALOGUE_VERSION {
+					t.Errorf("Wrong version; expected '%d', got '%d'", main.BUNDLE_CATALOGUE_VERSION, catalogue.Version)
+				}
+			} else {
+				testinggo.AssertError(t, tt.expectedError, err)
+			}
+		})
+	}
+	t.Run("Version1Prices", func(t *testing.T) {
+		dir := testinggo.MakeTempDir(t, "bundle")
+		defer testinggo.UnmakeTempDir(t, dir)
+		catalogue, err := main.ReadBundleCatalogue(makeBundleCatalogue(t, dir, `{"Version":1,"Bundle":[{"ID":"b1","ProductId":"prod_1","Name":"Starter","Quantity":100,"Price":150,"Currency":"eur"}]}`))
+		testinggo.AssertNoError(t, err)
+		if p := catalogue.Bundle[0].Prices["eur"]; p != 150 {
+			t.Errorf("Wrong price; expected '%d', got '%d'", 150, p)
+		}
+	})
+	t.Run("NoSuchFile", func(t *testing.T) {
+		dir := testinggo.MakeTempDir(t, "bundle")
+		defer testinggo.UnmakeTempDir(t, dir)
+		catalogue, err := main.ReadBundleCatalogue(path.Join(dir, "bundles.json"))
+		testinggo.AssertNoError(t, err)
+		// Falls back to single tokens
+		testinggo.AssertNoError(t, catalogue.Validate())
+		bundles := catalogue.GetActiveBundles(time.Now())
+		if len(bundles) != 1 {
+			t.Fatalf("Wrong number of bundles; expected '%d', got '%d'", 1, len(bundles))
+		}
+		if q := bundles[0].Quantity; q != 1 {
+			t.Errorf("Wrong quantity; expected '%d', got '%d'", 1, q)
+		}
+		if p := bundles[0].Prices[main.DEFAULT_BUNDLE_CURRENCY]; p != main.DEFAULT_BUNDLE_PRICE {
+			t.Errorf("Wrong price; expected '%d', got '%d'", main.DEFAULT_BUNDLE_PRICE, p)
+		}
+	})
+}
+
+func TestBundleCatalogue(t *testing.T) {
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	catalogue := &main.BundleCatalogue{
+		Version: main.BUNDLE_CATALOGUE_VERSION,
+		Bundle: []*main.Bundle{
+			{ID: "large", Quantity: 1250, Prices: map[string]uint64{"usd": 1000, "jpy": 1000}},
+			{ID: "small", Quantity: 100, Prices: map[string]uint64{"usd": 100, "eur": 100}},
+			{ID: "expired", Quantity: 200, Prices: map[string]uint64{"gbp": 100}, End: now.AddDate(0, -1, 0)},
+			{ID: "upcoming", Quantity: 300, Start: now.AddDate(0, 1, 0)},
+			{ID: "current", Quantity: 400, Start: now.AddDate(0, -1, 0), End: now.AddDate(0, 1, 0)},
+		},
+	}
+	t.Run("GetActiveBundles", func(t *testing.T) {
+		bundles := catalogue.GetActiveBundles(now)
+		expected := []string{"small", "current", "large"}
+		if len(bundles) != len(expected) {
+			t.Fatalf("Wrong number of bundles; expected '%d', got '%d'", len(expected), len(bundles))
+		}
+		for i, id := range expected {
+			if bundles[i].ID != id {
+				t.Errorf("Wrong bundle; expected '%s', got '%s'", id, bundles[i].ID)
+			}
+		}
+	})
+	t.Run("GetActiveCurrencies", func(t *testing.T) {
+		currencies := catalogue.GetActiveCurrencies(now)
+		expected := []string{"eur", "jpy", "usd"}
+		if len(currencies) != len(expected) {
+			t.Fatalf("Wrong number of currencies; expected '%d', got '%d'", len(expected), len(currencies))
+		}
+		for i, c := range expected {
+			if currencies[i] != c {
+				t.Errorf("Wrong currency; expected '%s', got '%s'", c, currencies[i])
+			}
+		}
+	})
+	for name, tt := range map[string]struct {
+		id            string
+		expectedError string
+	}{
+		"Active":   {"small", ""},
+		"Window":   {"current", ""},
+		"Expired":  {"expired", "No such product: expired"},
+		"Upcoming": {"upcoming", "No such product: upcoming"},
+		"Unknown":  {"foo", "No such product: foo"},
+	} {
+		t.Run("GetBundle_"+name, func(t *testing.T) {
+			bundle, err := catalogue.GetBundle(tt.id, now)
+			if tt.expectedError == "" {
+				testinggo.AssertNoError(t, err)
+				if bundle.ID != tt.id {
+					t.Errorf("Wrong bundle; expected '%s', got '%s'", tt.id, bundle.ID)
+				}
+			} else {
+				testinggo.AssertError(t, tt.expectedError, err)
+			}
+		})
+	}
+}
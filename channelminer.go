@@ -0,0 +1,147 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"github.com/AletheiaWareLLC/bcgo"
+	"github.com/golang/protobuf/proto"
+	"log"
+	"sync"
+	"time"
+)
+
+// pendingEntries are entries waiting to be mined, along with the network of the caller, if any, and the result once they are.
+type pendingEntries struct {
+	entries []*bcgo.BlockEntry
+	network bcgo.Network
+	done    chan struct{}
+	hash    []byte
+	err     error
+}
+
+func (p *pendingEntries) finish(hash []byte, err error) {
+	p.hash = hash
+	p.err = err
+	close(p.done)
+}
+
+// ChannelMiner funnels all mining of a channel through a single writer, so concurrent callers don't race each other for the channel's head.
+// The first caller mines the channel, while entries from callers that arrive in the meantime are merged into its next block.
+// Each caller is given the hash of the block holding its own entries.
+// A block is pushed to the network if any of the callers whose entries it holds is connected, whichever node mined it.
+// If pushing a mined block fails and there is an outbox, the block is left in the outbox to be pushed later, and the entries are treated as mined.
+type ChannelMiner struct {
+	Outbox  Outbox
+	lock    sync.Mutex
+	pending map[*bcgo.Channel][]*pendingEntries // Only contains channels which are being mined
+}
+
+func NewChannelMiner() *ChannelMiner {
+	return &ChannelMiner{
+		pending: make(map[*bcgo.Channel][]*pendingEntries),
+	}
+}
+
+// Mine mines the given entries into a single block of the given channel, pushes the new head to the network, and returns the hash of the block.
+func (m *ChannelMiner) Mine(node *bcgo.Node, listener bcgo.MiningListener, channel *bcgo.Channel, entries []*bcgo.BlockEntry) ([]byte, error) {
+	p := &pendingEntries{
+		entries: entries,
+		network: node.Network,
+		done:    make(chan struct{}),
+	}
+	m.lock.Lock()
+	pending, mining := m.pending[channel]
+	m.pending[channel] = append(pending, p)
+	m.lock.Unlock()
+	if mining {
+		// Wait for the writer to mine these entries
+		<-p.done
+		return p.hash, p.err
+	}
+	for {
+		batch := m.next(channel)
+		if len(batch) == 0 {
+			break
+		}
+		hash, err := m.mine(node, listener, channel, batch)
+		if err != nil && len(batch) > 1 {
+			// One of the entries may be invalid, mine each caller's entries separately so the others aren't rejected too
+			log.Println("Mining merged entries failed, retrying separately", err)
+			for _, b := range batch {
+				b.finish(m.mine(node, listener, channel, []*pendingEntries{b}))
+			}
+			continue
+		}
+		for _, b := range batch {
+			b.finish(hash, err)
+		}
+	}
+	return p.hash, p.err
+}
+
+// next takes as many of the channel's pending entries as fit in a block, or forgets the channel if there are none left.
+func (m *ChannelMiner) next(channel *bcgo.Channel) []*pendingEntries {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	pending := m.pending[channel]
+	if len(pending) == 0 {
+		delete(m.pending, channel)
+		return nil
+	}
+	var size uint64
+	count := 0
+	for _, p := range pending {
+		for _, e := range p.entries {
+			size += uint64(proto.Size(e))
+		}
+		if count > 0 && size > bcgo.MAX_BLOCK_SIZE_BYTES/2 {
+			// Leave the rest for the next block
+			break
+		}
+		count++
+	}
+	m.pending[channel] = pending[count:]
+	return pending[:count]
+}
+
+func (m *ChannelMiner) mine(node *bcgo.Node, listener bcgo.MiningListener, channel *bcgo.Channel, batch []*pendingEntries) ([]byte, error) {
+	var entries []*bcgo.BlockEntry
+	var network bcgo.Network
+	for _, b := range batch {
+		entries = append(entries, b.entries...)
+		if network == nil {
+			network = b.network
+		}
+	}
+	hash, _, err := node.MineEntries(channel, bcgo.THRESHOLD_G, listener, entries)
+	if err != nil {
+		return nil, err
+	}
+	if network != nil {
+		// Entries merged in from a connected caller are pushed, even if the writer isn't connected
+		if err := channel.Push(node.Cache, network); err != nil {
+			if m.Outbox == nil {
+				return nil, err
+			}
+			log.Println("Push failed, adding to outbox", channel.Name, err)
+			if err := m.Outbox.Add(channel.Name, hash, time.Now()); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return hash, nil
+}
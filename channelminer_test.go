@@ -0,0 +1,201 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main_test
+
+import (
+	"fmt"
+	"github.com/AletheiaWareLLC/bcgo"
+	"github.com/AletheiaWareLLC/conveyservergo"
+	"github.com/AletheiaWareLLC/cryptogo"
+	"github.com/AletheiaWareLLC/testinggo"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestChannelMiner(t *testing.T) {
+	key := makeKey(t)
+	node := makeNode(t, "Alice", key)
+	channel := bcgo.OpenPoWChannel("Test", bcgo.THRESHOLD_G)
+	node.AddChannel(channel)
+	miner := main.NewChannelMiner()
+
+	count := 5
+	entries := make([]*bcgo.BlockEntry, count)
+	for i := range entries {
+		_, record, err := bcgo.CreateRecord(bcgo.Timestamp(), "Alice", key, nil, nil, []byte(fmt.Sprintf("Hello %d", i)))
+		testinggo.AssertNoError(t, err)
+		hash, err := cryptogo.HashProtobuf(record)
+		testinggo.AssertNoError(t, err)
+		entries[i] = &bcgo.BlockEntry{
+			RecordHash: hash,
+			Record:     record,
+		}
+	}
+
+	// Mine all entries at once
+	hashes := make([][]byte, count)
+	errs := make([]error, count)
+	var wait sync.WaitGroup
+	for i := range entries {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			hashes[i], errs[i] = miner.Mine(node, nil, channel, []*bcgo.BlockEntry{entries[i]})
+		}(i)
+	}
+	wait.Wait()
+
+	for i, entry := range entries {
+		testinggo.AssertNoError(t, errs[i])
+		block, err := node.Cache.GetBlock(hashes[i])
+		testinggo.AssertNoError(t, err)
+		found := false
+		for _, e := range block.Entry {
+			if string(e.RecordHash) == string(entry.RecordHash) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Expected block of entry %d to contain its record", i)
+		}
+	}
+
+	// Every entry was mined once, onto a single chain
+	mined := 0
+	testinggo.AssertNoError(t, bcgo.Iterate(channel.Name, channel.Head, nil, node.Cache, nil, func(h []byte, b *bcgo.Block) error {
+		mined += len(b.Entry)
+		return nil
+	}))
+	if mined != count {
+		t.Errorf("Wrong number of entries; expected '%d', got '%d'", count, mined)
+	}
+}
+
+func TestChannelMiner_Outbox(t *testing.T) {
+	dir := testinggo.MakeTempDir(t, "outbox")
+	defer testinggo.UnmakeTempDir(t, dir)
+	key := makeKey(t)
+	node := makeNode(t, "Alice", key)
+	node.Network = &MockNetwork{Failures: 1}
+	channel := bcgo.OpenPoWChannel("Test", bcgo.THRESHOLD_G)
+	node.AddChannel(channel)
+	_, record, err := bcgo.CreateRecord(bcgo.Timestamp(), "Alice", key, nil, nil, []byte("Hello"))
+	testinggo.AssertNoError(t, err)
+	hash, err := cryptogo.HashProtobuf(record)
+	testinggo.AssertNoError(t, err)
+
+	t.Run("NoOutbox", func(t *testing.T) {
+		miner := main.NewChannelMiner()
+		_, err := miner.Mine(node, nil, channel, []*bcgo.BlockEntry{{RecordHash: hash, Record: record}})
+		testinggo.AssertError(t, "Broadcast failed", err)
+	})
+	t.Run("Outbox", func(t *testing.T) {
+		miner := main.NewChannelMiner()
+		miner.Outbox = main.NewFileOutbox(path.Join(dir, "outbox.json"))
+		// Fresh network so the broadcast fails again
+		node.Network = &MockNetwork{Failures: 1}
+		block, err := miner.Mine(node, nil, channel, []*bcgo.BlockEntry{{RecordHash: hash, Record: record}})
+		testinggo.AssertNoError(t, err)
+		entry, err := miner.Outbox.Get("Test")
+		testinggo.AssertNoError(t, err)
+		if entry == nil {
+			t.Fatal("Expected channel to be in outbox")
+		}
+		testinggo.AssertHashEqual(t, block, entry.Blocks[0])
+	})
+}
+
+// blockingListener holds up mining until released.
+type blockingListener struct {
+	started chan bool
+	release chan bool
+}
+
+func (l *blockingListener) OnMiningStarted(channel *bcgo.Channel, size uint64) {
+	if l.started != nil {
+		l.started <- true
+		<-l.release
+		l.started = nil
+	}
+}
+
+func (l *blockingListener) OnNewMaxOnes(channel *bcgo.Channel, nonce, ones uint64) {}
+
+func (l *blockingListener) OnMiningThresholdReached(channel *bcgo.Channel, hash []byte, block *bcgo.Block) {
+}
+
+func TestChannelMiner_Merged(t *testing.T) {
+	key := makeKey(t)
+	online := makeNode(t, "Alice", key)
+	network := &MockNetwork{}
+	online.Network = network
+	offline := &bcgo.Node{
+		Alias:    online.Alias,
+		Key:      online.Key,
+		Cache:    online.Cache,
+		Channels: online.Channels,
+	}
+	channel := bcgo.OpenPoWChannel("Test", bcgo.THRESHOLD_G)
+	online.AddChannel(channel)
+	miner := main.NewChannelMiner()
+
+	entries := make([]*bcgo.BlockEntry, 3)
+	for i := range entries {
+		_, record, err := bcgo.CreateRecord(bcgo.Timestamp(), "Alice", key, nil, nil, []byte(fmt.Sprintf("Hello %d", i)))
+		testinggo.AssertNoError(t, err)
+		hash, err := cryptogo.HashProtobuf(record)
+		testinggo.AssertNoError(t, err)
+		entries[i] = &bcgo.BlockEntry{
+			RecordHash: hash,
+			Record:     record,
+		}
+	}
+
+	// An offline caller starts mining, and online callers arrive in the meantime
+	listener := &blockingListener{
+		started: make(chan bool),
+		release: make(chan bool),
+	}
+	errs := make([]error, len(entries))
+	var wait sync.WaitGroup
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		_, errs[0] = miner.Mine(offline, listener, channel, []*bcgo.BlockEntry{entries[0]})
+	}()
+	<-listener.started
+	for i := 1; i < len(entries); i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			_, errs[i] = miner.Mine(online, nil, channel, []*bcgo.BlockEntry{entries[i]})
+		}(i)
+	}
+	time.Sleep(100 * time.Millisecond)
+	listener.release <- true
+	wait.Wait()
+
+	for i := range entries {
+		testinggo.AssertNoError(t, errs[i])
+	}
+	// The offline caller's block isn't pushed, but the block mined for the online callers is
+	if network.Broadcasts == 0 {
+		t.Error("Expected entries from online callers to be pushed")
+	}
+}
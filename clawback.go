@@ -0,0 +1,441 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/AletheiaWareLLC/aliasgo"
+	"github.com/AletheiaWareLLC/bcgo"
+	"github.com/AletheiaWareLLC/conveygo"
+	"github.com/AletheiaWareLLC/cryptogo"
+	"github.com/AletheiaWareLLC/financego"
+	"github.com/golang/protobuf/proto"
+	"log"
+	"strconv"
+	"sync"
+)
+
+/*
+Clawback Policy
+
+When a charge is refunded or disputed the tokens it bought are reclaimed;
+    - The event is mined into the Charge Chain as a Reversal Record which references the original Charge Record, is described by the event type, and declares the number of tokens reclaimed.
+    - The customer owes the reclaimed tokens to the merchant until a Transaction from the customer to the merchant, referencing the Reversal Record, is mined.
+    - A Transaction must be signed by its sender, so the debt is settled with the customer's key the next time they transfer tokens or publish.
+    - If the customer has already spent the tokens the settlement still happens, and leaves their balance negative.
+    - An account with tokens owed or a negative balance is frozen, and cannot transfer tokens or publish until the balance is restored.
+    - If a dispute is won the funds are reinstated and the merchant returns the reclaimed tokens.
+*/
+
+const (
+	ERROR_ACCOUNT_FROZEN = "Account frozen: balance is %d after a refunded or disputed purchase"
+	ERROR_NO_SUCH_CHARGE = "No such charge: %s"
+
+	META_REVERSED_TOKENS = "reversed_token_quantity"
+)
+
+type ChargeRecord struct {
+	Reference *bcgo.Reference
+	Charge    *financego.Charge
+	Quantity  int64 // Tokens bought by the charge
+	Credited  int64 // Tokens transferred to the customer for the charge
+	Reversed  int64 // Tokens reclaimed by refunds and disputes
+	Refunded  int64 // Amount refunded
+}
+
+type Clawbacks struct {
+	Node         *bcgo.Node
+	Miner        *ChannelMiner
+	Listener     bcgo.MiningListener
+	Ledger       *conveygo.Ledger
+	Aliases      *bcgo.Channel
+	Charges      *bcgo.Channel
+	Transactions *bcgo.Channel
+	Processed    map[string]map[string]bool   // Channel Name -> Block Hash -> Processed Flag
+	Charge       map[string]*ChargeRecord     // Charge ID -> Original Charge
+	Credits      map[string]string            // Original Charge Record Hash -> Charge ID
+	Reversals    map[string]string            // Reversal Record Hash -> Customer Alias
+	References   map[string][]*bcgo.Reference // Customer Alias -> Reversal Records
+	Owed         map[string]int64             // Customer Alias -> Tokens Reclaimed
+	Paid         map[string]int64             // Customer Alias -> Tokens Returned
+	Pending      map[string]bool              // Settlement Record Hash -> Counted in Paid while it is mined
+	lock         sync.Mutex
+	reversing    sync.Mutex
+}
+
+func NewClawbacks(node *bcgo.Node, miner *ChannelMiner, listener bcgo.MiningListener, ledger *conveygo.Ledger, aliases, charges, transactions *bcgo.Channel) *Clawbacks {
+	return &Clawbacks{
+		Node:         node,
+		Miner:        miner,
+		Listener:     listener,
+		Ledger:       ledger,
+		Aliases:      aliases,
+		Charges:      charges,
+		Transactions: transactions,
+		Processed:    make(map[string]map[string]bool),
+		Charge:       make(map[string]*ChargeRecord),
+		Credits:      make(map[string]string),
+		Reversals:    make(map[string]string),
+		References:   make(map[string][]*bcgo.Reference),
+		Owed:         make(map[string]int64),
+		Paid:         make(map[string]int64),
+		Pending:      make(map[string]bool),
+	}
+}
+
+// Iterates through unprocessed blocks in the given channel
+func (c *Clawbacks) iterate(channel *bcgo.Channel, callback func([]byte, *bcgo.Block) error) error {
+	processed, ok := c.Processed[channel.Name]
+	if !ok {
+		processed = make(map[string]bool)
+		c.Processed[channel.Name] = processed
+	}
+	// Collect unprocessed blocks so they can be processed chronologically
+	var hashes [][]byte
+	var blocks []*bcgo.Block
+	if err := bcgo.Iterate(channel.Name, channel.Head, nil, c.Node.Cache, c.Node.Network, func(h []byte, b *bcgo.Block) error {
+		if processed[base64.RawURLEncoding.EncodeToString(h)] {
+			return bcgo.StopIterationError{}
+		}
+		hashes = append(hashes, h)
+		blocks = append(blocks, b)
+		return nil
+	}); err != nil {
+		switch err.(type) {
+		case bcgo.StopIterationError:
+			// Do nothing
+			break
+		default:
+			return err
+		}
+	}
+	for i := len(blocks) - 1; i >= 0; i-- {
+		if err := callback(hashes[i], blocks[i]); err != nil {
+			return err
+		}
+		processed[base64.RawURLEncoding.EncodeToString(hashes[i])] = true
+	}
+	return nil
+}
+
+// Update processes any new charges, reversals, and settlements.
+func (c *Clawbacks) Update() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.update()
+}
+
+func (c *Clawbacks) update() error {
+	// Charges and reversals are encrypted, decrypt with merchant's key
+	if err := c.iterate(c.Charges, func(h []byte, b *bcgo.Block) error {
+		for _, entry := range b.Entry {
+			for _, access := range entry.Record.Access {
+				if access.Alias != c.Node.Alias {
+					continue
+				}
+				if err := bcgo.DecryptRecord(entry, access, c.Node.Key, func(e *bcgo.BlockEntry, key, payload []byte) error {
+					charge := &financego.Charge{}
+					if err := proto.Unmarshal(payload, charge); err != nil {
+						return err
+					}
+					reference := &bcgo.Reference{
+						Timestamp:   e.Record.Timestamp,
+						ChannelName: c.Charges.Name,
+						BlockHash:   h,
+						RecordHash:  e.RecordHash,
+					}
+					return c.addCharge(reference, e.Record.Meta, charge)
+				}); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	// Credits reference the charges they credit, settlements reference the reversals they settle
+	return c.iterate(c.Transactions, func(h []byte, b *bcgo.Block) error {
+		for _, entry := range b.Entry {
+			chargeId := ""
+			alias := ""
+			for _, r := range entry.Record.Reference {
+				key := base64.RawURLEncoding.EncodeToString(r.RecordHash)
+				if id, ok := c.Credits[key]; ok {
+					chargeId = id
+					break
+				}
+				if a, ok := c.Reversals[key]; ok {
+					alias = a
+					break
+				}
+			}
+			if chargeId == "" && alias == "" {
+				continue
+			}
+			if key := base64.RawURLEncoding.EncodeToString(entry.RecordHash); c.Pending[key] {
+				// Already counted when it was mined
+				delete(c.Pending, key)
+				continue
+			}
+			t := &conveygo.Transaction{}
+			if err := proto.Unmarshal(entry.Record.Payload, t); err != nil {
+				return err
+			}
+			if chargeId != "" {
+				c.Charge[chargeId].Credited += int64(t.Amount)
+			} else if t.Sender == alias {
+				c.Paid[alias] += int64(t.Amount)
+			} else if t.Receiver == alias {
+				c.Paid[alias] -= int64(t.Amount)
+			}
+		}
+		return nil
+	})
+}
+
+func (c *Clawbacks) addCharge(reference *bcgo.Reference, meta map[string]string, charge *financego.Charge) error {
+	if _, ok := meta[META_STRIPE_EVENT]; ok {
+		// Recorded events don't buy or reclaim tokens
+		return nil
+	}
+	reversed, ok := meta[META_REVERSED_TOKENS]
+	if !ok {
+		// Original Charge
+		record := &ChargeRecord{
+			Reference: reference,
+			Charge:    charge,
+		}
+		if quantity, ok := meta[META_QUANTITY_TOKENS]; ok {
+			q, err := strconv.ParseInt(quantity, 10, 64)
+			if err != nil {
+				return err
+			}
+			record.Quantity = q
+		}
+		c.Charge[charge.ChargeId] = record
+		c.Credits[base64.RawURLEncoding.EncodeToString(reference.RecordHash)] = charge.ChargeId
+		return nil
+	}
+	// Reversal of an earlier Charge
+	r, err := strconv.ParseInt(reversed, 10, 64)
+	if err != nil {
+		return err
+	}
+	alias := charge.CustomerAlias
+	if original, ok := c.Charge[charge.ChargeId]; ok {
+		original.Reversed += r
+		if charge.Description == "charge.refunded" {
+			original.Refunded -= charge.Amount
+		}
+	}
+	c.Owed[alias] += r
+	c.Reversals[base64.RawURLEncoding.EncodeToString(reference.RecordHash)] = alias
+	c.References[alias] = append(c.References[alias], reference)
+	return nil
+}
+
+// GetCharge returns the original charge with the given ID.
+func (c *Clawbacks) GetCharge(chargeId string) (*ChargeRecord, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := c.update(); err != nil {
+		return nil, err
+	}
+	record, ok := c.Charge[chargeId]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf(ERROR_NO_SUCH_CHARGE, chargeId))
+	}
+	return record, nil
+}
+
+// GetCharges returns a copy of every original charge.
+func (c *Clawbacks) GetCharges() ([]*ChargeRecord, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := c.update(); err != nil {
+		return nil, err
+	}
+	var charges []*ChargeRecord
+	for _, r := range c.Charge {
+		record := *r
+		charges = append(charges, &record)
+	}
+	return charges, nil
+}
+
+// Outstanding returns the number of tokens the given alias owes the merchant, negative values are owed by the merchant to the alias.
+func (c *Clawbacks) Outstanding(alias string) int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := c.update(); err != nil {
+		log.Println(err)
+	}
+	return c.Owed[alias] - c.Paid[alias]
+}
+
+// Purchased returns the tokens credited to customers for their charges, less those reclaimed by refunds and disputes.
+// Promo grants and transfers from the merchant don't credit a charge, so aren't counted.
+func (c *Clawbacks) Purchased() int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := c.update(); err != nil {
+		log.Println(err)
+	}
+	var purchased int64
+	for _, r := range c.Charge {
+		purchased += r.Credited - r.Reversed
+	}
+	return purchased
+}
+
+// Balance returns the balance of the given alias once outstanding clawbacks are settled.
+func (c *Clawbacks) Balance(alias string) int64 {
+	return c.Ledger.GetBalance(alias) - c.Outstanding(alias)
+}
+
+// IsFrozen returns true if the given alias cannot transfer or spend tokens.
+func (c *Clawbacks) IsFrozen(alias string) bool {
+	return c.Balance(alias) < 0
+}
+
+// Settle mines, with the given node, a Transaction signed by the given alias and key, returning any tokens owed to the merchant.
+func (c *Clawbacks) Settle(node *bcgo.Node, alias string, key *rsa.PrivateKey) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := c.update(); err != nil {
+		return err
+	}
+	outstanding := c.Owed[alias] - c.Paid[alias]
+	if outstanding <= 0 {
+		return nil
+	}
+	log.Println("Settling Clawback", alias, outstanding)
+	return c.mineSettlement(node, alias, alias, key, node.Alias, outstanding)
+}
+
+// mineSettlement mines a Transaction from sender to receiver which settles paid tokens of the given customer's clawbacks, negative when tokens are returned to the customer.
+// The tokens are counted as paid before the lock, which must be held, is released for mining, so they can't be settled twice by concurrent callers.
+func (c *Clawbacks) mineSettlement(node *bcgo.Node, customer, sender string, key *rsa.PrivateKey, receiver string, paid int64) error {
+	quantity := paid
+	if quantity < 0 {
+		quantity = -quantity
+	}
+	record, err := SignTransaction(bcgo.Timestamp(), sender, key, receiver, uint64(quantity), c.References[customer])
+	if err != nil {
+		return err
+	}
+	hash, err := cryptogo.HashProtobuf(record)
+	if err != nil {
+		return err
+	}
+	pending := base64.RawURLEncoding.EncodeToString(hash)
+	c.Paid[customer] += paid
+	c.Pending[pending] = true
+
+	c.lock.Unlock()
+	_, err = MineSignedRecord(node, c.Miner, c.Listener, c.Transactions, record)
+	c.lock.Lock()
+
+	if err != nil {
+		if c.Pending[pending] {
+			// Not mined, so no longer paid
+			delete(c.Pending, pending)
+			c.Paid[customer] -= paid
+		}
+		return err
+	}
+	return c.update()
+}
+
+// Reverse mines, with the given node, a record of the given event against the original charge so that the total tokens reclaimed from the charge matches the given target.
+// Reversals are mined one at a time, but without holding the lock so balances can still be read while mining.
+func (c *Clawbacks) Reverse(node *bcgo.Node, chargeId, event string, amount, target int64) error {
+	c.reversing.Lock()
+	defer c.reversing.Unlock()
+	c.lock.Lock()
+	if err := c.update(); err != nil {
+		c.lock.Unlock()
+		return err
+	}
+	original, ok := c.Charge[chargeId]
+	if !ok {
+		c.lock.Unlock()
+		return errors.New(fmt.Sprintf(ERROR_NO_SUCH_CHARGE, chargeId))
+	}
+	if target < 0 {
+		target = 0
+	}
+	if original.Quantity > 0 && target > original.Quantity {
+		target = original.Quantity
+	}
+	delta := target - original.Reversed
+	customer := original.Charge.CustomerAlias
+	merchant := original.Charge.MerchantAlias
+	c.lock.Unlock()
+
+	publicKey, err := aliasgo.GetPublicKey(c.Aliases, c.Node.Cache, c.Node.Network, customer)
+	if err != nil {
+		return err
+	}
+
+	reversal := &financego.Charge{
+		MerchantAlias: merchant,
+		CustomerAlias: customer,
+		Processor:     original.Charge.Processor,
+		CustomerId:    original.Charge.CustomerId,
+		PaymentId:     original.Charge.PaymentId,
+		ChargeId:      chargeId,
+		Amount:        amount,
+		Currency:      original.Charge.Currency,
+		Description:   event,
+	}
+	log.Println("Reversal", reversal, delta)
+	if _, err := MineRecord(node, c.Miner, c.Listener, c.Charges, node.Alias, node.Key, map[string]*rsa.PublicKey{
+		customer: publicKey,
+		merchant: &node.Key.PublicKey,
+	}, []*bcgo.Reference{original.Reference}, map[string]string{
+		META_REVERSED_TOKENS: strconv.FormatInt(delta, 10),
+	}, reversal); err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := c.update(); err != nil {
+		return err
+	}
+
+	// Return tokens reclaimed in excess, for example when a dispute is won after the customer settled
+	if outstanding := c.Owed[customer] - c.Paid[customer]; outstanding < 0 {
+		log.Println("Returning Clawback", customer, -outstanding)
+		return c.mineSettlement(node, customer, node.Alias, node.Key, customer, outstanding)
+	}
+	return nil
+}
+
+// ReclaimQuantity returns the number of tokens bought with the given amount out of a charge which bought quantity tokens for total.
+func ReclaimQuantity(quantity, total, amount int64) int64 {
+	if total <= 0 {
+		return 0
+	}
+	// Round up so a partial refund never leaves fractional tokens with the customer
+	return (quantity*amount + total - 1) / total
+}
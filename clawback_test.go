@@ -0,0 +1,207 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main_test
+
+import (
+	"crypto/rsa"
+	"github.com/AletheiaWareLLC/aliasgo"
+	"github.com/AletheiaWareLLC/bcgo"
+	"github.com/AletheiaWareLLC/conveygo"
+	"github.com/AletheiaWareLLC/conveyservergo"
+	"github.com/AletheiaWareLLC/financego"
+	"github.com/AletheiaWareLLC/testinggo"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func makeClawbacks(t *testing.T, ledger *conveygo.Ledger) *main.Clawbacks {
+	t.Helper()
+	return main.NewClawbacks(ledger.Node, main.NewChannelMiner(), nil, ledger, aliasgo.OpenAliasChannel(), conveygo.OpenChargeChannel(), conveygo.OpenTransactionChannel())
+}
+
+func makeCharge(t *testing.T, clawbacks *main.Clawbacks, customer, chargeId string, amount int64, quantity uint64, customerKey *rsa.PrivateKey) {
+	t.Helper()
+	node := clawbacks.Node
+	reference, err := main.MineRecord(node, clawbacks.Miner, nil, clawbacks.Charges, node.Alias, node.Key, map[string]*rsa.PublicKey{
+		customer:   &customerKey.PublicKey,
+		node.Alias: &node.Key.PublicKey,
+	}, nil, map[string]string{
+		main.META_QUANTITY_TOKENS: strconv.FormatUint(quantity, 10),
+	}, &financego.Charge{
+		MerchantAlias: node.Alias,
+		CustomerAlias: customer,
+		ChargeId:      chargeId,
+		Amount:        amount,
+		Currency:      "usd",
+	})
+	testinggo.AssertNoError(t, err)
+	testinggo.AssertNoError(t, main.MineTransaction(node, clawbacks.Miner, nil, clawbacks.Transactions, node.Alias, node.Key, customer, quantity, []*bcgo.Reference{reference}))
+}
+
+func updateLedger(t *testing.T, clawbacks *main.Clawbacks) {
+	t.Helper()
+	testinggo.AssertNoError(t, clawbacks.Ledger.Update(clawbacks.Transactions.Name, clawbacks.Transactions.Head))
+}
+
+func TestClawbacks(t *testing.T) {
+	merchant := "Merchant"
+	merchantKey := makeKey(t)
+	customer := "Alice"
+	customerKey := makeKey(t)
+	setup := func(t *testing.T) *main.Clawbacks {
+		t.Helper()
+		node := makeNode(t, merchant, merchantKey)
+		clawbacks := makeClawbacks(t, conveygo.NewLedger(node))
+		makeAlias(t, node, clawbacks.Aliases, customer, customerKey)
+		makeCharge(t, clawbacks, customer, "ch_1", 100, 100, customerKey)
+		updateLedger(t, clawbacks)
+		return clawbacks
+	}
+	t.Run("NoCharges", func(t *testing.T) {
+		node := makeNode(t, merchant, merchantKey)
+		clawbacks := makeClawbacks(t, conveygo.NewLedger(node))
+		if o := clawbacks.Outstanding(customer); o != 0 {
+			t.Errorf("Wrong outstanding; expected '%d', got '%d'", 0, o)
+		}
+		if clawbacks.IsFrozen(customer) {
+			t.Error("Expected account not to be frozen")
+		}
+		_, err := clawbacks.GetCharge("ch_1")
+		testinggo.AssertError(t, "No such charge: ch_1", err)
+	})
+	t.Run("GetCharge", func(t *testing.T) {
+		clawbacks := setup(t)
+		charge, err := clawbacks.GetCharge("ch_1")
+		testinggo.AssertNoError(t, err)
+		if charge.Quantity != 100 {
+			t.Errorf("Wrong quantity; expected '%d', got '%d'", 100, charge.Quantity)
+		}
+		if charge.Charge.CustomerAlias != customer {
+			t.Errorf("Wrong customer; expected '%s', got '%s'", customer, charge.Charge.CustomerAlias)
+		}
+	})
+	t.Run("PartialRefund", func(t *testing.T) {
+		clawbacks := setup(t)
+		testinggo.AssertNoError(t, clawbacks.Reverse(clawbacks.Node, "ch_1", "charge.refunded", -25, main.ReclaimQuantity(100, 100, 25)))
+		if o := clawbacks.Outstanding(customer); o != 25 {
+			t.Errorf("Wrong outstanding; expected '%d', got '%d'", 25, o)
+		}
+		if b := clawbacks.Balance(customer); b != 75 {
+			t.Errorf("Wrong balance; expected '%d', got '%d'", 75, b)
+		}
+		charge, err := clawbacks.GetCharge("ch_1")
+		testinggo.AssertNoError(t, err)
+		if charge.Refunded != 25 {
+			t.Errorf("Wrong refunded; expected '%d', got '%d'", 25, charge.Refunded)
+		}
+		// Cumulative refund only reclaims the difference
+		testinggo.AssertNoError(t, clawbacks.Reverse(clawbacks.Node, "ch_1", "charge.refunded", -75, main.ReclaimQuantity(100, 100, 100)))
+		if o := clawbacks.Outstanding(customer); o != 100 {
+			t.Errorf("Wrong outstanding; expected '%d', got '%d'", 100, o)
+		}
+	})
+	t.Run("Settle", func(t *testing.T) {
+		clawbacks := setup(t)
+		testinggo.AssertNoError(t, clawbacks.Reverse(clawbacks.Node, "ch_1", "charge.refunded", -100, 100))
+		testinggo.AssertNoError(t, clawbacks.Settle(clawbacks.Node, customer, customerKey))
+		updateLedger(t, clawbacks)
+		if o := clawbacks.Outstanding(customer); o != 0 {
+			t.Errorf("Wrong outstanding; expected '%d', got '%d'", 0, o)
+		}
+		if b := clawbacks.Ledger.GetBalance(customer); b != 0 {
+			t.Errorf("Wrong balance; expected '%d', got '%d'", 0, b)
+		}
+		if b := clawbacks.Ledger.GetBalance(merchant); b != 0 {
+			t.Errorf("Wrong balance; expected '%d', got '%d'", 0, b)
+		}
+	})
+	t.Run("SettleConcurrently", func(t *testing.T) {
+		// Tokens are counted as paid while mining, so they are only returned once
+		clawbacks := setup(t)
+		testinggo.AssertNoError(t, clawbacks.Reverse(clawbacks.Node, "ch_1", "charge.refunded", -100, 100))
+		var wait sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			wait.Add(1)
+			go func() {
+				defer wait.Done()
+				testinggo.AssertNoError(t, clawbacks.Settle(clawbacks.Node, customer, customerKey))
+			}()
+		}
+		wait.Wait()
+		updateLedger(t, clawbacks)
+		if o := clawbacks.Outstanding(customer); o != 0 {
+			t.Errorf("Wrong outstanding; expected '%d', got '%d'", 0, o)
+		}
+		if b := clawbacks.Ledger.GetBalance(customer); b != 0 {
+			t.Errorf("Wrong balance; expected '%d', got '%d'", 0, b)
+		}
+	})
+	t.Run("Spent", func(t *testing.T) {
+		// Customer transfers tokens before refund, settlement leaves balance negative and account frozen
+		clawbacks := setup(t)
+		testinggo.AssertNoError(t, main.MineTransaction(clawbacks.Node, clawbacks.Miner, nil, clawbacks.Transactions, customer, customerKey, "Bob", 60, nil))
+		updateLedger(t, clawbacks)
+		testinggo.AssertNoError(t, clawbacks.Reverse(clawbacks.Node, "ch_1", "charge.refunded", -100, 100))
+		if !clawbacks.IsFrozen(customer) {
+			t.Error("Expected account to be frozen")
+		}
+		testinggo.AssertNoError(t, clawbacks.Settle(clawbacks.Node, customer, customerKey))
+		updateLedger(t, clawbacks)
+		if b := clawbacks.Ledger.GetBalance(customer); b != -60 {
+			t.Errorf("Wrong balance; expected '%d', got '%d'", -60, b)
+		}
+		if !clawbacks.IsFrozen(customer) {
+			t.Error("Expected account to be frozen")
+		}
+	})
+	t.Run("DisputeWon", func(t *testing.T) {
+		clawbacks := setup(t)
+		testinggo.AssertNoError(t, clawbacks.Reverse(clawbacks.Node, "ch_1", "charge.dispute.created", 0, 100))
+		testinggo.AssertNoError(t, clawbacks.Reverse(clawbacks.Node, "ch_1", "charge.dispute.funds_withdrawn", -100, 100))
+		if o := clawbacks.Outstanding(customer); o != 100 {
+			t.Errorf("Wrong outstanding; expected '%d', got '%d'", 100, o)
+		}
+		testinggo.AssertNoError(t, clawbacks.Settle(clawbacks.Node, customer, customerKey))
+		testinggo.AssertNoError(t, clawbacks.Reverse(clawbacks.Node, "ch_1", "charge.dispute.funds_reinstated", 100, 0))
+		updateLedger(t, clawbacks)
+		if o := clawbacks.Outstanding(customer); o != 0 {
+			t.Errorf("Wrong outstanding; expected '%d', got '%d'", 0, o)
+		}
+		if b := clawbacks.Ledger.GetBalance(customer); b != 100 {
+			t.Errorf("Wrong balance; expected '%d', got '%d'", 100, b)
+		}
+	})
+}
+
+func TestReclaimQuantity(t *testing.T) {
+	for name, tt := range map[string]struct {
+		quantity, total, amount, expected int64
+	}{
+		"Full":    {100, 100, 100, 100},
+		"Half":    {1250, 1000, 500, 625},
+		"RoundUp": {25, 50, 1, 1},
+		"None":    {25, 50, 0, 0},
+		"NoTotal": {25, 0, 10, 0},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if actual := main.ReclaimQuantity(tt.quantity, tt.total, tt.amount); actual != tt.expected {
+				t.Errorf("Wrong quantity; expected '%d', got '%d'", tt.expected, actual)
+			}
+		})
+	}
+}
@@ -35,6 +35,7 @@ type ConversationTemplate struct {
 	Cost             uint64
 	Reward           uint64
 	Yield            int64
+	Tips             uint64
 	Author           string
 	Content          template.HTML
 	Replies          []*ReplyTemplate
@@ -48,12 +49,13 @@ type ReplyTemplate struct {
 	Cost             uint64
 	Reward           uint64
 	Yield            int64
+	Tips             uint64
 	Author           string
 	Content          template.HTML
 	Replies          []*ReplyTemplate
 }
 
-func ConversationHandler(sessions SessionStore, messages conveygo.MessageStore, template *template.Template) func(w http.ResponseWriter, r *http.Request) {
+func ConversationHandler(sessions SessionStore, messages conveygo.MessageStore, tips *Tips, template *template.Template) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		log.Println(r.RemoteAddr, r.Proto, r.Method, r.Host, r.URL.Path, r.Header)
 		cookie, err := GetSignInSessionCookie(r)
@@ -95,6 +97,12 @@ func ConversationHandler(sessions SessionStore, messages conveygo.MessageStore,
 				Author:           listing.Author,
 			}
 
+			// Tips are extras, so show the conversation without them rather than not at all
+			totals, err := tips.GetTips(h)
+			if err != nil {
+				log.Println(err)
+			}
+
 			// TODO(v3) limit message count and add "more" button
 			// TODO(v5) if message is encrypted only show if user is signed in, and alias is granted access
 			replies := make(map[string]*ReplyTemplate)
@@ -108,6 +116,7 @@ func ConversationHandler(sessions SessionStore, messages conveygo.MessageStore,
 					data.MessageHash = key
 					data.Content = content
 					data.Cost += cost
+					data.Tips = totals[key]
 				} else {
 					replies[key] = &ReplyTemplate{
 						ConversationHash: h,
@@ -116,6 +125,7 @@ func ConversationHandler(sessions SessionStore, messages conveygo.MessageStore,
 						Timestamp:        bcgo.TimestampToString(timestamp),
 						Cost:             cost,
 						Yield:            -int64(cost),
+						Tips:             totals[key],
 						Author:           author,
 						Content:          content,
 					}
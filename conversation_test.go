@@ -61,7 +61,7 @@ func TestConversationHandler(t *testing.T) {
 		request := makeGetConversationRequest(t, conversationHashString)
 		response := httptest.NewRecorder()
 
-		handler := main.ConversationHandler(sessionstore, datastore, makeConversationTemplate(t))
+		handler := main.ConversationHandler(sessionstore, datastore, main.NewTips(makeNode(t, alias, key), datastore, conveygo.OpenTransactionChannel()), makeConversationTemplate(t))
 		handler(response, request)
 
 		if response.Code != http.StatusOK {
@@ -102,7 +102,7 @@ func TestConversationHandler(t *testing.T) {
 		request := makeGetConversationRequest(t, conversationHashString)
 		response := httptest.NewRecorder()
 
-		handler := main.ConversationHandler(sessionstore, datastore, makeConversationTemplate(t))
+		handler := main.ConversationHandler(sessionstore, datastore, main.NewTips(makeNode(t, alias, key), datastore, conveygo.OpenTransactionChannel()), makeConversationTemplate(t))
 		handler(response, request)
 
 		if response.Code != http.StatusOK {
@@ -151,7 +151,7 @@ func TestConversationHandler(t *testing.T) {
 		request := makeGetConversationRequest(t, conversationHashString)
 		response := httptest.NewRecorder()
 
-		handler := main.ConversationHandler(sessionstore, datastore, makeConversationTemplate(t))
+		handler := main.ConversationHandler(sessionstore, datastore, main.NewTips(makeNode(t, alias, key), datastore, conveygo.OpenTransactionChannel()), makeConversationTemplate(t))
 		handler(response, request)
 
 		if response.Code != http.StatusOK {
@@ -165,6 +165,43 @@ func TestConversationHandler(t *testing.T) {
 			t.Errorf("Wrong response; expected '%s', got '%s'", expected, actual)
 		}
 	})
+	t.Run("Exists_TipsFailed", func(t *testing.T) {
+		datastore := conveygo.NewMemoryStore()
+		sessionstore := main.NewMemorySessionStore()
+		conversationHash, conversationRecord, err := conveygo.ProtoToRecord(alias, key, 0, &conveygo.Conversation{
+			Topic: "Test123",
+		})
+		testinggo.AssertNoError(t, err)
+		messageHash, messageRecord, err := conveygo.ProtoToRecord(alias, key, 0, &conveygo.Message{
+			Content: []byte("Foo"),
+			Type:    conveygo.MediaType_TEXT_PLAIN,
+		})
+		testinggo.AssertNoError(t, err)
+		testinggo.AssertNoError(t, datastore.NewConversation(conversationHash, conversationRecord, messageHash, messageRecord))
+
+		conversationHashString := base64.RawURLEncoding.EncodeToString(conversationHash)
+
+		request := makeGetConversationRequest(t, conversationHashString)
+		response := httptest.NewRecorder()
+
+		// Head of a block which isn't in the cache
+		transactions := conveygo.OpenTransactionChannel()
+		transactions.Head = []byte("missing")
+
+		handler := main.ConversationHandler(sessionstore, datastore, main.NewTips(makeNode(t, alias, key), datastore, transactions), makeConversationTemplate(t))
+		handler(response, request)
+
+		if response.Code != http.StatusOK {
+			t.Errorf("Wrong response code; expected '%d', got '%d'", http.StatusOK, response.Code)
+		}
+
+		actual := response.Body.String()
+		expected := conversationHashString + `1970-01-01 00:00:00Test123<p>Foo</p>`
+
+		if actual != expected {
+			t.Errorf("Wrong response; expected '%s', got '%s'", expected, actual)
+		}
+	})
 	t.Run("NotExists", func(t *testing.T) {
 		datastore := conveygo.NewMemoryStore()
 		sessionstore := main.NewMemorySessionStore()
@@ -172,7 +209,7 @@ func TestConversationHandler(t *testing.T) {
 		request := makeGetConversationRequest(t, "foobar123456")
 		response := httptest.NewRecorder()
 
-		handler := main.ConversationHandler(sessionstore, datastore, makeConversationTemplate(t))
+		handler := main.ConversationHandler(sessionstore, datastore, main.NewTips(makeNode(t, alias, key), datastore, conveygo.OpenTransactionChannel()), makeConversationTemplate(t))
 		handler(response, request)
 
 		if response.Code != http.StatusNotFound {
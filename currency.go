@@ -0,0 +1,150 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	DEFAULT_CURRENCY = "usd"
+)
+
+// Currency describes how amounts in a currency are formatted.
+// Amounts are always handled in the smallest unit of the currency, so a currency with zero decimals, such as the Japanese Yen, is charged in whole units.
+type Currency struct {
+	Code     string
+	Symbol   string
+	Decimals int
+}
+
+// Currencies lists the currencies tokens can be priced in.
+var Currencies = map[string]*Currency{
+	"aud": {"aud", "A$", 2},
+	"cad": {"cad", "CA$", 2},
+	"eur": {"eur", "€", 2},
+	"gbp": {"gbp", "£", 2},
+	"jpy": {"jpy", "¥", 0},
+	"krw": {"krw", "₩", 0},
+	"nzd": {"nzd", "NZ$", 2},
+	"usd": {"usd", "$", 2},
+}
+
+// RegionCurrencies maps the region subtag of a language tag to the currency used in that region.
+var RegionCurrencies = map[string]string{
+	"AT": "eur",
+	"AU": "aud",
+	"BE": "eur",
+	"CA": "cad",
+	"DE": "eur",
+	"ES": "eur",
+	"FI": "eur",
+	"FR": "eur",
+	"GB": "gbp",
+	"IE": "eur",
+	"IT": "eur",
+	"JP": "jpy",
+	"KR": "krw",
+	"NL": "eur",
+	"NZ": "nzd",
+	"PT": "eur",
+	"UK": "gbp",
+	"US": "usd",
+}
+
+// LanguageCurrencies maps a language without a region subtag to the currency most likely used by its speakers.
+var LanguageCurrencies = map[string]string{
+	"de": "eur",
+	"es": "eur",
+	"fi": "eur",
+	"fr": "eur",
+	"it": "eur",
+	"ja": "jpy",
+	"ko": "krw",
+	"nl": "eur",
+	"pt": "eur",
+}
+
+func getDecimals(currency string) int {
+	if c, ok := Currencies[currency]; ok {
+		return c.Decimals
+	}
+	return 2
+}
+
+// AmountToString formats the given amount in the smallest unit of the given currency.
+func AmountToString(currency string, amount int64) string {
+	d := getDecimals(currency)
+	return fmt.Sprintf("%.*f %s", d, float64(amount)/math.Pow10(d), strings.ToUpper(currency))
+}
+
+func getSymbol(currency string) string {
+	if c, ok := Currencies[currency]; ok {
+		return c.Symbol
+	}
+	return strings.ToUpper(currency) + " "
+}
+
+// PriceToString formats the given price in the smallest unit of the given currency with the currency symbol.
+func PriceToString(currency string, price uint64) string {
+	d := getDecimals(currency)
+	return fmt.Sprintf("%s%.*f", getSymbol(currency), d, float64(price)/math.Pow10(d))
+}
+
+// UnitPriceToString formats the given fraction of the smallest unit of the given currency with the currency symbol, keeping all significant digits.
+func UnitPriceToString(currency string, price float64) string {
+	return getSymbol(currency) + strconv.FormatFloat(price/math.Pow10(getDecimals(currency)), 'f', -1, 64)
+}
+
+// DefaultCurrency returns the first of the given currencies used by the locales in the given Accept-Language header.
+// If none match DEFAULT_CURRENCY is returned if available, else the first available currency.
+func DefaultCurrency(acceptLanguage string, available []string) string {
+	offered := make(map[string]bool)
+	for _, a := range available {
+		offered[a] = true
+	}
+	for _, l := range strings.Split(acceptLanguage, ",") {
+		// Drop quality value
+		tag := strings.TrimSpace(strings.Split(l, ";")[0])
+		parts := strings.FieldsFunc(tag, func(r rune) bool {
+			return r == '-' || r == '_'
+		})
+		if len(parts) == 0 {
+			continue
+		}
+		var currency string
+		for _, p := range parts[1:] {
+			if c, ok := RegionCurrencies[strings.ToUpper(p)]; ok {
+				currency = c
+				break
+			}
+		}
+		if currency == "" {
+			currency = LanguageCurrencies[strings.ToLower(parts[0])]
+		}
+		if currency != "" && offered[currency] {
+			return currency
+		}
+	}
+	if offered[DEFAULT_CURRENCY] || len(available) == 0 {
+		return DEFAULT_CURRENCY
+	}
+	return available[0]
+}
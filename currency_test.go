@@ -0,0 +1,101 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main_test
+
+import (
+	"github.com/AletheiaWareLLC/conveyservergo"
+	"testing"
+)
+
+func TestAmountToString(t *testing.T) {
+	for name, tt := range map[string]struct {
+		currency string
+		amount   int64
+		expected string
+	}{
+		"Zero":        {"usd", 0, "0.00 USD"},
+		"Cents":       {"usd", 5, "0.05 USD"},
+		"Whole":       {"eur", 2500, "25.00 EUR"},
+		"ZeroDecimal": {"jpy", 2500, "2500 JPY"},
+		"Unknown":     {"xyz", 2500, "25.00 XYZ"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if s := main.AmountToString(tt.currency, tt.amount); s != tt.expected {
+				t.Errorf("Wrong amount; expected '%s', got '%s'", tt.expected, s)
+			}
+		})
+	}
+}
+
+func TestPriceToString(t *testing.T) {
+	for name, tt := range map[string]struct {
+		currency string
+		price    uint64
+		expected string
+	}{
+		"Dollars":     {"usd", 50, "$0.50"},
+		"Pounds":      {"gbp", 1000, "£10.00"},
+		"ZeroDecimal": {"krw", 1000, "₩1000"},
+		"Unknown":     {"xyz", 1000, "XYZ 10.00"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if s := main.PriceToString(tt.currency, tt.price); s != tt.expected {
+				t.Errorf("Wrong price; expected '%s', got '%s'", tt.expected, s)
+			}
+		})
+	}
+}
+
+func TestUnitPriceToString(t *testing.T) {
+	for name, tt := range map[string]struct {
+		currency string
+		price    float64
+		expected string
+	}{
+		"Dollars":     {"usd", 0.8, "$0.008"},
+		"ZeroDecimal": {"jpy", 0.5, "¥0.5"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if s := main.UnitPriceToString(tt.currency, tt.price); s != tt.expected {
+				t.Errorf("Wrong price; expected '%s', got '%s'", tt.expected, s)
+			}
+		})
+	}
+}
+
+func TestDefaultCurrency(t *testing.T) {
+	for name, tt := range map[string]struct {
+		language  string
+		available []string
+		expected  string
+	}{
+		"Empty":        {"", []string{"eur", "usd"}, "usd"},
+		"Region":       {"en-GB,en;q=0.9", []string{"gbp", "usd"}, "gbp"},
+		"Underscore":   {"fr_CA", []string{"cad", "eur", "usd"}, "cad"},
+		"Language":     {"de", []string{"eur", "usd"}, "eur"},
+		"Fallthrough":  {"en-GB,de;q=0.8", []string{"eur", "usd"}, "eur"},
+		"Unavailable":  {"ja-JP", []string{"eur", "usd"}, "usd"},
+		"NoDefault":    {"ja-JP", []string{"eur", "gbp"}, "eur"},
+		"NoCurrencies": {"ja-JP", nil, "usd"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if c := main.DefaultCurrency(tt.language, tt.available); c != tt.expected {
+				t.Errorf("Wrong currency; expected '%s', got '%s'", tt.expected, c)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/AletheiaWareLLC/conveygo"
+	"html/template"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	ECONOMY_PERIODS     = 30
+	ECONOMY_TOP_EARNERS = 10
+)
+
+// Economy summarizes the flow of tokens through the ledger.
+type Economy struct {
+	Timestamp   time.Time
+	Minted      uint64 // Tokens minted by periodic validation
+	Burned      uint64 // Tokens burned by posts and replies
+	Earned      uint64 // Tokens rewarded to authors replied to
+	Spent       uint64 // Tokens spent on replies
+	Purchased   int64  // Tokens credited for charges, net of those reclaimed by refunds and disputes
+	Supply      int64  // Tokens held by every alias
+	Merchant    int64  // Tokens held by the merchant
+	Circulating int64  // Tokens held by every alias except the merchant
+	Ratio       float64
+	Period      string
+	Periods     []*EconomyPeriod
+	TopEarners  []*LedgerEntryTemplate
+}
+
+// EconomyPeriod is the change in the ledger between consecutive snapshots.
+type EconomyPeriod struct {
+	Start       time.Time
+	End         time.Time
+	Minted      int64
+	Burned      int64
+	Earned      int64
+	Purchased   int64
+	Circulating int64
+	Ratio       float64 // Tokens earned per token burned
+}
+
+// GetEconomy derives the economy from the totals of the ledger maps, the purchases credited for charges, the periods of the most recent snapshots in the history, and the aliases which earned the most.
+// Periods are daily unless hourly is given.
+func GetEconomy(ledger *conveygo.Ledger, clawbacks *Clawbacks, merchant string, history LedgerHistory, period string) (*Economy, error) {
+	period, err := parseLedgerHistoryPeriod(period, LEDGER_HISTORY_DAY)
+	if err != nil {
+		return nil, err
+	}
+	economy := &Economy{
+		Timestamp: time.Now().UTC(),
+		Purchased: clawbacks.Purchased(),
+		Merchant:  ledger.GetBalance(merchant),
+		Period:    period,
+	}
+	for alias := range ledger.Aliases {
+		economy.Minted += ledger.Minted[alias]
+		economy.Burned += ledger.Burned[alias]
+		economy.Earned += ledger.Earned[alias]
+		economy.Spent += ledger.Spent[alias]
+		economy.Supply += ledger.GetBalance(alias)
+	}
+	economy.Circulating = economy.Supply - economy.Merchant
+	economy.Ratio = economyRatio(int64(economy.Earned), int64(economy.Burned))
+
+	// Only read back as far as the periods shown, with one to spare as snapshots aren't exactly a period apart
+	last, err := history.Last()
+	if err != nil {
+		return nil, err
+	}
+	var entries []*LedgerHistoryEntry
+	if last != nil {
+		duration := time.Hour
+		if period == LEDGER_HISTORY_DAY {
+			duration = 24 * time.Hour
+		}
+		entries, err = history.Get(last.Timestamp.Add(-(ECONOMY_PERIODS+2)*duration), time.Time{})
+		if err != nil {
+			return nil, err
+		}
+	}
+	var snapshots []*LedgerHistoryEntry
+	for _, e := range entries {
+		if period == LEDGER_HISTORY_DAY && !e.Daily {
+			continue
+		}
+		snapshots = append(snapshots, e)
+	}
+	if len(snapshots) > ECONOMY_PERIODS+1 {
+		snapshots = snapshots[len(snapshots)-ECONOMY_PERIODS-1:]
+	}
+	// Newest period first
+	for i := len(snapshots) - 1; i > 0; i-- {
+		start, end := snapshots[i-1], snapshots[i]
+		p := &EconomyPeriod{
+			Start:       start.Timestamp,
+			End:         end.Timestamp,
+			Minted:      int64(end.Minted) - int64(start.Minted),
+			Burned:      int64(end.Burned) - int64(start.Burned),
+			Earned:      int64(end.Earned) - int64(start.Earned),
+			Purchased:   end.Purchased - start.Purchased,
+			Circulating: end.Circulating - start.Circulating,
+		}
+		p.Ratio = economyRatio(p.Earned, p.Burned)
+		economy.Periods = append(economy.Periods, p)
+	}
+
+	earners, _, _ := GetLedgerEntries(ledger, "earned", LEDGER_DESCENDING, "")
+	for _, e := range earners {
+		if e.Earned == 0 || len(economy.TopEarners) == ECONOMY_TOP_EARNERS {
+			break
+		}
+		economy.TopEarners = append(economy.TopEarners, e)
+	}
+	return economy, nil
+}
+
+// economyRatio returns the tokens earned per token burned.
+func economyRatio(earned, burned int64) float64 {
+	if burned == 0 {
+		return 0
+	}
+	return float64(earned) / float64(burned)
+}
+
+func EconomyHandler(ledger *conveygo.Ledger, clawbacks *Clawbacks, merchant string, history LedgerHistory, template *template.Template) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println(r.RemoteAddr, r.Proto, r.Method, r.Host, r.URL.Path, r.Header)
+		switch r.Method {
+		case "GET":
+			economy, err := GetEconomy(ledger, clawbacks, merchant, history, r.FormValue("period"))
+			if err != nil {
+				log.Println(err)
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			if err := template.Execute(w, economy); err != nil {
+				log.Println(err)
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			}
+		default:
+			log.Println("Unsupported method", r.Method)
+		}
+	}
+}
+
+// EconomyJSONHandler serves the economy as JSON.
+func EconomyJSONHandler(ledger *conveygo.Ledger, clawbacks *Clawbacks, merchant string, history LedgerHistory) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println(r.RemoteAddr, r.Proto, r.Method, r.Host, r.URL.Path, r.Header)
+		switch r.Method {
+		case "GET":
+			economy, err := GetEconomy(ledger, clawbacks, merchant, history, r.FormValue("period"))
+			if err != nil {
+				log.Println(err)
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			data, err := json.MarshalIndent(economy, "", "  ")
+			if err != nil {
+				log.Println(err)
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if _, err := w.Write(data); err != nil {
+				log.Println(err)
+			}
+		default:
+			log.Println("Unsupported method", r.Method)
+		}
+	}
+}
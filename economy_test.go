@@ -0,0 +1,167 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main_test
+
+import (
+	"encoding/json"
+	"github.com/AletheiaWareLLC/conveygo"
+	"github.com/AletheiaWareLLC/conveyservergo"
+	"github.com/AletheiaWareLLC/testinggo"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+)
+
+func makeEconomyClawbacks(t *testing.T, ledger *conveygo.Ledger) *main.Clawbacks {
+	t.Helper()
+	node := ledger.Node
+	bobKey := makeKey(t)
+	clawbacks := makeClawbacks(t, ledger)
+	makeAlias(t, node, clawbacks.Aliases, "Bob", bobKey)
+	makeCharge(t, clawbacks, "Bob", "ch_1", 100, 60, bobKey)
+	makeCharge(t, clawbacks, "Bob", "ch_2", 100, 40, bobKey)
+	// Half of the second charge is refunded
+	testinggo.AssertNoError(t, clawbacks.Reverse(node, "ch_2", "charge.refunded", -50, main.ReclaimQuantity(40, 100, 50)))
+	// Grants don't credit a charge
+	testinggo.AssertNoError(t, main.MineTransaction(node, clawbacks.Miner, nil, clawbacks.Transactions, node.Alias, node.Key, "Bob", 25, nil))
+	return clawbacks
+}
+
+func TestGetEconomy(t *testing.T) {
+	dir := testinggo.MakeTempDir(t, "economy")
+	defer testinggo.UnmakeTempDir(t, dir)
+	history := makeLedgerHistory(t, path.Join(dir, "ledger-history"))
+	ledger := makeLedger(t)
+	clawbacks := makeEconomyClawbacks(t, ledger)
+	ledger.Earned["Bob"] = 8
+	ledger.Burned["Charlie"] = 4
+
+	economy, err := main.GetEconomy(ledger, clawbacks, "Alice", history, "")
+	testinggo.AssertNoError(t, err)
+	for name, tt := range map[string]struct {
+		expected, actual int64
+	}{
+		"Minted":      {150, int64(economy.Minted)},
+		"Burned":      {4, int64(economy.Burned)},
+		"Earned":      {8, int64(economy.Earned)},
+		"Spent":       {10, int64(economy.Spent)},
+		"Purchased":   {80, economy.Purchased},
+		"Supply":      {144, economy.Supply},
+		"Merchant":    {100, economy.Merchant},
+		"Circulating": {44, economy.Circulating},
+	} {
+		if tt.actual != tt.expected {
+			t.Errorf("Wrong %s; expected '%d', got '%d'", name, tt.expected, tt.actual)
+		}
+	}
+	if economy.Ratio != 2 {
+		t.Errorf("Wrong ratio; expected '%f', got '%f'", 2.0, economy.Ratio)
+	}
+	if len(economy.TopEarners) != 1 || economy.TopEarners[0].Alias != "Bob" {
+		t.Errorf("Wrong top earners; got '%v'", economy.TopEarners)
+	}
+
+	for name, tt := range map[string]struct {
+		period   string
+		expected []*main.EconomyPeriod
+	}{
+		"Day": {"day", []*main.EconomyPeriod{
+			{Minted: 100, Burned: 30, Earned: 15, Purchased: 30, Circulating: 30, Ratio: 0.5},
+		}},
+		"Hour": {"hour", []*main.EconomyPeriod{
+			{Minted: 90, Burned: 20, Earned: 12, Purchased: 20, Circulating: 20, Ratio: 0.6},
+			{Minted: 10, Burned: 10, Earned: 3, Purchased: 10, Circulating: 10, Ratio: 0.3},
+		}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			economy, err := main.GetEconomy(ledger, clawbacks, "Alice", history, tt.period)
+			testinggo.AssertNoError(t, err)
+			if economy.Period != tt.period {
+				t.Errorf("Wrong period; expected '%s', got '%s'", tt.period, economy.Period)
+			}
+			if len(economy.Periods) != len(tt.expected) {
+				t.Fatalf("Wrong number of periods; expected '%d', got '%d'", len(tt.expected), len(economy.Periods))
+			}
+			for i, e := range tt.expected {
+				a := economy.Periods[i]
+				if a.Minted != e.Minted || a.Burned != e.Burned || a.Earned != e.Earned || a.Purchased != e.Purchased || a.Circulating != e.Circulating || a.Ratio != e.Ratio {
+					t.Errorf("Wrong period; expected '%v', got '%v'", e, a)
+				}
+				if !a.End.After(a.Start) {
+					t.Errorf("Wrong period; expected end '%s' after start '%s'", a.End, a.Start)
+				}
+			}
+		})
+	}
+	t.Run("Empty", func(t *testing.T) {
+		economy, err := main.GetEconomy(ledger, clawbacks, "Alice", main.NewFileLedgerHistory(path.Join(dir, "empty")), "")
+		testinggo.AssertNoError(t, err)
+		if len(economy.Periods) != 0 {
+			t.Errorf("Wrong number of periods; expected '%d', got '%d'", 0, len(economy.Periods))
+		}
+	})
+}
+
+func TestEconomyHandlers(t *testing.T) {
+	dir := testinggo.MakeTempDir(t, "economy")
+	defer testinggo.UnmakeTempDir(t, dir)
+	history := makeLedgerHistory(t, path.Join(dir, "ledger-history"))
+	ledger := makeLedger(t)
+	clawbacks := makeEconomyClawbacks(t, ledger)
+	tmplt, err := template.New("").Parse(`{{ .Period }}:{{ .Minted }}:{{ .Circulating }}:{{ len .Periods }}`)
+	testinggo.AssertNoError(t, err)
+	t.Run("Page", func(t *testing.T) {
+		request, err := http.NewRequest(http.MethodGet, "/economy?period=hour", nil)
+		testinggo.AssertNoError(t, err)
+		response := httptest.NewRecorder()
+		main.EconomyHandler(ledger, clawbacks, "Alice", history, tmplt)(response, request)
+		if expected, actual := "hour:150:40:2", response.Body.String(); actual != expected {
+			t.Errorf("Wrong response; expected '%s', got '%s'", expected, actual)
+		}
+	})
+	t.Run("InvalidPeriod", func(t *testing.T) {
+		request, err := http.NewRequest(http.MethodGet, "/economy?period=week", nil)
+		testinggo.AssertNoError(t, err)
+		response := httptest.NewRecorder()
+		main.EconomyHandler(ledger, clawbacks, "Alice", history, tmplt)(response, request)
+		if response.Code != http.StatusNotFound {
+			t.Errorf("Wrong response code; expected '%d', got '%d'", http.StatusNotFound, response.Code)
+		}
+	})
+	t.Run("JSON", func(t *testing.T) {
+		request, err := http.NewRequest(http.MethodGet, "/economy.json", nil)
+		testinggo.AssertNoError(t, err)
+		response := httptest.NewRecorder()
+		main.EconomyJSONHandler(ledger, clawbacks, "Alice", history)(response, request)
+		if c := response.Header().Get("Content-Type"); c != "application/json" {
+			t.Errorf("Wrong content type; expected '%s', got '%s'", "application/json", c)
+		}
+		economy := &main.Economy{}
+		testinggo.AssertNoError(t, json.Unmarshal(response.Body.Bytes(), economy))
+		if economy.Period != "day" {
+			t.Errorf("Wrong period; expected '%s', got '%s'", "day", economy.Period)
+		}
+		if economy.Purchased != 80 {
+			t.Errorf("Wrong purchased; expected '%d', got '%d'", 80, economy.Purchased)
+		}
+		if len(economy.Periods) != 1 {
+			t.Errorf("Wrong number of periods; expected '%d', got '%d'", 1, len(economy.Periods))
+		}
+	})
+}
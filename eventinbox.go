@@ -0,0 +1,56 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"github.com/stripe/stripe-go"
+	"io"
+	"time"
+)
+
+// EventInboxEntry is an event in the inbox, along with the attempts to handle it.
+type EventInboxEntry struct {
+	Event    *stripe.Event
+	Attempts int // Number of failed attempts to handle the event
+	Error    string
+	Failed   bool // True once the event has failed every attempt, so it is no longer retried
+}
+
+// EventInbox keeps payment processor events from when they are received until they have been handled, so events which fail or can't be queued are retried.
+type EventInbox interface {
+	Add(event *stripe.Event) error
+	Remove(id string) error
+	// Retry records a failed attempt to handle the given event, and marks it as failed once it has had the given number of attempts.
+	Retry(id, e string, limit int) error
+	// GetAll returns the events waiting to be handled, oldest first.
+	GetAll() ([]*stripe.Event, error)
+	// GetFailed returns the entries of the events which failed every attempt, oldest first.
+	GetFailed() ([]*EventInboxEntry, error)
+}
+
+// HandleInbox lists the events which failed every attempt to handle them.
+func HandleInbox(inbox EventInbox, args []string, output io.Writer) error {
+	entries, err := inbox.GetFailed()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		fmt.Fprintln(output, e.Event.ID, e.Event.Type, time.Unix(e.Event.Created, 0).UTC().Format(time.RFC3339), e.Attempts, "attempts", e.Error)
+	}
+	return nil
+}
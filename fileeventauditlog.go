@@ -0,0 +1,95 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/stripe/stripe-go"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditEntry is a line of the audit log.
+type AuditEntry struct {
+	Time   time.Time       `json:"time"`
+	ID     string          `json:"id"`
+	Type   string          `json:"type"`
+	Reason string          `json:"reason"`
+	Object json.RawMessage `json:"object,omitempty"`
+}
+
+// FileEventAuditLog appends each audited event as a line of JSON in a file.
+type FileEventAuditLog struct {
+	Path string
+	lock sync.Mutex
+}
+
+func NewFileEventAuditLog(path string) *FileEventAuditLog {
+	return &FileEventAuditLog{
+		Path: path,
+	}
+}
+
+func (l *FileEventAuditLog) AuditEvent(event *stripe.Event, reason string) error {
+	entry := &AuditEntry{
+		Time:   time.Now().UTC(),
+		ID:     event.ID,
+		Type:   event.Type,
+		Reason: reason,
+	}
+	if event.Data != nil {
+		entry.Object = event.Data.Raw
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	file, err := os.OpenFile(l.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ReadAuditLog returns the entries of the audit log at the given path.
+func ReadAuditLog(path string) ([]*AuditEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	var entries []*AuditEntry
+	decoder := json.NewDecoder(file)
+	for decoder.More() {
+		entry := &AuditEntry{}
+		if err := decoder.Decode(entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
@@ -0,0 +1,67 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main_test
+
+import (
+	"github.com/AletheiaWareLLC/conveyservergo"
+	"github.com/AletheiaWareLLC/testinggo"
+	"path"
+	"testing"
+)
+
+func TestFileEventAuditLog(t *testing.T) {
+	t.Run("Empty", func(t *testing.T) {
+		dir := testinggo.MakeTempDir(t, "audit")
+		defer testinggo.UnmakeTempDir(t, dir)
+		entries, err := main.ReadAuditLog(path.Join(dir, "audit"))
+		testinggo.AssertNoError(t, err)
+		if len(entries) != 0 {
+			t.Errorf("Wrong number of entries; expected '%d', got '%d'", 0, len(entries))
+		}
+	})
+	t.Run("AuditEvent", func(t *testing.T) {
+		dir := testinggo.MakeTempDir(t, "audit")
+		defer testinggo.UnmakeTempDir(t, dir)
+		audit := main.NewFileEventAuditLog(path.Join(dir, "audit"))
+		testinggo.AssertNoError(t, audit.AuditEvent(makeStripeEvent(t, `{"id":"evt_1","type":"payout.paid","data":{"object":{"id":"po_1"}}}`), "Foo"))
+		testinggo.AssertNoError(t, audit.AuditEvent(makeStripeEvent(t, `{"id":"evt_2","type":"payout.failed","data":{"object":{"id":"po_2"}}}`), "Bar"))
+		entries, err := main.ReadAuditLog(path.Join(dir, "audit"))
+		testinggo.AssertNoError(t, err)
+		if len(entries) != 2 {
+			t.Fatalf("Wrong number of entries; expected '%d', got '%d'", 2, len(entries))
+		}
+		for i, expected := range []struct {
+			id, kind, reason, object string
+		}{
+			{"evt_1", "payout.paid", "Foo", `{"id":"po_1"}`},
+			{"evt_2", "payout.failed", "Bar", `{"id":"po_2"}`},
+		} {
+			if entries[i].ID != expected.id {
+				t.Errorf("Wrong ID; expected '%s', got '%s'", expected.id, entries[i].ID)
+			}
+			if entries[i].Type != expected.kind {
+				t.Errorf("Wrong type; expected '%s', got '%s'", expected.kind, entries[i].Type)
+			}
+			if entries[i].Reason != expected.reason {
+				t.Errorf("Wrong reason; expected '%s', got '%s'", expected.reason, entries[i].Reason)
+			}
+			if string(entries[i].Object) != expected.object {
+				t.Errorf("Wrong object; expected '%s', got '%s'", expected.object, string(entries[i].Object))
+			}
+		}
+	})
+}
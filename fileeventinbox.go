@@ -0,0 +1,149 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/stripe/stripe-go"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+)
+
+// FileEventInbox keeps the events waiting to be handled, and those which failed every attempt, in a JSON file.
+type FileEventInbox struct {
+	Path string
+	lock sync.Mutex
+}
+
+func NewFileEventInbox(path string) *FileEventInbox {
+	return &FileEventInbox{
+		Path: path,
+	}
+}
+
+func (f *FileEventInbox) read() (map[string]*EventInboxEntry, error) {
+	entries := make(map[string]*EventInboxEntry)
+	data, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return entries, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (f *FileEventInbox) write(entries map[string]*EventInboxEntry) error {
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomically(f.Path, data, 0600)
+}
+
+func (f *FileEventInbox) Add(event *stripe.Event) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	entries, err := f.read()
+	if err != nil {
+		return err
+	}
+	if _, ok := entries[event.ID]; ok {
+		// Redelivered
+		return nil
+	}
+	entries[event.ID] = &EventInboxEntry{
+		Event: event,
+	}
+	return f.write(entries)
+}
+
+func (f *FileEventInbox) Remove(id string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	entries, err := f.read()
+	if err != nil {
+		return err
+	}
+	if _, ok := entries[id]; !ok {
+		return nil
+	}
+	delete(entries, id)
+	return f.write(entries)
+}
+
+func (f *FileEventInbox) Retry(id, e string, limit int) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	entries, err := f.read()
+	if err != nil {
+		return err
+	}
+	entry, ok := entries[id]
+	if !ok {
+		return nil
+	}
+	entry.Attempts++
+	entry.Error = e
+	entry.Failed = entry.Attempts >= limit
+	return f.write(entries)
+}
+
+// GetAll returns the events waiting to be handled, oldest first.
+func (f *FileEventInbox) GetAll() ([]*stripe.Event, error) {
+	entries, err := f.get(false)
+	if err != nil {
+		return nil, err
+	}
+	var results []*stripe.Event
+	for _, e := range entries {
+		results = append(results, e.Event)
+	}
+	return results, nil
+}
+
+// GetFailed returns the entries of the events which failed every attempt, oldest first.
+func (f *FileEventInbox) GetFailed() ([]*EventInboxEntry, error) {
+	return f.get(true)
+}
+
+func (f *FileEventInbox) get(failed bool) ([]*EventInboxEntry, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	entries, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	var results []*EventInboxEntry
+	for _, e := range entries {
+		if e.Failed == failed {
+			results = append(results, e)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Event.Created == results[j].Event.Created {
+			return results[i].Event.ID < results[j].Event.ID
+		}
+		return results[i].Event.Created < results[j].Event.Created
+	})
+	return results, nil
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main_test
+
+import (
+	"bytes"
+	"github.com/AletheiaWareLLC/conveyservergo"
+	"github.com/AletheiaWareLLC/testinggo"
+	"path"
+	"testing"
+)
+
+func TestFileEventInbox(t *testing.T) {
+	dir := testinggo.MakeTempDir(t, "inbox")
+	defer testinggo.UnmakeTempDir(t, dir)
+	inbox := main.NewFileEventInbox(path.Join(dir, "inbox.json"))
+
+	events, err := inbox.GetAll()
+	testinggo.AssertNoError(t, err)
+	if len(events) != 0 {
+		t.Errorf("Wrong number of events; expected '%d', got '%d'", 0, len(events))
+	}
+
+	testinggo.AssertNoError(t, inbox.Add(makeStripeEvent(t, `{"id":"evt_2","created":2,"type":"charge.refunded","data":{"object":{"id":"ch_1"}}}`)))
+	testinggo.AssertNoError(t, inbox.Add(makeStripeEvent(t, `{"id":"evt_1","created":1,"type":"charge.succeeded","data":{"object":{"id":"ch_1"}}}`)))
+	// Redelivered
+	testinggo.AssertNoError(t, inbox.Add(makeStripeEvent(t, `{"id":"evt_1","created":1,"type":"charge.succeeded","data":{"object":{"id":"ch_1"}}}`)))
+
+	// Reopen file
+	inbox = main.NewFileEventInbox(path.Join(dir, "inbox.json"))
+	events, err = inbox.GetAll()
+	testinggo.AssertNoError(t, err)
+	if len(events) != 2 {
+		t.Fatalf("Wrong number of events; expected '%d', got '%d'", 2, len(events))
+	}
+	if events[0].ID != "evt_1" {
+		t.Errorf("Wrong event; expected '%s', got '%s'", "evt_1", events[0].ID)
+	}
+	if id := main.GetEventValue(events[0], "id"); id != "ch_1" {
+		t.Errorf("Wrong object; expected '%s', got '%s'", "ch_1", id)
+	}
+
+	testinggo.AssertNoError(t, inbox.Remove("evt_1"))
+	testinggo.AssertNoError(t, inbox.Remove("evt_3"))
+	events, err = inbox.GetAll()
+	testinggo.AssertNoError(t, err)
+	if len(events) != 1 || events[0].ID != "evt_2" {
+		t.Errorf("Wrong events; expected '%s', got '%v'", "evt_2", events)
+	}
+
+	// Failed once the attempts are exhausted
+	testinggo.AssertNoError(t, inbox.Retry("evt_2", "Failed", 2))
+	events, err = inbox.GetAll()
+	testinggo.AssertNoError(t, err)
+	if len(events) != 1 {
+		t.Errorf("Wrong number of events; expected '%d', got '%d'", 1, len(events))
+	}
+	testinggo.AssertNoError(t, inbox.Retry("evt_2", "Failed again", 2))
+	testinggo.AssertNoError(t, inbox.Retry("evt_3", "Unknown", 2))
+	events, err = inbox.GetAll()
+	testinggo.AssertNoError(t, err)
+	if len(events) != 0 {
+		t.Errorf("Wrong number of events; expected '%d', got '%d'", 0, len(events))
+	}
+	failed, err := inbox.GetFailed()
+	testinggo.AssertNoError(t, err)
+	if len(failed) != 1 {
+		t.Fatalf("Wrong number of failed events; expected '%d', got '%d'", 1, len(failed))
+	}
+	if f := failed[0]; f.Event.ID != "evt_2" || f.Attempts != 2 || f.Error != "Failed again" {
+		t.Errorf("Wrong failed event; expected '%s' '%d' '%s', got '%s' '%d' '%s'", "evt_2", 2, "Failed again", f.Event.ID, f.Attempts, f.Error)
+	}
+	// Redelivering doesn't reset a failed event
+	testinggo.AssertNoError(t, inbox.Add(makeStripeEvent(t, `{"id":"evt_2","created":2,"type":"charge.refunded","data":{"object":{"id":"ch_1"}}}`)))
+	failed, err = inbox.GetFailed()
+	testinggo.AssertNoError(t, err)
+	if len(failed) != 1 {
+		t.Errorf("Wrong number of failed events; expected '%d', got '%d'", 1, len(failed))
+	}
+
+	output := &bytes.Buffer{}
+	testinggo.AssertNoError(t, main.HandleInbox(inbox, nil, output))
+	expected := "evt_2 charge.refunded 1970-01-01T00:00:02Z 2 attempts Failed again\n"
+	if actual := output.String(); actual != expected {
+		t.Errorf("Wrong output; expected '%s', got '%s'", expected, actual)
+	}
+}
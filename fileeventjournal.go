@@ -0,0 +1,79 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"sync"
+)
+
+// FileEventJournal appends each processed event ID as a line in a file.
+type FileEventJournal struct {
+	Path      string
+	Processed map[string]bool
+	lock      sync.Mutex
+}
+
+func NewFileEventJournal(path string) (*FileEventJournal, error) {
+	j := &FileEventJournal{
+		Path:      path,
+		Processed: make(map[string]bool),
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return j, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if id := scanner.Text(); id != "" {
+			j.Processed[id] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *FileEventJournal) IsProcessed(id string) bool {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.Processed[id]
+}
+
+func (j *FileEventJournal) MarkProcessed(id string) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.Processed[id] {
+		return nil
+	}
+	file, err := os.OpenFile(j.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.WriteString(id + "\n"); err != nil {
+		return err
+	}
+	j.Processed[id] = true
+	return nil
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main_test
+
+import (
+	"github.com/AletheiaWareLLC/conveyservergo"
+	"github.com/AletheiaWareLLC/testinggo"
+	"path"
+	"testing"
+)
+
+func makeEventJournal(t *testing.T, dir string) *main.FileEventJournal {
+	t.Helper()
+	journal, err := main.NewFileEventJournal(path.Join(dir, "events"))
+	testinggo.AssertNoError(t, err)
+	return journal
+}
+
+func TestFileEventJournal(t *testing.T) {
+	t.Run("Empty", func(t *testing.T) {
+		dir := testinggo.MakeTempDir(t, "journal")
+		defer testinggo.UnmakeTempDir(t, dir)
+		journal := makeEventJournal(t, dir)
+		if journal.IsProcessed("evt_1") {
+			t.Error("Expected event not to be processed")
+		}
+	})
+	t.Run("MarkProcessed", func(t *testing.T) {
+		dir := testinggo.MakeTempDir(t, "journal")
+		defer testinggo.UnmakeTempDir(t, dir)
+		journal := makeEventJournal(t, dir)
+		testinggo.AssertNoError(t, journal.MarkProcessed("evt_1"))
+		if !journal.IsProcessed("evt_1") {
+			t.Error("Expected event to be processed")
+		}
+		if journal.IsProcessed("evt_2") {
+			t.Error("Expected event not to be processed")
+		}
+	})
+	t.Run("Reload", func(t *testing.T) {
+		dir := testinggo.MakeTempDir(t, "journal")
+		defer testinggo.UnmakeTempDir(t, dir)
+		journal := makeEventJournal(t, dir)
+		testinggo.AssertNoError(t, journal.MarkProcessed("evt_1"))
+		testinggo.AssertNoError(t, journal.MarkProcessed("evt_2"))
+		journal = makeEventJournal(t, dir)
+		if !journal.IsProcessed("evt_1") {
+			t.Error("Expected event to be processed")
+		}
+		if !journal.IsProcessed("evt_2") {
+			t.Error("Expected event to be processed")
+		}
+	})
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"sync"
+)
+
+// FileFraudFlags keeps fraud flags in a JSON file.
+// Every check reads the file afresh, so an alias cleared with `conveyserver fraud clear` can buy and transfer again straight away.
+type FileFraudFlags struct {
+	Path string
+	lock sync.Mutex
+}
+
+func NewFileFraudFlags(path string) *FileFraudFlags {
+	return &FileFraudFlags{
+		Path: path,
+	}
+}
+
+func (f *FileFraudFlags) read() (map[string]*FraudFlag, error) {
+	flags := make(map[string]*FraudFlag)
+	data, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return flags, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &flags); err != nil {
+		return nil, err
+	}
+	return flags, nil
+}
+
+func (f *FileFraudFlags) write(flags map[string]*FraudFlag) error {
+	data, err := json.MarshalIndent(flags, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomically(f.Path, data, 0600)
+}
+
+func (f *FileFraudFlags) Flag(flag *FraudFlag) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	flags, err := f.read()
+	if err != nil {
+		return err
+	}
+	if _, ok := flags[flag.Alias]; ok {
+		// Keep the first reason
+		return nil
+	}
+	log.Println("Flagging", flag)
+	flags[flag.Alias] = flag
+	return f.write(flags)
+}
+
+// GetFlag returns the flag for the given alias, or nil if the alias isn't flagged.
+func (f *FileFraudFlags) GetFlag(alias string) (*FraudFlag, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	flags, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	return flags[alias], nil
+}
+
+// GetFlags returns all flags, oldest first.
+func (f *FileFraudFlags) GetFlags() ([]*FraudFlag, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	flags, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	var results []*FraudFlag
+	for _, flag := range flags {
+		results = append(results, flag)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Time.Before(results[j].Time)
+	})
+	return results, nil
+}
+
+func (f *FileFraudFlags) Clear(alias string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	flags, err := f.read()
+	if err != nil {
+		return err
+	}
+	if _, ok := flags[alias]; !ok {
+		return errors.New(fmt.Sprintf(ERROR_NO_SUCH_FLAG, alias))
+	}
+	delete(flags, alias)
+	return f.write(flags)
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main_test
+
+import (
+	"github.com/AletheiaWareLLC/conveyservergo"
+	"github.com/AletheiaWareLLC/testinggo"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestFileFraudFlags(t *testing.T) {
+	dir := testinggo.MakeTempDir(t, "fraud")
+	defer testinggo.UnmakeTempDir(t, dir)
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	flags := main.NewFileFraudFlags(path.Join(dir, "fraud-flags.json"))
+
+	flag, err := flags.GetFlag("Alice")
+	testinggo.AssertNoError(t, err)
+	if flag != nil {
+		t.Errorf("Expected no flag, got '%s'", flag)
+	}
+
+	testinggo.AssertNoError(t, flags.Flag(&main.FraudFlag{Alias: "Bob", Reason: main.FRAUD_HIGHEST_RISK, Time: now.Add(time.Hour)}))
+	testinggo.AssertNoError(t, flags.Flag(&main.FraudFlag{Alias: "Alice", Reason: main.FRAUD_EARLY_WARNING, Time: now}))
+	// First reason is kept
+	testinggo.AssertNoError(t, flags.Flag(&main.FraudFlag{Alias: "Alice", Reason: main.FRAUD_HIGHEST_RISK, Time: now.Add(2 * time.Hour)}))
+
+	// Reopen file
+	flags = main.NewFileFraudFlags(path.Join(dir, "fraud-flags.json"))
+	flag, err = flags.GetFlag("Alice")
+	testinggo.AssertNoError(t, err)
+	if flag.Reason != main.FRAUD_EARLY_WARNING {
+		t.Errorf("Wrong reason; expected '%s', got '%s'", main.FRAUD_EARLY_WARNING, flag.Reason)
+	}
+
+	all, err := flags.GetFlags()
+	testinggo.AssertNoError(t, err)
+	if len(all) != 2 {
+		t.Fatalf("Wrong number of flags; expected '%d', got '%d'", 2, len(all))
+	}
+	if all[0].Alias != "Alice" {
+		t.Errorf("Wrong alias; expected '%s', got '%s'", "Alice", all[0].Alias)
+	}
+
+	testinggo.AssertNoError(t, flags.Clear("Alice"))
+	flag, err = flags.GetFlag("Alice")
+	testinggo.AssertNoError(t, err)
+	if flag != nil {
+		t.Errorf("Expected no flag, got '%s'", flag)
+	}
+	testinggo.AssertError(t, "No fraud flag for alias: Alice", flags.Clear("Alice"))
+}
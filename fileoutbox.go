@@ -0,0 +1,149 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// FileOutbox keeps the blocks waiting to be pushed in a JSON file.
+type FileOutbox struct {
+	Path string
+	lock sync.Mutex
+}
+
+func NewFileOutbox(path string) *FileOutbox {
+	return &FileOutbox{
+		Path: path,
+	}
+}
+
+func (f *FileOutbox) read() (map[string]*OutboxEntry, error) {
+	entries := make(map[string]*OutboxEntry)
+	data, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return entries, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (f *FileOutbox) write(entries map[string]*OutboxEntry) error {
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomically(f.Path, data, 0600)
+}
+
+func (f *FileOutbox) Add(channel string, block []byte, now time.Time) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	entries, err := f.read()
+	if err != nil {
+		return err
+	}
+	entry, ok := entries[channel]
+	if !ok {
+		entry = &OutboxEntry{
+			Channel: channel,
+			Created: now,
+			Next:    now,
+		}
+		entries[channel] = entry
+	}
+	entry.Blocks = append(entry.Blocks, block)
+	return f.write(entries)
+}
+
+func (f *FileOutbox) Get(channel string) (*OutboxEntry, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	entries, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	return entries[channel], nil
+}
+
+func (f *FileOutbox) GetAll() ([]*OutboxEntry, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	entries, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	var results []*OutboxEntry
+	for _, e := range entries {
+		results = append(results, e)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Created.Before(results[j].Created)
+	})
+	return results, nil
+}
+
+func (f *FileOutbox) Retry(channel string, next time.Time, e string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	entries, err := f.read()
+	if err != nil {
+		return err
+	}
+	entry, ok := entries[channel]
+	if !ok {
+		return nil
+	}
+	entry.Attempts++
+	entry.Next = next
+	entry.Error = e
+	return f.write(entries)
+}
+
+func (f *FileOutbox) Remove(channel string, block []byte) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	entries, err := f.read()
+	if err != nil {
+		return err
+	}
+	entry, ok := entries[channel]
+	if !ok {
+		return nil
+	}
+	for i, b := range entry.Blocks {
+		if bytes.Equal(b, block) {
+			entry.Blocks = entry.Blocks[i+1:]
+			break
+		}
+	}
+	if len(entry.Blocks) == 0 {
+		delete(entries, channel)
+	}
+	return f.write(entries)
+}
@@ -0,0 +1,86 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main_test
+
+import (
+	"github.com/AletheiaWareLLC/conveyservergo"
+	"github.com/AletheiaWareLLC/testinggo"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestFileOutbox(t *testing.T) {
+	dir := testinggo.MakeTempDir(t, "outbox")
+	defer testinggo.UnmakeTempDir(t, dir)
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	outbox := main.NewFileOutbox(path.Join(dir, "outbox.json"))
+
+	entry, err := outbox.Get("Foo")
+	testinggo.AssertNoError(t, err)
+	if entry != nil {
+		t.Errorf("Expected no entry, got '%s'", entry.Channel)
+	}
+
+	testinggo.AssertNoError(t, outbox.Add("Bar", []byte("bar1"), now.Add(time.Hour)))
+	testinggo.AssertNoError(t, outbox.Add("Foo", []byte("foo1"), now))
+	testinggo.AssertNoError(t, outbox.Add("Foo", []byte("foo2"), now.Add(2*time.Hour)))
+	testinggo.AssertNoError(t, outbox.Retry("Foo", now.Add(time.Minute), "Broadcast failed"))
+
+	// Reopen file
+	outbox = main.NewFileOutbox(path.Join(dir, "outbox.json"))
+	all, err := outbox.GetAll()
+	testinggo.AssertNoError(t, err)
+	if len(all) != 2 {
+		t.Fatalf("Wrong number of entries; expected '%d', got '%d'", 2, len(all))
+	}
+	foo := all[0]
+	if foo.Channel != "Foo" {
+		t.Errorf("Wrong channel; expected '%s', got '%s'", "Foo", foo.Channel)
+	}
+	if len(foo.Blocks) != 2 {
+		t.Errorf("Wrong number of blocks; expected '%d', got '%d'", 2, len(foo.Blocks))
+	}
+	if !foo.Created.Equal(now) {
+		t.Errorf("Wrong created; expected '%s', got '%s'", now, foo.Created)
+	}
+	if foo.Attempts != 1 {
+		t.Errorf("Wrong attempts; expected '%d', got '%d'", 1, foo.Attempts)
+	}
+	if !foo.Next.Equal(now.Add(time.Minute)) {
+		t.Errorf("Wrong next; expected '%s', got '%s'", now.Add(time.Minute), foo.Next)
+	}
+	if foo.Error != "Broadcast failed" {
+		t.Errorf("Wrong error; expected '%s', got '%s'", "Broadcast failed", foo.Error)
+	}
+
+	// Removing the first block leaves the second waiting
+	testinggo.AssertNoError(t, outbox.Remove("Foo", []byte("foo1")))
+	foo, err = outbox.Get("Foo")
+	testinggo.AssertNoError(t, err)
+	if len(foo.Blocks) != 1 || string(foo.Blocks[0]) != "foo2" {
+		t.Errorf("Wrong blocks; expected '%s', got '%s'", "foo2", foo.Blocks)
+	}
+
+	// Removing the last block removes the entry
+	testinggo.AssertNoError(t, outbox.Remove("Foo", []byte("foo2")))
+	foo, err = outbox.Get("Foo")
+	testinggo.AssertNoError(t, err)
+	if foo != nil {
+		t.Errorf("Expected no entry, got '%s'", foo.Channel)
+	}
+}
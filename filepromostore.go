@@ -0,0 +1,169 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// FilePromoStore keeps promo codes and their redemptions in a JSON file.
+// Codes are looked up in the file each time, so a code added or removed with `conveyserver promo` applies to the next purchase.
+type FilePromoStore struct {
+	Path string
+	lock sync.Mutex
+}
+
+func NewFilePromoStore(path string) *FilePromoStore {
+	return &FilePromoStore{
+		Path: path,
+	}
+}
+
+func (s *FilePromoStore) read() (map[string]*PromoCode, error) {
+	codes := make(map[string]*PromoCode)
+	data, err := ioutil.ReadFile(s.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return codes, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &codes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func (s *FilePromoStore) write(codes map[string]*PromoCode) error {
+	data, err := json.MarshalIndent(codes, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomically(s.Path, data, 0600)
+}
+
+func (s *FilePromoStore) AddPromoCode(code *PromoCode) error {
+	if err := code.Validate(); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	codes, err := s.read()
+	if err != nil {
+		return err
+	}
+	if _, ok := codes[code.Code]; ok {
+		return errors.New(fmt.Sprintf(ERROR_DUPLICATE_PROMO_CODE, code.Code))
+	}
+	codes[code.Code] = code
+	return s.write(codes)
+}
+
+func (s *FilePromoStore) GetPromoCode(code string) (*PromoCode, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	codes, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	c, ok := codes[NormalizePromoCode(code)]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf(ERROR_NO_SUCH_PROMO_CODE, code))
+	}
+	return c, nil
+}
+
+// GetPromoCodes returns all promo codes sorted by code.
+func (s *FilePromoStore) GetPromoCodes() ([]*PromoCode, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	codes, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	var results []*PromoCode
+	for _, c := range codes {
+		results = append(results, c)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Code < results[j].Code
+	})
+	return results, nil
+}
+
+func (s *FilePromoStore) RemovePromoCode(code string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	codes, err := s.read()
+	if err != nil {
+		return err
+	}
+	if _, ok := codes[code]; !ok {
+		return errors.New(fmt.Sprintf(ERROR_NO_SUCH_PROMO_CODE, code))
+	}
+	delete(codes, code)
+	return s.write(codes)
+}
+
+func (s *FilePromoStore) Redeem(code, alias string, now time.Time) (*PromoCode, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	codes, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	c, ok := codes[NormalizePromoCode(code)]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf(ERROR_NO_SUCH_PROMO_CODE, code))
+	}
+	if err := c.Check(alias, now); err != nil {
+		return nil, err
+	}
+	if c.Redeemed == nil {
+		c.Redeemed = make(map[string]time.Time)
+	}
+	c.Redeemed[alias] = now.UTC()
+	if err := s.write(codes); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s *FilePromoStore) Release(code, alias string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	codes, err := s.read()
+	if err != nil {
+		return err
+	}
+	c, ok := codes[NormalizePromoCode(code)]
+	if !ok {
+		return errors.New(fmt.Sprintf(ERROR_NO_SUCH_PROMO_CODE, code))
+	}
+	if _, ok := c.Redeemed[alias]; !ok {
+		return nil
+	}
+	delete(c.Redeemed, alias)
+	return s.write(codes)
+}
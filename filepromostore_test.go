@@ -0,0 +1,106 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main_test
+
+import (
+	"fmt"
+	"github.com/AletheiaWareLLC/conveyservergo"
+	"github.com/AletheiaWareLLC/testinggo"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFilePromoStore(t *testing.T) {
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	t.Run("AddGetRemove", func(t *testing.T) {
+		dir := testinggo.MakeTempDir(t, "promo")
+		defer testinggo.UnmakeTempDir(t, dir)
+		promos := main.NewFilePromoStore(path.Join(dir, "promo-codes.json"))
+		testinggo.AssertNoError(t, promos.AddPromoCode(&main.PromoCode{Code: "SAVE20", Type: main.PROMO_DISCOUNT, Percent: 20}))
+		testinggo.AssertError(t, "Duplicate promo code: SAVE20", promos.AddPromoCode(&main.PromoCode{Code: "SAVE20", Type: main.PROMO_DISCOUNT, Percent: 10}))
+		// Reopen file
+		promos = main.NewFilePromoStore(path.Join(dir, "promo-codes.json"))
+		code, err := promos.GetPromoCode("save20")
+		testinggo.AssertNoError(t, err)
+		if code.Percent != 20 {
+			t.Errorf("Wrong percent; expected '%d', got '%d'", 20, code.Percent)
+		}
+		testinggo.AssertNoError(t, promos.RemovePromoCode("SAVE20"))
+		_, err = promos.GetPromoCode("SAVE20")
+		testinggo.AssertError(t, "No such promo code: SAVE20", err)
+		testinggo.AssertError(t, "No such promo code: SAVE20", promos.RemovePromoCode("SAVE20"))
+	})
+	t.Run("AddInvalid", func(t *testing.T) {
+		dir := testinggo.MakeTempDir(t, "promo")
+		defer testinggo.UnmakeTempDir(t, dir)
+		promos := main.NewFilePromoStore(path.Join(dir, "promo-codes.json"))
+		testinggo.AssertError(t, "Invalid promo code FREE: zero quantity", promos.AddPromoCode(&main.PromoCode{Code: "FREE", Type: main.PROMO_GRANT}))
+	})
+	t.Run("Redeem", func(t *testing.T) {
+		dir := testinggo.MakeTempDir(t, "promo")
+		defer testinggo.UnmakeTempDir(t, dir)
+		promos := main.NewFilePromoStore(path.Join(dir, "promo-codes.json"))
+		testinggo.AssertNoError(t, promos.AddPromoCode(&main.PromoCode{Code: "FREE", Type: main.PROMO_GRANT, Quantity: 10, Limit: 2}))
+		_, err := promos.Redeem("free", "Alice", now)
+		testinggo.AssertNoError(t, err)
+		_, err = promos.Redeem("FREE", "Alice", now)
+		testinggo.AssertError(t, "Promo code already redeemed: FREE", err)
+		_, err = promos.Redeem("FREE", "Bob", now)
+		testinggo.AssertNoError(t, err)
+		_, err = promos.Redeem("FREE", "Charlie", now)
+		testinggo.AssertError(t, "Promo code has been used up: FREE", err)
+		_, err = promos.Redeem("NONE", "Charlie", now)
+		testinggo.AssertError(t, "No such promo code: NONE", err)
+	})
+	t.Run("Release", func(t *testing.T) {
+		dir := testinggo.MakeTempDir(t, "promo")
+		defer testinggo.UnmakeTempDir(t, dir)
+		promos := main.NewFilePromoStore(path.Join(dir, "promo-codes.json"))
+		testinggo.AssertNoError(t, promos.AddPromoCode(&main.PromoCode{Code: "FREE", Type: main.PROMO_GRANT, Quantity: 10, Limit: 1}))
+		_, err := promos.Redeem("FREE", "Alice", now)
+		testinggo.AssertNoError(t, err)
+		_, err = promos.Redeem("FREE", "Bob", now)
+		testinggo.AssertError(t, "Promo code has been used up: FREE", err)
+		testinggo.AssertNoError(t, promos.Release("free", "Alice"))
+		_, err = promos.Redeem("FREE", "Bob", now)
+		testinggo.AssertNoError(t, err)
+		testinggo.AssertError(t, "No such promo code: NONE", promos.Release("NONE", "Alice"))
+	})
+	t.Run("RedeemParallel", func(t *testing.T) {
+		// Only one of many concurrent redemptions can use a code with a limit of one
+		dir := testinggo.MakeTempDir(t, "promo")
+		defer testinggo.UnmakeTempDir(t, dir)
+		promos := main.NewFilePromoStore(path.Join(dir, "promo-codes.json"))
+		testinggo.AssertNoError(t, promos.AddPromoCode(&main.PromoCode{Code: "ONCE", Type: main.PROMO_DISCOUNT, Percent: 50, Limit: 1}))
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(alias string) {
+				defer wg.Done()
+				promos.Redeem("ONCE", alias, now)
+			}(fmt.Sprintf("Alias%d", i))
+		}
+		wg.Wait()
+		code, err := promos.GetPromoCode("ONCE")
+		testinggo.AssertNoError(t, err)
+		if len(code.Redeemed) != 1 {
+			t.Errorf("Wrong redemptions; expected '%d', got '%d'", 1, len(code.Redeemed))
+		}
+	})
+}
@@ -0,0 +1,126 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+)
+
+// FileScheduledTransfers keeps scheduled transfers, and their signed records, in a JSON file.
+type FileScheduledTransfers struct {
+	Path string
+	lock sync.Mutex
+}
+
+func NewFileScheduledTransfers(path string) *FileScheduledTransfers {
+	return &FileScheduledTransfers{
+		Path: path,
+	}
+}
+
+func (f *FileScheduledTransfers) read() (map[string]*ScheduledTransfer, error) {
+	transfers := make(map[string]*ScheduledTransfer)
+	data, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return transfers, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &transfers); err != nil {
+		return nil, err
+	}
+	return transfers, nil
+}
+
+func (f *FileScheduledTransfers) write(transfers map[string]*ScheduledTransfer) error {
+	data, err := json.MarshalIndent(transfers, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomically(f.Path, data, 0600)
+}
+
+func (f *FileScheduledTransfers) Add(transfer *ScheduledTransfer) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	transfers, err := f.read()
+	if err != nil {
+		return err
+	}
+	transfers[transfer.ID] = transfer
+	return f.write(transfers)
+}
+
+// Get returns the transfer with the given ID, or nil if there is no such transfer.
+func (f *FileScheduledTransfers) Get(id string) (*ScheduledTransfer, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	transfers, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	return transfers[id], nil
+}
+
+// GetAll returns the transfers scheduled by the given alias, or by every alias if empty, oldest first.
+func (f *FileScheduledTransfers) GetAll(alias string) ([]*ScheduledTransfer, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	transfers, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	var results []*ScheduledTransfer
+	for _, t := range transfers {
+		if alias == "" || t.Alias == alias {
+			results = append(results, t)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Created.Before(results[j].Created)
+	})
+	return results, nil
+}
+
+func (f *FileScheduledTransfers) UpdateOccurrence(id string, index int, status string, change func(*ScheduledOccurrence)) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	transfers, err := f.read()
+	if err != nil {
+		return err
+	}
+	transfer, ok := transfers[id]
+	if !ok {
+		return errors.New(fmt.Sprintf(ERROR_NO_SUCH_SCHEDULED_TRANSFER, id))
+	}
+	if index < 0 || index >= len(transfer.Occurrences) {
+		return errors.New(fmt.Sprintf(ERROR_NO_SUCH_OCCURRENCE, id, index))
+	}
+	o := transfer.Occurrences[index]
+	if o.Status != status {
+		return errors.New(ERROR_OCCURRENCE_CHANGED)
+	}
+	change(o)
+	return f.write(transfers)
+}
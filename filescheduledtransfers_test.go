@@ -0,0 +1,72 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main_test
+
+import (
+	"github.com/AletheiaWareLLC/conveyservergo"
+	"github.com/AletheiaWareLLC/testinggo"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestFileScheduledTransfers(t *testing.T) {
+	dir := testinggo.MakeTempDir(t, "scheduled")
+	defer testinggo.UnmakeTempDir(t, dir)
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	transfers := main.NewFileScheduledTransfers(path.Join(dir, "scheduled-transfers.json"))
+
+	transfer, err := transfers.Get("st_1")
+	testinggo.AssertNoError(t, err)
+	if transfer != nil {
+		t.Errorf("Expected no transfer, got '%s'", transfer.ID)
+	}
+
+	testinggo.AssertNoError(t, transfers.Add(&main.ScheduledTransfer{ID: "st_2", Alias: "Bob", Created: now.Add(time.Hour)}))
+	testinggo.AssertNoError(t, transfers.Add(&main.ScheduledTransfer{ID: "st_1", Alias: "Alice", Created: now, Occurrences: []*main.ScheduledOccurrence{
+		{Time: now, Status: main.SCHEDULED_PENDING},
+	}}))
+	mine := func(o *main.ScheduledOccurrence) {
+		o.Status = main.SCHEDULED_MINED
+	}
+	testinggo.AssertError(t, "No such scheduled transfer: st_3", transfers.UpdateOccurrence("st_3", 0, main.SCHEDULED_PENDING, mine))
+	testinggo.AssertError(t, "No such occurrence of scheduled transfer st_1: 1", transfers.UpdateOccurrence("st_1", 1, main.SCHEDULED_PENDING, mine))
+
+	// Reopen file
+	transfers = main.NewFileScheduledTransfers(path.Join(dir, "scheduled-transfers.json"))
+	testinggo.AssertNoError(t, transfers.UpdateOccurrence("st_1", 0, main.SCHEDULED_PENDING, mine))
+	// Occurrence is no longer pending
+	testinggo.AssertError(t, main.ERROR_OCCURRENCE_CHANGED, transfers.UpdateOccurrence("st_1", 0, main.SCHEDULED_PENDING, mine))
+
+	all, err := transfers.GetAll("")
+	testinggo.AssertNoError(t, err)
+	if len(all) != 2 {
+		t.Fatalf("Wrong number of transfers; expected '%d', got '%d'", 2, len(all))
+	}
+	if all[0].ID != "st_1" {
+		t.Errorf("Wrong transfer; expected '%s', got '%s'", "st_1", all[0].ID)
+	}
+	if s := all[0].Occurrences[0].Status; s != main.SCHEDULED_MINED {
+		t.Errorf("Wrong status; expected '%s', got '%s'", main.SCHEDULED_MINED, s)
+	}
+
+	bob, err := transfers.GetAll("Bob")
+	testinggo.AssertNoError(t, err)
+	if len(bob) != 1 || bob[0].ID != "st_2" {
+		t.Errorf("Wrong transfers for Bob; expected '%s', got '%v'", "st_2", bob)
+	}
+}
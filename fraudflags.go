@@ -0,0 +1,91 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	ERROR_ACCOUNT_FLAGGED = "Account frozen after a payment was reported as fraudulent, for help contact support"
+	ERROR_FRAUD_USAGE     = "Usage: fraud [clear ALIAS]"
+	ERROR_NO_SUCH_FLAG    = "No fraud flag for alias: %s"
+
+	FRAUD_EARLY_WARNING = "Early fraud warning"
+	FRAUD_HIGHEST_RISK  = "Highest risk"
+)
+
+// FraudFlag records why an alias was frozen.
+type FraudFlag struct {
+	Alias    string
+	Reason   string
+	ChargeId string
+	EventId  string
+	Time     time.Time
+}
+
+func (f *FraudFlag) String() string {
+	return fmt.Sprintf("%s %s: %s %s %s", f.Time.Format(time.RFC3339), f.Alias, f.Reason, f.ChargeId, f.EventId)
+}
+
+// FraudFlags holds the aliases frozen after the payment processor reported fraud.
+// A flagged alias cannot purchase or transfer tokens until the flag is cleared.
+type FraudFlags interface {
+	Flag(flag *FraudFlag) error
+	GetFlag(alias string) (*FraudFlag, error)
+	GetFlags() ([]*FraudFlag, error)
+	Clear(alias string) error
+}
+
+// IsFlagged returns true if the given alias is flagged, or if the flags cannot be read.
+func IsFlagged(flags FraudFlags, alias string) bool {
+	flag, err := flags.GetFlag(alias)
+	if err != nil {
+		return true
+	}
+	return flag != nil
+}
+
+// HandleFraud manages fraud flags from the command line.
+func HandleFraud(flags FraudFlags, args []string, output io.Writer) error {
+	if len(args) == 0 {
+		fs, err := flags.GetFlags()
+		if err != nil {
+			return err
+		}
+		for _, f := range fs {
+			fmt.Fprintln(output, f)
+		}
+		return nil
+	}
+	switch args[0] {
+	case "clear":
+		if len(args) != 2 {
+			return errors.New(ERROR_FRAUD_USAGE)
+		}
+		if err := flags.Clear(args[1]); err != nil {
+			return err
+		}
+		fmt.Fprintln(output, "Cleared", args[1])
+		return nil
+	default:
+		return errors.New(ERROR_FRAUD_USAGE)
+	}
+}
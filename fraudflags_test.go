@@ -0,0 +1,115 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main_test
+
+import (
+	"bytes"
+	"errors"
+	"github.com/AletheiaWareLLC/conveyservergo"
+	"github.com/AletheiaWareLLC/testinggo"
+	"testing"
+	"time"
+)
+
+// MockFraudFlags holds flags in memory, the nil key makes every call fail
+type MockFraudFlags map[string]*main.FraudFlag
+
+func (m MockFraudFlags) Flag(flag *main.FraudFlag) error {
+	m[flag.Alias] = flag
+	return nil
+}
+
+func (m MockFraudFlags) GetFlag(alias string) (*main.FraudFlag, error) {
+	if _, ok := m[""]; ok {
+		return nil, errors.New("Broken")
+	}
+	return m[alias], nil
+}
+
+func (m MockFraudFlags) GetFlags() ([]*main.FraudFlag, error) {
+	var flags []*main.FraudFlag
+	for _, f := range m {
+		flags = append(flags, f)
+	}
+	return flags, nil
+}
+
+func (m MockFraudFlags) Clear(alias string) error {
+	delete(m, alias)
+	return nil
+}
+
+func TestIsFlagged(t *testing.T) {
+	for name, tt := range map[string]struct {
+		flags    MockFraudFlags
+		expected bool
+	}{
+		"NotFlagged": {MockFraudFlags{}, false},
+		"Flagged": {MockFraudFlags{
+			"Alice": &main.FraudFlag{Alias: "Alice"},
+		}, true},
+		"OtherFlagged": {MockFraudFlags{
+			"Bob": &main.FraudFlag{Alias: "Bob"},
+		}, false},
+		"Error": {MockFraudFlags{
+			"": nil,
+		}, true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if f := main.IsFlagged(tt.flags, "Alice"); f != tt.expected {
+				t.Errorf("Wrong flagged; expected '%t', got '%t'", tt.expected, f)
+			}
+		})
+	}
+}
+
+func TestHandleFraud(t *testing.T) {
+	flags := MockFraudFlags{
+		"Alice": &main.FraudFlag{
+			Alias:    "Alice",
+			Reason:   main.FRAUD_EARLY_WARNING,
+			ChargeId: "ch_1",
+			EventId:  "evt_1",
+			Time:     time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC),
+		},
+	}
+	for _, tt := range []struct {
+		name          string
+		args          []string
+		expectedError string
+		expected      string
+	}{
+		{"List", nil, "", "2020-06-01T00:00:00Z Alice: Early fraud warning ch_1 evt_1\n"},
+		{"Clear", []string{"clear", "Alice"}, "", "Cleared Alice\n"},
+		{"ListEmpty", nil, "", ""},
+		{"ClearMissing", []string{"clear"}, main.ERROR_FRAUD_USAGE, ""},
+		{"Unrecognized", []string{"foo"}, main.ERROR_FRAUD_USAGE, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			output := &bytes.Buffer{}
+			err := main.HandleFraud(flags, tt.args, output)
+			if tt.expectedError == "" {
+				testinggo.AssertNoError(t, err)
+			} else {
+				testinggo.AssertError(t, tt.expectedError, err)
+			}
+			if o := output.String(); o != tt.expected {
+				t.Errorf("Wrong output; expected '%s', got '%s'", tt.expected, o)
+			}
+		})
+	}
+}
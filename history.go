@@ -0,0 +1,551 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"container/heap"
+	"encoding/base64"
+	"github.com/AletheiaWareLLC/bcgo"
+	"github.com/AletheiaWareLLC/conveygo"
+	"github.com/AletheiaWareLLC/netgo"
+	"github.com/golang/protobuf/proto"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	HISTORY_PAGE_SIZE = 50
+
+	HISTORY_MINTED = "Minted"
+	HISTORY_BURNED = "Burned"
+	HISTORY_BOUGHT = "Bought"
+	HISTORY_SOLD   = "Sold"
+	HISTORY_EARNED = "Earned"
+	HISTORY_SPENT  = "Spent"
+
+	HISTORY_PURCHASE = "Purchase"
+	HISTORY_REVERSAL = "Reversal"
+	HISTORY_TRANSFER = "Transfer"
+	HISTORY_TIP      = "Tip"
+	HISTORY_REWARD   = "Reward"
+	HISTORY_POST     = "Post"
+	HISTORY_REPLY    = "Reply"
+)
+
+var pvcRewards = map[string]uint64{
+	conveygo.CONVEY_HOUR:    conveygo.HOURLY_PVC_REWARD,
+	conveygo.CONVEY_DAY:     conveygo.DAILY_PVC_REWARD,
+	conveygo.CONVEY_WEEK:    conveygo.WEEKLY_PVC_REWARD,
+	conveygo.CONVEY_YEAR:    conveygo.YEARLY_PVC_REWARD,
+	conveygo.CONVEY_DECADE:  conveygo.DECENNIALLY_PVC_REWARD,
+	conveygo.CONVEY_CENTURY: conveygo.CENTENNIALLY_PVC_REWARD,
+}
+
+// HistoryEntry is a change to the balance of an alias.
+type HistoryEntry struct {
+	Alias        string // Alias whose balance was changed
+	Timestamp    uint64
+	Channel      string
+	Hash         string // Record Hash, or Block Hash for Minted
+	Type         string // Ledger column which was changed
+	Description  string
+	Amount       int64
+	Counterparty string
+	Conversation string // Conversation Hash for Burned, Earned, and Spent
+	Memo         string
+	Balance      int64 // Balance after this entry
+}
+
+// GetHistory returns every change to the balance of the given alias, oldest first, with a running balance.
+// Channels are walked the same way as conveygo.Ledger.Update, so the final balance matches Ledger.GetBalance.
+// Memos are keyed by transaction record hash and may be nil.
+func GetHistory(node *bcgo.Node, alias string, memos map[string]string) ([]*HistoryEntry, error) {
+	entries, err := getHistory(node, func(a string) bool {
+		return a == alias
+	}, memos, nil)
+	if err != nil {
+		return nil, err
+	}
+	sortHistory(entries)
+	var balance int64
+	for _, e := range entries {
+		balance += e.Amount
+		e.Balance = balance
+	}
+	return entries, nil
+}
+
+// GetRecentHistory returns up to the given number of the most recent changes to the balance of the given alias, oldest first, with a running balance counted back from its current balance.
+// Channels are walked from their heads and only as far back as could still hold one of the changes, so the walk doesn't grow with the age of the chains.
+func GetRecentHistory(node *bcgo.Node, alias string, balance int64, limit int) ([]*HistoryEntry, error) {
+	entries, err := getHistory(node, func(a string) bool {
+		return a == alias
+	}, nil, &recentTimestamps{Limit: limit})
+	if err != nil {
+		return nil, err
+	}
+	sortHistory(entries)
+	if len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		entries[i].Balance = balance
+		balance -= entries[i].Amount
+	}
+	return entries, nil
+}
+
+func sortHistory(entries []*HistoryEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Timestamp != entries[j].Timestamp {
+			return entries[i].Timestamp < entries[j].Timestamp
+		}
+		if entries[i].Channel != entries[j].Channel {
+			return entries[i].Channel < entries[j].Channel
+		}
+		if entries[i].Hash != entries[j].Hash {
+			return entries[i].Hash < entries[j].Hash
+		}
+		return entries[i].Type < entries[j].Type
+	})
+}
+
+// timestampHeap is a min-heap of timestamps.
+type timestampHeap []uint64
+
+func (h timestampHeap) Len() int            { return len(h) }
+func (h timestampHeap) Less(i, j int) bool  { return h[i] < h[j] }
+func (h timestampHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *timestampHeap) Push(x interface{}) { *h = append(*h, x.(uint64)) }
+func (h *timestampHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// recentTimestamps keeps the newest timestamps of the entries found so far, up to a limit, so a walk can stop at blocks too old to hold one of the most recent entries.
+// A nil recentTimestamps keeps nothing, and nothing is too old.
+type recentTimestamps struct {
+	Limit      int
+	timestamps timestampHeap
+}
+
+func (r *recentTimestamps) add(timestamp uint64) {
+	if r == nil {
+		return
+	}
+	heap.Push(&r.timestamps, timestamp)
+	if len(r.timestamps) > r.Limit {
+		heap.Pop(&r.timestamps)
+	}
+}
+
+// older returns true if the limit has been reached and the given timestamp is older than every timestamp kept.
+func (r *recentTimestamps) older(timestamp uint64) bool {
+	return r != nil && len(r.timestamps) >= r.Limit && timestamp < r.timestamps[0]
+}
+
+// iterateHistory iterates the given channel from its head, stopping at the first block older than the recent entries.
+func iterateHistory(node *bcgo.Node, channel *bcgo.Channel, recent *recentTimestamps, callback func([]byte, *bcgo.Block) error) error {
+	if err := bcgo.Iterate(channel.Name, channel.Head, nil, node.Cache, node.Network, func(h []byte, b *bcgo.Block) error {
+		// Records are created before the block which holds them is mined
+		if recent.older(b.Timestamp) {
+			return bcgo.StopIterationError{}
+		}
+		return callback(h, b)
+	}); err != nil {
+		switch err.(type) {
+		case bcgo.StopIterationError:
+			// Do nothing
+			break
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// getHistory returns every change to the balance of each alias matched, in no particular order.
+// If recent is not nil the walk skips blocks too old to hold one of the most recent changes, though older changes may still be returned.
+func getHistory(node *bcgo.Node, match func(string) bool, memos map[string]string, recent *recentTimestamps) ([]*HistoryEntry, error) {
+	var entries []*HistoryEntry
+	add := func(entry *HistoryEntry) {
+		if entry.Amount != 0 {
+			entries = append(entries, entry)
+			recent.add(entry.Timestamp)
+		}
+	}
+	channels := node.GetChannels()
+	if recent != nil {
+		// Walk the most recently updated channels first so older channels can be skipped
+		sort.SliceStable(channels, func(i, j int) bool {
+			return channels[i].Timestamp > channels[j].Timestamp
+		})
+	}
+	for _, channel := range channels {
+		if channel.Head == nil || recent.older(channel.Timestamp) {
+			continue
+		}
+		name := channel.Name
+		if reward, ok := pvcRewards[name]; ok {
+			if err := iterateHistory(node, channel, recent, func(h []byte, b *bcgo.Block) error {
+				if match(b.Miner) {
+					add(&HistoryEntry{
+						Alias:       b.Miner,
+						Timestamp:   b.Timestamp,
+						Channel:     name,
+						Hash:        base64.RawURLEncoding.EncodeToString(h),
+						Type:        HISTORY_MINTED,
+						Description: HISTORY_REWARD,
+						Amount:      int64(reward),
+					})
+				}
+				return nil
+			}); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		switch {
+		case name == conveygo.CONVEY_TRANSACTION:
+			if err := iterateHistory(node, channel, recent, func(h []byte, b *bcgo.Block) error {
+				for _, entry := range b.Entry {
+					t := &conveygo.Transaction{}
+					if err := proto.Unmarshal(entry.Record.Payload, t); err != nil {
+						return err
+					}
+					hash := base64.RawURLEncoding.EncodeToString(entry.RecordHash)
+					description, conversation := transactionDescription(entry.Record)
+					if match(t.Sender) {
+						d := description
+						if d == HISTORY_PURCHASE {
+							d = HISTORY_REVERSAL
+						}
+						add(&HistoryEntry{
+							Alias:        t.Sender,
+							Timestamp:    entry.Record.Timestamp,
+							Channel:      name,
+							Hash:         hash,
+							Type:         HISTORY_SOLD,
+							Description:  d,
+							Amount:       -int64(t.Amount),
+							Counterparty: t.Receiver,
+							Conversation: conversation,
+							Memo:         memos[hash],
+						})
+					}
+					if match(t.Receiver) {
+						add(&HistoryEntry{
+							Alias:        t.Receiver,
+							Timestamp:    entry.Record.Timestamp,
+							Channel:      name,
+							Hash:         hash,
+							Type:         HISTORY_BOUGHT,
+							Description:  description,
+							Amount:       int64(t.Amount),
+							Counterparty: t.Sender,
+							Conversation: conversation,
+							Memo:         memos[hash],
+						})
+					}
+				}
+				return nil
+			}); err != nil {
+				return nil, err
+			}
+		case name == conveygo.CONVEY_CONVERSATION:
+			if err := iterateHistory(node, channel, recent, func(h []byte, b *bcgo.Block) error {
+				for _, entry := range b.Entry {
+					if match(entry.Record.Creator) {
+						hash := base64.RawURLEncoding.EncodeToString(entry.RecordHash)
+						add(&HistoryEntry{
+							Alias:        entry.Record.Creator,
+							Timestamp:    entry.Record.Timestamp,
+							Channel:      name,
+							Hash:         hash,
+							Type:         HISTORY_BURNED,
+							Description:  HISTORY_POST,
+							Amount:       -int64(conveygo.Cost(entry.Record)),
+							Conversation: hash,
+						})
+					}
+				}
+				return nil
+			}); err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(name, conveygo.CONVEY_PREFIX_MESSAGE):
+			e, err := getMessageHistory(node, channel, match)
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range e {
+				add(entry)
+			}
+		}
+	}
+	return entries, nil
+}
+
+// transactionDescription describes a transaction by the record it references, and returns the conversation of a tipped message.
+func transactionDescription(record *bcgo.Record) (string, string) {
+	for _, r := range record.Reference {
+		if r.ChannelName == conveygo.CONVEY_CHARGE {
+			return HISTORY_PURCHASE, ""
+		}
+		if strings.HasPrefix(r.ChannelName, conveygo.CONVEY_PREFIX_MESSAGE) {
+			return HISTORY_TIP, strings.TrimPrefix(r.ChannelName, conveygo.CONVEY_PREFIX_MESSAGE)
+		}
+	}
+	return HISTORY_TRANSFER, ""
+}
+
+type messageHistoryNode struct {
+	Hash      string
+	Timestamp uint64
+	Author    string
+	Cost      uint64
+	Previous  string
+}
+
+// getMessageHistory splits the cost of each message the same way as conveygo.Ledger.Update; the first message is burned, replies are spent and earned up the message hierarchy with the remainder burned.
+func getMessageHistory(node *bcgo.Node, channel *bcgo.Channel, match func(string) bool) ([]*HistoryEntry, error) {
+	conversation := strings.TrimPrefix(channel.Name, conveygo.CONVEY_PREFIX_MESSAGE)
+	nodes := make(map[string]*messageHistoryNode)
+	if err := bcgo.Iterate(channel.Name, channel.Head, nil, node.Cache, node.Network, func(h []byte, b *bcgo.Block) error {
+		for _, entry := range b.Entry {
+			m := &conveygo.Message{}
+			if err := proto.Unmarshal(entry.Record.Payload, m); err != nil {
+				return err
+			}
+			n := &messageHistoryNode{
+				Hash:      base64.RawURLEncoding.EncodeToString(entry.RecordHash),
+				Timestamp: entry.Record.Timestamp,
+				Author:    entry.Record.Creator,
+				Cost:      conveygo.Cost(entry.Record),
+			}
+			if len(m.Previous) > 0 {
+				n.Previous = base64.RawURLEncoding.EncodeToString(m.Previous)
+			}
+			nodes[n.Hash] = n
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	var entries []*HistoryEntry
+	for _, n := range nodes {
+		entry := func(alias, t, description string, amount int64, counterparty string) *HistoryEntry {
+			return &HistoryEntry{
+				Alias:        alias,
+				Timestamp:    n.Timestamp,
+				Channel:      channel.Name,
+				Hash:         n.Hash,
+				Type:         t,
+				Description:  description,
+				Amount:       amount,
+				Counterparty: counterparty,
+				Conversation: conversation,
+			}
+		}
+		if n.Previous == "" {
+			if match(n.Author) {
+				entries = append(entries, entry(n.Author, HISTORY_BURNED, HISTORY_POST, -int64(n.Cost), ""))
+			}
+			continue
+		}
+		var spent uint64
+		cost := n.Cost
+		prev := n.Previous
+		for {
+			half := cost / 2
+			previous, ok := nodes[prev]
+			if !ok {
+				break
+			}
+			spent += half
+			if match(previous.Author) {
+				entries = append(entries, entry(previous.Author, HISTORY_EARNED, HISTORY_REPLY, int64(half), n.Author))
+			}
+			if previous.Previous == "" {
+				cost -= half
+				break
+			}
+			cost -= half
+			prev = previous.Previous
+		}
+		if match(n.Author) {
+			entries = append(entries, entry(n.Author, HISTORY_SPENT, HISTORY_REPLY, -int64(spent), ""))
+			entries = append(entries, entry(n.Author, HISTORY_BURNED, HISTORY_REPLY, -int64(cost), ""))
+		}
+	}
+	return entries, nil
+}
+
+type HistoryEntryTemplate struct {
+	Timestamp    string
+	Type         string
+	Description  string
+	Amount       int64
+	Counterparty string
+	Conversation string
+	Memo         string
+	Balance      int64
+}
+
+type HistoryTemplate struct {
+	Alias    string
+	Path     string
+	Balance  int64
+	Entry    []*HistoryEntryTemplate
+	Page     int
+	Pages    int
+	Previous int
+	Next     int
+}
+
+// NewHistoryTemplate returns the given page of the history, newest first.
+func NewHistoryTemplate(alias, path string, entries []*HistoryEntry, page int) *HistoryTemplate {
+	data := &HistoryTemplate{
+		Alias: alias,
+		Path:  path,
+		Pages: (len(entries) + HISTORY_PAGE_SIZE - 1) / HISTORY_PAGE_SIZE,
+	}
+	if data.Pages == 0 {
+		data.Pages = 1
+	}
+	if page < 1 {
+		page = 1
+	}
+	if page > data.Pages {
+		page = data.Pages
+	}
+	data.Page = page
+	if page > 1 {
+		data.Previous = page - 1
+	}
+	if page < data.Pages {
+		data.Next = page + 1
+	}
+	if len(entries) > 0 {
+		data.Balance = entries[len(entries)-1].Balance
+	}
+	// Count back from the newest entry
+	end := len(entries) - (page-1)*HISTORY_PAGE_SIZE
+	start := end - HISTORY_PAGE_SIZE
+	if start < 0 {
+		start = 0
+	}
+	for i := end - 1; i >= start; i-- {
+		e := entries[i]
+		data.Entry = append(data.Entry, &HistoryEntryTemplate{
+			Timestamp:    bcgo.TimestampToString(e.Timestamp),
+			Type:         e.Type,
+			Description:  e.Description,
+			Amount:       e.Amount,
+			Counterparty: e.Counterparty,
+			Conversation: e.Conversation,
+			Memo:         e.Memo,
+			Balance:      e.Balance,
+		})
+	}
+	return data
+}
+
+func getHistoryPage(r *http.Request) int {
+	page, err := strconv.Atoi(r.FormValue("page"))
+	if err != nil {
+		return 1
+	}
+	return page
+}
+
+// HistoryHandler shows the history of the signed in alias, including the memos of their transfers.
+func HistoryHandler(sessions SessionStore, node *bcgo.Node, memos *bcgo.Channel, template *template.Template) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println(r.RemoteAddr, r.Proto, r.Method, r.Host, r.URL.Path, r.Header)
+		// If not signed in, redirect to sign in page
+		cookie, err := GetSignInSessionCookie(r)
+		if err == nil {
+			session := sessions.GetSignInSession(cookie.Value)
+			if session != nil {
+				id, err := sessions.RefreshSignInSession(session)
+				if err == nil {
+					http.SetCookie(w, CreateSignInSessionCookie(id, sessions.GetSignInSessionTimeout()))
+				}
+				switch r.Method {
+				case "GET":
+					m, err := GetTransferMemos(node, memos, session.Alias, session.Key)
+					if err != nil {
+						log.Println(err)
+						http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+						return
+					}
+					entries, err := GetHistory(node, session.Alias, m)
+					if err != nil {
+						log.Println(err)
+						http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+						return
+					}
+					data := NewHistoryTemplate(session.Alias, "/account/history?", entries, getHistoryPage(r))
+					if err := template.Execute(w, data); err != nil {
+						log.Println(err)
+						http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+					}
+					return
+				default:
+					log.Println("Unsupported method", r.Method)
+				}
+			}
+		}
+		RedirectSignIn(w, r)
+	}
+}
+
+// AliasHistoryHandler shows the public history of the alias given in the request, memos are not shown as they are encrypted.
+func AliasHistoryHandler(node *bcgo.Node, template *template.Template) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println(r.RemoteAddr, r.Proto, r.Method, r.Host, r.URL.Path, r.Header)
+		switch r.Method {
+		case "GET":
+			alias := netgo.GetQueryParameter(r.URL.Query(), "alias")
+			if alias == "" {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			entries, err := GetHistory(node, alias, nil)
+			if err != nil {
+				log.Println(err)
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			data := NewHistoryTemplate(alias, "/alias/history?"+url.Values{"alias": {alias}}.Encode()+"&", entries, getHistoryPage(r))
+			if err := template.Execute(w, data); err != nil {
+				log.Println(err)
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			}
+		default:
+			log.Println("Unsupported method", r.Method)
+		}
+	}
+}
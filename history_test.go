@@ -0,0 +1,259 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main_test
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"github.com/AletheiaWareLLC/bcgo"
+	"github.com/AletheiaWareLLC/conveygo"
+	"github.com/AletheiaWareLLC/conveyservergo"
+	"github.com/AletheiaWareLLC/financego"
+	"github.com/AletheiaWareLLC/testinggo"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGetHistory(t *testing.T) {
+	merchantKey := makeKey(t)
+	aliceKey := makeKey(t)
+	bobKey := makeKey(t)
+	node := makeNode(t, "Merchant", merchantKey)
+	miner := main.NewChannelMiner()
+
+	hours := bcgo.OpenPoWChannel(conveygo.CONVEY_HOUR, bcgo.THRESHOLD_G)
+	charges := conveygo.OpenChargeChannel()
+	transactions := conveygo.OpenTransactionChannel()
+	conversations := conveygo.OpenConversationChannel()
+	memos := main.OpenTransferMemoChannel()
+	for _, c := range []*bcgo.Channel{hours, charges, transactions, conversations, memos} {
+		node.AddChannel(c)
+	}
+
+	// Merchant mints by mining the hourly chain
+	_, err := main.MineRecord(node, miner, nil, hours, node.Alias, merchantKey, nil, nil, nil, &conveygo.Message{})
+	testinggo.AssertNoError(t, err)
+
+	// Alice buys tokens, Bob is given some
+	charge, err := main.MineRecord(node, miner, nil, charges, node.Alias, merchantKey, map[string]*rsa.PublicKey{
+		"Alice": &aliceKey.PublicKey,
+	}, nil, nil, &financego.Charge{ChargeId: "ch_1"})
+	testinggo.AssertNoError(t, err)
+	testinggo.AssertNoError(t, main.MineTransaction(node, miner, nil, transactions, node.Alias, merchantKey, "Alice", 1000, []*bcgo.Reference{charge}))
+	testinggo.AssertNoError(t, main.MineTransfer(node, miner, nil, transactions, memos, node.Alias, merchantKey, "Bob", &bobKey.PublicKey, 500, "", nil))
+
+	// Alice starts a conversation, Bob replies, Alice replies to Bob
+	conversation, err := main.MineRecord(node, miner, nil, conversations, "Alice", aliceKey, nil, nil, nil, &conveygo.Conversation{Topic: "Hello"})
+	testinggo.AssertNoError(t, err)
+	messages := conveygo.OpenMessageChannel(base64.RawURLEncoding.EncodeToString(conversation.RecordHash))
+	node.AddChannel(messages)
+	first, err := main.MineRecord(node, miner, nil, messages, "Alice", aliceKey, nil, nil, nil, &conveygo.Message{Content: []byte("Hello World"), Type: conveygo.MediaType_TEXT_PLAIN})
+	testinggo.AssertNoError(t, err)
+	reply, err := main.MineRecord(node, miner, nil, messages, "Bob", bobKey, nil, nil, nil, &conveygo.Message{Previous: first.RecordHash, Content: []byte("Hi Alice, this is a reply long enough to earn a few tokens for the author of the message it replies to"), Type: conveygo.MediaType_TEXT_PLAIN})
+	testinggo.AssertNoError(t, err)
+	_, err = main.MineRecord(node, miner, nil, messages, "Alice", aliceKey, nil, nil, nil, &conveygo.Message{Previous: reply.RecordHash, Content: []byte("Hi Bob, this is a reply to a reply which splits its cost between Bob and up the conversation to Alice"), Type: conveygo.MediaType_TEXT_PLAIN})
+	testinggo.AssertNoError(t, err)
+
+	// Alice tips Bob with a memo
+	testinggo.AssertNoError(t, main.MineTransfer(node, miner, nil, transactions, memos, "Alice", aliceKey, "Bob", &bobKey.PublicKey, 10, "Thanks", nil))
+
+	ledger := conveygo.NewLedger(node)
+	testinggo.AssertNoError(t, ledger.UpdateAll())
+
+	for name, key := range map[string]*rsa.PrivateKey{
+		"Merchant": merchantKey,
+		"Alice":    aliceKey,
+		"Bob":      bobKey,
+	} {
+		t.Run(name, func(t *testing.T) {
+			m, err := main.GetTransferMemos(node, memos, name, key)
+			testinggo.AssertNoError(t, err)
+			entries, err := main.GetHistory(node, name, m)
+			testinggo.AssertNoError(t, err)
+			if len(entries) == 0 {
+				t.Fatal("Expected history")
+			}
+			// Reconciles with the ledger in total and per column
+			if b := entries[len(entries)-1].Balance; b != ledger.GetBalance(name) {
+				t.Errorf("Wrong balance; expected '%d', got '%d'", ledger.GetBalance(name), b)
+			}
+			totals := make(map[string]int64)
+			for i, e := range entries {
+				totals[e.Type] += e.Amount
+				if i > 0 && e.Timestamp < entries[i-1].Timestamp {
+					t.Errorf("Entries out of order at %d", i)
+				}
+			}
+			for column, expected := range map[string]int64{
+				main.HISTORY_MINTED: int64(ledger.Minted[name]),
+				main.HISTORY_BURNED: -int64(ledger.Burned[name]),
+				main.HISTORY_BOUGHT: int64(ledger.Bought[name]),
+				main.HISTORY_SOLD:   -int64(ledger.Sold[name]),
+				main.HISTORY_EARNED: int64(ledger.Earned[name]),
+				main.HISTORY_SPENT:  -int64(ledger.Spent[name]),
+			} {
+				if totals[column] != expected {
+					t.Errorf("Wrong %s; expected '%d', got '%d'", column, expected, totals[column])
+				}
+			}
+		})
+	}
+
+	t.Run("Descriptions", func(t *testing.T) {
+		m, err := main.GetTransferMemos(node, memos, "Alice", aliceKey)
+		testinggo.AssertNoError(t, err)
+		entries, err := main.GetHistory(node, "Alice", m)
+		testinggo.AssertNoError(t, err)
+		purchase := entries[0]
+		if purchase.Description != main.HISTORY_PURCHASE || purchase.Amount != 1000 || purchase.Counterparty != "Merchant" {
+			t.Errorf("Wrong purchase; got '%v'", purchase)
+		}
+		tip := entries[len(entries)-1]
+		if tip.Description != main.HISTORY_TRANSFER || tip.Amount != -10 || tip.Memo != "Thanks" {
+			t.Errorf("Wrong transfer; got '%v'", tip)
+		}
+		// Memos can't be read without the key
+		entries, err = main.GetHistory(node, "Alice", nil)
+		testinggo.AssertNoError(t, err)
+		if memo := entries[len(entries)-1].Memo; memo != "" {
+			t.Errorf("Expected no memo, got '%s'", memo)
+		}
+	})
+
+	t.Run("Recent", func(t *testing.T) {
+		for _, name := range []string{"Merchant", "Alice", "Bob"} {
+			entries, err := main.GetHistory(node, name, nil)
+			testinggo.AssertNoError(t, err)
+			for _, limit := range []int{1, 2, 3, 100} {
+				recent, err := main.GetRecentHistory(node, name, ledger.GetBalance(name), limit)
+				testinggo.AssertNoError(t, err)
+				expected := entries
+				if len(expected) > limit {
+					expected = expected[len(expected)-limit:]
+				}
+				if len(recent) != len(expected) {
+					t.Fatalf("Wrong number of %s entries; expected '%d', got '%d'", name, len(expected), len(recent))
+				}
+				for i, e := range expected {
+					if recent[i].Hash != e.Hash || recent[i].Type != e.Type || recent[i].Amount != e.Amount || recent[i].Balance != e.Balance {
+						t.Errorf("Wrong %s entry %d; expected '%v', got '%v'", name, i, e, recent[i])
+					}
+				}
+			}
+		}
+	})
+}
+
+func TestNewHistoryTemplate(t *testing.T) {
+	var entries []*main.HistoryEntry
+	for i := 1; i <= 120; i++ {
+		entries = append(entries, &main.HistoryEntry{
+			Timestamp: uint64(i),
+			Amount:    1,
+			Balance:   int64(i),
+		})
+	}
+	for name, tt := range map[string]struct {
+		entries          []*main.HistoryEntry
+		page             int
+		expectedPage     int
+		expectedPrevious int
+		expectedNext     int
+		expectedFirst    int64
+		expectedCount    int
+	}{
+		"First":  {entries, 1, 1, 0, 2, 120, 50},
+		"Middle": {entries, 2, 2, 1, 3, 70, 50},
+		"Last":   {entries, 3, 3, 2, 0, 20, 20},
+		"Beyond": {entries, 9, 3, 2, 0, 20, 20},
+		"Before": {entries, -1, 1, 0, 2, 120, 50},
+		"Empty":  {nil, 1, 1, 0, 0, 0, 0},
+	} {
+		t.Run(name, func(t *testing.T) {
+			data := main.NewHistoryTemplate("Alice", "/account/history?", tt.entries, tt.page)
+			if data.Page != tt.expectedPage {
+				t.Errorf("Wrong page; expected '%d', got '%d'", tt.expectedPage, data.Page)
+			}
+			if data.Previous != tt.expectedPrevious {
+				t.Errorf("Wrong previous; expected '%d', got '%d'", tt.expectedPrevious, data.Previous)
+			}
+			if data.Next != tt.expectedNext {
+				t.Errorf("Wrong next; expected '%d', got '%d'", tt.expectedNext, data.Next)
+			}
+			if len(data.Entry) != tt.expectedCount {
+				t.Fatalf("Wrong number of entries; expected '%d', got '%d'", tt.expectedCount, len(data.Entry))
+			}
+			if tt.expectedCount > 0 && data.Entry[0].Balance != tt.expectedFirst {
+				t.Errorf("Wrong first balance; expected '%d', got '%d'", tt.expectedFirst, data.Entry[0].Balance)
+			}
+			if int64(len(tt.entries)) != data.Balance {
+				t.Errorf("Wrong balance; expected '%d', got '%d'", len(tt.entries), data.Balance)
+			}
+		})
+	}
+}
+
+func TestHistoryHandlers(t *testing.T) {
+	aliceKey := makeKey(t)
+	bobKey := makeKey(t)
+	node := makeNode(t, "Merchant", makeKey(t))
+	transactions := conveygo.OpenTransactionChannel()
+	memos := main.OpenTransferMemoChannel()
+	node.AddChannel(transactions)
+	node.AddChannel(memos)
+	testinggo.AssertNoError(t, main.MineTransfer(node, main.NewChannelMiner(), nil, transactions, memos, "Alice", aliceKey, "Bob", &bobKey.PublicKey, 10, "Lunch", nil))
+
+	tmplt, err := template.New("").Parse(`{{ .Alias }}:{{ .Balance }}:{{ .Path }}:{{ range .Entry }}{{ .Type }}:{{ .Amount }}:{{ .Counterparty }}:{{ .Memo }};{{ end }}`)
+	testinggo.AssertNoError(t, err)
+
+	t.Run("Account", func(t *testing.T) {
+		sessionstore := main.NewMemorySessionStore()
+		session, err := sessionstore.CreateSignInSession("Bob", bobKey)
+		testinggo.AssertNoError(t, err)
+		request, err := http.NewRequest("GET", "/account/history", nil)
+		testinggo.AssertNoError(t, err)
+		request.AddCookie(main.CreateSignInSessionCookie(session, time.Hour))
+		response := httptest.NewRecorder()
+		main.HistoryHandler(sessionstore, node, memos, tmplt)(response, request)
+		expected := "Bob:10:/account/history?:Bought:10:Alice:Lunch;"
+		if actual := response.Body.String(); actual != expected {
+			t.Errorf("Wrong response; expected '%s', got '%s'", expected, actual)
+		}
+	})
+	t.Run("Alias", func(t *testing.T) {
+		request, err := http.NewRequest("GET", "/alias/history?alias=Alice", nil)
+		testinggo.AssertNoError(t, err)
+		response := httptest.NewRecorder()
+		main.AliasHistoryHandler(node, tmplt)(response, request)
+		expected := "Alice:-10:/alias/history?alias=Alice&amp;:Sold:-10:Bob:;"
+		if actual := response.Body.String(); actual != expected {
+			t.Errorf("Wrong response; expected '%s', got '%s'", expected, actual)
+		}
+	})
+	t.Run("AliasMissing", func(t *testing.T) {
+		request, err := http.NewRequest("GET", "/alias/history", nil)
+		testinggo.AssertNoError(t, err)
+		response := httptest.NewRecorder()
+		main.AliasHistoryHandler(node, tmplt)(response, request)
+		if response.Code != http.StatusNotFound {
+			t.Errorf("Wrong response code; expected '%d', got '%d'", http.StatusNotFound, response.Code)
+		}
+	})
+}
@@ -0,0 +1,292 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/AletheiaWareLLC/bcgo"
+	"html/template"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	JOB_QUEUED      = "Queued"
+	JOB_MINING      = "Mining"
+	JOB_PUSHING     = "Pushing"
+	JOB_DONE        = "Done"
+	JOB_PROPAGATING = "Propagating" // Mined, but left in the outbox as pushing failed
+	JOB_FAILED      = "Failed"
+
+	ERROR_NO_SUCH_JOB   = "No such job: %s"
+	ERROR_QUEUE_FULL    = "Mining queue is full, try again later"
+	ERROR_QUEUE_STOPPED = "Mining queue is stopped"
+
+	JOB_QUEUE_SIZE     = 100
+	JOB_RETENTION      = time.Hour
+	JOB_REFRESH_PERIOD = 2 // Seconds between refreshes of the job page
+)
+
+// Job is work queued for mining, along with its progress.
+type Job struct {
+	ID          string
+	Alias       string
+	Description string
+	Redirect    string // Page to show once the job is done
+	Status      string
+	Error       string
+	Records     []string // Hashes of the records mined, for jobs which report them
+	Created     time.Time
+	Updated     time.Time
+}
+
+// Finished returns true if the job is done, propagating, or has failed.
+func (j *Job) Finished() bool {
+	return j.Status == JOB_DONE || j.Status == JOB_PROPAGATING || j.Status == JOB_FAILED
+}
+
+// JobFunc mines a job's records using the given node, which isn't connected to the network, and returns the channels to push once mining is finished.
+// The hashes of the records mined may also be returned, and are kept on the job so handlers can show them without sharing state with the worker.
+type JobFunc func(node *bcgo.Node) ([]*bcgo.Channel, []string, error)
+
+type queuedJob struct {
+	job  *Job
+	work JobFunc
+}
+
+// MiningQueue mines jobs in the background with a bounded number of workers, so handlers don't wait for proof of work.
+// New heads are pushed to the network once mining is finished.
+// If the push fails and there is an outbox, the heads are left in the outbox to be retried in the background, so workers aren't held up waiting to retry.
+type MiningQueue struct {
+	Node    *bcgo.Node
+	Outbox  Outbox
+	Workers int
+	jobs    map[string]*Job
+	queue   chan *queuedJob
+	stopped bool
+	lock    sync.Mutex
+	wait    sync.WaitGroup
+}
+
+func NewMiningQueue(node *bcgo.Node, workers int) *MiningQueue {
+	if workers <= 0 {
+		workers = 1
+	}
+	return &MiningQueue{
+		Node:    node,
+		Workers: workers,
+		jobs:    make(map[string]*Job),
+		queue:   make(chan *queuedJob, JOB_QUEUE_SIZE),
+	}
+}
+
+// Start starts the workers, which run until Stop is called.
+func (q *MiningQueue) Start() {
+	for i := 0; i < q.Workers; i++ {
+		q.wait.Add(1)
+		go func() {
+			defer q.wait.Done()
+			for j := range q.queue {
+				q.run(j)
+			}
+		}()
+	}
+}
+
+// Stop stops accepting jobs, and waits for the queued jobs to finish.
+func (q *MiningQueue) Stop() {
+	q.lock.Lock()
+	if !q.stopped {
+		q.stopped = true
+		close(q.queue)
+	}
+	q.lock.Unlock()
+	q.wait.Wait()
+}
+
+// Enqueue adds work to the queue on behalf of the given alias, and returns the job tracking its progress.
+// Work can't be added once the queue is stopped.
+func (q *MiningQueue) Enqueue(alias, description, redirect string, work JobFunc) (*Job, error) {
+	id, err := newLocalId("job")
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	job := &Job{
+		ID:          id,
+		Alias:       alias,
+		Description: description,
+		Redirect:    redirect,
+		Status:      JOB_QUEUED,
+		Created:     now,
+		Updated:     now,
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.stopped {
+		return nil, errors.New(ERROR_QUEUE_STOPPED)
+	}
+	// Forget jobs which finished a while ago
+	for k, j := range q.jobs {
+		if j.Finished() && now.Sub(j.Updated) > JOB_RETENTION {
+			delete(q.jobs, k)
+		}
+	}
+	select {
+	case q.queue <- &queuedJob{job, work}:
+	default:
+		return nil, errors.New(ERROR_QUEUE_FULL)
+	}
+	q.jobs[id] = job
+	log.Println("Queued job", id, description)
+	c := *job
+	return &c, nil
+}
+
+// GetJob returns a copy of the job with the given ID.
+func (q *MiningQueue) GetJob(id string) (*Job, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	job, ok := q.jobs[id]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf(ERROR_NO_SUCH_JOB, id))
+	}
+	c := *job
+	return &c, nil
+}
+
+func (q *MiningQueue) update(job *Job, status, e string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	job.Status = status
+	job.Error = e
+	job.Updated = time.Now()
+	log.Println("Job", job.ID, status, e)
+}
+
+func (q *MiningQueue) run(j *queuedJob) {
+	q.update(j.job, JOB_MINING, "")
+	// Mine with a copy of the node which isn't connected to the network, so pushing can be retried separately
+	offline := &bcgo.Node{
+		Alias:    q.Node.Alias,
+		Key:      q.Node.Key,
+		Cache:    q.Node.Cache,
+		Channels: q.Node.Channels,
+	}
+	channels, records, err := j.work(offline)
+	if err != nil {
+		q.update(j.job, JOB_FAILED, err.Error())
+		return
+	}
+	q.lock.Lock()
+	j.job.Records = records
+	q.lock.Unlock()
+	if q.Node.Network != nil {
+		q.update(j.job, JOB_PUSHING, "")
+		if err := pushChannels(q.Node, channels); err != nil {
+			if q.Outbox == nil {
+				q.update(j.job, JOB_FAILED, err.Error())
+				return
+			}
+			for _, c := range channels {
+				if c.Head == nil {
+					continue
+				}
+				if err := q.Outbox.Add(c.Name, c.Head, time.Now()); err != nil {
+					q.update(j.job, JOB_FAILED, err.Error())
+					return
+				}
+			}
+			log.Println("Push failed, adding to outbox", j.job.ID, err)
+			q.update(j.job, JOB_PROPAGATING, err.Error())
+			return
+		}
+	}
+	q.update(j.job, JOB_DONE, "")
+}
+
+func pushChannels(node *bcgo.Node, channels []*bcgo.Channel) error {
+	for _, c := range channels {
+		if c.Head == nil {
+			// Nothing mined
+			continue
+		}
+		if err := c.Push(node.Cache, node.Network); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type JobTemplate struct {
+	ID          string
+	Description string
+	Redirect    string
+	Status      string
+	Error       string
+	Created     string
+	Finished    bool
+	Refresh     int
+}
+
+// JobHandler shows the progress of one of the signed in alias' jobs, refreshing until it is finished.
+func JobHandler(sessions SessionStore, queue *MiningQueue, template *template.Template) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println(r.RemoteAddr, r.Proto, r.Method, r.Host, r.URL.Path, r.Header)
+		// If not signed in, redirect to sign in page
+		cookie, err := GetSignInSessionCookie(r)
+		if err == nil {
+			session := sessions.GetSignInSession(cookie.Value)
+			if session != nil {
+				id, err := sessions.RefreshSignInSession(session)
+				if err == nil {
+					http.SetCookie(w, CreateSignInSessionCookie(id, sessions.GetSignInSessionTimeout()))
+				}
+				switch r.Method {
+				case "GET":
+					job, err := queue.GetJob(r.FormValue("id"))
+					if err != nil || job.Alias != session.Alias {
+						log.Println(err)
+						http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+						return
+					}
+					data := &JobTemplate{
+						ID:          job.ID,
+						Description: job.Description,
+						Redirect:    job.Redirect,
+						Status:      job.Status,
+						Error:       job.Error,
+						Created:     bcgo.TimestampToString(uint64(job.Created.UnixNano())),
+						Finished:    job.Finished(),
+						Refresh:     JOB_REFRESH_PERIOD,
+					}
+					if err := template.Execute(w, data); err != nil {
+						log.Println(err)
+						http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+					}
+					return
+				default:
+					log.Println("Unsupported method", r.Method)
+				}
+			}
+		}
+		RedirectSignIn(w, r)
+	}
+}
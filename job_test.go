@@ -0,0 +1,254 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main_test
+
+import (
+	"errors"
+	"github.com/AletheiaWareLLC/bcgo"
+	"github.com/AletheiaWareLLC/conveyservergo"
+	"github.com/AletheiaWareLLC/testinggo"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+type MockNetwork struct {
+	Failures   int    // Number of broadcasts to fail before succeeding
+	Error      string // Error returned by failed broadcasts
+	Broadcasts int
+	Head       []byte     // Hash of the remote head
+	Remote     bcgo.Cache // Cache holding the remote blocks
+}
+
+func (n *MockNetwork) GetHead(channel string) (*bcgo.Reference, error) {
+	if n.Head == nil {
+		return nil, errors.New("Not implemented")
+	}
+	return &bcgo.Reference{
+		ChannelName: channel,
+		BlockHash:   n.Head,
+	}, nil
+}
+
+func (n *MockNetwork) GetBlock(reference *bcgo.Reference) (*bcgo.Block, error) {
+	if n.Remote == nil {
+		return nil, errors.New("Not implemented")
+	}
+	return n.Remote.GetBlock(reference.BlockHash)
+}
+
+func (n *MockNetwork) Broadcast(channel *bcgo.Channel, cache bcgo.Cache, hash []byte, block *bcgo.Block) error {
+	n.Broadcasts++
+	if n.Broadcasts <= n.Failures {
+		if n.Error != "" {
+			return errors.New(n.Error)
+		}
+		return errors.New("Broadcast failed")
+	}
+	return nil
+}
+
+func makeMiningQueue(t *testing.T, node *bcgo.Node) *main.MiningQueue {
+	t.Helper()
+	queue := main.NewMiningQueue(node, 1)
+	queue.Start()
+	return queue
+}
+
+func waitForJob(t *testing.T, queue *main.MiningQueue, id string) *main.Job {
+	t.Helper()
+	for {
+		job, err := queue.GetJob(id)
+		testinggo.AssertNoError(t, err)
+		if job.Finished() {
+			return job
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// followJob waits for the job at the given location to finish, and returns the location it redirects to.
+func followJob(t *testing.T, queue *main.MiningQueue, location string) string {
+	t.Helper()
+	if !strings.HasPrefix(location, "/job?id=") {
+		return location
+	}
+	job := waitForJob(t, queue, strings.TrimPrefix(location, "/job?id="))
+	if job.Status != main.JOB_DONE {
+		t.Fatalf("Wrong status; expected '%s', got '%s' '%s'", main.JOB_DONE, job.Status, job.Error)
+	}
+	return job.Redirect
+}
+
+// mineTestRecord is a job which mines a record into a test channel.
+func mineTestRecord(node *bcgo.Node) ([]*bcgo.Channel, []string, error) {
+	channel := node.GetOrOpenChannel("Test", func() *bcgo.Channel {
+		return bcgo.OpenPoWChannel("Test", 0)
+	})
+	if _, err := node.Write(bcgo.Timestamp(), channel, nil, nil, []byte("Hello")); err != nil {
+		return nil, nil, err
+	}
+	if _, _, err := node.Mine(channel, 0, nil); err != nil {
+		return nil, nil, err
+	}
+	return []*bcgo.Channel{channel}, nil, nil
+}
+
+func TestMiningQueue(t *testing.T) {
+	mine := mineTestRecord
+	for name, tt := range map[string]struct {
+		work           main.JobFunc
+		network        *MockNetwork
+		expectedStatus string
+		expectedError  string
+	}{
+		"Offline": {mine, nil, main.JOB_DONE, ""},
+		"Pushed":  {mine, &MockNetwork{}, main.JOB_DONE, ""},
+		// Without an outbox there is nowhere to retry from
+		"NotPushed": {mine, &MockNetwork{Failures: 1}, main.JOB_FAILED, "Broadcast failed"},
+		"Failed": {func(node *bcgo.Node) ([]*bcgo.Channel, []string, error) {
+			return nil, nil, errors.New("Mining failed")
+		}, &MockNetwork{}, main.JOB_FAILED, "Mining failed"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			node := makeNode(t, "Merchant", makeKey(t))
+			if tt.network != nil {
+				node.Network = tt.network
+			}
+			queue := makeMiningQueue(t, node)
+			defer queue.Stop()
+			job, err := queue.Enqueue("Alice", "Test", "/", tt.work)
+			testinggo.AssertNoError(t, err)
+			job = waitForJob(t, queue, job.ID)
+			if job.Status != tt.expectedStatus {
+				t.Errorf("Wrong status; expected '%s', got '%s'", tt.expectedStatus, job.Status)
+			}
+			if job.Error != tt.expectedError {
+				t.Errorf("Wrong error; expected '%s', got '%s'", tt.expectedError, job.Error)
+			}
+			if _, err := node.GetChannel("Test"); tt.expectedError != "Mining failed" && err != nil {
+				t.Errorf("Expected channel to be mined, got '%s'", err)
+			}
+		})
+	}
+}
+
+func TestMiningQueue_Outbox(t *testing.T) {
+	dir := testinggo.MakeTempDir(t, "outbox")
+	defer testinggo.UnmakeTempDir(t, dir)
+	outbox := main.NewFileOutbox(path.Join(dir, "outbox.json"))
+	node := makeNode(t, "Merchant", makeKey(t))
+	network := &MockNetwork{Failures: 1}
+	node.Network = network
+	queue := makeMiningQueue(t, node)
+	queue.Outbox = outbox
+	defer queue.Stop()
+
+	job, err := queue.Enqueue("Alice", "Test", "/", mineTestRecord)
+	testinggo.AssertNoError(t, err)
+	job = waitForJob(t, queue, job.ID)
+	if job.Status != main.JOB_PROPAGATING {
+		t.Errorf("Wrong status; expected '%s', got '%s'", main.JOB_PROPAGATING, job.Status)
+	}
+
+	channel, err := node.GetChannel("Test")
+	testinggo.AssertNoError(t, err)
+	entry, err := outbox.Get("Test")
+	testinggo.AssertNoError(t, err)
+	if entry == nil {
+		t.Fatal("Expected channel to be in outbox")
+	}
+	if len(entry.Blocks) != 1 {
+		t.Fatalf("Wrong number of blocks; expected '%d', got '%d'", 1, len(entry.Blocks))
+	}
+	testinggo.AssertHashEqual(t, channel.Head, entry.Blocks[0])
+	// Pushed once by the queue, leaving retries to the outbox
+	if network.Broadcasts != 1 {
+		t.Errorf("Wrong number of broadcasts; expected '%d', got '%d'", 1, network.Broadcasts)
+	}
+}
+
+func TestMiningQueue_Full(t *testing.T) {
+	queue := main.NewMiningQueue(makeNode(t, "Merchant", makeKey(t)), 1)
+	// Not started, so nothing is taken from the queue
+	for i := 0; i < main.JOB_QUEUE_SIZE; i++ {
+		_, err := queue.Enqueue("Alice", "Test", "/", nil)
+		testinggo.AssertNoError(t, err)
+	}
+	_, err := queue.Enqueue("Alice", "Test", "/", nil)
+	testinggo.AssertError(t, main.ERROR_QUEUE_FULL, err)
+}
+
+func TestMiningQueue_Stopped(t *testing.T) {
+	queue := makeMiningQueue(t, makeNode(t, "Merchant", makeKey(t)))
+	queue.Stop()
+	_, err := queue.Enqueue("Alice", "Test", "/", mineTestRecord)
+	testinggo.AssertError(t, main.ERROR_QUEUE_STOPPED, err)
+	// Stopping again does nothing
+	queue.Stop()
+}
+
+func TestJobHandler(t *testing.T) {
+	tmplt, err := template.New("").Parse(`{{ .Description }}:{{ .Status }}:{{ .Redirect }}:{{ .Finished }}`)
+	testinggo.AssertNoError(t, err)
+	queue := makeMiningQueue(t, makeNode(t, "Merchant", makeKey(t)))
+	defer queue.Stop()
+	job, err := queue.Enqueue("Alice", "Test", "/transfered.html", func(node *bcgo.Node) ([]*bcgo.Channel, []string, error) {
+		return nil, nil, nil
+	})
+	testinggo.AssertNoError(t, err)
+	waitForJob(t, queue, job.ID)
+
+	sessionstore := main.NewMemorySessionStore()
+	alice, err := sessionstore.CreateSignInSession("Alice", makeKey(t))
+	testinggo.AssertNoError(t, err)
+	bob, err := sessionstore.CreateSignInSession("Bob", makeKey(t))
+	testinggo.AssertNoError(t, err)
+	handler := main.JobHandler(sessionstore, queue, tmplt)
+
+	for name, tt := range map[string]struct {
+		session      string
+		id           string
+		expectedCode int
+		expectedBody string
+	}{
+		"Owner":     {alice, job.ID, http.StatusOK, "Test:Done:/transfered.html:true"},
+		"NotOwner":  {bob, job.ID, http.StatusNotFound, "Not Found\n"},
+		"Unknown":   {alice, "job_unknown", http.StatusNotFound, "Not Found\n"},
+		"SignedOut": {"", job.ID, http.StatusFound, ""},
+	} {
+		t.Run(name, func(t *testing.T) {
+			request, err := http.NewRequest("GET", "/job?id="+tt.id, nil)
+			testinggo.AssertNoError(t, err)
+			if tt.session != "" {
+				request.AddCookie(main.CreateSignInSessionCookie(tt.session, time.Hour))
+			}
+			response := httptest.NewRecorder()
+			handler(response, request)
+			if response.Code != tt.expectedCode {
+				t.Errorf("Wrong response code; expected '%d', got '%d'", tt.expectedCode, response.Code)
+			}
+			if tt.expectedBody != "" && response.Body.String() != tt.expectedBody {
+				t.Errorf("Wrong response; expected '%s', got '%s'", tt.expectedBody, response.Body.String())
+			}
+		})
+	}
+}
@@ -17,16 +17,53 @@
 package main
 
 import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/AletheiaWareLLC/bcgo"
 	"github.com/AletheiaWareLLC/conveygo"
+	"github.com/AletheiaWareLLC/netgo"
 	"html/template"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
+const (
+	LEDGER_PAGE_SIZE       = 50
+	LEDGER_RECENT_ACTIVITY = 10
+
+	LEDGER_ASCENDING  = "asc"
+	LEDGER_DESCENDING = "desc"
+)
+
+// ledgerColumns are the sort keys of the ledger, in the order they are shown.
+var ledgerColumns = []string{"alias", "minted", "burned", "bought", "sold", "earned", "spent", "balance"}
+
 type LedgerTemplate struct {
-	Entries []*LedgerEntryTemplate
-	Sort    string
+	Columns  []*LedgerColumnTemplate
+	Entries  []*LedgerEntryTemplate
+	Sort     string
+	Order    string
+	Search   string
+	Total    int
+	Path     string // Query of the current sort, order, and search for links to other pages
+	Page     int
+	Pages    int
+	Previous int
+	Next     int
+}
+
+type LedgerColumnTemplate struct {
+	Name  string
+	Label string
+	Link  string // Query which sorts by this column, toggling the order if already sorted by it
+	Arrow string
 }
 
 type LedgerEntryTemplate struct {
@@ -40,74 +77,231 @@ type LedgerEntryTemplate struct {
 	Balance int64
 }
 
+type LedgerAliasTemplate struct {
+	Entry  *LedgerEntryTemplate
+	Recent []*HistoryEntryTemplate
+}
+
+// LedgerSnapshot is the state of the ledger at a point in time, as exported by the JSON and CSV handlers.
+type LedgerSnapshot struct {
+	Timestamp time.Time
+	Sort      string
+	Order     string
+	Search    string `json:",omitempty"`
+	Entries   []*LedgerEntryTemplate
+}
+
+// defaultLedgerOrder returns the order a column is sorted in when first selected; aliases ascend while amounts descend.
+func defaultLedgerOrder(s string) string {
+	if s == "alias" {
+		return LEDGER_ASCENDING
+	}
+	return LEDGER_DESCENDING
+}
+
+// GetLedgerEntries returns the entries of the ledger sorted by the given key and order, along with the key and order used.
+// The key defaults to balance if it isn't recognized, and the order defaults to that of the key.
+// Ties are broken by alias so pages are stable.
+// If a search is given, only aliases starting with it are returned, ignoring case.
+// If any aliases are given, only their entries are returned.
+func GetLedgerEntries(ledger *conveygo.Ledger, s, order, search string, aliases ...string) ([]*LedgerEntryTemplate, string, string) {
+	var less func(*LedgerEntryTemplate, *LedgerEntryTemplate) bool
+	switch s {
+	case "alias":
+		less = func(i, j *LedgerEntryTemplate) bool {
+			return i.Alias < j.Alias
+		}
+	case "minted":
+		less = func(i, j *LedgerEntryTemplate) bool {
+			return i.Minted < j.Minted
+		}
+	case "burned":
+		less = func(i, j *LedgerEntryTemplate) bool {
+			return i.Burned < j.Burned
+		}
+	case "bought":
+		less = func(i, j *LedgerEntryTemplate) bool {
+			return i.Bought < j.Bought
+		}
+	case "sold":
+		less = func(i, j *LedgerEntryTemplate) bool {
+			return i.Sold < j.Sold
+		}
+	case "earned":
+		less = func(i, j *LedgerEntryTemplate) bool {
+			return i.Earned < j.Earned
+		}
+	case "spent":
+		less = func(i, j *LedgerEntryTemplate) bool {
+			return i.Spent < j.Spent
+		}
+	default:
+		s = "balance"
+		fallthrough
+	case "balance":
+		less = func(i, j *LedgerEntryTemplate) bool {
+			return i.Balance < j.Balance
+		}
+	}
+	switch order {
+	case LEDGER_ASCENDING, LEDGER_DESCENDING:
+	default:
+		order = defaultLedgerOrder(s)
+	}
+
+	filter := make(map[string]bool)
+	for _, a := range aliases {
+		if a != "" {
+			filter[a] = true
+		}
+	}
+	search = strings.ToLower(search)
+
+	var entries []*LedgerEntryTemplate
+	for alias := range ledger.Aliases {
+		if len(filter) > 0 && !filter[alias] {
+			continue
+		}
+		if !strings.HasPrefix(strings.ToLower(alias), search) {
+			continue
+		}
+		entries = append(entries, NewLedgerEntryTemplate(ledger, alias))
+	}
+
+	sort.Slice(entries, func(a, b int) bool {
+		i, j := entries[a], entries[b]
+		if order == LEDGER_DESCENDING {
+			i, j = j, i
+		}
+		if less(i, j) {
+			return true
+		}
+		if less(j, i) {
+			return false
+		}
+		return entries[a].Alias < entries[b].Alias
+	})
+	return entries, s, order
+}
+
+func NewLedgerEntryTemplate(ledger *conveygo.Ledger, alias string) *LedgerEntryTemplate {
+	return &LedgerEntryTemplate{
+		Alias:   alias,
+		Minted:  ledger.Minted[alias],
+		Burned:  ledger.Burned[alias],
+		Bought:  ledger.Bought[alias],
+		Sold:    ledger.Sold[alias],
+		Earned:  ledger.Earned[alias],
+		Spent:   ledger.Spent[alias],
+		Balance: ledger.GetBalance(alias),
+	}
+}
+
+// NewLedgerTemplate returns the given page of the entries, with links to sort each column.
+func NewLedgerTemplate(entries []*LedgerEntryTemplate, s, order, search string, page int) *LedgerTemplate {
+	data := &LedgerTemplate{
+		Sort:   s,
+		Order:  order,
+		Search: search,
+		Total:  len(entries),
+		Path:   "/ledger?" + ledgerQuery(s, order, search) + "&",
+		Pages:  (len(entries) + LEDGER_PAGE_SIZE - 1) / LEDGER_PAGE_SIZE,
+	}
+	for _, c := range ledgerColumns {
+		column := &LedgerColumnTemplate{
+			Name:  c,
+			Label: strings.Title(c),
+		}
+		o := defaultLedgerOrder(c)
+		if c == s {
+			if order == LEDGER_ASCENDING {
+				column.Arrow = "▲"
+				o = LEDGER_DESCENDING
+			} else {
+				column.Arrow = "▼"
+				o = LEDGER_ASCENDING
+			}
+		}
+		column.Link = "/ledger?" + ledgerQuery(c, o, search)
+		data.Columns = append(data.Columns, column)
+	}
+	if data.Pages == 0 {
+		data.Pages = 1
+	}
+	if page < 1 {
+		page = 1
+	}
+	if page > data.Pages {
+		page = data.Pages
+	}
+	data.Page = page
+	if page > 1 {
+		data.Previous = page - 1
+	}
+	if page < data.Pages {
+		data.Next = page + 1
+	}
+	start := (page - 1) * LEDGER_PAGE_SIZE
+	end := start + LEDGER_PAGE_SIZE
+	if end > len(entries) {
+		end = len(entries)
+	}
+	data.Entries = entries[start:end]
+	return data
+}
+
+func ledgerQuery(s, order, search string) string {
+	values := url.Values{
+		"sort":  {s},
+		"order": {order},
+	}
+	if search != "" {
+		values.Set("search", search)
+	}
+	return values.Encode()
+}
+
 func LedgerHandler(ledger *conveygo.Ledger, template *template.Template) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		log.Println(r.RemoteAddr, r.Proto, r.Method, r.Host, r.URL.Path, r.Header)
 		switch r.Method {
 		case "GET":
-			s := r.FormValue("sort")
-			var sorter func(*LedgerEntryTemplate, *LedgerEntryTemplate) bool
-			switch s {
-			case "alias":
-				sorter = func(i, j *LedgerEntryTemplate) bool {
-					return i.Alias > j.Alias
-				}
-			case "minted":
-				sorter = func(i, j *LedgerEntryTemplate) bool {
-					return i.Minted > j.Minted
-				}
-			case "burned":
-				sorter = func(i, j *LedgerEntryTemplate) bool {
-					return i.Burned > j.Burned
-				}
-			case "bought":
-				sorter = func(i, j *LedgerEntryTemplate) bool {
-					return i.Bought > j.Bought
-				}
-			case "sold":
-				sorter = func(i, j *LedgerEntryTemplate) bool {
-					return i.Sold > j.Sold
-				}
-			case "earned":
-				sorter = func(i, j *LedgerEntryTemplate) bool {
-					return i.Earned > j.Earned
-				}
-			case "spent":
-				sorter = func(i, j *LedgerEntryTemplate) bool {
-					return i.Spent > j.Spent
-				}
-			default:
-				s = "balance"
-				fallthrough
-			case "balance":
-				sorter = func(i, j *LedgerEntryTemplate) bool {
-					return i.Balance > j.Balance
-				}
-			}
-
-			var entries []*LedgerEntryTemplate
-			for alias := range ledger.Aliases {
-				entries = append(entries, &LedgerEntryTemplate{
-					Alias:   alias,
-					Minted:  ledger.Minted[alias],
-					Burned:  ledger.Burned[alias],
-					Bought:  ledger.Bought[alias],
-					Sold:    ledger.Sold[alias],
-					Earned:  ledger.Earned[alias],
-					Spent:   ledger.Spent[alias],
-					Balance: ledger.GetBalance(alias),
-				})
-			}
+			s, order, search := r.FormValue("sort"), r.FormValue("order"), r.FormValue("search")
+			entries, s, order := GetLedgerEntries(ledger, s, order, search, r.Form["alias"]...)
 
-			sort.Slice(entries, func(i, j int) bool {
-				return sorter(entries[i], entries[j])
-			})
+			data := NewLedgerTemplate(entries, s, order, search, getHistoryPage(r))
 
-			data := &LedgerTemplate{
-				Entries: entries,
-				Sort:    s,
+			if err := template.Execute(w, data); err != nil {
+				log.Println(err)
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 			}
+		default:
+			log.Println("Unsupported method", r.Method)
+		}
+	}
+}
 
+// LedgerAliasHandler shows the breakdown of the balance of the alias given in the request, along with its most recent activity.
+func LedgerAliasHandler(ledger *conveygo.Ledger, node *bcgo.Node, template *template.Template) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println(r.RemoteAddr, r.Proto, r.Method, r.Host, r.URL.Path, r.Header)
+		switch r.Method {
+		case "GET":
+			alias := netgo.GetQueryParameter(r.URL.Query(), "alias")
+			if alias == "" || !ledger.Aliases[alias] {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			entries, err := GetRecentHistory(node, alias, ledger.GetBalance(alias), LEDGER_RECENT_ACTIVITY)
+			if err != nil {
+				log.Println(err)
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			data := &LedgerAliasTemplate{
+				Entry:  NewLedgerEntryTemplate(ledger, alias),
+				Recent: NewHistoryTemplate(alias, "", entries, 1).Entry,
+			}
 			if err := template.Execute(w, data); err != nil {
 				log.Println(err)
 				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
@@ -117,3 +311,80 @@ func LedgerHandler(ledger *conveygo.Ledger, template *template.Template) func(w
 		}
 	}
 }
+
+// LedgerJSONHandler serves a snapshot of the ledger as JSON, sorted and filtered just as the ledger page, but not paginated.
+func LedgerJSONHandler(ledger *conveygo.Ledger) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println(r.RemoteAddr, r.Proto, r.Method, r.Host, r.URL.Path, r.Header)
+		switch r.Method {
+		case "GET":
+			s, order, search := r.FormValue("sort"), r.FormValue("order"), r.FormValue("search")
+			entries, s, order := GetLedgerEntries(ledger, s, order, search, r.Form["alias"]...)
+			data, err := json.MarshalIndent(&LedgerSnapshot{
+				Timestamp: time.Now().UTC(),
+				Sort:      s,
+				Order:     order,
+				Search:    search,
+				Entries:   entries,
+			}, "", "  ")
+			if err != nil {
+				log.Println(err)
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if _, err := w.Write(data); err != nil {
+				log.Println(err)
+			}
+		default:
+			log.Println("Unsupported method", r.Method)
+		}
+	}
+}
+
+// LedgerCSVHandler serves a snapshot of the ledger as CSV, sorted and filtered just as the ledger page, but not paginated.
+// Every row holds the time of the snapshot so snapshots can be appended to each other.
+func LedgerCSVHandler(ledger *conveygo.Ledger) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println(r.RemoteAddr, r.Proto, r.Method, r.Host, r.URL.Path, r.Header)
+		switch r.Method {
+		case "GET":
+			s, order, search := r.FormValue("sort"), r.FormValue("order"), r.FormValue("search")
+			entries, _, _ := GetLedgerEntries(ledger, s, order, search, r.Form["alias"]...)
+			timestamp := time.Now().UTC()
+			w.Header().Set("Content-Type", "text/csv")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"ledger-%s.csv\"", timestamp.Format("20060102T150405Z")))
+			if err := WriteLedgerCSV(w, timestamp, entries); err != nil {
+				log.Println(err)
+			}
+		default:
+			log.Println("Unsupported method", r.Method)
+		}
+	}
+}
+
+// WriteLedgerCSV writes the entries as CSV with a header row.
+func WriteLedgerCSV(writer io.Writer, timestamp time.Time, entries []*LedgerEntryTemplate) error {
+	w := csv.NewWriter(writer)
+	if err := w.Write([]string{"timestamp", "alias", "minted", "burned", "bought", "sold", "earned", "spent", "balance"}); err != nil {
+		return err
+	}
+	t := timestamp.Format(time.RFC3339)
+	for _, e := range entries {
+		if err := w.Write([]string{
+			t,
+			e.Alias,
+			strconv.FormatUint(e.Minted, 10),
+			strconv.FormatUint(e.Burned, 10),
+			strconv.FormatUint(e.Bought, 10),
+			strconv.FormatUint(e.Sold, 10),
+			strconv.FormatUint(e.Earned, 10),
+			strconv.FormatUint(e.Spent, 10),
+			strconv.FormatInt(e.Balance, 10),
+		}); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
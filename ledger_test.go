@@ -17,8 +17,15 @@
 package main_test
 
 import (
+	"encoding/json"
+	"fmt"
+	"github.com/AletheiaWareLLC/conveygo"
+	"github.com/AletheiaWareLLC/conveyservergo"
 	"github.com/AletheiaWareLLC/testinggo"
+	"html/template"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
@@ -63,3 +70,228 @@ func makeGetLedgerRequest(t *testing.T, sort string) *http.Request {
 	testinggo.AssertNoError(t, err)
 	return request
 }
+
+func makeLedger(t *testing.T) *conveygo.Ledger {
+	t.Helper()
+	ledger := conveygo.NewLedger(makeNode(t, "Merchant", makeKey(t)))
+	ledger.Aliases["Alice"] = true
+	ledger.Aliases["Bob"] = true
+	ledger.Aliases["Charlie"] = true
+	ledger.Minted["Alice"] = 150
+	ledger.Bought["Bob"] = 50
+	ledger.Sold["Alice"] = 50
+	ledger.Spent["Charlie"] = 10
+	return ledger
+}
+
+func TestGetLedgerEntries(t *testing.T) {
+	ledger := makeLedger(t)
+	ledger.Aliases["alfred"] = true
+	for name, tt := range map[string]struct {
+		sort          string
+		order         string
+		search        string
+		aliases       []string
+		expectedSort  string
+		expectedOrder string
+		expected      string
+	}{
+		"Default":         {"", "", "", nil, "balance", "desc", "Alice,Bob,alfred,Charlie"},
+		"Unknown":         {"foo", "up", "", nil, "balance", "desc", "Alice,Bob,alfred,Charlie"},
+		"BalanceAsc":      {"balance", "asc", "", nil, "balance", "asc", "Charlie,alfred,Bob,Alice"},
+		"Alias":           {"alias", "", "", nil, "alias", "asc", "Alice,Bob,Charlie,alfred"},
+		"AliasDesc":       {"alias", "desc", "", nil, "alias", "desc", "alfred,Charlie,Bob,Alice"},
+		"Minted":          {"minted", "", "", []string{"Alice"}, "minted", "desc", "Alice"},
+		"Bought":          {"bought", "", "", []string{"Alice", "Bob"}, "bought", "desc", "Bob,Alice"},
+		"Filtered":        {"spent", "", "", []string{"Charlie", "Dan"}, "spent", "desc", "Charlie"},
+		"Search":          {"alias", "", "al", nil, "alias", "asc", "Alice,alfred"},
+		"SearchNoMatches": {"alias", "", "Dan", nil, "alias", "asc", ""},
+		"SearchFiltered":  {"alias", "", "al", []string{"Bob", "alfred"}, "alias", "asc", "alfred"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			entries, s, o := main.GetLedgerEntries(ledger, tt.sort, tt.order, tt.search, tt.aliases...)
+			if s != tt.expectedSort {
+				t.Errorf("Wrong sort; expected '%s', got '%s'", tt.expectedSort, s)
+			}
+			if o != tt.expectedOrder {
+				t.Errorf("Wrong order; expected '%s', got '%s'", tt.expectedOrder, o)
+			}
+			var aliases []string
+			for _, e := range entries {
+				aliases = append(aliases, e.Alias)
+			}
+			if actual := strings.Join(aliases, ","); actual != tt.expected {
+				t.Errorf("Wrong entries; expected '%s', got '%s'", tt.expected, actual)
+			}
+		})
+	}
+}
+
+func TestNewLedgerTemplate(t *testing.T) {
+	var entries []*main.LedgerEntryTemplate
+	for i := 0; i < 120; i++ {
+		entries = append(entries, &main.LedgerEntryTemplate{
+			Alias: fmt.Sprintf("Alias%03d", i),
+		})
+	}
+	for name, tt := range map[string]struct {
+		entries          []*main.LedgerEntryTemplate
+		page             int
+		expectedPage     int
+		expectedPrevious int
+		expectedNext     int
+		expectedFirst    string
+		expectedCount    int
+	}{
+		"First":  {entries, 1, 1, 0, 2, "Alias000", 50},
+		"Middle": {entries, 2, 2, 1, 3, "Alias050", 50},
+		"Last":   {entries, 3, 3, 2, 0, "Alias100", 20},
+		"Beyond": {entries, 9, 3, 2, 0, "Alias100", 20},
+		"Before": {entries, -1, 1, 0, 2, "Alias000", 50},
+		"Empty":  {nil, 1, 1, 0, 0, "", 0},
+	} {
+		t.Run(name, func(t *testing.T) {
+			data := main.NewLedgerTemplate(tt.entries, "alias", "asc", "Al", tt.page)
+			if data.Page != tt.expectedPage {
+				t.Errorf("Wrong page; expected '%d', got '%d'", tt.expectedPage, data.Page)
+			}
+			if data.Previous != tt.expectedPrevious {
+				t.Errorf("Wrong previous; expected '%d', got '%d'", tt.expectedPrevious, data.Previous)
+			}
+			if data.Next != tt.expectedNext {
+				t.Errorf("Wrong next; expected '%d', got '%d'", tt.expectedNext, data.Next)
+			}
+			if data.Total != len(tt.entries) {
+				t.Errorf("Wrong total; expected '%d', got '%d'", len(tt.entries), data.Total)
+			}
+			if len(data.Entries) != tt.expectedCount {
+				t.Fatalf("Wrong number of entries; expected '%d', got '%d'", tt.expectedCount, len(data.Entries))
+			}
+			if tt.expectedCount > 0 && data.Entries[0].Alias != tt.expectedFirst {
+				t.Errorf("Wrong first alias; expected '%s', got '%s'", tt.expectedFirst, data.Entries[0].Alias)
+			}
+		})
+	}
+	t.Run("Columns", func(t *testing.T) {
+		data := main.NewLedgerTemplate(entries, "alias", "asc", "Al", 1)
+		if expected := "/ledger?order=asc&search=Al&sort=alias&"; data.Path != expected {
+			t.Errorf("Wrong path; expected '%s', got '%s'", expected, data.Path)
+		}
+		if len(data.Columns) != 8 {
+			t.Fatalf("Wrong number of columns; expected '%d', got '%d'", 8, len(data.Columns))
+		}
+		for i, tt := range []struct {
+			label string
+			link  string
+			arrow string
+		}{
+			{"Alias", "/ledger?order=desc&search=Al&sort=alias", "▲"},
+			{"Minted", "/ledger?order=desc&search=Al&sort=minted", ""},
+		} {
+			c := data.Columns[i]
+			if c.Label != tt.label {
+				t.Errorf("Wrong label; expected '%s', got '%s'", tt.label, c.Label)
+			}
+			if c.Link != tt.link {
+				t.Errorf("Wrong link; expected '%s', got '%s'", tt.link, c.Link)
+			}
+			if c.Arrow != tt.arrow {
+				t.Errorf("Wrong arrow; expected '%s', got '%s'", tt.arrow, c.Arrow)
+			}
+		}
+	})
+}
+
+func TestLedgerAliasHandler(t *testing.T) {
+	aliceKey := makeKey(t)
+	bobKey := makeKey(t)
+	node := makeNode(t, "Merchant", makeKey(t))
+	transactions := conveygo.OpenTransactionChannel()
+	memos := main.OpenTransferMemoChannel()
+	node.AddChannel(transactions)
+	node.AddChannel(memos)
+	testinggo.AssertNoError(t, main.MineTransfer(node, main.NewChannelMiner(), nil, transactions, memos, "Alice", aliceKey, "Bob", &bobKey.PublicKey, 10, "Lunch", nil))
+	ledger := conveygo.NewLedger(node)
+	testinggo.AssertNoError(t, ledger.UpdateAll())
+	ledger.Aliases["Alice"] = true
+	ledger.Aliases["Bob"] = true
+
+	tmplt, err := template.New("").Parse(`{{ .Entry.Alias }}:{{ .Entry.Bought }}:{{ .Entry.Balance }}:{{ range .Recent }}{{ .Type }}:{{ .Amount }}:{{ .Counterparty }}:{{ .Memo }};{{ end }}`)
+	testinggo.AssertNoError(t, err)
+
+	for name, tt := range map[string]struct {
+		query    string
+		code     int
+		expected string
+	}{
+		"Alias":   {"?alias=Bob", http.StatusOK, "Bob:10:10:Bought:10:Alice:;"},
+		"Missing": {"", http.StatusNotFound, ""},
+		"Unknown": {"?alias=Dan", http.StatusNotFound, ""},
+	} {
+		t.Run(name, func(t *testing.T) {
+			request, err := http.NewRequest(http.MethodGet, "/ledger/alias"+tt.query, nil)
+			testinggo.AssertNoError(t, err)
+			response := httptest.NewRecorder()
+			main.LedgerAliasHandler(ledger, node, tmplt)(response, request)
+			if response.Code != tt.code {
+				t.Fatalf("Wrong response code; expected '%d', got '%d'", tt.code, response.Code)
+			}
+			if tt.expected != "" {
+				if actual := response.Body.String(); actual != tt.expected {
+					t.Errorf("Wrong response; expected '%s', got '%s'", tt.expected, actual)
+				}
+			}
+		})
+	}
+}
+
+func TestLedgerJSONHandler(t *testing.T) {
+	request, err := http.NewRequest(http.MethodGet, "/ledger.json?sort=sold&alias=Alice&alias=Bob", nil)
+	testinggo.AssertNoError(t, err)
+	response := httptest.NewRecorder()
+	main.LedgerJSONHandler(makeLedger(t))(response, request)
+	if c := response.Header().Get("Content-Type"); c != "application/json" {
+		t.Errorf("Wrong content type; expected '%s', got '%s'", "application/json", c)
+	}
+	snapshot := &main.LedgerSnapshot{}
+	testinggo.AssertNoError(t, json.Unmarshal(response.Body.Bytes(), snapshot))
+	if snapshot.Timestamp.IsZero() {
+		t.Error("Expected timestamp")
+	}
+	if snapshot.Sort != "sold" {
+		t.Errorf("Wrong sort; expected '%s', got '%s'", "sold", snapshot.Sort)
+	}
+	if len(snapshot.Entries) != 2 {
+		t.Fatalf("Wrong number of entries; expected '%d', got '%d'", 2, len(snapshot.Entries))
+	}
+	alice := snapshot.Entries[0]
+	if alice.Alias != "Alice" || alice.Minted != 150 || alice.Sold != 50 || alice.Balance != 100 {
+		t.Errorf("Wrong entry; got '%v'", alice)
+	}
+}
+
+func TestLedgerCSVHandler(t *testing.T) {
+	request, err := http.NewRequest(http.MethodGet, "/ledger.csv?sort=alias", nil)
+	testinggo.AssertNoError(t, err)
+	response := httptest.NewRecorder()
+	main.LedgerCSVHandler(makeLedger(t))(response, request)
+	if c := response.Header().Get("Content-Type"); c != "text/csv" {
+		t.Errorf("Wrong content type; expected '%s', got '%s'", "text/csv", c)
+	}
+	lines := strings.Split(strings.TrimSpace(response.Body.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("Wrong number of lines; expected '%d', got '%d'", 4, len(lines))
+	}
+	if expected := "timestamp,alias,minted,burned,bought,sold,earned,spent,balance"; lines[0] != expected {
+		t.Errorf("Wrong header; expected '%s', got '%s'", expected, lines[0])
+	}
+	for i, expected := range []string{
+		",Alice,150,0,0,50,0,0,100",
+		",Bob,0,0,50,0,0,0,50",
+		",Charlie,0,0,0,0,0,10,-10",
+	} {
+		if !strings.HasSuffix(lines[i+1], expected) {
+			t.Errorf("Wrong row; expected '%s', got '%s'", expected, lines[i+1])
+		}
+	}
+}
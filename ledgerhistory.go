@@ -0,0 +1,514 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/AletheiaWareLLC/bcgo"
+	"github.com/AletheiaWareLLC/conveygo"
+	"html"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LEDGER_HISTORY_HOUR = "hour"
+	LEDGER_HISTORY_DAY  = "day"
+
+	LEDGER_HISTORY_DATE_FORMAT = "2006-01-02"
+	LEDGER_HISTORY_EXTENSION   = ".jsonl"
+
+	ERROR_INVALID_LEDGER_HISTORY_PERIOD = "Invalid period: %s"
+	ERROR_INVALID_LEDGER_HISTORY_DATE   = "Invalid date: %s"
+
+	LEDGER_CHART_WIDTH  = 600
+	LEDGER_CHART_HEIGHT = 200
+	LEDGER_CHART_MARGIN = 40
+)
+
+var ledgerChartColours = []string{"#2196f3", "#4caf50", "#ff9800", "#9c27b0", "#f44336", "#607d8b"}
+
+// LedgerHistoryEntry is a snapshot of the ledger taken when a block was added to the hourly periodic validation chain.
+type LedgerHistoryEntry struct {
+	Timestamp   time.Time // Time the hourly block was mined
+	Hour        string    // Hash of the hourly block
+	Day         string    // Hash of the head of the daily chain
+	Daily       bool      // True if the daily chain had a new block since the previous snapshot
+	Supply      int64     // Tokens held by every alias
+	Circulating int64     // Tokens held by every alias except the server
+	Minted      uint64    // Tokens ever minted by every alias
+	Burned      uint64    // Tokens ever burned by every alias
+	Earned      uint64    // Tokens ever earned by every alias
+	Purchased   int64     // Tokens credited for charges, net of those reclaimed by refunds and disputes
+	Balances    map[string]int64
+}
+
+// LedgerHistory keeps snapshots of the ledger.
+type LedgerHistory interface {
+	Add(entry *LedgerHistoryEntry) error
+	// Get returns the snapshots taken between the given times, which are ignored if zero, oldest first.
+	Get(from, to time.Time) ([]*LedgerHistoryEntry, error)
+	// Last returns the most recent snapshot, or nil if there are none.
+	Last() (*LedgerHistoryEntry, error)
+}
+
+// FileLedgerHistory appends each snapshot as a line of JSON in a file per day, named by the date the snapshot was taken, in the given directory.
+// Reading a range only opens the files of the days it covers.
+type FileLedgerHistory struct {
+	Directory string
+	lock      sync.Mutex
+}
+
+func NewFileLedgerHistory(directory string) *FileLedgerHistory {
+	return &FileLedgerHistory{
+		Directory: directory,
+	}
+}
+
+func (h *FileLedgerHistory) Add(entry *LedgerHistoryEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if err := os.MkdirAll(h.Directory, 0700); err != nil {
+		return err
+	}
+	name := filepath.Join(h.Directory, entry.Timestamp.UTC().Format(LEDGER_HISTORY_DATE_FORMAT)+LEDGER_HISTORY_EXTENSION)
+	file, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Get skips the files of days before from, and decodes the rest a line at a time, keeping only the snapshots in range.
+// Snapshots are appended as the hourly chain grows, so reading stops at the first snapshot taken at or after to.
+func (h *FileLedgerHistory) Get(from, to time.Time) ([]*LedgerHistoryEntry, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	days, err := h.days()
+	if err != nil {
+		return nil, err
+	}
+	var entries []*LedgerHistoryEntry
+	for _, day := range days {
+		if !from.IsZero() && !day.AddDate(0, 0, 1).After(from) {
+			continue
+		}
+		if !to.IsZero() && !day.Before(to) {
+			break
+		}
+		es, err := h.read(day)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range es {
+			if !to.IsZero() && !e.Timestamp.Before(to) {
+				return entries, nil
+			}
+			if !from.IsZero() && e.Timestamp.Before(from) {
+				continue
+			}
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+// Last decodes only the file of the most recent day with a snapshot.
+func (h *FileLedgerHistory) Last() (*LedgerHistoryEntry, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	days, err := h.days()
+	if err != nil {
+		return nil, err
+	}
+	for i := len(days) - 1; i >= 0; i-- {
+		entries, err := h.read(days[i])
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) > 0 {
+			return entries[len(entries)-1], nil
+		}
+	}
+	return nil, nil
+}
+
+// days returns the dates of the files in the directory, oldest first.
+func (h *FileLedgerHistory) days() ([]time.Time, error) {
+	infos, err := ioutil.ReadDir(h.Directory)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var days []time.Time
+	for _, i := range infos {
+		name := i.Name()
+		if i.IsDir() || !strings.HasSuffix(name, LEDGER_HISTORY_EXTENSION) {
+			continue
+		}
+		day, err := time.Parse(LEDGER_HISTORY_DATE_FORMAT, strings.TrimSuffix(name, LEDGER_HISTORY_EXTENSION))
+		if err != nil {
+			continue
+		}
+		days = append(days, day)
+	}
+	sort.Slice(days, func(i, j int) bool {
+		return days[i].Before(days[j])
+	})
+	return days, nil
+}
+
+// read decodes the snapshots taken on the given day.
+func (h *FileLedgerHistory) read(day time.Time) ([]*LedgerHistoryEntry, error) {
+	file, err := os.Open(filepath.Join(h.Directory, day.Format(LEDGER_HISTORY_DATE_FORMAT)+LEDGER_HISTORY_EXTENSION))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var entries []*LedgerHistoryEntry
+	decoder := json.NewDecoder(file)
+	for decoder.More() {
+		entry := &LedgerHistoryEntry{}
+		if err := decoder.Decode(entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// LedgerHistoryRecorder snapshots the ledger each time the hourly periodic validation chain gets a new block.
+type LedgerHistoryRecorder struct {
+	History   LedgerHistory
+	Ledger    *conveygo.Ledger
+	Clawbacks *Clawbacks
+	Alias     string // Alias of the server, whose tokens aren't circulating
+	Hours     *bcgo.Channel
+	Days      *bcgo.Channel
+	last      *LedgerHistoryEntry
+	loaded    bool
+	lock      sync.Mutex
+}
+
+func NewLedgerHistoryRecorder(history LedgerHistory, ledger *conveygo.Ledger, clawbacks *Clawbacks, alias string, hours, days *bcgo.Channel) *LedgerHistoryRecorder {
+	return &LedgerHistoryRecorder{
+		History:   history,
+		Ledger:    ledger,
+		Clawbacks: clawbacks,
+		Alias:     alias,
+		Hours:     hours,
+		Days:      days,
+	}
+}
+
+// Record takes a snapshot of the ledger if the hourly chain has a new head since the last snapshot, and should be called after the ledger is updated.
+func (r *LedgerHistoryRecorder) Record() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.loaded {
+		// Continue from the last snapshot taken before a restart
+		last, err := r.History.Last()
+		if err != nil {
+			return err
+		}
+		r.last = last
+		r.loaded = true
+	}
+	hour := r.Hours.Head
+	if hour == nil {
+		return nil
+	}
+	if r.last != nil && r.last.Hour == base64.RawURLEncoding.EncodeToString(hour) {
+		return nil
+	}
+	block, err := r.Ledger.Node.Cache.GetBlock(hour)
+	if err != nil {
+		return err
+	}
+	entry := &LedgerHistoryEntry{
+		Timestamp: time.Unix(0, int64(block.Timestamp)).UTC(),
+		Hour:      base64.RawURLEncoding.EncodeToString(hour),
+		Balances:  make(map[string]int64),
+	}
+	if day := r.Days.Head; day != nil {
+		entry.Day = base64.RawURLEncoding.EncodeToString(day)
+		entry.Daily = r.last == nil || r.last.Day != entry.Day
+	}
+	for alias := range r.Ledger.Aliases {
+		entry.Minted += r.Ledger.Minted[alias]
+		entry.Burned += r.Ledger.Burned[alias]
+		entry.Earned += r.Ledger.Earned[alias]
+		balance := r.Ledger.GetBalance(alias)
+		if balance == 0 {
+			continue
+		}
+		entry.Balances[alias] = balance
+		entry.Supply += balance
+		if alias != r.Alias {
+			entry.Circulating += balance
+		}
+	}
+	entry.Purchased = r.Clawbacks.Purchased()
+	if err := r.History.Add(entry); err != nil {
+		return err
+	}
+	log.Println("Ledger snapshot", entry.Timestamp, entry.Supply, entry.Circulating)
+	r.last = entry
+	return nil
+}
+
+// LedgerHistoryPoint is a point in the time series of the ledger.
+type LedgerHistoryPoint struct {
+	Timestamp   time.Time
+	Supply      int64
+	Circulating int64
+	Balances    map[string]int64 `json:",omitempty"`
+}
+
+// LedgerHistorySeries is the time series of the ledger for a period.
+type LedgerHistorySeries struct {
+	Period  string
+	Aliases []string
+	Points  []*LedgerHistoryPoint
+}
+
+// parseLedgerHistoryPeriod returns the given period, or the default if it is empty.
+func parseLedgerHistoryPeriod(period, fallback string) (string, error) {
+	switch period {
+	case "":
+		return fallback, nil
+	case LEDGER_HISTORY_HOUR, LEDGER_HISTORY_DAY:
+		return period, nil
+	default:
+		return "", errors.New(fmt.Sprintf(ERROR_INVALID_LEDGER_HISTORY_PERIOD, period))
+	}
+}
+
+// GetLedgerHistorySeries returns a point for every snapshot in the given period between the given times, which are ignored if zero, with the balances of the given aliases.
+func GetLedgerHistorySeries(history LedgerHistory, period string, from, to time.Time, aliases []string) (*LedgerHistorySeries, error) {
+	period, err := parseLedgerHistoryPeriod(period, LEDGER_HISTORY_HOUR)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := history.Get(from, to)
+	if err != nil {
+		return nil, err
+	}
+	series := &LedgerHistorySeries{
+		Period:  period,
+		Aliases: aliases,
+	}
+	for _, e := range entries {
+		if period == LEDGER_HISTORY_DAY && !e.Daily {
+			continue
+		}
+		point := &LedgerHistoryPoint{
+			Timestamp:   e.Timestamp,
+			Supply:      e.Supply,
+			Circulating: e.Circulating,
+		}
+		if len(aliases) > 0 {
+			point.Balances = make(map[string]int64)
+			for _, a := range aliases {
+				point.Balances[a] = e.Balances[a]
+			}
+		}
+		series.Points = append(series.Points, point)
+	}
+	sort.SliceStable(series.Points, func(i, j int) bool {
+		return series.Points[i].Timestamp.Before(series.Points[j].Timestamp)
+	})
+	return series, nil
+}
+
+// parseLedgerHistoryRequest returns the series requested by the period, from, to, and alias parameters.
+func parseLedgerHistoryRequest(history LedgerHistory, r *http.Request) (*LedgerHistorySeries, error) {
+	var times []time.Time
+	for _, p := range []string{"from", "to"} {
+		var t time.Time
+		if v := r.FormValue(p); v != "" {
+			var err error
+			t, err = time.Parse(LEDGER_HISTORY_DATE_FORMAT, v)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf(ERROR_INVALID_LEDGER_HISTORY_DATE, v))
+			}
+		}
+		times = append(times, t)
+	}
+	var aliases []string
+	for _, a := range r.Form["alias"] {
+		if a != "" {
+			aliases = append(aliases, a)
+		}
+	}
+	return GetLedgerHistorySeries(history, r.FormValue("period"), times[0], times[1], aliases)
+}
+
+// LedgerHistoryHandler serves the time series of total supply, circulating tokens, and the balances of the given aliases as JSON.
+func LedgerHistoryHandler(history LedgerHistory) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println(r.RemoteAddr, r.Proto, r.Method, r.Host, r.URL.Path, r.Header)
+		switch r.Method {
+		case "GET":
+			series, err := parseLedgerHistoryRequest(history, r)
+			if err != nil {
+				log.Println(err)
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			data, err := json.MarshalIndent(series, "", "  ")
+			if err != nil {
+				log.Println(err)
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if _, err := w.Write(data); err != nil {
+				log.Println(err)
+			}
+		default:
+			log.Println("Unsupported method", r.Method)
+		}
+	}
+}
+
+// LedgerHistoryChartHandler serves a chart of the time series as SVG, showing the balances of the given aliases, or the total supply and circulating tokens if none are given.
+func LedgerHistoryChartHandler(history LedgerHistory) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println(r.RemoteAddr, r.Proto, r.Method, r.Host, r.URL.Path, r.Header)
+		switch r.Method {
+		case "GET":
+			series, err := parseLedgerHistoryRequest(history, r)
+			if err != nil {
+				log.Println(err)
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "image/svg+xml")
+			if err := WriteLedgerChart(w, series); err != nil {
+				log.Println(err)
+			}
+		default:
+			log.Println("Unsupported method", r.Method)
+		}
+	}
+}
+
+// WriteLedgerChart draws a line for each alias in the series, or for the total supply and circulating tokens if there are no aliases.
+func WriteLedgerChart(writer io.Writer, series *LedgerHistorySeries) error {
+	type line struct {
+		label  string
+		values []int64
+	}
+	var lines []*line
+	if len(series.Aliases) == 0 {
+		supply := &line{label: "Supply"}
+		circulating := &line{label: "Circulating"}
+		for _, p := range series.Points {
+			supply.values = append(supply.values, p.Supply)
+			circulating.values = append(circulating.values, p.Circulating)
+		}
+		lines = append(lines, supply, circulating)
+	} else {
+		for _, a := range series.Aliases {
+			l := &line{label: a}
+			for _, p := range series.Points {
+				l.values = append(l.values, p.Balances[a])
+			}
+			lines = append(lines, l)
+		}
+	}
+
+	var buffer bytes.Buffer
+	fmt.Fprintf(&buffer, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="sans-serif" font-size="10">`+"\n", LEDGER_CHART_WIDTH, LEDGER_CHART_HEIGHT, LEDGER_CHART_WIDTH, LEDGER_CHART_HEIGHT)
+	if len(series.Points) == 0 {
+		fmt.Fprintf(&buffer, `<text x="%d" y="%d" text-anchor="middle">No history yet</text>`+"\n", LEDGER_CHART_WIDTH/2, LEDGER_CHART_HEIGHT/2)
+	} else {
+		var min, max int64
+		for _, l := range lines {
+			for _, v := range l.values {
+				if v < min {
+					min = v
+				}
+				if v > max {
+					max = v
+				}
+			}
+		}
+		if max == min {
+			max = min + 1
+		}
+		start := series.Points[0].Timestamp
+		duration := series.Points[len(series.Points)-1].Timestamp.Sub(start)
+		width := float64(LEDGER_CHART_WIDTH - 2*LEDGER_CHART_MARGIN)
+		height := float64(LEDGER_CHART_HEIGHT - 2*LEDGER_CHART_MARGIN)
+		x := func(i int) float64 {
+			if duration <= 0 {
+				return float64(LEDGER_CHART_MARGIN) + width/2
+			}
+			return float64(LEDGER_CHART_MARGIN) + width*float64(series.Points[i].Timestamp.Sub(start))/float64(duration)
+		}
+		y := func(v int64) float64 {
+			return float64(LEDGER_CHART_MARGIN) + height*float64(max-v)/float64(max-min)
+		}
+		// Axes
+		fmt.Fprintf(&buffer, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#999" />`+"\n", LEDGER_CHART_MARGIN, LEDGER_CHART_MARGIN, LEDGER_CHART_MARGIN, LEDGER_CHART_HEIGHT-LEDGER_CHART_MARGIN)
+		fmt.Fprintf(&buffer, `<line x1="%d" y1="%.1f" x2="%d" y2="%.1f" stroke="#999" />`+"\n", LEDGER_CHART_MARGIN, y(0), LEDGER_CHART_WIDTH-LEDGER_CHART_MARGIN, y(0))
+		fmt.Fprintf(&buffer, `<text x="%d" y="%d" text-anchor="end">%d</text>`+"\n", LEDGER_CHART_MARGIN-4, LEDGER_CHART_MARGIN+4, max)
+		fmt.Fprintf(&buffer, `<text x="%d" y="%d" text-anchor="end">%d</text>`+"\n", LEDGER_CHART_MARGIN-4, LEDGER_CHART_HEIGHT-LEDGER_CHART_MARGIN+4, min)
+		fmt.Fprintf(&buffer, `<text x="%d" y="%d">%s</text>`+"\n", LEDGER_CHART_MARGIN, LEDGER_CHART_HEIGHT-LEDGER_CHART_MARGIN+16, start.Format(LEDGER_HISTORY_DATE_FORMAT))
+		fmt.Fprintf(&buffer, `<text x="%d" y="%d" text-anchor="end">%s</text>`+"\n", LEDGER_CHART_WIDTH-LEDGER_CHART_MARGIN, LEDGER_CHART_HEIGHT-LEDGER_CHART_MARGIN+16, series.Points[len(series.Points)-1].Timestamp.Format(LEDGER_HISTORY_DATE_FORMAT))
+		for i, l := range lines {
+			colour := ledgerChartColours[i%len(ledgerChartColours)]
+			fmt.Fprintf(&buffer, `<polyline fill="none" stroke="%s" stroke-width="2" points="`, colour)
+			for j, v := range l.values {
+				if j > 0 {
+					buffer.WriteString(" ")
+				}
+				fmt.Fprintf(&buffer, "%.1f,%.1f", x(j), y(v))
+			}
+			buffer.WriteString(`" />` + "\n")
+			// Legend
+			fmt.Fprintf(&buffer, `<text x="%d" y="%d" fill="%s">%s</text>`+"\n", LEDGER_CHART_MARGIN+i*100, LEDGER_CHART_MARGIN-16, colour, html.EscapeString(l.label))
+		}
+	}
+	buffer.WriteString("</svg>\n")
+	_, err := writer.Write(buffer.Bytes())
+	return err
+}
@@ -0,0 +1,302 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main_test
+
+import (
+	"encoding/json"
+	"github.com/AletheiaWareLLC/bcgo"
+	"github.com/AletheiaWareLLC/conveygo"
+	"github.com/AletheiaWareLLC/conveyservergo"
+	"github.com/AletheiaWareLLC/cryptogo"
+	"github.com/AletheiaWareLLC/testinggo"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func addTestBlock(t *testing.T, node *bcgo.Node, channel *bcgo.Channel, timestamp time.Time) {
+	t.Helper()
+	block := &bcgo.Block{
+		Timestamp:   uint64(timestamp.UnixNano()),
+		ChannelName: channel.Name,
+		Length:      1,
+		Previous:    channel.Head,
+	}
+	if channel.Head != nil {
+		block.Length = 2
+	}
+	hash, err := cryptogo.HashProtobuf(block)
+	testinggo.AssertNoError(t, err)
+	testinggo.AssertNoError(t, node.Cache.PutBlock(hash, block))
+	channel.Head = hash
+}
+
+func makeLedgerHistory(t *testing.T, file string) main.LedgerHistory {
+	t.Helper()
+	history := main.NewFileLedgerHistory(file)
+	for _, e := range []*main.LedgerHistoryEntry{
+		{Timestamp: time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC), Daily: true, Supply: 100, Circulating: 40, Minted: 100, Burned: 10, Earned: 5, Purchased: 20, Balances: map[string]int64{"Merchant": 60, "Alice": 40}},
+		{Timestamp: time.Date(2020, 6, 1, 1, 0, 0, 0, time.UTC), Supply: 100, Circulating: 50, Minted: 110, Burned: 20, Earned: 8, Purchased: 30, Balances: map[string]int64{"Merchant": 50, "Alice": 30, "Bob": 20}},
+		{Timestamp: time.Date(2020, 6, 2, 0, 0, 0, 0, time.UTC), Daily: true, Supply: 200, Circulating: 70, Minted: 200, Burned: 40, Earned: 20, Purchased: 50, Balances: map[string]int64{"Merchant": 130, "Alice": 70}},
+	} {
+		testinggo.AssertNoError(t, history.Add(e))
+	}
+	return history
+}
+
+func TestFileLedgerHistory(t *testing.T) {
+	dir := testinggo.MakeTempDir(t, "history")
+	defer testinggo.UnmakeTempDir(t, dir)
+	empty := main.NewFileLedgerHistory(path.Join(dir, "empty"))
+	entries, err := empty.Get(time.Time{}, time.Time{})
+	testinggo.AssertNoError(t, err)
+	if len(entries) != 0 {
+		t.Errorf("Wrong number of entries; expected '%d', got '%d'", 0, len(entries))
+	}
+	history := makeLedgerHistory(t, path.Join(dir, "ledger-history"))
+	entries, err = history.Get(time.Time{}, time.Time{})
+	testinggo.AssertNoError(t, err)
+	if len(entries) != 3 {
+		t.Fatalf("Wrong number of entries; expected '%d', got '%d'", 3, len(entries))
+	}
+	if b := entries[1].Balances["Bob"]; b != 20 {
+		t.Errorf("Wrong balance; expected '%d', got '%d'", 20, b)
+	}
+	// Snapshots are kept in a file per day
+	for _, name := range []string{"2020-06-01.jsonl", "2020-06-02.jsonl"} {
+		if _, err := os.Stat(path.Join(dir, "ledger-history", name)); err != nil {
+			t.Errorf("Missing file; expected '%s', got '%s'", name, err)
+		}
+	}
+	last, err := history.Last()
+	testinggo.AssertNoError(t, err)
+	if last == nil || last.Circulating != 70 {
+		t.Errorf("Wrong last entry; expected circulating '%d', got '%v'", 70, last)
+	}
+	last, err = empty.Last()
+	testinggo.AssertNoError(t, err)
+	if last != nil {
+		t.Errorf("Unexpected last entry; got '%v'", last)
+	}
+	for name, tt := range map[string]struct {
+		from     time.Time
+		to       time.Time
+		expected []int64
+	}{
+		"From":    {time.Date(2020, 6, 1, 1, 0, 0, 0, time.UTC), time.Time{}, []int64{50, 70}},
+		"To":      {time.Time{}, time.Date(2020, 6, 1, 1, 0, 0, 0, time.UTC), []int64{40}},
+		"FromTo":  {time.Date(2020, 6, 1, 1, 0, 0, 0, time.UTC), time.Date(2020, 6, 2, 0, 0, 0, 0, time.UTC), []int64{50}},
+		"After":   {time.Date(2020, 6, 3, 0, 0, 0, 0, time.UTC), time.Time{}, nil},
+		"NextDay": {time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC), time.Time{}, []int64{70}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			entries, err := history.Get(tt.from, tt.to)
+			testinggo.AssertNoError(t, err)
+			if len(entries) != len(tt.expected) {
+				t.Fatalf("Wrong number of entries; expected '%d', got '%d'", len(tt.expected), len(entries))
+			}
+			for i, e := range tt.expected {
+				if entries[i].Circulating != e {
+					t.Errorf("Wrong circulating; expected '%d', got '%d'", e, entries[i].Circulating)
+				}
+			}
+		})
+	}
+}
+
+func TestLedgerHistoryRecorder(t *testing.T) {
+	dir := testinggo.MakeTempDir(t, "history")
+	defer testinggo.UnmakeTempDir(t, dir)
+	history := main.NewFileLedgerHistory(path.Join(dir, "ledger-history"))
+	ledger := makeLedger(t)
+	node := ledger.Node
+	hours := conveygo.OpenHourChannel()
+	days := conveygo.OpenDayChannel()
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	clawbacks := makeClawbacks(t, ledger)
+	makeCharge(t, clawbacks, "Bob", "ch_1", 100, 50, makeKey(t))
+
+	recorder := main.NewLedgerHistoryRecorder(history, ledger, clawbacks, "Alice", hours, days)
+	// Nothing recorded until the hourly chain has a block
+	testinggo.AssertNoError(t, recorder.Record())
+
+	addTestBlock(t, node, hours, now)
+	addTestBlock(t, node, days, now)
+	testinggo.AssertNoError(t, recorder.Record())
+	// Ledger updates without a new hourly block aren't recorded
+	testinggo.AssertNoError(t, recorder.Record())
+
+	addTestBlock(t, node, hours, now.Add(time.Hour))
+	ledger.Bought["Bob"] = 60
+	testinggo.AssertNoError(t, recorder.Record())
+
+	// A new recorder continues from the last snapshot
+	recorder = main.NewLedgerHistoryRecorder(history, ledger, clawbacks, "Alice", hours, days)
+	testinggo.AssertNoError(t, recorder.Record())
+
+	entries, err := history.Get(time.Time{}, time.Time{})
+	testinggo.AssertNoError(t, err)
+	if len(entries) != 2 {
+		t.Fatalf("Wrong number of entries; expected '%d', got '%d'", 2, len(entries))
+	}
+	for i, tt := range []struct {
+		timestamp   time.Time
+		daily       bool
+		supply      int64
+		circulating int64
+		bob         int64
+	}{
+		{now, true, 140, 40, 50},
+		{now.Add(time.Hour), false, 150, 50, 60},
+	} {
+		e := entries[i]
+		if !e.Timestamp.Equal(tt.timestamp) {
+			t.Errorf("Wrong timestamp; expected '%s', got '%s'", tt.timestamp, e.Timestamp)
+		}
+		if e.Daily != tt.daily {
+			t.Errorf("Wrong daily; expected '%t', got '%t'", tt.daily, e.Daily)
+		}
+		if e.Supply != tt.supply {
+			t.Errorf("Wrong supply; expected '%d', got '%d'", tt.supply, e.Supply)
+		}
+		if e.Circulating != tt.circulating {
+			t.Errorf("Wrong circulating; expected '%d', got '%d'", tt.circulating, e.Circulating)
+		}
+		if b := e.Balances["Bob"]; b != tt.bob {
+			t.Errorf("Wrong balance; expected '%d', got '%d'", tt.bob, b)
+		}
+		if e.Minted != 150 {
+			t.Errorf("Wrong minted; expected '%d', got '%d'", 150, e.Minted)
+		}
+		if e.Purchased != 50 {
+			t.Errorf("Wrong purchased; expected '%d', got '%d'", 50, e.Purchased)
+		}
+	}
+}
+
+func TestGetLedgerHistorySeries(t *testing.T) {
+	dir := testinggo.MakeTempDir(t, "history")
+	defer testinggo.UnmakeTempDir(t, dir)
+	history := makeLedgerHistory(t, path.Join(dir, "ledger-history"))
+	for name, tt := range map[string]struct {
+		period   string
+		from, to time.Time
+		err      string
+		expected []int64
+	}{
+		"Default": {"", time.Time{}, time.Time{}, "", []int64{40, 50, 70}},
+		"Day":     {"day", time.Time{}, time.Time{}, "", []int64{40, 70}},
+		"From":    {"hour", time.Date(2020, 6, 1, 1, 0, 0, 0, time.UTC), time.Time{}, "", []int64{50, 70}},
+		"To":      {"hour", time.Time{}, time.Date(2020, 6, 2, 0, 0, 0, 0, time.UTC), "", []int64{40, 50}},
+		"Invalid": {"week", time.Time{}, time.Time{}, "Invalid period: week", nil},
+	} {
+		t.Run(name, func(t *testing.T) {
+			series, err := main.GetLedgerHistorySeries(history, tt.period, tt.from, tt.to, nil)
+			if tt.err != "" {
+				testinggo.AssertError(t, tt.err, err)
+				return
+			}
+			testinggo.AssertNoError(t, err)
+			if len(series.Points) != len(tt.expected) {
+				t.Fatalf("Wrong number of points; expected '%d', got '%d'", len(tt.expected), len(series.Points))
+			}
+			for i, p := range series.Points {
+				if p.Circulating != tt.expected[i] {
+					t.Errorf("Wrong circulating; expected '%d', got '%d'", tt.expected[i], p.Circulating)
+				}
+				if p.Balances != nil {
+					t.Errorf("Unexpected balances; got '%v'", p.Balances)
+				}
+			}
+		})
+	}
+}
+
+func TestLedgerHistoryHandler(t *testing.T) {
+	dir := testinggo.MakeTempDir(t, "history")
+	defer testinggo.UnmakeTempDir(t, dir)
+	handler := main.LedgerHistoryHandler(makeLedgerHistory(t, path.Join(dir, "ledger-history")))
+	t.Run("Alias", func(t *testing.T) {
+		request, err := http.NewRequest(http.MethodGet, "/ledger/history?period=day&alias=Bob&alias=Alice", nil)
+		testinggo.AssertNoError(t, err)
+		response := httptest.NewRecorder()
+		handler(response, request)
+		if response.Code != http.StatusOK {
+			t.Fatalf("Wrong response code; expected '%d', got '%d'", http.StatusOK, response.Code)
+		}
+		if c := response.Header().Get("Content-Type"); c != "application/json" {
+			t.Errorf("Wrong content type; expected '%s', got '%s'", "application/json", c)
+		}
+		series := &main.LedgerHistorySeries{}
+		testinggo.AssertNoError(t, json.Unmarshal(response.Body.Bytes(), series))
+		if len(series.Points) != 2 {
+			t.Fatalf("Wrong number of points; expected '%d', got '%d'", 2, len(series.Points))
+		}
+		if b := series.Points[1].Balances["Alice"]; b != 70 {
+			t.Errorf("Wrong balance; expected '%d', got '%d'", 70, b)
+		}
+		if _, ok := series.Points[1].Balances["Merchant"]; ok {
+			t.Errorf("Unexpected balance for Merchant")
+		}
+	})
+	t.Run("InvalidDate", func(t *testing.T) {
+		request, err := http.NewRequest(http.MethodGet, "/ledger/history?from=yesterday", nil)
+		testinggo.AssertNoError(t, err)
+		response := httptest.NewRecorder()
+		handler(response, request)
+		if response.Code != http.StatusNotFound {
+			t.Errorf("Wrong response code; expected '%d', got '%d'", http.StatusNotFound, response.Code)
+		}
+	})
+}
+
+func TestLedgerHistoryChartHandler(t *testing.T) {
+	dir := testinggo.MakeTempDir(t, "history")
+	defer testinggo.UnmakeTempDir(t, dir)
+	for name, tt := range map[string]struct {
+		history  main.LedgerHistory
+		query    string
+		expected []string
+	}{
+		"Empty":  {main.NewFileLedgerHistory(path.Join(dir, "empty")), "", []string{"No history yet"}},
+		"Supply": {makeLedgerHistory(t, path.Join(dir, "supply")), "", []string{">Supply<", ">Circulating<", "2020-06-01", "2020-06-02", ">200<"}},
+		"Alias":  {makeLedgerHistory(t, path.Join(dir, "alias")), "?alias=%3CBob%3E", []string{"&lt;Bob&gt;"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			request, err := http.NewRequest(http.MethodGet, "/ledger/history.svg"+tt.query, nil)
+			testinggo.AssertNoError(t, err)
+			response := httptest.NewRecorder()
+			main.LedgerHistoryChartHandler(tt.history)(response, request)
+			if c := response.Header().Get("Content-Type"); c != "image/svg+xml" {
+				t.Errorf("Wrong content type; expected '%s', got '%s'", "image/svg+xml", c)
+			}
+			body := response.Body.String()
+			if !strings.HasPrefix(body, "<svg") {
+				t.Errorf("Wrong body; expected svg, got '%s'", body)
+			}
+			for _, e := range tt.expected {
+				if !strings.Contains(body, e) {
+					t.Errorf("Wrong body; expected '%s' in '%s'", e, body)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,357 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/stripe/stripe-go"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	LOCAL_CARD_DECLINED = "0002" // Last 4 digits of a card which is always declined
+
+	ERROR_CARD_DECLINED = "Your card was declined."
+)
+
+// LocalCustomer is a customer registered with the LocalPaymentProcessor.
+type LocalCustomer struct {
+	ID    string
+	Name  string
+	Email string
+	Alias string
+}
+
+// LocalPaymentIntent is a payment made through the LocalPaymentProcessor.
+type LocalPaymentIntent struct {
+	ID            string
+	ChargeID      string
+	Customer      string
+	PaymentMethod string
+	Alias         string
+	ProductId     string
+	Description   string
+	Currency      string
+	Quantity      int64
+	Amount        int64
+	Created       int64
+	Status        string
+	Error         string
+}
+
+// LocalPaymentState is the content of the LocalPaymentProcessor's file.
+type LocalPaymentState struct {
+	Customers      map[string]*LocalCustomer
+	PaymentMethods map[string][]*PaymentMethod // Customer ID -> Payment Methods
+	PaymentIntents map[string]*LocalPaymentIntent
+}
+
+// LocalPaymentProcessor is a PaymentProcessor for development which keeps customers, payment methods, and payment intents in a local file.
+// Payments succeed unless the card number ends in LOCAL_CARD_DECLINED, and a charge.succeeded event is synthesised into the given event handler, just as Stripe would send to the webhook.
+// Payments never require authentication.
+type LocalPaymentProcessor struct {
+	Path    string
+	Alias   string
+	Handler func(*stripe.Event)
+	State   *LocalPaymentState
+	lock    sync.Mutex
+}
+
+func NewLocalPaymentProcessor(path, alias string, handler func(*stripe.Event)) (*LocalPaymentProcessor, error) {
+	p := &LocalPaymentProcessor{
+		Path:    path,
+		Alias:   alias,
+		Handler: handler,
+		State: &LocalPaymentState{
+			Customers:      make(map[string]*LocalCustomer),
+			PaymentMethods: make(map[string][]*PaymentMethod),
+			PaymentIntents: make(map[string]*LocalPaymentIntent),
+		},
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return p, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, p.State); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *LocalPaymentProcessor) save() error {
+	data, err := json.MarshalIndent(p.State, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomically(p.Path, data, 0600)
+}
+
+func newLocalId(prefix string) (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return prefix + "_" + hex.EncodeToString(b), nil
+}
+
+// GetPublishableKey returns an empty key, as there is no client side library to load.
+func (p *LocalPaymentProcessor) GetPublishableKey() string {
+	return ""
+}
+
+func (p *LocalPaymentProcessor) NewSetupIntent() (string, error) {
+	return newLocalId("seti")
+}
+
+func (p *LocalPaymentProcessor) RegisterCustomer(name, email, alias string) (string, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	id, err := newLocalId("cus")
+	if err != nil {
+		return "", err
+	}
+	p.State.Customers[id] = &LocalCustomer{
+		ID:    id,
+		Name:  name,
+		Email: email,
+		Alias: alias,
+	}
+	if err := p.save(); err != nil {
+		return "", err
+	}
+	log.Println("Local Customer", id)
+	return id, nil
+}
+
+// AddPaymentMethod adds a card to the customer, the given payment method ID is the card number entered into the form.
+func (p *LocalPaymentProcessor) AddPaymentMethod(customerId, paymentMethodId string) (string, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	customer, ok := p.State.Customers[customerId]
+	if !ok {
+		return "", errors.New(fmt.Sprintf(ERROR_NO_SUCH_CUSTOMER, customerId))
+	}
+	id, err := newLocalId("pm")
+	if err != nil {
+		return "", err
+	}
+	last4 := paymentMethodId
+	if len(last4) > 4 {
+		last4 = last4[len(last4)-4:]
+	}
+	fingerprint := sha256.Sum256([]byte(paymentMethodId))
+	expiry := time.Now().AddDate(1, 0, 0)
+	p.State.PaymentMethods[customerId] = append(p.State.PaymentMethods[customerId], &PaymentMethod{
+		ID: id,
+		BillingDetails: &BillingDetails{
+			Address: &Address{},
+			Email:   customer.Email,
+			Name:    customer.Name,
+		},
+		Card: &PaymentMethodCard{
+			Brand:       "local",
+			ExpMonth:    uint64(expiry.Month()),
+			ExpYear:     uint64(expiry.Year()),
+			Fingerprint: hex.EncodeToString(fingerprint[:8]),
+			Funding:     "credit",
+			Last4:       last4,
+		},
+	})
+	if err := p.save(); err != nil {
+		return "", err
+	}
+	log.Println("Local Payment Method", id)
+	return id, nil
+}
+
+func (p *LocalPaymentProcessor) GetPaymentMethods(customerId string) ([]*PaymentMethod, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.State.PaymentMethods[customerId], nil
+}
+
+func (p *LocalPaymentProcessor) DetachPaymentMethod(customerId, paymentMethodId string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	methods := p.State.PaymentMethods[customerId]
+	for i, m := range methods {
+		if m.ID == paymentMethodId {
+			p.State.PaymentMethods[customerId] = append(methods[:i:i], methods[i+1:]...)
+			return p.save()
+		}
+	}
+	return errors.New(fmt.Sprintf(ERROR_NO_SUCH_PAYMENT_METHOD, paymentMethodId))
+}
+
+func (p *LocalPaymentProcessor) SetDefaultPaymentMethod(customerId, paymentMethodId string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	found := false
+	for _, m := range p.State.PaymentMethods[customerId] {
+		if m.ID == paymentMethodId {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return errors.New(fmt.Sprintf(ERROR_NO_SUCH_PAYMENT_METHOD, paymentMethodId))
+	}
+	for _, m := range p.State.PaymentMethods[customerId] {
+		m.Default = m.ID == paymentMethodId
+	}
+	return p.save()
+}
+
+// NewPaymentIntent records the payment and synthesises a charge.succeeded event into the event handler.
+func (p *LocalPaymentProcessor) NewPaymentIntent(customerId, paymentMethodId, alias, productId, description, currency string, quantity, amount int64) (*PaymentIntent, error) {
+	intent, err := p.addPaymentIntent(customerId, paymentMethodId, alias, productId, description, currency, quantity, amount)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("Local Payment Intent", intent.ID, intent.Status)
+
+	if intent.Status == PAYMENT_INTENT_SUCCEEDED {
+		// Handle event outside of lock as the handler may call back into the processor
+		event, err := p.newChargeSucceededEvent(intent)
+		if err != nil {
+			return nil, err
+		}
+		if p.Handler != nil {
+			p.Handler(event)
+		}
+	}
+	return newLocalPaymentIntent(intent), nil
+}
+
+func (p *LocalPaymentProcessor) GetPaymentIntent(paymentIntentId string) (*PaymentIntent, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	intent, ok := p.State.PaymentIntents[paymentIntentId]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf(ERROR_NO_SUCH_PAYMENT_INTENT, paymentIntentId))
+	}
+	return newLocalPaymentIntent(intent), nil
+}
+
+func newLocalPaymentIntent(intent *LocalPaymentIntent) *PaymentIntent {
+	return &PaymentIntent{
+		ID:     intent.ID,
+		Status: intent.Status,
+		Error:  intent.Error,
+	}
+}
+
+func (p *LocalPaymentProcessor) addPaymentIntent(customerId, paymentMethodId, alias, productId, description, currency string, quantity, amount int64) (*LocalPaymentIntent, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if _, ok := p.State.Customers[customerId]; !ok {
+		return nil, errors.New(fmt.Sprintf(ERROR_NO_SUCH_CUSTOMER, customerId))
+	}
+	var method *PaymentMethod
+	for _, m := range p.State.PaymentMethods[customerId] {
+		if m.ID == paymentMethodId {
+			method = m
+			break
+		}
+	}
+	if method == nil {
+		return nil, errors.New(fmt.Sprintf(ERROR_NO_SUCH_PAYMENT_METHOD, paymentMethodId))
+	}
+	intentId, err := newLocalId("pi")
+	if err != nil {
+		return nil, err
+	}
+	chargeId, err := newLocalId("ch")
+	if err != nil {
+		return nil, err
+	}
+	intent := &LocalPaymentIntent{
+		ID:            intentId,
+		ChargeID:      chargeId,
+		Customer:      customerId,
+		PaymentMethod: paymentMethodId,
+		Alias:         alias,
+		ProductId:     productId,
+		Description:   description,
+		Currency:      currency,
+		Quantity:      quantity,
+		Amount:        amount,
+		Created:       time.Now().Unix(),
+		Status:        PAYMENT_INTENT_SUCCEEDED,
+	}
+	if method.Card.Last4 == LOCAL_CARD_DECLINED {
+		intent.Status = PAYMENT_INTENT_REQUIRES_PAYMENT_METHOD
+		intent.Error = ERROR_CARD_DECLINED
+	}
+	p.State.PaymentIntents[intentId] = intent
+	if err := p.save(); err != nil {
+		return nil, err
+	}
+	return intent, nil
+}
+
+func (p *LocalPaymentProcessor) newChargeSucceededEvent(intent *LocalPaymentIntent) (*stripe.Event, error) {
+	eventId, err := newLocalId("evt")
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"id":      eventId,
+		"object":  "event",
+		"type":    "charge.succeeded",
+		"created": intent.Created,
+		"data": map[string]interface{}{
+			"object": map[string]interface{}{
+				"id":             intent.ChargeID,
+				"object":         "charge",
+				"amount":         intent.Amount,
+				"currency":       intent.Currency,
+				"customer":       intent.Customer,
+				"description":    intent.Description,
+				"payment_intent": intent.ID,
+				"payment_method": intent.PaymentMethod,
+				"metadata": map[string]string{
+					META_ALIAS_MERCHANT:  p.Alias,
+					META_ALIAS_CUSTOMER:  intent.Alias,
+					META_QUANTITY_TOKENS: strconv.FormatInt(intent.Quantity, 10),
+					META_PRODUCT_ID:      intent.ProductId,
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	event := &stripe.Event{}
+	if err := json.Unmarshal(data, event); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
@@ -0,0 +1,226 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main_test
+
+import (
+	"github.com/AletheiaWareLLC/conveygo"
+	"github.com/AletheiaWareLLC/conveyservergo"
+	"github.com/AletheiaWareLLC/testinggo"
+	"github.com/stripe/stripe-go"
+	"path"
+	"testing"
+)
+
+func makeLocalPaymentProcessor(t *testing.T, dir string, handler func(*stripe.Event)) *main.LocalPaymentProcessor {
+	t.Helper()
+	processor, err := main.NewLocalPaymentProcessor(path.Join(dir, "payments.json"), "Merchant", handler)
+	testinggo.AssertNoError(t, err)
+	return processor
+}
+
+func TestLocalPaymentProcessor(t *testing.T) {
+	t.Run("PublishableKey", func(t *testing.T) {
+		dir := testinggo.MakeTempDir(t, "local")
+		defer testinggo.UnmakeTempDir(t, dir)
+		processor := makeLocalPaymentProcessor(t, dir, nil)
+		if k := processor.GetPublishableKey(); k != "" {
+			t.Errorf("Wrong publishable key; expected '%s', got '%s'", "", k)
+		}
+	})
+	t.Run("PaymentMethods", func(t *testing.T) {
+		dir := testinggo.MakeTempDir(t, "local")
+		defer testinggo.UnmakeTempDir(t, dir)
+		processor := makeLocalPaymentProcessor(t, dir, nil)
+		customerId, err := processor.RegisterCustomer("Alice", "alice@example.com", "Alice")
+		testinggo.AssertNoError(t, err)
+		methodId, err := processor.AddPaymentMethod(customerId, "4242424242424242")
+		testinggo.AssertNoError(t, err)
+		// Reload from file
+		processor = makeLocalPaymentProcessor(t, dir, nil)
+		methods, err := processor.GetPaymentMethods(customerId)
+		testinggo.AssertNoError(t, err)
+		if len(methods) != 1 {
+			t.Fatalf("Wrong number of payment methods; expected '%d', got '%d'", 1, len(methods))
+		}
+		if methods[0].ID != methodId {
+			t.Errorf("Wrong ID; expected '%s', got '%s'", methodId, methods[0].ID)
+		}
+		if methods[0].Card.Last4 != "4242" {
+			t.Errorf("Wrong last 4; expected '%s', got '%s'", "4242", methods[0].Card.Last4)
+		}
+		if methods[0].BillingDetails.Email != "alice@example.com" {
+			t.Errorf("Wrong email; expected '%s', got '%s'", "alice@example.com", methods[0].BillingDetails.Email)
+		}
+	})
+	t.Run("PaymentMethods_NoSuchCustomer", func(t *testing.T) {
+		dir := testinggo.MakeTempDir(t, "local")
+		defer testinggo.UnmakeTempDir(t, dir)
+		processor := makeLocalPaymentProcessor(t, dir, nil)
+		_, err := processor.AddPaymentMethod("cus_1", "4242424242424242")
+		testinggo.AssertError(t, "No such customer: cus_1", err)
+	})
+	t.Run("DefaultPaymentMethod", func(t *testing.T) {
+		dir := testinggo.MakeTempDir(t, "local")
+		defer testinggo.UnmakeTempDir(t, dir)
+		processor := makeLocalPaymentProcessor(t, dir, nil)
+		customerId, err := processor.RegisterCustomer("Alice", "alice@example.com", "Alice")
+		testinggo.AssertNoError(t, err)
+		_, err = processor.AddPaymentMethod(customerId, "4242424242424242")
+		testinggo.AssertNoError(t, err)
+		second, err := processor.AddPaymentMethod(customerId, "5555555555554444")
+		testinggo.AssertNoError(t, err)
+		testinggo.AssertNoError(t, processor.SetDefaultPaymentMethod(customerId, second))
+		methods, err := processor.GetPaymentMethods(customerId)
+		testinggo.AssertNoError(t, err)
+		if id := main.GetDefaultPaymentMethod(methods); id != second {
+			t.Errorf("Wrong default; expected '%s', got '%s'", second, id)
+		}
+		testinggo.AssertError(t, "No such payment method: pm_1", processor.SetDefaultPaymentMethod(customerId, "pm_1"))
+	})
+	t.Run("DetachPaymentMethod", func(t *testing.T) {
+		dir := testinggo.MakeTempDir(t, "local")
+		defer testinggo.UnmakeTempDir(t, dir)
+		processor := makeLocalPaymentProcessor(t, dir, nil)
+		customerId, err := processor.RegisterCustomer("Alice", "alice@example.com", "Alice")
+		testinggo.AssertNoError(t, err)
+		first, err := processor.AddPaymentMethod(customerId, "4242424242424242")
+		testinggo.AssertNoError(t, err)
+		second, err := processor.AddPaymentMethod(customerId, "5555555555554444")
+		testinggo.AssertNoError(t, err)
+		testinggo.AssertNoError(t, processor.DetachPaymentMethod(customerId, first))
+		methods, err := processor.GetPaymentMethods(customerId)
+		testinggo.AssertNoError(t, err)
+		if len(methods) != 1 {
+			t.Fatalf("Wrong number of payment methods; expected '%d', got '%d'", 1, len(methods))
+		}
+		if methods[0].ID != second {
+			t.Errorf("Wrong ID; expected '%s', got '%s'", second, methods[0].ID)
+		}
+		// Payment methods of other customers cannot be detached
+		other, err := processor.RegisterCustomer("Bob", "bob@example.com", "Bob")
+		testinggo.AssertNoError(t, err)
+		testinggo.AssertError(t, "No such payment method: "+second, processor.DetachPaymentMethod(other, second))
+	})
+	t.Run("PaymentIntent", func(t *testing.T) {
+		dir := testinggo.MakeTempDir(t, "local")
+		defer testinggo.UnmakeTempDir(t, dir)
+		var events []*stripe.Event
+		processor := makeLocalPaymentProcessor(t, dir, func(event *stripe.Event) {
+			events = append(events, event)
+		})
+		customerId, err := processor.RegisterCustomer("Alice", "alice@example.com", "Alice")
+		testinggo.AssertNoError(t, err)
+		methodId, err := processor.AddPaymentMethod(customerId, "4242424242424242")
+		testinggo.AssertNoError(t, err)
+		intent, err := processor.NewPaymentIntent(customerId, methodId, "Alice", "prod_1", "100 Convey Tokens", "jpy", 100, 2500000)
+		testinggo.AssertNoError(t, err)
+		if intent.Status != main.PAYMENT_INTENT_SUCCEEDED {
+			t.Errorf("Wrong status; expected '%s', got '%s'", main.PAYMENT_INTENT_SUCCEEDED, intent.Status)
+		}
+		if len(events) != 1 {
+			t.Fatalf("Wrong number of events; expected '%d', got '%d'", 1, len(events))
+		}
+		event := events[0]
+		for name, tt := range map[string]struct {
+			keys     []string
+			expected string
+		}{
+			"Type":     {nil, "charge.succeeded"},
+			"Amount":   {[]string{"amount"}, "2500000"},
+			"Currency": {[]string{"currency"}, "jpy"},
+			"Method":   {[]string{"payment_method"}, methodId},
+			"Merchant": {[]string{"metadata", main.META_ALIAS_MERCHANT}, "Merchant"},
+			"Customer": {[]string{"metadata", main.META_ALIAS_CUSTOMER}, "Alice"},
+			"Quantity": {[]string{"metadata", main.META_QUANTITY_TOKENS}, "100"},
+			"Product":  {[]string{"metadata", main.META_PRODUCT_ID}, "prod_1"},
+		} {
+			t.Run(name, func(t *testing.T) {
+				v := event.Type
+				if tt.keys != nil {
+					v = main.GetEventValue(event, tt.keys...)
+				}
+				if v != tt.expected {
+					t.Errorf("Wrong value; expected '%s', got '%s'", tt.expected, v)
+				}
+			})
+		}
+	})
+	t.Run("PaymentIntent_Declined", func(t *testing.T) {
+		dir := testinggo.MakeTempDir(t, "local")
+		defer testinggo.UnmakeTempDir(t, dir)
+		var events []*stripe.Event
+		processor := makeLocalPaymentProcessor(t, dir, func(event *stripe.Event) {
+			events = append(events, event)
+		})
+		customerId, err := processor.RegisterCustomer("Alice", "alice@example.com", "Alice")
+		testinggo.AssertNoError(t, err)
+		methodId, err := processor.AddPaymentMethod(customerId, "4000000000000002")
+		testinggo.AssertNoError(t, err)
+		intent, err := processor.NewPaymentIntent(customerId, methodId, "Alice", "prod_1", "100 Convey Tokens", "usd", 100, 100)
+		testinggo.AssertNoError(t, err)
+		if intent.Status != main.PAYMENT_INTENT_REQUIRES_PAYMENT_METHOD {
+			t.Errorf("Wrong status; expected '%s', got '%s'", main.PAYMENT_INTENT_REQUIRES_PAYMENT_METHOD, intent.Status)
+		}
+		if intent.Error != main.ERROR_CARD_DECLINED {
+			t.Errorf("Wrong error; expected '%s', got '%s'", main.ERROR_CARD_DECLINED, intent.Error)
+		}
+		if len(events) != 0 {
+			t.Errorf("Wrong number of events; expected '%d', got '%d'", 0, len(events))
+		}
+		// Reload from file
+		processor = makeLocalPaymentProcessor(t, dir, nil)
+		got, err := processor.GetPaymentIntent(intent.ID)
+		testinggo.AssertNoError(t, err)
+		if got.Status != intent.Status {
+			t.Errorf("Wrong status; expected '%s', got '%s'", intent.Status, got.Status)
+		}
+		_, err = processor.GetPaymentIntent("pi_1")
+		testinggo.AssertError(t, "No such payment intent: pi_1", err)
+	})
+	t.Run("PaymentIntent_NoSuchPaymentMethod", func(t *testing.T) {
+		dir := testinggo.MakeTempDir(t, "local")
+		defer testinggo.UnmakeTempDir(t, dir)
+		processor := makeLocalPaymentProcessor(t, dir, nil)
+		customerId, err := processor.RegisterCustomer("Alice", "alice@example.com", "Alice")
+		testinggo.AssertNoError(t, err)
+		_, err = processor.NewPaymentIntent(customerId, "pm_1", "Alice", "prod_1", "100 Convey Tokens", "usd", 100, 100)
+		testinggo.AssertError(t, "No such payment method: pm_1", err)
+	})
+	t.Run("PurchaseToToken", func(t *testing.T) {
+		dir := testinggo.MakeTempDir(t, "local")
+		defer testinggo.UnmakeTempDir(t, dir)
+		merchantKey := makeKey(t)
+		customerKey := makeKey(t)
+		node := makeNode(t, "Merchant", merchantKey)
+		clawbacks := makeClawbacks(t, conveygo.NewLedger(node))
+		makeAlias(t, node, clawbacks.Aliases, "Alice", customerKey)
+		handler := makeStripeEventHandler(t, clawbacks, dir)
+		processor := makeLocalPaymentProcessor(t, dir, func(event *stripe.Event) {
+			testinggo.AssertNoError(t, handler(clawbacks.Node, event))
+		})
+		customerId, err := processor.RegisterCustomer("Alice", "alice@example.com", "Alice")
+		testinggo.AssertNoError(t, err)
+		methodId, err := processor.AddPaymentMethod(customerId, "4242424242424242")
+		testinggo.AssertNoError(t, err)
+		_, err = processor.NewPaymentIntent(customerId, methodId, "Alice", "prod_1", "100 Convey Tokens", "usd", 100, 100)
+		testinggo.AssertNoError(t, err)
+		updateLedger(t, clawbacks)
+		if b := clawbacks.Ledger.GetBalance("Alice"); b != 100 {
+			t.Errorf("Wrong balance; expected '%d', got '%d'", 100, b)
+		}
+	})
+}
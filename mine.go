@@ -0,0 +1,71 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/rsa"
+	"github.com/AletheiaWareLLC/bcgo"
+	"github.com/AletheiaWareLLC/cryptogo"
+	"github.com/golang/protobuf/proto"
+	"log"
+)
+
+// MineRecord creates a record containing the given protobuf, signed by the given alias and key, mines it into the given channel, and pushes the new head to the network.
+// The returned reference identifies the new record and the block it was mined into.
+// Meta should hold at most one entry, as map entries are not hashed in a deterministic order.
+func MineRecord(node *bcgo.Node, miner *ChannelMiner, listener bcgo.MiningListener, channel *bcgo.Channel, alias string, key *rsa.PrivateKey, access map[string]*rsa.PublicKey, references []*bcgo.Reference, meta map[string]string, message proto.Message) (*bcgo.Reference, error) {
+	data, err := proto.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+
+	_, record, err := bcgo.CreateRecord(bcgo.Timestamp(), alias, key, access, references, data)
+	if err != nil {
+		return nil, err
+	}
+	record.Meta = meta
+
+	return MineSignedRecord(node, miner, listener, channel, record)
+}
+
+// MineSignedRecord mines a record which was created and signed earlier into the given channel, and pushes the new head to the network.
+// The record may share its block with records mined into the same channel at the same time.
+func MineSignedRecord(node *bcgo.Node, miner *ChannelMiner, listener bcgo.MiningListener, channel *bcgo.Channel, record *bcgo.Record) (*bcgo.Reference, error) {
+	log.Println("Record", record)
+
+	hash, err := cryptogo.HashProtobuf(record)
+	if err != nil {
+		return nil, err
+	}
+
+	blockHash, err := miner.Mine(node, listener, channel, []*bcgo.BlockEntry{
+		{
+			RecordHash: hash,
+			Record:     record,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &bcgo.Reference{
+		Timestamp:   record.Timestamp,
+		ChannelName: channel.Name,
+		BlockHash:   blockHash,
+		RecordHash:  hash,
+	}, nil
+}
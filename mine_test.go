@@ -0,0 +1,106 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"github.com/AletheiaWareLLC/aliasgo"
+	"github.com/AletheiaWareLLC/bcgo"
+	"github.com/AletheiaWareLLC/conveygo"
+	"github.com/AletheiaWareLLC/conveyservergo"
+	"github.com/AletheiaWareLLC/testinggo"
+	"github.com/golang/protobuf/proto"
+	"testing"
+)
+
+func makeKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 4096)
+	if err != nil {
+		t.Error("Could not generate key:", err)
+	}
+	return key
+}
+
+func makeNode(t *testing.T, alias string, key *rsa.PrivateKey) *bcgo.Node {
+	t.Helper()
+	return &bcgo.Node{
+		Alias:    alias,
+		Key:      key,
+		Cache:    bcgo.NewMemoryCache(100),
+		Channels: make(map[string]*bcgo.Channel),
+	}
+}
+
+func makeAlias(t *testing.T, node *bcgo.Node, aliases *bcgo.Channel, alias string, key *rsa.PrivateKey) {
+	t.Helper()
+	record, err := aliasgo.CreateSignedAliasRecord(alias, key)
+	testinggo.AssertNoError(t, err)
+	_, err = bcgo.WriteRecord(aliases.Name, node.Cache, record)
+	testinggo.AssertNoError(t, err)
+	_, _, err = node.Mine(aliases, aliasgo.ALIAS_THRESHOLD, nil)
+	testinggo.AssertNoError(t, err)
+}
+
+func TestMineRecord(t *testing.T) {
+	alias := "Alice"
+	key := makeKey(t)
+	t.Run("Public", func(t *testing.T) {
+		node := makeNode(t, alias, key)
+		transactions := conveygo.OpenTransactionChannel()
+		transaction := &conveygo.Transaction{
+			Sender:   alias,
+			Receiver: "Bob",
+			Amount:   10,
+		}
+		reference, err := main.MineRecord(node, main.NewChannelMiner(), nil, transactions, alias, key, nil, nil, map[string]string{
+			"foo": "bar",
+		}, transaction)
+		testinggo.AssertNoError(t, err)
+		testinggo.AssertHashEqual(t, transactions.Head, reference.BlockHash)
+
+		block, err := node.Cache.GetBlock(reference.BlockHash)
+		testinggo.AssertNoError(t, err)
+		if len(block.Entry) != 1 {
+			t.Fatalf("Wrong number of entries; expected '%d', got '%d'", 1, len(block.Entry))
+		}
+		record := block.Entry[0].Record
+		if record.Creator != alias {
+			t.Errorf("Wrong creator; expected '%s', got '%s'", alias, record.Creator)
+		}
+		if record.Meta["foo"] != "bar" {
+			t.Errorf("Wrong meta; expected '%s', got '%s'", "bar", record.Meta["foo"])
+		}
+		actual := &conveygo.Transaction{}
+		testinggo.AssertNoError(t, proto.Unmarshal(record.Payload, actual))
+		testinggo.AssertProtobufEqual(t, transaction, actual)
+	})
+	t.Run("Invalid", func(t *testing.T) {
+		// Transaction validator rejects records not created by the sender
+		node := makeNode(t, alias, key)
+		transactions := conveygo.OpenTransactionChannel()
+		_, err := main.MineRecord(node, main.NewChannelMiner(), nil, transactions, alias, key, nil, nil, nil, &conveygo.Transaction{
+			Sender:   "Bob",
+			Receiver: alias,
+			Amount:   10,
+		})
+		if err == nil {
+			t.Error("Expected error")
+		}
+	})
+}
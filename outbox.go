@@ -0,0 +1,233 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"github.com/AletheiaWareLLC/bcgo"
+	"io"
+	"log"
+	"time"
+)
+
+const (
+	OUTBOX_PERIOD          = 30 * time.Second
+	OUTBOX_BACKOFF         = time.Minute // Doubles after each failed attempt
+	OUTBOX_MAXIMUM_BACKOFF = time.Hour
+)
+
+// OutboxEntry is a channel with blocks which were mined locally but haven't been pushed to the network.
+type OutboxEntry struct {
+	Channel  string
+	Blocks   [][]byte // Hashes of the blocks waiting to be pushed, oldest first
+	Created  time.Time
+	Attempts int
+	Next     time.Time // Time of the next attempt
+	Error    string
+}
+
+// Outbox keeps blocks waiting to be pushed to the network, so they are retried after a restart.
+type Outbox interface {
+	// Add records that the given block of the given channel is waiting to be pushed.
+	Add(channel string, block []byte, now time.Time) error
+	// Get returns the entry for the given channel, or nil if there is nothing waiting.
+	Get(channel string) (*OutboxEntry, error)
+	// GetAll returns the entries of every channel, oldest first.
+	GetAll() ([]*OutboxEntry, error)
+	// Retry records a failed attempt to push the given channel, and when to try again.
+	Retry(channel string, next time.Time, e string) error
+	// Remove forgets the blocks of the given channel up to and including the given block, as they have been pushed.
+	Remove(channel string, block []byte) error
+}
+
+// OutboxBackoff returns how long to wait after the given number of failed attempts.
+func OutboxBackoff(attempts int) time.Duration {
+	backoff := OUTBOX_BACKOFF
+	for i := 1; i < attempts && backoff < OUTBOX_MAXIMUM_BACKOFF; i++ {
+		backoff *= 2
+	}
+	if backoff > OUTBOX_MAXIMUM_BACKOFF {
+		backoff = OUTBOX_MAXIMUM_BACKOFF
+	}
+	return backoff
+}
+
+// OutboxPusher periodically pushes the channels in the outbox to the network.
+type OutboxPusher struct {
+	Outbox   Outbox
+	Node     *bcgo.Node
+	Miner    *ChannelMiner
+	Listener bcgo.MiningListener
+	stop     chan bool
+}
+
+func NewOutboxPusher(outbox Outbox, node *bcgo.Node, miner *ChannelMiner, listener bcgo.MiningListener) *OutboxPusher {
+	return &OutboxPusher{
+		Outbox:   outbox,
+		Node:     node,
+		Miner:    miner,
+		Listener: listener,
+		stop:     make(chan bool),
+	}
+}
+
+func (p *OutboxPusher) Start() {
+	ticker := time.NewTicker(OUTBOX_PERIOD)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := p.Run(time.Now()); err != nil {
+				log.Println(err)
+			}
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+func (p *OutboxPusher) Stop() {
+	close(p.stop)
+}
+
+// Run pushes every channel in the outbox which is due by the given time.
+// Channels which fail to push are retried with exponential backoff, and channels which are out of date are reconciled with the network.
+func (p *OutboxPusher) Run(now time.Time) error {
+	if p.Node.Network == nil {
+		return nil
+	}
+	entries, err := p.Outbox.GetAll()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Next.After(now) {
+			continue
+		}
+		last := entry.Blocks[len(entry.Blocks)-1]
+		channel, err := p.Node.GetChannel(entry.Channel)
+		if err != nil {
+			log.Println("Outbox", entry.Channel, err)
+			if err := p.Outbox.Remove(entry.Channel, last); err != nil {
+				return err
+			}
+			continue
+		}
+		err = channel.Push(p.Node.Cache, p.Node.Network)
+		if err != nil && err.Error() == bcgo.ERROR_CHANNEL_OUT_OF_DATE {
+			// The network has a longer chain, re-mine any records which were dropped from it
+			var hash []byte
+			hash, err = p.reconcile(channel, entry)
+			if hash != nil {
+				// The waiting blocks were replaced by a new block
+				if err := p.Outbox.Remove(entry.Channel, last); err != nil {
+					return err
+				}
+				if err != nil {
+					if err := p.Outbox.Add(entry.Channel, hash, now); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		if err != nil {
+			log.Println("Outbox", entry.Channel, err)
+			if err := p.Outbox.Retry(entry.Channel, now.Add(OutboxBackoff(entry.Attempts+1)), err.Error()); err != nil {
+				return err
+			}
+			continue
+		}
+		log.Println("Outbox pushed", entry.Channel)
+		if err := p.Outbox.Remove(entry.Channel, last); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reconcile pulls the network's chain and mines the records of the waiting blocks which aren't on it into a new block on top, returning the hash of the new block if one was mined.
+func (p *OutboxPusher) reconcile(channel *bcgo.Channel, entry *OutboxEntry) ([]byte, error) {
+	var pending []*bcgo.BlockEntry
+	var oldest uint64
+	for _, hash := range entry.Blocks {
+		block, err := p.Node.Cache.GetBlock(hash)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range block.Entry {
+			pending = append(pending, e)
+			if oldest == 0 || e.Record.Timestamp < oldest {
+				oldest = e.Record.Timestamp
+			}
+		}
+	}
+	if err := channel.Pull(p.Node.Cache, p.Node.Network); err != nil {
+		return nil, err
+	}
+	// Find the records which made it onto the network's chain
+	mined := make(map[string]bool)
+	if err := bcgo.Iterate(channel.Name, channel.Head, nil, p.Node.Cache, p.Node.Network, func(h []byte, b *bcgo.Block) error {
+		if b.Timestamp < oldest {
+			return bcgo.StopIterationError{}
+		}
+		for _, e := range b.Entry {
+			mined[string(e.RecordHash)] = true
+		}
+		return nil
+	}); err != nil {
+		switch err.(type) {
+		case bcgo.StopIterationError:
+			// Do nothing
+		default:
+			return nil, err
+		}
+	}
+	var dropped []*bcgo.BlockEntry
+	for _, e := range pending {
+		if !mined[string(e.RecordHash)] {
+			dropped = append(dropped, e)
+		}
+	}
+	log.Println("Outbox reconciling", channel.Name, len(dropped), "of", len(pending), "records dropped")
+	if len(dropped) == 0 {
+		return nil, nil
+	}
+	// Mine without a network so the new block is pushed here rather than added to the outbox
+	offline := &bcgo.Node{
+		Alias:    p.Node.Alias,
+		Key:      p.Node.Key,
+		Cache:    p.Node.Cache,
+		Channels: p.Node.Channels,
+	}
+	hash, err := p.Miner.Mine(offline, p.Listener, channel, dropped)
+	if err != nil {
+		return nil, err
+	}
+	return hash, channel.Push(p.Node.Cache, p.Node.Network)
+}
+
+// HandleOutbox lists the channels waiting to be pushed.
+func HandleOutbox(outbox Outbox, args []string, output io.Writer) error {
+	entries, err := outbox.GetAll()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		fmt.Fprintln(output, e.Channel, len(e.Blocks), "blocks", e.Attempts, "attempts", "next", e.Next.Format(time.RFC3339), e.Error)
+	}
+	return nil
+}
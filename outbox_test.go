@@ -0,0 +1,157 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main_test
+
+import (
+	"bytes"
+	"github.com/AletheiaWareLLC/bcgo"
+	"github.com/AletheiaWareLLC/conveyservergo"
+	"github.com/AletheiaWareLLC/testinggo"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestOutboxBackoff(t *testing.T) {
+	for name, tt := range map[string]struct {
+		attempts int
+		expected time.Duration
+	}{
+		"First":   {1, time.Minute},
+		"Second":  {2, 2 * time.Minute},
+		"Third":   {3, 4 * time.Minute},
+		"Maximum": {100, main.OUTBOX_MAXIMUM_BACKOFF},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if b := main.OutboxBackoff(tt.attempts); b != tt.expected {
+				t.Errorf("Wrong backoff; expected '%s', got '%s'", tt.expected, b)
+			}
+		})
+	}
+}
+
+func TestOutboxPusher(t *testing.T) {
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	setup := func(t *testing.T, dir string, network *MockNetwork) (*bcgo.Node, *main.FileOutbox) {
+		t.Helper()
+		node := makeNode(t, "Merchant", makeKey(t))
+		channels, _, err := mineTestRecord(node)
+		testinggo.AssertNoError(t, err)
+		if network != nil {
+			// Avoid a non-nil interface holding a nil pointer
+			node.Network = network
+		}
+		outbox := main.NewFileOutbox(path.Join(dir, "outbox.json"))
+		testinggo.AssertNoError(t, outbox.Add("Test", channels[0].Head, now))
+		return node, outbox
+	}
+	for name, tt := range map[string]struct {
+		network            *MockNetwork
+		time               time.Time
+		expectedBroadcasts int
+		expectedAttempts   int
+		expectedNext       time.Time
+	}{
+		"Pushed":  {&MockNetwork{}, now, 1, 0, time.Time{}},
+		"Failed":  {&MockNetwork{Failures: 1}, now, 1, 1, now.Add(time.Minute)},
+		"NotDue":  {&MockNetwork{}, now.Add(-time.Second), 0, 0, now},
+		"Offline": {nil, now, 0, 0, now},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := testinggo.MakeTempDir(t, "outbox")
+			defer testinggo.UnmakeTempDir(t, dir)
+			node, outbox := setup(t, dir, tt.network)
+			testinggo.AssertNoError(t, main.NewOutboxPusher(outbox, node, main.NewChannelMiner(), nil).Run(tt.time))
+			if tt.network != nil && tt.network.Broadcasts != tt.expectedBroadcasts {
+				t.Errorf("Wrong broadcasts; expected '%d', got '%d'", tt.expectedBroadcasts, tt.network.Broadcasts)
+			}
+			entry, err := outbox.Get("Test")
+			testinggo.AssertNoError(t, err)
+			if tt.expectedNext.IsZero() {
+				if entry != nil {
+					t.Errorf("Expected entry to be removed")
+				}
+				return
+			}
+			if entry == nil {
+				t.Fatal("Expected entry to remain")
+			}
+			if entry.Attempts != tt.expectedAttempts {
+				t.Errorf("Wrong attempts; expected '%d', got '%d'", tt.expectedAttempts, entry.Attempts)
+			}
+			if !entry.Next.Equal(tt.expectedNext) {
+				t.Errorf("Wrong next; expected '%s', got '%s'", tt.expectedNext, entry.Next)
+			}
+		})
+	}
+}
+
+func TestOutboxPusher_Reconcile(t *testing.T) {
+	dir := testinggo.MakeTempDir(t, "outbox")
+	defer testinggo.UnmakeTempDir(t, dir)
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	// Remote chain is longer than the local chain
+	remote := makeNode(t, "Remote", makeKey(t))
+	remoteChannel := bcgo.OpenPoWChannel("Test", bcgo.THRESHOLD_G)
+	remote.AddChannel(remoteChannel)
+	for i := 0; i < 2; i++ {
+		_, err := remote.Write(bcgo.Timestamp(), remoteChannel, nil, nil, []byte("Remote"))
+		testinggo.AssertNoError(t, err)
+		_, _, err = remote.Mine(remoteChannel, bcgo.THRESHOLD_G, nil)
+		testinggo.AssertNoError(t, err)
+	}
+
+	node := makeNode(t, "Merchant", makeKey(t))
+	channel := bcgo.OpenPoWChannel("Test", bcgo.THRESHOLD_G)
+	node.AddChannel(channel)
+	reference, err := node.Write(bcgo.Timestamp(), channel, nil, nil, []byte("Local"))
+	testinggo.AssertNoError(t, err)
+	local, _, err := node.Mine(channel, bcgo.THRESHOLD_G, nil)
+	testinggo.AssertNoError(t, err)
+
+	network := &MockNetwork{
+		Failures: 1,
+		Error:    bcgo.ERROR_CHANNEL_OUT_OF_DATE,
+		Head:     remoteChannel.Head,
+		Remote:   remote.Cache,
+	}
+	node.Network = network
+	outbox := main.NewFileOutbox(path.Join(dir, "outbox.json"))
+	testinggo.AssertNoError(t, outbox.Add("Test", local, now))
+
+	testinggo.AssertNoError(t, main.NewOutboxPusher(outbox, node, main.NewChannelMiner(), nil).Run(now))
+
+	if network.Broadcasts != 2 {
+		t.Errorf("Wrong broadcasts; expected '%d', got '%d'", 2, network.Broadcasts)
+	}
+	entry, err := outbox.Get("Test")
+	testinggo.AssertNoError(t, err)
+	if entry != nil {
+		t.Errorf("Expected entry to be removed")
+	}
+	// Local record was mined on top of the remote chain
+	head, err := node.Cache.GetBlock(channel.Head)
+	testinggo.AssertNoError(t, err)
+	if head.Length != 3 {
+		t.Errorf("Wrong length; expected '%d', got '%d'", 3, head.Length)
+	}
+	testinggo.AssertHashEqual(t, remoteChannel.Head, head.Previous)
+	if len(head.Entry) != 1 || !bytes.Equal(head.Entry[0].RecordHash, reference.RecordHash) {
+		t.Errorf("Expected head to contain the local record")
+	}
+}
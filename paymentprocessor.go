@@ -16,20 +16,86 @@
 
 package main
 
+import (
+	"errors"
+	"time"
+)
+
+const (
+	ERROR_NO_SUCH_PAYMENT_INTENT         = "No such payment intent: %s"
+	ERROR_NO_SUCH_PAYMENT_METHOD         = "No such payment method: %s"
+	ERROR_PAYMENT_FAILED                 = "Payment failed: %s"
+	ERROR_PAYMENT_METHODS_TIMEOUT        = "Timed out getting payment methods"
+	ERROR_UNRECOGNIZED_PAYMENT_PROCESSOR = "Unrecognized payment processor: %s"
+
+	PAYMENT_METHODS_TIMEOUT = 3 * time.Second
+
+	PAYMENT_INTENT_CANCELED                = "canceled"
+	PAYMENT_INTENT_PROCESSING              = "processing"
+	PAYMENT_INTENT_REQUIRES_ACTION         = "requires_action"
+	PAYMENT_INTENT_REQUIRES_PAYMENT_METHOD = "requires_payment_method"
+	PAYMENT_INTENT_SUCCEEDED               = "succeeded"
+)
+
 type PaymentProcessor interface {
 	GetPublishableKey() string
 	NewSetupIntent() (string, error)
 	RegisterCustomer(name, email, alias string) (string, error)
 	AddPaymentMethod(customerId, paymentMethodId string) (string, error)
 	GetPaymentMethods(customerId string) ([]*PaymentMethod, error)
-	NewPaymentIntent(customerId, paymentMethodId, alias, description string, quantity, amount int64) (string, error)
-	GetProducts(productIds []string) (map[string]*Product, error)
+	DetachPaymentMethod(customerId, paymentMethodId string) error
+	SetDefaultPaymentMethod(customerId, paymentMethodId string) error
+	NewPaymentIntent(customerId, paymentMethodId, alias, productId, description, currency string, quantity, amount int64) (*PaymentIntent, error)
+	GetPaymentIntent(paymentIntentId string) (*PaymentIntent, error)
+}
+
+// PaymentIntent is the state of a payment.
+// A payment which requires action must be authenticated by the customer on-session with the client secret, a payment which requires a payment method has failed.
+type PaymentIntent struct {
+	ID           string
+	Status       string
+	ClientSecret string
+	Error        string
 }
 
 type PaymentMethod struct {
 	ID             string
 	BillingDetails *BillingDetails
 	Card           *PaymentMethodCard
+	Default        bool
+}
+
+// GetPaymentMethodsWithin returns the payment methods of the customer, or an error if the processor doesn't respond within the timeout.
+func GetPaymentMethodsWithin(payments PaymentProcessor, customerId string, timeout time.Duration) ([]*PaymentMethod, error) {
+	type result struct {
+		methods []*PaymentMethod
+		err     error
+	}
+	// Buffered so the lookup can finish after a timeout
+	results := make(chan *result, 1)
+	go func() {
+		methods, err := payments.GetPaymentMethods(customerId)
+		results <- &result{methods, err}
+	}()
+	select {
+	case r := <-results:
+		return r.methods, r.err
+	case <-time.After(timeout):
+		return nil, errors.New(ERROR_PAYMENT_METHODS_TIMEOUT)
+	}
+}
+
+// GetDefaultPaymentMethod returns the ID of the default payment method, or the first if none is the default.
+func GetDefaultPaymentMethod(methods []*PaymentMethod) string {
+	for _, m := range methods {
+		if m.Default {
+			return m.ID
+		}
+	}
+	if len(methods) > 0 {
+		return methods[0].ID
+	}
+	return ""
 }
 
 type BillingDetails struct {
@@ -49,16 +115,11 @@ type Address struct {
 }
 
 type PaymentMethodCard struct {
-	Brand    string
-	Country  string
-	ExpMonth uint64
-	ExpYear  uint64
-	Funding  string
-	Last4    string
-}
-
-type Product struct {
-	ID       string
-	Quantity uint64
-	Price    uint64
+	Brand       string
+	Country     string
+	ExpMonth    uint64
+	ExpYear     uint64
+	Fingerprint string // Identifies the card across customers
+	Funding     string
+	Last4       string
 }
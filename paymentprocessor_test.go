@@ -17,10 +17,54 @@
 package main_test
 
 import (
+	"errors"
 	"github.com/AletheiaWareLLC/conveyservergo"
+	"github.com/AletheiaWareLLC/testinggo"
 	"testing"
+	"time"
 )
 
+func TestGetDefaultPaymentMethod(t *testing.T) {
+	for name, tt := range map[string]struct {
+		methods  []*main.PaymentMethod
+		expected string
+	}{
+		"Empty":     {nil, ""},
+		"NoDefault": {[]*main.PaymentMethod{{ID: "pm_1"}, {ID: "pm_2"}}, "pm_1"},
+		"Default":   {[]*main.PaymentMethod{{ID: "pm_1"}, {ID: "pm_2", Default: true}}, "pm_2"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if id := main.GetDefaultPaymentMethod(tt.methods); id != tt.expected {
+				t.Errorf("Wrong default; expected '%s', got '%s'", tt.expected, id)
+			}
+		})
+	}
+}
+
+func TestGetPaymentMethodsWithin(t *testing.T) {
+	for name, tt := range map[string]struct {
+		payments *MockPaymentProcessor
+		err      string
+		expected int
+	}{
+		"Methods": {&MockPaymentProcessor{PaymentMethods: []*main.PaymentMethod{{ID: "pm_1"}}}, "", 1},
+		"Error":   {&MockPaymentProcessor{Error: errors.New("Foo")}, "Foo", 0},
+		"Timeout": {&MockPaymentProcessor{Delay: time.Second}, main.ERROR_PAYMENT_METHODS_TIMEOUT, 0},
+	} {
+		t.Run(name, func(t *testing.T) {
+			methods, err := main.GetPaymentMethodsWithin(tt.payments, "cus_1", 10*time.Millisecond)
+			if tt.err == "" {
+				testinggo.AssertNoError(t, err)
+			} else {
+				testinggo.AssertError(t, tt.err, err)
+			}
+			if len(methods) != tt.expected {
+				t.Errorf("Wrong number of methods; expected '%d', got '%d'", tt.expected, len(methods))
+			}
+		})
+	}
+}
+
 func makeMockPaymentProcessor(t *testing.T) main.PaymentProcessor {
 	return &MockPaymentProcessor{
 		PublishableKey: "foo",
@@ -30,6 +74,12 @@ func makeMockPaymentProcessor(t *testing.T) main.PaymentProcessor {
 
 type MockPaymentProcessor struct {
 	PublishableKey, ClientSecret string
+	PaymentMethods               []*main.PaymentMethod
+	Detached, Default            string
+	PaymentIntent                *main.PaymentIntent
+	Amount                       int64
+	Delay                        time.Duration
+	Error                        error
 }
 
 func (m *MockPaymentProcessor) GetPublishableKey() string {
@@ -49,13 +99,28 @@ func (m *MockPaymentProcessor) AddPaymentMethod(customerId, paymentMethodId stri
 }
 
 func (m *MockPaymentProcessor) GetPaymentMethods(customerId string) ([]*main.PaymentMethod, error) {
-	return nil, nil
+	time.Sleep(m.Delay)
+	if m.Error != nil {
+		return nil, m.Error
+	}
+	return m.PaymentMethods, nil
 }
 
-func (m *MockPaymentProcessor) NewPaymentIntent(customerId, paymentMethodId, alias, description string, quantity, amount int64) (string, error) {
-	return "", nil
+func (m *MockPaymentProcessor) DetachPaymentMethod(customerId, paymentMethodId string) error {
+	m.Detached = paymentMethodId
+	return nil
+}
+
+func (m *MockPaymentProcessor) SetDefaultPaymentMethod(customerId, paymentMethodId string) error {
+	m.Default = paymentMethodId
+	return nil
+}
+
+func (m *MockPaymentProcessor) NewPaymentIntent(customerId, paymentMethodId, alias, productId, description, currency string, quantity, amount int64) (*main.PaymentIntent, error) {
+	m.Amount = amount
+	return m.PaymentIntent, nil
 }
 
-func (m *MockPaymentProcessor) GetProducts(productIds []string) (map[string]*main.Product, error) {
-	return nil, nil
+func (m *MockPaymentProcessor) GetPaymentIntent(paymentIntentId string) (*main.PaymentIntent, error) {
+	return m.PaymentIntent, nil
 }
@@ -0,0 +1,197 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	PROMO_DISCOUNT = "discount"
+	PROMO_GRANT    = "grant"
+
+	PROMO_EXPIRY_FORMAT = "2006-01-02"
+
+	ERROR_DUPLICATE_PROMO_CODE = "Duplicate promo code: %s"
+	ERROR_INVALID_PROMO_CODE   = "Invalid promo code %s: %s"
+	ERROR_NO_SUCH_PROMO_CODE   = "No such promo code: %s"
+	ERROR_PROMO_CODE_EXHAUSTED = "Promo code has been used up: %s"
+	ERROR_PROMO_CODE_EXPIRED   = "Promo code has expired: %s"
+	ERROR_PROMO_CODE_REDEEMED  = "Promo code already redeemed: %s"
+	ERROR_PROMO_USAGE          = "Usage: promo [add discount CODE PERCENT [LIMIT [EXPIRY]] | add grant CODE QUANTITY [LIMIT [EXPIRY]] | remove CODE]"
+)
+
+// PromoCode is either a discount off the price of a token bundle, or a grant of free tokens.
+// Each alias can redeem a code once, and a code can be redeemed at most Limit times before Expiry, a zero Limit or Expiry means no limit.
+type PromoCode struct {
+	Code     string
+	Type     string
+	Percent  uint64 // Discount off the bundle price
+	Quantity uint64 // Tokens granted
+	Limit    uint64
+	Expiry   time.Time
+	Redeemed map[string]time.Time // Alias -> Redemption Time
+}
+
+// NormalizePromoCode returns the given code in the form it is stored, so codes can be entered in any case.
+func NormalizePromoCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+func (p *PromoCode) Validate() error {
+	if p.Code == "" || p.Code != NormalizePromoCode(p.Code) {
+		return errors.New(fmt.Sprintf(ERROR_INVALID_PROMO_CODE, p.Code, "code must be upper case"))
+	}
+	switch p.Type {
+	case PROMO_DISCOUNT:
+		// A full discount would need a zero amount payment
+		if p.Percent == 0 || p.Percent >= 100 {
+			return errors.New(fmt.Sprintf(ERROR_INVALID_PROMO_CODE, p.Code, "percent must be between 1 and 99"))
+		}
+	case PROMO_GRANT:
+		if p.Quantity == 0 {
+			return errors.New(fmt.Sprintf(ERROR_INVALID_PROMO_CODE, p.Code, "zero quantity"))
+		}
+	default:
+		return errors.New(fmt.Sprintf(ERROR_INVALID_PROMO_CODE, p.Code, "unrecognized type "+p.Type))
+	}
+	return nil
+}
+
+// Check returns an error if the given alias cannot redeem the code at the given time.
+func (p *PromoCode) Check(alias string, now time.Time) error {
+	if !p.Expiry.IsZero() && !now.Before(p.Expiry) {
+		return errors.New(fmt.Sprintf(ERROR_PROMO_CODE_EXPIRED, p.Code))
+	}
+	if _, ok := p.Redeemed[alias]; ok {
+		return errors.New(fmt.Sprintf(ERROR_PROMO_CODE_REDEEMED, p.Code))
+	}
+	if p.Limit > 0 && uint64(len(p.Redeemed)) >= p.Limit {
+		return errors.New(fmt.Sprintf(ERROR_PROMO_CODE_EXHAUSTED, p.Code))
+	}
+	return nil
+}
+
+// Discount returns the given amount after the code's discount, rounded up to the smallest unit of currency.
+func (p *PromoCode) Discount(amount int64) int64 {
+	if p.Type != PROMO_DISCOUNT {
+		return amount
+	}
+	remaining := 100 - int64(p.Percent)
+	return (amount*remaining + 99) / 100
+}
+
+func (p *PromoCode) String() string {
+	var s string
+	switch p.Type {
+	case PROMO_DISCOUNT:
+		s = fmt.Sprintf("%s %d%% off", p.Code, p.Percent)
+	case PROMO_GRANT:
+		s = fmt.Sprintf("%s %d free tokens", p.Code, p.Quantity)
+	default:
+		s = p.Code
+	}
+	if p.Limit > 0 {
+		s += fmt.Sprintf(", redeemed %d of %d", len(p.Redeemed), p.Limit)
+	} else {
+		s += fmt.Sprintf(", redeemed %d", len(p.Redeemed))
+	}
+	if !p.Expiry.IsZero() {
+		s += ", expires " + p.Expiry.Format(PROMO_EXPIRY_FORMAT)
+	}
+	return s
+}
+
+type PromoStore interface {
+	AddPromoCode(code *PromoCode) error
+	GetPromoCode(code string) (*PromoCode, error)
+	GetPromoCodes() ([]*PromoCode, error)
+	RemovePromoCode(code string) error
+	// Redeem checks the given alias can redeem the code at the given time and records the redemption.
+	// The check and the record happen together so concurrent purchases can't redeem a code beyond its limit.
+	Redeem(code, alias string, now time.Time) (*PromoCode, error)
+	// Release removes the given alias's redemption of the code, so a code reserved for a failed purchase can be used again.
+	Release(code, alias string) error
+}
+
+// HandlePromo manages promo codes from the command line.
+func HandlePromo(promos PromoStore, args []string, output io.Writer) error {
+	if len(args) == 0 {
+		codes, err := promos.GetPromoCodes()
+		if err != nil {
+			return err
+		}
+		for _, c := range codes {
+			fmt.Fprintln(output, c)
+		}
+		return nil
+	}
+	switch args[0] {
+	case "add":
+		if len(args) < 4 || len(args) > 6 {
+			return errors.New(ERROR_PROMO_USAGE)
+		}
+		code := &PromoCode{
+			Code: NormalizePromoCode(args[2]),
+			Type: args[1],
+		}
+		value, err := strconv.ParseUint(args[3], 10, 64)
+		if err != nil {
+			return err
+		}
+		switch code.Type {
+		case PROMO_DISCOUNT:
+			code.Percent = value
+		case PROMO_GRANT:
+			code.Quantity = value
+		}
+		if len(args) > 4 {
+			code.Limit, err = strconv.ParseUint(args[4], 10, 64)
+			if err != nil {
+				return err
+			}
+		}
+		if len(args) > 5 {
+			code.Expiry, err = time.Parse(PROMO_EXPIRY_FORMAT, args[5])
+			if err != nil {
+				return err
+			}
+		}
+		if err := promos.AddPromoCode(code); err != nil {
+			return err
+		}
+		fmt.Fprintln(output, "Added", code)
+		return nil
+	case "remove":
+		if len(args) != 2 {
+			return errors.New(ERROR_PROMO_USAGE)
+		}
+		code := NormalizePromoCode(args[1])
+		if err := promos.RemovePromoCode(code); err != nil {
+			return err
+		}
+		fmt.Fprintln(output, "Removed", code)
+		return nil
+	default:
+		return errors.New(ERROR_PROMO_USAGE)
+	}
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main_test
+
+import (
+	"bytes"
+	"github.com/AletheiaWareLLC/conveyservergo"
+	"github.com/AletheiaWareLLC/testinggo"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestPromoCode_Validate(t *testing.T) {
+	for name, tt := range map[string]struct {
+		code          *main.PromoCode
+		expectedError string
+	}{
+		"Discount":         {&main.PromoCode{Code: "SAVE20", Type: main.PROMO_DISCOUNT, Percent: 20}, ""},
+		"Grant":            {&main.PromoCode{Code: "FREE", Type: main.PROMO_GRANT, Quantity: 100}, ""},
+		"LowerCase":        {&main.PromoCode{Code: "save20", Type: main.PROMO_DISCOUNT, Percent: 20}, "Invalid promo code save20: code must be upper case"},
+		"ZeroPercent":      {&main.PromoCode{Code: "SAVE0", Type: main.PROMO_DISCOUNT}, "Invalid promo code SAVE0: percent must be between 1 and 99"},
+		"FullDiscount":     {&main.PromoCode{Code: "SAVE100", Type: main.PROMO_DISCOUNT, Percent: 100}, "Invalid promo code SAVE100: percent must be between 1 and 99"},
+		"ZeroQuantity":     {&main.PromoCode{Code: "FREE", Type: main.PROMO_GRANT}, "Invalid promo code FREE: zero quantity"},
+		"UnrecognizedType": {&main.PromoCode{Code: "FOO", Type: "foo"}, "Invalid promo code FOO: unrecognized type foo"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := tt.code.Validate()
+			if tt.expectedError == "" {
+				testinggo.AssertNoError(t, err)
+			} else {
+				testinggo.AssertError(t, tt.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestPromoCode_Check(t *testing.T) {
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	for name, tt := range map[string]struct {
+		code          *main.PromoCode
+		expectedError string
+	}{
+		"Unlimited":  {&main.PromoCode{Code: "FREE"}, ""},
+		"Expired":    {&main.PromoCode{Code: "FREE", Expiry: now}, "Promo code has expired: FREE"},
+		"NotExpired": {&main.PromoCode{Code: "FREE", Expiry: now.AddDate(0, 0, 1)}, ""},
+		"Redeemed": {&main.PromoCode{Code: "FREE", Redeemed: map[string]time.Time{
+			"Alice": now,
+		}}, "Promo code already redeemed: FREE"},
+		"Exhausted": {&main.PromoCode{Code: "FREE", Limit: 1, Redeemed: map[string]time.Time{
+			"Bob": now,
+		}}, "Promo code has been used up: FREE"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := tt.code.Check("Alice", now)
+			if tt.expectedError == "" {
+				testinggo.AssertNoError(t, err)
+			} else {
+				testinggo.AssertError(t, tt.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestPromoCode_Discount(t *testing.T) {
+	for name, tt := range map[string]struct {
+		code     *main.PromoCode
+		amount   int64
+		expected int64
+	}{
+		"Discount": {&main.PromoCode{Type: main.PROMO_DISCOUNT, Percent: 20}, 1000, 800},
+		"RoundUp":  {&main.PromoCode{Type: main.PROMO_DISCOUNT, Percent: 20}, 99, 80},
+		"Grant":    {&main.PromoCode{Type: main.PROMO_GRANT, Quantity: 100}, 1000, 1000},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if a := tt.code.Discount(tt.amount); a != tt.expected {
+				t.Errorf("Wrong amount; expected '%d', got '%d'", tt.expected, a)
+			}
+		})
+	}
+}
+
+func TestHandlePromo(t *testing.T) {
+	dir := testinggo.MakeTempDir(t, "promo")
+	defer testinggo.UnmakeTempDir(t, dir)
+	promos := main.NewFilePromoStore(path.Join(dir, "promo-codes.json"))
+	for _, tt := range []struct {
+		name          string
+		args          []string
+		expectedError string
+		expected      string
+	}{
+		{"AddDiscount", []string{"add", "discount", "save20", "20", "100", "2020-12-31"}, "", "Added SAVE20 20% off, redeemed 0 of 100, expires 2020-12-31\n"},
+		{"AddGrant", []string{"add", "grant", "FREE", "50"}, "", "Added FREE 50 free tokens, redeemed 0\n"},
+		{"AddMissing", []string{"add", "grant", "FREE"}, main.ERROR_PROMO_USAGE, ""},
+		{"AddInvalidType", []string{"add", "foo", "FOO", "1"}, "Invalid promo code FOO: unrecognized type foo", ""},
+		{"List", nil, "", "FREE 50 free tokens, redeemed 0\nSAVE20 20% off, redeemed 0 of 100, expires 2020-12-31\n"},
+		{"Remove", []string{"remove", "free"}, "", "Removed FREE\n"},
+		{"RemoveMissing", []string{"remove", "FREE"}, "No such promo code: FREE", ""},
+		{"Unrecognized", []string{"foo"}, main.ERROR_PROMO_USAGE, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			output := &bytes.Buffer{}
+			err := main.HandlePromo(promos, tt.args, output)
+			if tt.expectedError == "" {
+				testinggo.AssertNoError(t, err)
+			} else {
+				testinggo.AssertError(t, tt.expectedError, err)
+			}
+			if o := output.String(); o != tt.expected {
+				t.Errorf("Wrong output; expected '%s', got '%s'", tt.expected, o)
+			}
+		})
+	}
+}
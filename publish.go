@@ -18,13 +18,16 @@ package main
 
 import (
 	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/AletheiaWareLLC/bcgo"
 	"github.com/AletheiaWareLLC/conveygo"
 	"html/template"
 	"log"
 	"net/http"
 )
 
-func PublishHandler(sessions SessionStore, messages conveygo.MessageStore, ledger *conveygo.Ledger, template *template.Template) func(w http.ResponseWriter, r *http.Request) {
+func PublishHandler(sessions SessionStore, messages conveygo.MessageStore, clawbacks *Clawbacks, miner *ChannelMiner, queue *MiningQueue, template *template.Template) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		log.Println(r.RemoteAddr, r.Proto, r.Method, r.Host, r.URL.Path, r.Header)
 		// If not signed in, redirect to sign in page
@@ -45,7 +48,7 @@ func PublishHandler(sessions SessionStore, messages conveygo.MessageStore, ledge
 				switch r.Method {
 				case "POST":
 					// Ensure user has sufficient balance to post
-					balance := ledger.GetBalance(session.Alias)
+					balance := clawbacks.Balance(session.Alias)
 					cost := draft.MessageCost
 					if draft.Conversation != nil {
 						cost += draft.ConversationCost
@@ -54,23 +57,19 @@ func PublishHandler(sessions SessionStore, messages conveygo.MessageStore, ledge
 						http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 						return
 					}
-
-					var err error
+					conversation := base64.RawURLEncoding.EncodeToString(draft.ConversationHash)
+					description := "Reply to conversation"
 					if draft.Conversation != nil {
-						// Start new Conversation
-						err = messages.NewConversation(draft.ConversationHash, draft.ConversationRecord, draft.MessageHash, draft.MessageRecord)
-					} else {
-						// Add Message to existing Conversation
-						err = messages.AddMessage(draft.ConversationHash, draft.MessageHash, draft.MessageRecord)
+						description = "Start conversation: " + draft.Conversation.Topic
 					}
+					job, err := queue.Enqueue(session.Alias, description, "/conversation?hash="+conversation, publishJob(messages, clawbacks, miner, session, draft))
 					if err != nil {
 						log.Println(err)
 						http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
-					} else {
-						session.DraftContribution = nil
-						RedirectConversation(w, r, base64.RawURLEncoding.EncodeToString(draft.ConversationHash))
+						return
 					}
-					ledger.TriggerUpdate()
+					session.DraftContribution = nil
+					RedirectJob(w, r, job.ID)
 					return
 				default:
 					log.Println("Unsupported method", r.Method)
@@ -81,3 +80,79 @@ func PublishHandler(sessions SessionStore, messages conveygo.MessageStore, ledge
 		RedirectSignIn(w, r)
 	}
 }
+
+// publishJob returns any reclaimed tokens, then mines the draft into its conversation.
+func publishJob(messages conveygo.MessageStore, clawbacks *Clawbacks, miner *ChannelMiner, session *SignInSession, draft *DraftContributionSession) JobFunc {
+	alias, key := session.Alias, session.Key
+	return func(node *bcgo.Node) ([]*bcgo.Channel, []string, error) {
+		var channels []*bcgo.Channel
+		if clawbacks.Outstanding(alias) > 0 {
+			if err := clawbacks.Settle(node, alias, key); err != nil {
+				return nil, nil, err
+			}
+			channels = append(channels, clawbacks.Transactions)
+		}
+		var err error
+		if s, ok := messages.(*conveygo.BCStore); ok {
+			// Mine with the queue's node, which leaves pushing to the queue
+			err = publishDraft(node, miner, s.Listener, draft)
+		} else if draft.Conversation != nil {
+			// Start new Conversation
+			err = messages.NewConversation(draft.ConversationHash, draft.ConversationRecord, draft.MessageHash, draft.MessageRecord)
+		} else {
+			// Add Message to existing Conversation
+			err = messages.AddMessage(draft.ConversationHash, draft.MessageHash, draft.MessageRecord)
+		}
+		clawbacks.Ledger.TriggerUpdate()
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, name := range []string{
+			conveygo.CONVEY_CONVERSATION,
+			conveygo.CONVEY_PREFIX_MESSAGE + base64.RawURLEncoding.EncodeToString(draft.ConversationHash),
+		} {
+			if c, err := node.GetChannel(name); err == nil {
+				channels = append(channels, c)
+			}
+		}
+		return channels, nil, nil
+	}
+}
+
+// publishDraft mines the draft's records as BCStore would, but through the channel miner so concurrent replies to a conversation don't race.
+func publishDraft(node *bcgo.Node, miner *ChannelMiner, listener bcgo.MiningListener, draft *DraftContributionSession) error {
+	conversation := base64.RawURLEncoding.EncodeToString(draft.ConversationHash)
+	name := conveygo.CONVEY_PREFIX_MESSAGE + conversation
+	var messages *bcgo.Channel
+	if draft.Conversation != nil {
+		// Start new Conversation
+		conversations, err := node.GetChannel(conveygo.CONVEY_CONVERSATION)
+		if err != nil {
+			return err
+		}
+		if _, err := miner.Mine(node, listener, conversations, []*bcgo.BlockEntry{
+			{
+				RecordHash: draft.ConversationHash,
+				Record:     draft.ConversationRecord,
+			},
+		}); err != nil {
+			return err
+		}
+		messages = bcgo.OpenPoWChannel(name, bcgo.THRESHOLD_G)
+		node.AddChannel(messages)
+	} else {
+		// Add Message to existing Conversation
+		var err error
+		messages, err = node.GetChannel(name)
+		if err != nil {
+			return errors.New(fmt.Sprintf(conveygo.ERROR_NO_SUCH_CONVERSATION, conversation))
+		}
+	}
+	_, err := miner.Mine(node, listener, messages, []*bcgo.BlockEntry{
+		{
+			RecordHash: draft.MessageHash,
+			Record:     draft.MessageRecord,
+		},
+	})
+	return err
+}
@@ -0,0 +1,231 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"github.com/AletheiaWareLLC/bcgo"
+	"github.com/AletheiaWareLLC/financego"
+	"github.com/golang/protobuf/proto"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	ERROR_NO_SUCH_PURCHASE = "No such purchase: %s"
+)
+
+// Purchase is a charge made by a customer, along with any amount since refunded.
+type Purchase struct {
+	ChargeId    string
+	Timestamp   uint64
+	Merchant    string
+	Customer    string
+	Amount      int64
+	Refunded    int64
+	Currency    string
+	Quantity    int64
+	Description string
+}
+
+// GetPurchases returns the charges made by the given customer, newest first, by decrypting the charge channel with the customer's key.
+func GetPurchases(node *bcgo.Node, charges *bcgo.Channel, alias string, key *rsa.PrivateKey) ([]*Purchase, error) {
+	purchases := make(map[string]*Purchase)
+	refunds := make(map[string]int64)
+	if err := bcgo.Read(charges.Name, charges.Head, nil, node.Cache, node.Network, alias, key, nil, func(entry *bcgo.BlockEntry, key, payload []byte) error {
+		meta := entry.Record.Meta
+		if _, ok := meta[META_STRIPE_EVENT]; ok {
+			// Recorded events are not purchases
+			return nil
+		}
+		charge := &financego.Charge{}
+		if err := proto.Unmarshal(payload, charge); err != nil {
+			return err
+		}
+		if charge.CustomerAlias != alias {
+			return nil
+		}
+		if _, ok := meta[META_REVERSED_TOKENS]; ok {
+			if charge.Description == "charge.refunded" {
+				// Refunds are recorded as negative amounts
+				refunds[charge.ChargeId] -= charge.Amount
+			}
+			return nil
+		}
+		purchase := &Purchase{
+			ChargeId:    charge.ChargeId,
+			Timestamp:   entry.Record.Timestamp,
+			Merchant:    charge.MerchantAlias,
+			Customer:    charge.CustomerAlias,
+			Amount:      charge.Amount,
+			Currency:    charge.Currency,
+			Description: charge.Description,
+		}
+		if quantity, ok := meta[META_QUANTITY_TOKENS]; ok {
+			q, err := strconv.ParseInt(quantity, 10, 64)
+			if err != nil {
+				return err
+			}
+			purchase.Quantity = q
+		}
+		purchases[charge.ChargeId] = purchase
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	var results []*Purchase
+	for id, p := range purchases {
+		p.Refunded = refunds[id]
+		results = append(results, p)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Timestamp > results[j].Timestamp
+	})
+	return results, nil
+}
+
+type PurchaseTemplate struct {
+	ChargeId    string
+	Timestamp   string
+	Merchant    string
+	Customer    string
+	Amount      string
+	Refunded    string
+	Currency    string
+	Quantity    int64
+	Description string
+}
+
+func NewPurchaseTemplate(p *Purchase) *PurchaseTemplate {
+	t := &PurchaseTemplate{
+		ChargeId:    p.ChargeId,
+		Timestamp:   bcgo.TimestampToString(p.Timestamp),
+		Merchant:    p.Merchant,
+		Customer:    p.Customer,
+		Amount:      AmountToString(p.Currency, p.Amount),
+		Currency:    strings.ToUpper(p.Currency),
+		Quantity:    p.Quantity,
+		Description: p.Description,
+	}
+	if p.Refunded > 0 {
+		t.Refunded = AmountToString(p.Currency, p.Refunded)
+	}
+	return t
+}
+
+type PurchasesTemplate struct {
+	Alias    string
+	Purchase []*PurchaseTemplate
+}
+
+func PurchasesHandler(sessions SessionStore, node *bcgo.Node, charges *bcgo.Channel, template *template.Template) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println(r.RemoteAddr, r.Proto, r.Method, r.Host, r.URL.Path, r.Header)
+		// If not signed in, redirect to sign in page
+		cookie, err := GetSignInSessionCookie(r)
+		if err == nil {
+			session := sessions.GetSignInSession(cookie.Value)
+			if session != nil {
+				id, err := sessions.RefreshSignInSession(session)
+				if err == nil {
+					http.SetCookie(w, CreateSignInSessionCookie(id, sessions.GetSignInSessionTimeout()))
+				}
+				switch r.Method {
+				case "GET":
+					purchases, err := GetPurchases(node, charges, session.Alias, session.Key)
+					if err != nil {
+						log.Println(err)
+						http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+						return
+					}
+					data := &PurchasesTemplate{
+						Alias: session.Alias,
+					}
+					for _, p := range purchases {
+						data.Purchase = append(data.Purchase, NewPurchaseTemplate(p))
+					}
+					if err := template.Execute(w, data); err != nil {
+						log.Println(err)
+						http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+						return
+					}
+					return
+				default:
+					log.Println("Unsupported method", r.Method)
+				}
+			}
+		}
+		RedirectSignIn(w, r)
+	}
+}
+
+// ReceiptHandler shows a printable receipt for the charge given in the request, which is downloaded as an attachment when requested.
+func ReceiptHandler(sessions SessionStore, node *bcgo.Node, charges *bcgo.Channel, template *template.Template) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println(r.RemoteAddr, r.Proto, r.Method, r.Host, r.URL.Path, r.Header)
+		// If not signed in, redirect to sign in page
+		cookie, err := GetSignInSessionCookie(r)
+		if err == nil {
+			session := sessions.GetSignInSession(cookie.Value)
+			if session != nil {
+				id, err := sessions.RefreshSignInSession(session)
+				if err == nil {
+					http.SetCookie(w, CreateSignInSessionCookie(id, sessions.GetSignInSessionTimeout()))
+				}
+				switch r.Method {
+				case "GET":
+					chargeId := r.FormValue("charge")
+					purchases, err := GetPurchases(node, charges, session.Alias, session.Key)
+					if err != nil {
+						log.Println(err)
+						http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+						return
+					}
+					var purchase *Purchase
+					for _, p := range purchases {
+						if p.ChargeId == chargeId {
+							purchase = p
+							break
+						}
+					}
+					if purchase == nil {
+						log.Println(fmt.Sprintf(ERROR_NO_SUCH_PURCHASE, chargeId))
+						http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+						return
+					}
+					if r.FormValue("download") != "" {
+						w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"receipt-%s.html\"", chargeId))
+					}
+					if err := template.Execute(w, NewPurchaseTemplate(purchase)); err != nil {
+						log.Println(err)
+						http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+						return
+					}
+					return
+				default:
+					log.Println("Unsupported method", r.Method)
+				}
+			}
+		}
+		RedirectSignIn(w, r)
+	}
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main_test
+
+import (
+	"github.com/AletheiaWareLLC/conveygo"
+	"github.com/AletheiaWareLLC/conveyservergo"
+	"github.com/AletheiaWareLLC/testinggo"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func makeReceiptTemplate(t *testing.T) *template.Template {
+	t.Helper()
+	tmplt, err := template.New("").Parse(`{{ .ChargeId }} {{ .Amount }} {{ .Refunded }} {{ .Quantity }}`)
+	testinggo.AssertNoError(t, err)
+	return tmplt
+}
+
+func TestGetPurchases(t *testing.T) {
+	merchantKey := makeKey(t)
+	aliceKey := makeKey(t)
+	bobKey := makeKey(t)
+	node := makeNode(t, "Merchant", merchantKey)
+	clawbacks := makeClawbacks(t, conveygo.NewLedger(node))
+	makeAlias(t, node, clawbacks.Aliases, "Alice", aliceKey)
+	makeAlias(t, node, clawbacks.Aliases, "Bob", bobKey)
+	makeCharge(t, clawbacks, "Alice", "ch_1", 100, 100, aliceKey)
+	makeCharge(t, clawbacks, "Bob", "ch_2", 200, 200, bobKey)
+	makeCharge(t, clawbacks, "Alice", "ch_3", 300, 300, aliceKey)
+	testinggo.AssertNoError(t, clawbacks.Reverse(clawbacks.Node, "ch_1", "charge.refunded", -25, main.ReclaimQuantity(100, 100, 25)))
+
+	purchases, err := main.GetPurchases(node, clawbacks.Charges, "Alice", aliceKey)
+	testinggo.AssertNoError(t, err)
+	if len(purchases) != 2 {
+		t.Fatalf("Wrong number of purchases; expected '%d', got '%d'", 2, len(purchases))
+	}
+	// Newest first
+	for i, tt := range []struct {
+		chargeId string
+		amount   int64
+		refunded int64
+		quantity int64
+	}{
+		{"ch_3", 300, 0, 300},
+		{"ch_1", 100, 25, 100},
+	} {
+		p := purchases[i]
+		if p.ChargeId != tt.chargeId {
+			t.Errorf("Wrong charge; expected '%s', got '%s'", tt.chargeId, p.ChargeId)
+		}
+		if p.Amount != tt.amount {
+			t.Errorf("Wrong amount; expected '%d', got '%d'", tt.amount, p.Amount)
+		}
+		if p.Refunded != tt.refunded {
+			t.Errorf("Wrong refunded; expected '%d', got '%d'", tt.refunded, p.Refunded)
+		}
+		if p.Quantity != tt.quantity {
+			t.Errorf("Wrong quantity; expected '%d', got '%d'", tt.quantity, p.Quantity)
+		}
+	}
+}
+
+func TestReceiptHandler(t *testing.T) {
+	merchantKey := makeKey(t)
+	aliceKey := makeKey(t)
+	bobKey := makeKey(t)
+	node := makeNode(t, "Merchant", merchantKey)
+	clawbacks := makeClawbacks(t, conveygo.NewLedger(node))
+	makeAlias(t, node, clawbacks.Aliases, "Alice", aliceKey)
+	makeAlias(t, node, clawbacks.Aliases, "Bob", bobKey)
+	makeCharge(t, clawbacks, "Alice", "ch_1", 100, 100, aliceKey)
+	makeCharge(t, clawbacks, "Bob", "ch_2", 200, 200, bobKey)
+	for name, tt := range map[string]struct {
+		query               string
+		expectedCode        int
+		expectedBody        string
+		expectedDisposition string
+	}{
+		"Receipt":      {"charge=ch_1", http.StatusOK, "ch_1 1.00 USD  100", ""},
+		"Download":     {"charge=ch_1&download=true", http.StatusOK, "ch_1 1.00 USD  100", `attachment; filename="receipt-ch_1.html"`},
+		"OtherAlias":   {"charge=ch_2", http.StatusNotFound, "", ""},
+		"NoSuchCharge": {"charge=ch_3", http.StatusNotFound, "", ""},
+	} {
+		t.Run(name, func(t *testing.T) {
+			sessionstore := main.NewMemorySessionStore()
+			session, err := sessionstore.CreateSignInSession("Alice", aliceKey)
+			testinggo.AssertNoError(t, err)
+
+			request, err := http.NewRequest("GET", "/account/receipt?"+tt.query, nil)
+			testinggo.AssertNoError(t, err)
+			request.AddCookie(main.CreateSignInSessionCookie(session, time.Hour))
+			response := httptest.NewRecorder()
+
+			handler := main.ReceiptHandler(sessionstore, node, clawbacks.Charges, makeReceiptTemplate(t))
+			handler(response, request)
+
+			if response.Code != tt.expectedCode {
+				t.Errorf("Wrong response code; expected '%d', got '%d'", tt.expectedCode, response.Code)
+			}
+			if tt.expectedBody != "" {
+				if actual := response.Body.String(); actual != tt.expectedBody {
+					t.Errorf("Wrong response; expected '%s', got '%s'", tt.expectedBody, actual)
+				}
+			}
+			if d := response.Header().Get("Content-Disposition"); d != tt.expectedDisposition {
+				t.Errorf("Wrong disposition; expected '%s', got '%s'", tt.expectedDisposition, d)
+			}
+		})
+	}
+}
@@ -41,10 +41,18 @@ func RedirectHome(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
+func RedirectJob(w http.ResponseWriter, r *http.Request, job string) {
+	http.Redirect(w, r, "/job?id="+job, http.StatusFound)
+}
+
 func RedirectPreview(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/preview", http.StatusFound)
 }
 
+func RedirectScheduledTransfers(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, "/account/scheduled-transfers", http.StatusFound)
+}
+
 func RedirectSignIn(w http.ResponseWriter, r *http.Request) {
 	// TODO(v2) add a redirect parameter to send users to after they successfully sign in
 	http.Redirect(w, r, "/sign-in", http.StatusFound)
@@ -63,10 +71,26 @@ func RedirectTokenPurchase(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/token-purchase", http.StatusFound)
 }
 
+func RedirectTokenPurchaseConfirmation(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, "/token-purchase-confirmation", http.StatusFound)
+}
+
 func RedirectTokenTransfer(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/token-transfer", http.StatusFound)
 }
 
+func RedirectTokenTransferConfirmation(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, "/token-transfer-confirmation", http.StatusFound)
+}
+
+func RedirectTokenTransferBulk(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, "/token-transfer-bulk", http.StatusFound)
+}
+
+func RedirectTokenTransferBulkConfirmation(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, "/token-transfer-bulk-confirmation", http.StatusFound)
+}
+
 func RedirectPurchased(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/purchased.html", http.StatusFound)
 }
@@ -0,0 +1,278 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/AletheiaWareLLC/conveygo"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	ERROR_INVALID_RESERVE_THRESHOLDS = "Invalid reserve thresholds: critical %d is above low %d"
+
+	RESERVE_OK       = "ok"
+	RESERVE_LOW      = "low"
+	RESERVE_CRITICAL = "critical"
+
+	RESERVE_BURN_WINDOW = 24 * time.Hour // Burn rate is measured over the last day
+)
+
+// ReserveThresholds are the merchant reserve levels, in tokens, below which operators are alerted.
+// A threshold of zero is not monitored.
+type ReserveThresholds struct {
+	Low      uint64
+	Critical uint64
+}
+
+func ParseReserveThresholds(low, critical string) (*ReserveThresholds, error) {
+	thresholds := &ReserveThresholds{}
+	if low != "" {
+		l, err := strconv.ParseUint(low, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		thresholds.Low = l
+	}
+	if critical != "" {
+		c, err := strconv.ParseUint(critical, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		thresholds.Critical = c
+	}
+	if thresholds.Low != 0 && thresholds.Critical > thresholds.Low {
+		return nil, errors.New(fmt.Sprintf(ERROR_INVALID_RESERVE_THRESHOLDS, thresholds.Critical, thresholds.Low))
+	}
+	return thresholds, nil
+}
+
+// Level returns the alert level of the given reserve.
+func (t *ReserveThresholds) Level(reserve int64) string {
+	if t.Critical != 0 && reserve < int64(t.Critical) {
+		return RESERVE_CRITICAL
+	}
+	if t.Low != 0 && reserve < int64(t.Low) {
+		return RESERVE_LOW
+	}
+	return RESERVE_OK
+}
+
+func reserveSeverity(level string) int {
+	switch level {
+	case RESERVE_LOW:
+		return 1
+	case RESERVE_CRITICAL:
+		return 2
+	}
+	return 0
+}
+
+// ReserveStatus is a snapshot of the merchant's token reserve.
+type ReserveStatus struct {
+	Alias      string
+	Reserve    int64
+	BurnRate   float64       // Tokens per day
+	Remaining  time.Duration // Until the reserve runs out at the current burn rate, zero if not burning
+	Level      string
+	Thresholds *ReserveThresholds
+	Time       time.Time
+}
+
+// ReserveAlerter notifies operators that the reserve has dropped to a lower level.
+type ReserveAlerter interface {
+	AlertReserve(status *ReserveStatus) error
+}
+
+type reserveSample struct {
+	Time    time.Time
+	Reserve int64
+}
+
+// ReserveMonitor runs the ledger's updates, and samples the reserve of the merchant's alias after each one to measure its burn rate.
+// Operators are alerted once each time the reserve drops to a lower level, and again if it recovers and drops again.
+type ReserveMonitor struct {
+	Ledger     *conveygo.Ledger
+	Alias      string
+	Thresholds *ReserveThresholds
+	Alerter    ReserveAlerter
+	samples    []*reserveSample
+	level      string
+	listeners  []func()
+	lock       sync.Mutex
+}
+
+func NewReserveMonitor(ledger *conveygo.Ledger, alias string, thresholds *ReserveThresholds, alerter ReserveAlerter) *ReserveMonitor {
+	return &ReserveMonitor{
+		Ledger:     ledger,
+		Alias:      alias,
+		Thresholds: thresholds,
+		Alerter:    alerter,
+		level:      RESERVE_OK,
+	}
+}
+
+func (m *ReserveMonitor) SetAlerter(alerter ReserveAlerter) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.Alerter = alerter
+}
+
+// AddUpdateListener adds a function to be called after each sample.
+func (m *ReserveMonitor) AddUpdateListener(listener func()) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.listeners = append(m.listeners, listener)
+}
+
+// Start updates the ledger in place of conveygo.Ledger.Start, and samples the reserve once each update has finished, until Stop is called.
+// Updates are triggered as before with Ledger.TriggerUpdate.
+func (m *ReserveMonitor) Start() {
+	trigger := make(chan bool)
+	m.Ledger.Trigger = trigger
+	for ok := true; ok; ok = <-trigger {
+		if err := m.Ledger.UpdateAll(); err != nil {
+			// Keep taking triggers, so callers of TriggerUpdate aren't blocked
+			log.Println(err)
+			continue
+		}
+		m.Sample(time.Now())
+		m.lock.Lock()
+		listeners := m.listeners
+		m.lock.Unlock()
+		for _, l := range listeners {
+			l()
+		}
+	}
+}
+
+func (m *ReserveMonitor) Stop() {
+	if m.Ledger.Trigger != nil {
+		m.Ledger.Stop()
+	}
+}
+
+// Sample records the current reserve, and alerts operators if it has dropped to a lower level.
+func (m *ReserveMonitor) Sample(now time.Time) *ReserveStatus {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.samples = append(m.samples, &reserveSample{
+		Time:    now,
+		Reserve: m.Ledger.GetBalance(m.Alias),
+	})
+	// Drop samples which have left the window, keeping one as the starting point
+	cutoff := now.Add(-RESERVE_BURN_WINDOW)
+	for len(m.samples) > 1 && !m.samples[1].Time.After(cutoff) {
+		m.samples = m.samples[1:]
+	}
+	status := m.status(now)
+	previous := m.level
+	m.level = status.Level
+	if reserveSeverity(status.Level) > reserveSeverity(previous) {
+		log.Println("Reserve", status.Level, status.Reserve)
+		if m.Alerter != nil {
+			if err := m.Alerter.AlertReserve(status); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+	return status
+}
+
+// GetStatus returns the reserve as of the last sample.
+func (m *ReserveMonitor) GetStatus() *ReserveStatus {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := time.Now()
+	if len(m.samples) > 0 {
+		now = m.samples[len(m.samples)-1].Time
+	}
+	return m.status(now)
+}
+
+func (m *ReserveMonitor) status(now time.Time) *ReserveStatus {
+	status := &ReserveStatus{
+		Alias:      m.Alias,
+		Thresholds: m.Thresholds,
+		Time:       now,
+	}
+	if len(m.samples) == 0 {
+		status.Reserve = m.Ledger.GetBalance(m.Alias)
+	} else {
+		status.Reserve = m.samples[len(m.samples)-1].Reserve
+		// Only count decreases, so replenishing the reserve doesn't hide the rate it is being used
+		var burned int64
+		for i := 1; i < len(m.samples); i++ {
+			if d := m.samples[i-1].Reserve - m.samples[i].Reserve; d > 0 {
+				burned += d
+			}
+		}
+		if elapsed := now.Sub(m.samples[0].Time); elapsed > 0 {
+			status.BurnRate = float64(burned) * float64(24*time.Hour) / float64(elapsed)
+		}
+	}
+	if status.BurnRate > 0 && status.Reserve > 0 {
+		status.Remaining = time.Duration(float64(status.Reserve) / status.BurnRate * float64(24*time.Hour)).Round(time.Minute)
+	}
+	status.Level = m.Thresholds.Level(status.Reserve)
+	return status
+}
+
+type ReserveTemplate struct {
+	Alias     string
+	Reserve   int64
+	BurnRate  string
+	Remaining string
+	Level     string
+	Low       uint64
+	Critical  uint64
+	Updated   string
+}
+
+func ReserveHandler(monitor *ReserveMonitor, template *template.Template) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println(r.RemoteAddr, r.Proto, r.Method, r.Host, r.URL.Path, r.Header)
+		switch r.Method {
+		case "GET":
+			status := monitor.GetStatus()
+			data := &ReserveTemplate{
+				Alias:    status.Alias,
+				Reserve:  status.Reserve,
+				BurnRate: fmt.Sprintf("%.0f", status.BurnRate),
+				Level:    status.Level,
+				Low:      status.Thresholds.Low,
+				Critical: status.Thresholds.Critical,
+				Updated:  status.Time.UTC().Format(time.RFC3339),
+			}
+			if status.Remaining > 0 {
+				data.Remaining = status.Remaining.String()
+			}
+			if err := template.Execute(w, data); err != nil {
+				log.Println(err)
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			}
+		default:
+			log.Println("Unsupported method", r.Method)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main_test
+
+import (
+	"errors"
+	"github.com/AletheiaWareLLC/bcgo"
+	"github.com/AletheiaWareLLC/conveygo"
+	"github.com/AletheiaWareLLC/conveyservergo"
+	"github.com/AletheiaWareLLC/testinggo"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type MockReserveAlerter struct {
+	Alerts []*main.ReserveStatus
+	Error  error
+}
+
+func (m *MockReserveAlerter) AlertReserve(status *main.ReserveStatus) error {
+	m.Alerts = append(m.Alerts, status)
+	return m.Error
+}
+
+func TestParseReserveThresholds(t *testing.T) {
+	for name, tt := range map[string]struct {
+		low, critical    string
+		expectedLow      uint64
+		expectedCritical uint64
+		expectedError    string
+	}{
+		"Empty":        {"", "", 0, 0, ""},
+		"Both":         {"1000", "100", 1000, 100, ""},
+		"CriticalOnly": {"", "100", 0, 100, ""},
+		"Inverted":     {"100", "1000", 0, 0, "Invalid reserve thresholds: critical 1000 is above low 100"},
+		"Invalid":      {"lots", "", 0, 0, `strconv.ParseUint: parsing "lots": invalid syntax`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			thresholds, err := main.ParseReserveThresholds(tt.low, tt.critical)
+			if tt.expectedError != "" {
+				testinggo.AssertError(t, tt.expectedError, err)
+				return
+			}
+			testinggo.AssertNoError(t, err)
+			if thresholds.Low != tt.expectedLow {
+				t.Errorf("Wrong low; expected '%d', got '%d'", tt.expectedLow, thresholds.Low)
+			}
+			if thresholds.Critical != tt.expectedCritical {
+				t.Errorf("Wrong critical; expected '%d', got '%d'", tt.expectedCritical, thresholds.Critical)
+			}
+		})
+	}
+}
+
+func TestReserveThresholds_Level(t *testing.T) {
+	thresholds := &main.ReserveThresholds{Low: 1000, Critical: 100}
+	for name, tt := range map[string]struct {
+		reserve  int64
+		expected string
+	}{
+		"OK":       {1000, main.RESERVE_OK},
+		"Low":      {999, main.RESERVE_LOW},
+		"Critical": {99, main.RESERVE_CRITICAL},
+		"Negative": {-1, main.RESERVE_CRITICAL},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if l := thresholds.Level(tt.reserve); l != tt.expected {
+				t.Errorf("Wrong level; expected '%s', got '%s'", tt.expected, l)
+			}
+		})
+	}
+	t.Run("Unmonitored", func(t *testing.T) {
+		if l := (&main.ReserveThresholds{}).Level(-1); l != main.RESERVE_OK {
+			t.Errorf("Wrong level; expected '%s', got '%s'", main.RESERVE_OK, l)
+		}
+	})
+}
+
+func TestReserveMonitor(t *testing.T) {
+	node := &bcgo.Node{Alias: "Merchant"}
+	ledger := conveygo.NewLedger(node)
+	alerter := &MockReserveAlerter{}
+	monitor := main.NewReserveMonitor(ledger, node.Alias, &main.ReserveThresholds{Low: 1000, Critical: 100}, alerter)
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	ledger.Earned[node.Alias] = 2000
+	monitor.Sample(now)
+
+	// Sells 600 tokens in 6 hours
+	ledger.Sold[node.Alias] = 600
+	status := monitor.Sample(now.Add(6 * time.Hour))
+	if status.Reserve != 1400 {
+		t.Errorf("Wrong reserve; expected '%d', got '%d'", 1400, status.Reserve)
+	}
+	if status.BurnRate != 2400 {
+		t.Errorf("Wrong burn rate; expected '%f', got '%f'", 2400.0, status.BurnRate)
+	}
+	if status.Remaining != 14*time.Hour {
+		t.Errorf("Wrong remaining; expected '%s', got '%s'", 14*time.Hour, status.Remaining)
+	}
+	if len(alerter.Alerts) != 0 {
+		t.Fatalf("Wrong number of alerts; expected '%d', got '%d'", 0, len(alerter.Alerts))
+	}
+
+	// Drops below low
+	ledger.Sold[node.Alias] = 1200
+	monitor.Sample(now.Add(12 * time.Hour))
+	if len(alerter.Alerts) != 1 {
+		t.Fatalf("Wrong number of alerts; expected '%d', got '%d'", 1, len(alerter.Alerts))
+	}
+	if l := alerter.Alerts[0].Level; l != main.RESERVE_LOW {
+		t.Errorf("Wrong level; expected '%s', got '%s'", main.RESERVE_LOW, l)
+	}
+
+	// Stays low, no further alert
+	ledger.Sold[node.Alias] = 1300
+	monitor.Sample(now.Add(13 * time.Hour))
+	if len(alerter.Alerts) != 1 {
+		t.Fatalf("Wrong number of alerts; expected '%d', got '%d'", 1, len(alerter.Alerts))
+	}
+
+	// Drops below critical
+	ledger.Sold[node.Alias] = 1950
+	monitor.Sample(now.Add(14 * time.Hour))
+	if len(alerter.Alerts) != 2 {
+		t.Fatalf("Wrong number of alerts; expected '%d', got '%d'", 2, len(alerter.Alerts))
+	}
+	if l := alerter.Alerts[1].Level; l != main.RESERVE_CRITICAL {
+		t.Errorf("Wrong level; expected '%s', got '%s'", main.RESERVE_CRITICAL, l)
+	}
+
+	// Replenished, replenishing doesn't reduce burn rate
+	ledger.Earned[node.Alias] = 12000
+	status = monitor.Sample(now.Add(16 * time.Hour))
+	if status.Level != main.RESERVE_OK {
+		t.Errorf("Wrong level; expected '%s', got '%s'", main.RESERVE_OK, status.Level)
+	}
+	if status.BurnRate != 2925 {
+		t.Errorf("Wrong burn rate; expected '%f', got '%f'", 2925.0, status.BurnRate)
+	}
+
+	// Drops below low again, alerts again
+	alerter.Error = errors.New("Unreachable")
+	ledger.Sold[node.Alias] = 11500
+	monitor.Sample(now.Add(18 * time.Hour))
+	if len(alerter.Alerts) != 3 {
+		t.Fatalf("Wrong number of alerts; expected '%d', got '%d'", 3, len(alerter.Alerts))
+	}
+
+	// Samples older than a day no longer count towards the burn rate
+	status = monitor.Sample(now.Add(48 * time.Hour))
+	if status.BurnRate != 0 {
+		t.Errorf("Wrong burn rate; expected '%f', got '%f'", 0.0, status.BurnRate)
+	}
+	if status.Remaining != 0 {
+		t.Errorf("Wrong remaining; expected '%s', got '%s'", time.Duration(0), status.Remaining)
+	}
+}
+
+func TestReserveMonitor_Trigger(t *testing.T) {
+	node := makeNode(t, "Merchant", makeKey(t))
+	hours := bcgo.OpenPoWChannel(conveygo.CONVEY_HOUR, bcgo.THRESHOLD_G)
+	node.AddChannel(hours)
+	ledger := conveygo.NewLedger(node)
+	monitor := main.NewReserveMonitor(ledger, node.Alias, &main.ReserveThresholds{}, nil)
+	sampled := make(chan bool, 1)
+	monitor.AddUpdateListener(func() {
+		sampled <- true
+	})
+	hours.AddTrigger(ledger.TriggerUpdate)
+
+	go monitor.Start()
+	// Sampled after the initial update
+	<-sampled
+	defer monitor.Stop()
+
+	_, err := main.MineRecord(node, main.NewChannelMiner(), nil, hours, node.Alias, node.Key, nil, nil, nil, &conveygo.Message{})
+	testinggo.AssertNoError(t, err)
+
+	select {
+	case <-sampled:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Reserve not sampled")
+	}
+	if status := monitor.GetStatus(); status.Reserve != conveygo.HOURLY_PVC_REWARD {
+		t.Errorf("Wrong reserve; expected '%d', got '%d'", conveygo.HOURLY_PVC_REWARD, status.Reserve)
+	}
+}
+
+func TestReserveHandler(t *testing.T) {
+	node := &bcgo.Node{Alias: "Merchant"}
+	ledger := conveygo.NewLedger(node)
+	ledger.Earned[node.Alias] = 500
+	monitor := main.NewReserveMonitor(ledger, node.Alias, &main.ReserveThresholds{Low: 1000}, nil)
+	monitor.Sample(time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC))
+	ledger.Sold[node.Alias] = 100
+	monitor.Sample(time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC))
+
+	tmplt, err := template.New("").Parse(`{{ .Alias }} {{ .Reserve }} {{ .BurnRate }} {{ .Remaining }} {{ .Level }} {{ .Low }} {{ .Critical }} {{ .Updated }}`)
+	testinggo.AssertNoError(t, err)
+
+	request, err := http.NewRequest("GET", "/reserve", nil)
+	testinggo.AssertNoError(t, err)
+	response := httptest.NewRecorder()
+
+	main.ReserveHandler(monitor, tmplt)(response, request)
+
+	expected := "Merchant 400 200 48h0m0s low 1000 0 2020-06-01T12:00:00Z"
+	if actual := response.Body.String(); actual != expected {
+		t.Errorf("Wrong response; expected '%s', got '%s'", expected, actual)
+	}
+}
@@ -0,0 +1,528 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/AletheiaWareLLC/aliasgo"
+	"github.com/AletheiaWareLLC/bcgo"
+	"github.com/AletheiaWareLLC/cryptogo"
+	"github.com/golang/protobuf/proto"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	SCHEDULE_ONCE    = "once"
+	SCHEDULE_DAILY   = "daily"
+	SCHEDULE_WEEKLY  = "weekly"
+	SCHEDULE_MONTHLY = "monthly"
+
+	SCHEDULED_PENDING   = "Pending"
+	SCHEDULED_MINING    = "Mining"
+	SCHEDULED_MINED     = "Mined"
+	SCHEDULED_SKIPPED   = "Skipped"
+	SCHEDULED_CANCELLED = "Cancelled"
+
+	SCHEDULE_TIME_FORMAT = "2006-01-02T15:04"
+
+	ERROR_INVALID_SCHEDULE           = "Invalid schedule: %s"
+	ERROR_INVALID_OCCURRENCES        = "Invalid number of occurrences: %d, maximum %d"
+	ERROR_SCHEDULE_IN_PAST           = "Scheduled time has passed: %s"
+	ERROR_NO_SUCH_SCHEDULED_TRANSFER = "No such scheduled transfer: %s"
+	ERROR_NO_SUCH_OCCURRENCE         = "No such occurrence of scheduled transfer %s: %d"
+	ERROR_OCCURRENCE_CHANGED         = "Scheduled occurrence has changed"
+
+	MAXIMUM_SCHEDULED_OCCURRENCES = 52
+	SCHEDULER_PERIOD              = time.Minute
+)
+
+// ScheduledOccurrence is a single execution of a scheduled transfer.
+// The transaction record is signed by the sender when the transfer is scheduled, so the scheduler can mine it without holding the sender's key.
+type ScheduledOccurrence struct {
+	Time   time.Time
+	Record []byte // Marshalled bcgo.Record signed by the sender
+	Status string
+	Error  string
+	Hash   string // Record Hash once mined
+}
+
+// ScheduledTransfer is a one-off future or recurring transfer of tokens from one alias to another.
+type ScheduledTransfer struct {
+	ID          string
+	Alias       string
+	Recipient   string
+	Amount      uint64
+	Schedule    string
+	Created     time.Time
+	Occurrences []*ScheduledOccurrence
+}
+
+// Next returns the earliest pending occurrence, or nil if there are none left.
+func (s *ScheduledTransfer) Next() *ScheduledOccurrence {
+	for _, o := range s.Occurrences {
+		if o.Status == SCHEDULED_PENDING {
+			return o
+		}
+	}
+	return nil
+}
+
+// Remaining returns the number of pending occurrences.
+func (s *ScheduledTransfer) Remaining() int {
+	count := 0
+	for _, o := range s.Occurrences {
+		if o.Status == SCHEDULED_PENDING {
+			count++
+		}
+	}
+	return count
+}
+
+// ScheduledTransfers holds the transfers waiting to be executed by the scheduler.
+type ScheduledTransfers interface {
+	Add(transfer *ScheduledTransfer) error
+	Get(id string) (*ScheduledTransfer, error)
+	// GetAll returns the transfers scheduled by the given alias, or by every alias if empty.
+	GetAll(alias string) ([]*ScheduledTransfer, error)
+	// UpdateOccurrence applies the given change to an occurrence of a transfer if the occurrence still has the given status.
+	// The status is checked and the change saved together, so the scheduler and a cancellation can't overwrite each other.
+	UpdateOccurrence(id string, index int, status string, change func(*ScheduledOccurrence)) error
+}
+
+// ScheduleTimes returns the time of each occurrence of the given schedule.
+func ScheduleTimes(start time.Time, schedule string, occurrences int) ([]time.Time, error) {
+	if schedule == SCHEDULE_ONCE {
+		occurrences = 1
+	}
+	if occurrences <= 0 || occurrences > MAXIMUM_SCHEDULED_OCCURRENCES {
+		return nil, errors.New(fmt.Sprintf(ERROR_INVALID_OCCURRENCES, occurrences, MAXIMUM_SCHEDULED_OCCURRENCES))
+	}
+	var times []time.Time
+	for i := 0; i < occurrences; i++ {
+		switch schedule {
+		case SCHEDULE_ONCE:
+			times = append(times, start)
+		case SCHEDULE_DAILY:
+			times = append(times, start.AddDate(0, 0, i))
+		case SCHEDULE_WEEKLY:
+			times = append(times, start.AddDate(0, 0, 7*i))
+		case SCHEDULE_MONTHLY:
+			times = append(times, start.AddDate(0, i, 0))
+		default:
+			return nil, errors.New(fmt.Sprintf(ERROR_INVALID_SCHEDULE, schedule))
+		}
+	}
+	return times, nil
+}
+
+// NewScheduledTransfer signs a transaction for every occurrence of the given schedule.
+func NewScheduledTransfer(now time.Time, alias string, key *rsa.PrivateKey, recipient string, amount uint64, schedule string, start time.Time, occurrences int) (*ScheduledTransfer, error) {
+	if start.Before(now) {
+		return nil, errors.New(fmt.Sprintf(ERROR_SCHEDULE_IN_PAST, start.Format(SCHEDULE_TIME_FORMAT)))
+	}
+	times, err := ScheduleTimes(start, schedule, occurrences)
+	if err != nil {
+		return nil, err
+	}
+	id, err := newLocalId("st")
+	if err != nil {
+		return nil, err
+	}
+	transfer := &ScheduledTransfer{
+		ID:        id,
+		Alias:     alias,
+		Recipient: recipient,
+		Amount:    amount,
+		Schedule:  schedule,
+		Created:   now,
+	}
+	for _, t := range times {
+		record, err := SignTransaction(uint64(t.UnixNano()), alias, key, recipient, amount, nil)
+		if err != nil {
+			return nil, err
+		}
+		data, err := proto.Marshal(record)
+		if err != nil {
+			return nil, err
+		}
+		transfer.Occurrences = append(transfer.Occurrences, &ScheduledOccurrence{
+			Time:   t,
+			Record: data,
+			Status: SCHEDULED_PENDING,
+		})
+	}
+	return transfer, nil
+}
+
+// CancelScheduledTransfer cancels the pending occurrences of the given alias' transfer, and discards their signed records.
+// Occurrences the scheduler is already mining are left to finish.
+func CancelScheduledTransfer(transfers ScheduledTransfers, alias, id string) error {
+	transfer, err := transfers.Get(id)
+	if err != nil {
+		return err
+	}
+	if transfer == nil || transfer.Alias != alias {
+		return errors.New(fmt.Sprintf(ERROR_NO_SUCH_SCHEDULED_TRANSFER, id))
+	}
+	for i, o := range transfer.Occurrences {
+		if o.Status != SCHEDULED_PENDING {
+			continue
+		}
+		if err := transfers.UpdateOccurrence(id, i, SCHEDULED_PENDING, func(o *ScheduledOccurrence) {
+			o.Status = SCHEDULED_CANCELLED
+			o.Record = nil
+		}); err != nil && err.Error() != ERROR_OCCURRENCE_CHANGED {
+			return err
+		}
+	}
+	return nil
+}
+
+// TransferScheduler periodically mines the scheduled transfers which have come due.
+type TransferScheduler struct {
+	Transfers    ScheduledTransfers
+	Clawbacks    *Clawbacks
+	Flags        FraudFlags
+	Node         *bcgo.Node
+	Miner        *ChannelMiner
+	Listener     bcgo.MiningListener
+	Transactions *bcgo.Channel
+	stop         chan bool
+}
+
+func NewTransferScheduler(transfers ScheduledTransfers, clawbacks *Clawbacks, flags FraudFlags, node *bcgo.Node, miner *ChannelMiner, listener bcgo.MiningListener, transactions *bcgo.Channel) *TransferScheduler {
+	return &TransferScheduler{
+		Transfers:    transfers,
+		Clawbacks:    clawbacks,
+		Flags:        flags,
+		Node:         node,
+		Miner:        miner,
+		Listener:     listener,
+		Transactions: transactions,
+		stop:         make(chan bool),
+	}
+}
+
+func (s *TransferScheduler) Start() {
+	ticker := time.NewTicker(SCHEDULER_PERIOD)
+	defer ticker.Stop()
+	// Wait a period before the first run so the ledger is up to date
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Run(time.Now()); err != nil {
+				log.Println(err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *TransferScheduler) Stop() {
+	close(s.stop)
+}
+
+// Run mines every pending occurrence due by the given time.
+// Occurrences are skipped, and not retried, if the sender is flagged or doesn't have enough tokens.
+// Each occurrence is marked as mining before its record is mined, so it is never mined twice, even if a cancellation or a failure happens part way through.
+func (s *TransferScheduler) Run(now time.Time) error {
+	transfers, err := s.Transfers.GetAll("")
+	if err != nil {
+		return err
+	}
+	// Tokens sent during this run, which the ledger may not have seen yet
+	sent := make(map[string]int64)
+	for _, transfer := range transfers {
+		for i, o := range transfer.Occurrences {
+			if o.Status == SCHEDULED_MINING {
+				// A previous run failed or stopped part way through mining
+				if err := s.resolve(transfer, i, o); err != nil {
+					log.Println("Scheduled transfer", transfer.ID, err)
+				}
+				continue
+			}
+			if o.Status != SCHEDULED_PENDING || o.Time.After(now) {
+				continue
+			}
+			reason := ""
+			available := s.Clawbacks.Balance(transfer.Alias) - sent[transfer.Alias]
+			if IsFlagged(s.Flags, transfer.Alias) {
+				reason = ERROR_ACCOUNT_FLAGGED
+			} else if int64(transfer.Amount) > available {
+				reason = fmt.Sprintf(ERROR_NOT_ENOUGH_TOKENS_AVAILABLE, transfer.Amount, available)
+			}
+			if reason != "" {
+				log.Println("Skipping scheduled transfer", transfer.ID, reason)
+				if err := s.Transfers.UpdateOccurrence(transfer.ID, i, SCHEDULED_PENDING, func(o *ScheduledOccurrence) {
+					o.Status = SCHEDULED_SKIPPED
+					o.Error = reason
+					o.Record = nil
+				}); err != nil && err.Error() != ERROR_OCCURRENCE_CHANGED {
+					return err
+				}
+				continue
+			}
+			// Claim the occurrence, unless it was cancelled since the transfers were read
+			if err := s.Transfers.UpdateOccurrence(transfer.ID, i, SCHEDULED_PENDING, func(o *ScheduledOccurrence) {
+				o.Status = SCHEDULED_MINING
+			}); err != nil {
+				if err.Error() == ERROR_OCCURRENCE_CHANGED {
+					continue
+				}
+				return err
+			}
+			reference, err := s.mine(o)
+			if err != nil {
+				// The record may already be on the chain, leave it as mining to be resolved on the next run
+				log.Println("Scheduled transfer", transfer.ID, err)
+				continue
+			}
+			sent[transfer.Alias] += int64(transfer.Amount)
+			if err := s.mined(transfer, i, reference); err != nil {
+				// Resolved on the next run
+				log.Println("Scheduled transfer", transfer.ID, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *TransferScheduler) mine(o *ScheduledOccurrence) (*bcgo.Reference, error) {
+	record := &bcgo.Record{}
+	if err := proto.Unmarshal(o.Record, record); err != nil {
+		return nil, err
+	}
+	return MineSignedRecord(s.Node, s.Miner, s.Listener, s.Transactions, record)
+}
+
+func (s *TransferScheduler) mined(transfer *ScheduledTransfer, index int, reference *bcgo.Reference) error {
+	return s.Transfers.UpdateOccurrence(transfer.ID, index, SCHEDULED_MINING, func(o *ScheduledOccurrence) {
+		o.Status = SCHEDULED_MINED
+		o.Error = ""
+		o.Hash = base64.RawURLEncoding.EncodeToString(reference.RecordHash)
+	})
+}
+
+// resolve looks for the record of an occurrence left mining in the transactions channel, marking the occurrence as mined if it is there, or pending to be retried if it isn't.
+func (s *TransferScheduler) resolve(transfer *ScheduledTransfer, index int, o *ScheduledOccurrence) error {
+	record := &bcgo.Record{}
+	if err := proto.Unmarshal(o.Record, record); err != nil {
+		return err
+	}
+	hash, err := cryptogo.HashProtobuf(record)
+	if err != nil {
+		return err
+	}
+	var reference *bcgo.Reference
+	if err := bcgo.Iterate(s.Transactions.Name, s.Transactions.Head, nil, s.Node.Cache, s.Node.Network, func(h []byte, b *bcgo.Block) error {
+		if b.Timestamp < record.Timestamp {
+			// Blocks mined before the occurrence came due can't hold its record
+			return bcgo.StopIterationError{}
+		}
+		for _, e := range b.Entry {
+			if bytes.Equal(e.RecordHash, hash) {
+				reference = &bcgo.Reference{
+					Timestamp:   record.Timestamp,
+					ChannelName: s.Transactions.Name,
+					BlockHash:   h,
+					RecordHash:  hash,
+				}
+				return bcgo.StopIterationError{}
+			}
+		}
+		return nil
+	}); err != nil {
+		switch err.(type) {
+		case bcgo.StopIterationError:
+			// Do nothing
+		default:
+			return err
+		}
+	}
+	if reference != nil {
+		return s.mined(transfer, index, reference)
+	}
+	return s.Transfers.UpdateOccurrence(transfer.ID, index, SCHEDULED_MINING, func(o *ScheduledOccurrence) {
+		o.Status = SCHEDULED_PENDING
+	})
+}
+
+type ScheduledOccurrenceTemplate struct {
+	Time   string
+	Status string
+	Error  string
+	Hash   string
+}
+
+type ScheduledTransferTemplate struct {
+	ID         string
+	Recipient  string
+	Amount     uint64
+	Schedule   string
+	Next       string
+	Remaining  int
+	Occurrence []*ScheduledOccurrenceTemplate
+}
+
+type ScheduledTransfersTemplate struct {
+	Error       string
+	Available   int64
+	Recipient   string
+	Quantity    int64
+	Start       string
+	Schedule    string
+	Occurrences int
+	Maximum     int
+	Transfer    []*ScheduledTransferTemplate
+}
+
+// ScheduledTransfersHandler lists the signed in alias' scheduled transfers, and schedules or cancels them.
+func ScheduledTransfersHandler(sessions SessionStore, transfers ScheduledTransfers, clawbacks *Clawbacks, flags FraudFlags, aliases *bcgo.Channel, node *bcgo.Node, template *template.Template) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println(r.RemoteAddr, r.Proto, r.Method, r.Host, r.URL.Path, r.Header)
+		// If not signed in, redirect to sign in page
+		cookie, err := GetSignInSessionCookie(r)
+		if err == nil {
+			session := sessions.GetSignInSession(cookie.Value)
+			if session != nil {
+				id, err := sessions.RefreshSignInSession(session)
+				if err == nil {
+					http.SetCookie(w, CreateSignInSessionCookie(id, sessions.GetSignInSessionTimeout()))
+				}
+				if session.ScheduledTransfer == nil {
+					session.ScheduledTransfer = &ScheduledTransferSession{
+						Schedule:    SCHEDULE_WEEKLY,
+						Occurrences: MAXIMUM_SCHEDULED_OCCURRENCES,
+					}
+				}
+				s := session.ScheduledTransfer
+				switch r.Method {
+				case "GET":
+					ts, err := transfers.GetAll(session.Alias)
+					if err != nil {
+						log.Println(err)
+						http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+						return
+					}
+					data := &ScheduledTransfersTemplate{
+						Error:       s.Error,
+						Available:   clawbacks.Balance(session.Alias),
+						Recipient:   s.Recipient,
+						Quantity:    s.Quantity,
+						Start:       s.Start,
+						Schedule:    s.Schedule,
+						Occurrences: s.Occurrences,
+						Maximum:     MAXIMUM_SCHEDULED_OCCURRENCES,
+					}
+					if data.Quantity <= 0 {
+						data.Quantity = 1
+					}
+					for _, t := range ts {
+						tt := &ScheduledTransferTemplate{
+							ID:        t.ID,
+							Recipient: t.Recipient,
+							Amount:    t.Amount,
+							Schedule:  t.Schedule,
+							Remaining: t.Remaining(),
+						}
+						if next := t.Next(); next != nil {
+							tt.Next = next.Time.UTC().Format(SCHEDULE_TIME_FORMAT)
+						}
+						for _, o := range t.Occurrences {
+							tt.Occurrence = append(tt.Occurrence, &ScheduledOccurrenceTemplate{
+								Time:   o.Time.UTC().Format(SCHEDULE_TIME_FORMAT),
+								Status: o.Status,
+								Error:  o.Error,
+								Hash:   o.Hash,
+							})
+						}
+						data.Transfer = append(data.Transfer, tt)
+					}
+					if err := template.Execute(w, data); err != nil {
+						log.Println(err)
+						http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+					}
+					return
+				case "POST":
+					s.Error = ""
+					if cancel := r.FormValue("cancel"); cancel != "" {
+						if err := CancelScheduledTransfer(transfers, session.Alias, cancel); err != nil {
+							s.Error = err.Error()
+						}
+						RedirectScheduledTransfers(w, r)
+						return
+					}
+					s.Recipient = r.FormValue("recipient")
+					s.Start = r.FormValue("start")
+					s.Schedule = r.FormValue("schedule")
+					if err := scheduleTransfer(transfers, flags, aliases, node, session, s, r.FormValue("quantity"), r.FormValue("occurrences")); err != nil {
+						s.Error = err.Error()
+					} else {
+						session.ScheduledTransfer = nil
+					}
+					RedirectScheduledTransfers(w, r)
+					return
+				default:
+					log.Println("Unsupported method", r.Method)
+				}
+			}
+		}
+		RedirectSignIn(w, r)
+	}
+}
+
+func scheduleTransfer(transfers ScheduledTransfers, flags FraudFlags, aliases *bcgo.Channel, node *bcgo.Node, session *SignInSession, s *ScheduledTransferSession, quantity, occurrences string) error {
+	q, err := strconv.Atoi(quantity)
+	if err != nil {
+		return err
+	}
+	s.Quantity = int64(q)
+	o, err := strconv.Atoi(occurrences)
+	if err != nil {
+		return err
+	}
+	s.Occurrences = o
+	if IsFlagged(flags, session.Alias) {
+		return errors.New(ERROR_ACCOUNT_FLAGGED)
+	}
+	if s.Quantity <= 0 {
+		return errors.New(fmt.Sprintf(ERROR_INVALID_TOKEN_QUANTITY, s.Quantity))
+	}
+	if _, err := aliasgo.GetPublicKey(aliases, node.Cache, node.Network, s.Recipient); err != nil {
+		return errors.New(fmt.Sprintf(ERROR_NO_SUCH_ALIAS, s.Recipient))
+	}
+	// Times are entered in UTC, so occurrences don't depend on the server's time zone
+	start, err := time.Parse(SCHEDULE_TIME_FORMAT, s.Start)
+	if err != nil {
+		return err
+	}
+	transfer, err := NewScheduledTransfer(time.Now(), session.Alias, session.Key, s.Recipient, uint64(s.Quantity), s.Schedule, start, s.Occurrences)
+	if err != nil {
+		return err
+	}
+	log.Println("Scheduled transfer", transfer.ID, transfer.Alias, transfer.Recipient, transfer.Amount, transfer.Schedule)
+	return transfers.Add(transfer)
+}
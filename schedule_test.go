@@ -0,0 +1,364 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main_test
+
+import (
+	"bytes"
+	"github.com/AletheiaWareLLC/bcgo"
+	"github.com/AletheiaWareLLC/conveygo"
+	"github.com/AletheiaWareLLC/conveyservergo"
+	"github.com/AletheiaWareLLC/testinggo"
+	"github.com/golang/protobuf/proto"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestScheduleTimes(t *testing.T) {
+	start := time.Date(2020, 1, 31, 9, 0, 0, 0, time.UTC)
+	for name, tt := range map[string]struct {
+		schedule      string
+		occurrences   int
+		expected      []string
+		expectedError string
+	}{
+		"Once":        {main.SCHEDULE_ONCE, 5, []string{"2020-01-31T09:00"}, ""},
+		"Daily":       {main.SCHEDULE_DAILY, 3, []string{"2020-01-31T09:00", "2020-02-01T09:00", "2020-02-02T09:00"}, ""},
+		"Weekly":      {main.SCHEDULE_WEEKLY, 3, []string{"2020-01-31T09:00", "2020-02-07T09:00", "2020-02-14T09:00"}, ""},
+		"Monthly":     {main.SCHEDULE_MONTHLY, 2, []string{"2020-01-31T09:00", "2020-03-02T09:00"}, ""},
+		"Zero":        {main.SCHEDULE_WEEKLY, 0, nil, "Invalid number of occurrences: 0, maximum 52"},
+		"TooMany":     {main.SCHEDULE_WEEKLY, 53, nil, "Invalid number of occurrences: 53, maximum 52"},
+		"Fortnightly": {"fortnightly", 2, nil, "Invalid schedule: fortnightly"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			times, err := main.ScheduleTimes(start, tt.schedule, tt.occurrences)
+			if tt.expectedError != "" {
+				testinggo.AssertError(t, tt.expectedError, err)
+				return
+			}
+			testinggo.AssertNoError(t, err)
+			if len(times) != len(tt.expected) {
+				t.Fatalf("Wrong number of times; expected '%d', got '%d'", len(tt.expected), len(times))
+			}
+			for i, e := range tt.expected {
+				if a := times[i].Format(main.SCHEDULE_TIME_FORMAT); a != e {
+					t.Errorf("Wrong time; expected '%s', got '%s'", e, a)
+				}
+			}
+		})
+	}
+}
+
+func TestNewScheduledTransfer(t *testing.T) {
+	key := makeKey(t)
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	t.Run("Past", func(t *testing.T) {
+		_, err := main.NewScheduledTransfer(now, "Alice", key, "Bob", 10, main.SCHEDULE_ONCE, now.Add(-time.Minute), 1)
+		testinggo.AssertError(t, "Scheduled time has passed: 2020-05-31T23:59", err)
+	})
+	t.Run("Weekly", func(t *testing.T) {
+		transfer, err := main.NewScheduledTransfer(now, "Alice", key, "Bob", 10, main.SCHEDULE_WEEKLY, now.Add(time.Hour), 3)
+		testinggo.AssertNoError(t, err)
+		if len(transfer.Occurrences) != 3 {
+			t.Fatalf("Wrong number of occurrences; expected '%d', got '%d'", 3, len(transfer.Occurrences))
+		}
+		for _, o := range transfer.Occurrences {
+			if o.Status != main.SCHEDULED_PENDING {
+				t.Errorf("Wrong status; expected '%s', got '%s'", main.SCHEDULED_PENDING, o.Status)
+			}
+			record := &bcgo.Record{}
+			testinggo.AssertNoError(t, proto.Unmarshal(o.Record, record))
+			if record.Creator != "Alice" {
+				t.Errorf("Wrong creator; expected '%s', got '%s'", "Alice", record.Creator)
+			}
+			if record.Timestamp != uint64(o.Time.UnixNano()) {
+				t.Errorf("Wrong timestamp; expected '%d', got '%d'", o.Time.UnixNano(), record.Timestamp)
+			}
+			transaction := &conveygo.Transaction{}
+			testinggo.AssertNoError(t, proto.Unmarshal(record.Payload, transaction))
+			if transaction.Sender != "Alice" || transaction.Receiver != "Bob" || transaction.Amount != 10 {
+				t.Errorf("Wrong transaction; got '%s'", transaction)
+			}
+		}
+		if next := transfer.Next(); next != transfer.Occurrences[0] {
+			t.Errorf("Wrong next occurrence")
+		}
+		if r := transfer.Remaining(); r != 3 {
+			t.Errorf("Wrong remaining; expected '%d', got '%d'", 3, r)
+		}
+	})
+}
+
+func TestTransferScheduler(t *testing.T) {
+	aliceKey := makeKey(t)
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	setup := func(t *testing.T, dir string, flags main.FraudFlags) (*main.Clawbacks, *main.FileScheduledTransfers, *main.TransferScheduler) {
+		t.Helper()
+		node := makeNode(t, "Merchant", makeKey(t))
+		clawbacks := makeClawbacks(t, conveygo.NewLedger(node))
+		transfers := main.NewFileScheduledTransfers(path.Join(dir, "scheduled-transfers.json"))
+		return clawbacks, transfers, main.NewTransferScheduler(transfers, clawbacks, flags, node, clawbacks.Miner, nil, clawbacks.Transactions)
+	}
+	schedule := func(t *testing.T, transfers main.ScheduledTransfers, alias string, amount uint64, occurrences int) *main.ScheduledTransfer {
+		t.Helper()
+		transfer, err := main.NewScheduledTransfer(now, alias, aliceKey, "Charlie", amount, main.SCHEDULE_DAILY, now.Add(time.Hour), occurrences)
+		testinggo.AssertNoError(t, err)
+		testinggo.AssertNoError(t, transfers.Add(transfer))
+		return transfer
+	}
+	assertStatus := func(t *testing.T, transfers main.ScheduledTransfers, id string, expected ...string) []*main.ScheduledOccurrence {
+		t.Helper()
+		transfer, err := transfers.Get(id)
+		testinggo.AssertNoError(t, err)
+		for i, e := range expected {
+			if s := transfer.Occurrences[i].Status; s != e {
+				t.Errorf("Wrong status of occurrence %d; expected '%s', got '%s'", i, e, s)
+			}
+		}
+		return transfer.Occurrences
+	}
+	t.Run("Due", func(t *testing.T) {
+		dir := testinggo.MakeTempDir(t, "scheduled")
+		defer testinggo.UnmakeTempDir(t, dir)
+		clawbacks, transfers, scheduler := setup(t, dir, MockFraudFlags{})
+		clawbacks.Ledger.Earned["Alice"] = 100
+		transfer := schedule(t, transfers, "Alice", 30, 3)
+
+		// Nothing due yet
+		testinggo.AssertNoError(t, scheduler.Run(now))
+		assertStatus(t, transfers, transfer.ID, main.SCHEDULED_PENDING, main.SCHEDULED_PENDING, main.SCHEDULED_PENDING)
+
+		// First two due
+		testinggo.AssertNoError(t, scheduler.Run(now.Add(25*time.Hour)))
+		occurrences := assertStatus(t, transfers, transfer.ID, main.SCHEDULED_MINED, main.SCHEDULED_MINED, main.SCHEDULED_PENDING)
+		if occurrences[0].Hash == "" {
+			t.Errorf("Expected mined occurrence to have a record hash")
+		}
+
+		updateLedger(t, clawbacks)
+		if b := clawbacks.Ledger.Bought["Charlie"]; b != 60 {
+			t.Errorf("Wrong bought; expected '%d', got '%d'", 60, b)
+		}
+	})
+	t.Run("Insufficient", func(t *testing.T) {
+		dir := testinggo.MakeTempDir(t, "scheduled")
+		defer testinggo.UnmakeTempDir(t, dir)
+		clawbacks, transfers, scheduler := setup(t, dir, MockFraudFlags{})
+		clawbacks.Ledger.Earned["Alice"] = 50
+		transfer := schedule(t, transfers, "Alice", 30, 2)
+
+		testinggo.AssertNoError(t, scheduler.Run(now.Add(49*time.Hour)))
+		occurrences := assertStatus(t, transfers, transfer.ID, main.SCHEDULED_MINED, main.SCHEDULED_SKIPPED)
+		if e := "Not enough tokens available: 30 requested, 20 available"; occurrences[1].Error != e {
+			t.Errorf("Wrong error; expected '%s', got '%s'", e, occurrences[1].Error)
+		}
+		if occurrences[1].Record != nil {
+			t.Errorf("Expected skipped record to be discarded")
+		}
+	})
+	t.Run("Flagged", func(t *testing.T) {
+		dir := testinggo.MakeTempDir(t, "scheduled")
+		defer testinggo.UnmakeTempDir(t, dir)
+		clawbacks, transfers, scheduler := setup(t, dir, MockFraudFlags{"Alice": &main.FraudFlag{Alias: "Alice"}})
+		clawbacks.Ledger.Earned["Alice"] = 100
+		transfer := schedule(t, transfers, "Alice", 30, 1)
+
+		testinggo.AssertNoError(t, scheduler.Run(now.Add(2*time.Hour)))
+		occurrences := assertStatus(t, transfers, transfer.ID, main.SCHEDULED_SKIPPED)
+		if occurrences[0].Error != main.ERROR_ACCOUNT_FLAGGED {
+			t.Errorf("Wrong error; expected '%s', got '%s'", main.ERROR_ACCOUNT_FLAGGED, occurrences[0].Error)
+		}
+	})
+	t.Run("Cancelled", func(t *testing.T) {
+		dir := testinggo.MakeTempDir(t, "scheduled")
+		defer testinggo.UnmakeTempDir(t, dir)
+		clawbacks, transfers, scheduler := setup(t, dir, MockFraudFlags{})
+		clawbacks.Ledger.Earned["Alice"] = 100
+		transfer := schedule(t, transfers, "Alice", 30, 2)
+
+		testinggo.AssertError(t, "No such scheduled transfer: "+transfer.ID, main.CancelScheduledTransfer(transfers, "Bob", transfer.ID))
+		testinggo.AssertNoError(t, main.CancelScheduledTransfer(transfers, "Alice", transfer.ID))
+		testinggo.AssertNoError(t, scheduler.Run(now.Add(49*time.Hour)))
+		assertStatus(t, transfers, transfer.ID, main.SCHEDULED_CANCELLED, main.SCHEDULED_CANCELLED)
+		if clawbacks.Transactions.Head != nil {
+			t.Errorf("Expected no transactions to be mined")
+		}
+	})
+	t.Run("CancelledWhileMining", func(t *testing.T) {
+		dir := testinggo.MakeTempDir(t, "scheduled")
+		defer testinggo.UnmakeTempDir(t, dir)
+		_, transfers, _ := setup(t, dir, MockFraudFlags{})
+		transfer := schedule(t, transfers, "Alice", 30, 2)
+
+		// Scheduler claims the first occurrence
+		testinggo.AssertNoError(t, transfers.UpdateOccurrence(transfer.ID, 0, main.SCHEDULED_PENDING, func(o *main.ScheduledOccurrence) {
+			o.Status = main.SCHEDULED_MINING
+		}))
+		testinggo.AssertNoError(t, main.CancelScheduledTransfer(transfers, "Alice", transfer.ID))
+		occurrences := assertStatus(t, transfers, transfer.ID, main.SCHEDULED_MINING, main.SCHEDULED_CANCELLED)
+		if occurrences[0].Record == nil {
+			t.Errorf("Expected mining record to be kept")
+		}
+	})
+	t.Run("MinedNotRecorded", func(t *testing.T) {
+		// Record was mined but the run stopped before the occurrence was marked as mined
+		dir := testinggo.MakeTempDir(t, "scheduled")
+		defer testinggo.UnmakeTempDir(t, dir)
+		clawbacks, transfers, scheduler := setup(t, dir, MockFraudFlags{})
+		clawbacks.Ledger.Earned["Alice"] = 100
+		transfer := schedule(t, transfers, "Alice", 30, 1)
+
+		testinggo.AssertNoError(t, transfers.UpdateOccurrence(transfer.ID, 0, main.SCHEDULED_PENDING, func(o *main.ScheduledOccurrence) {
+			o.Status = main.SCHEDULED_MINING
+		}))
+		record := &bcgo.Record{}
+		testinggo.AssertNoError(t, proto.Unmarshal(transfer.Occurrences[0].Record, record))
+		_, err := main.MineSignedRecord(scheduler.Node, clawbacks.Miner, nil, clawbacks.Transactions, record)
+		testinggo.AssertNoError(t, err)
+		head := clawbacks.Transactions.Head
+
+		testinggo.AssertNoError(t, scheduler.Run(now.Add(2*time.Hour)))
+		occurrences := assertStatus(t, transfers, transfer.ID, main.SCHEDULED_MINED)
+		if occurrences[0].Hash == "" {
+			t.Errorf("Expected mined occurrence to have a record hash")
+		}
+		if !bytes.Equal(clawbacks.Transactions.Head, head) {
+			t.Errorf("Expected record not to be mined again")
+		}
+	})
+	t.Run("ClaimedNotMined", func(t *testing.T) {
+		// Run stopped after claiming the occurrence but before mining it
+		dir := testinggo.MakeTempDir(t, "scheduled")
+		defer testinggo.UnmakeTempDir(t, dir)
+		clawbacks, transfers, scheduler := setup(t, dir, MockFraudFlags{})
+		clawbacks.Ledger.Earned["Alice"] = 100
+		transfer := schedule(t, transfers, "Alice", 30, 1)
+
+		testinggo.AssertNoError(t, transfers.UpdateOccurrence(transfer.ID, 0, main.SCHEDULED_PENDING, func(o *main.ScheduledOccurrence) {
+			o.Status = main.SCHEDULED_MINING
+		}))
+		testinggo.AssertNoError(t, scheduler.Run(now.Add(2*time.Hour)))
+		assertStatus(t, transfers, transfer.ID, main.SCHEDULED_PENDING)
+		if clawbacks.Transactions.Head != nil {
+			t.Errorf("Expected no transactions to be mined")
+		}
+
+		// Retried on the next run
+		testinggo.AssertNoError(t, scheduler.Run(now.Add(2*time.Hour)))
+		assertStatus(t, transfers, transfer.ID, main.SCHEDULED_MINED)
+	})
+}
+
+func TestScheduledTransfersHandler(t *testing.T) {
+	aliceKey := makeKey(t)
+	node := makeNode(t, "Merchant", makeKey(t))
+	clawbacks := makeClawbacks(t, conveygo.NewLedger(node))
+	makeAlias(t, node, clawbacks.Aliases, "Bob", makeKey(t))
+	start := time.Now().UTC().Add(time.Hour).Format(main.SCHEDULE_TIME_FORMAT)
+	utc, err := time.Parse(main.SCHEDULE_TIME_FORMAT, start)
+	testinggo.AssertNoError(t, err)
+	tmplt, err := template.New("").Parse(`{{ .Error }}:{{ range .Transfer }}{{ .Recipient }}:{{ .Amount }}:{{ .Schedule }}:{{ .Remaining }}:{{ .Next }};{{ end }}`)
+	testinggo.AssertNoError(t, err)
+
+	for name, tt := range map[string]struct {
+		recipient string
+		quantity  string
+		start     string
+		schedule  string
+		expected  string
+	}{
+		"Weekly":       {"Bob", "10", start, main.SCHEDULE_WEEKLY, ":Bob:10:weekly:4:" + start + ";"},
+		"Once":         {"Bob", "10", start, main.SCHEDULE_ONCE, ":Bob:10:once:1:" + start + ";"},
+		"UnknownAlias": {"Bobb", "10", start, main.SCHEDULE_WEEKLY, "No such alias: Bobb:"},
+		"Zero":         {"Bob", "0", start, main.SCHEDULE_WEEKLY, "Invalid token quantity: 0:"},
+		"Past":         {"Bob", "10", "2020-01-01T00:00", main.SCHEDULE_WEEKLY, "Scheduled time has passed: 2020-01-01T00:00:"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := testinggo.MakeTempDir(t, "scheduled")
+			defer testinggo.UnmakeTempDir(t, dir)
+			transfers := main.NewFileScheduledTransfers(path.Join(dir, "scheduled-transfers.json"))
+			sessionstore := main.NewMemorySessionStore()
+			session, err := sessionstore.CreateSignInSession("Alice", aliceKey)
+			testinggo.AssertNoError(t, err)
+			cookie := main.CreateSignInSessionCookie(session, time.Hour)
+			handler := main.ScheduledTransfersHandler(sessionstore, transfers, clawbacks, MockFraudFlags{}, clawbacks.Aliases, node, tmplt)
+
+			request := makePostTokenTransferRequest(t, "/account/scheduled-transfers", &url.Values{
+				"recipient":   {tt.recipient},
+				"quantity":    {tt.quantity},
+				"start":       {tt.start},
+				"schedule":    {tt.schedule},
+				"occurrences": {"4"},
+			})
+			request.AddCookie(cookie)
+			response := httptest.NewRecorder()
+			handler(response, request)
+			if l := response.Header().Get("Location"); l != "/account/scheduled-transfers" {
+				t.Errorf("Wrong location; expected '%s', got '%s'", "/account/scheduled-transfers", l)
+			}
+
+			request, err = http.NewRequest("GET", "/account/scheduled-transfers", nil)
+			testinggo.AssertNoError(t, err)
+			request.AddCookie(cookie)
+			response = httptest.NewRecorder()
+			handler(response, request)
+			if actual := response.Body.String(); actual != tt.expected {
+				t.Errorf("Wrong response; expected '%s', got '%s'", tt.expected, actual)
+			}
+
+			// Start time is in UTC, whatever the server's time zone
+			ts, err := transfers.GetAll("Alice")
+			testinggo.AssertNoError(t, err)
+			for _, transfer := range ts {
+				next := transfer.Next()
+				if next == nil {
+					t.Fatal("Expected next occurrence")
+				}
+				if !next.Time.Equal(utc) {
+					t.Errorf("Wrong start; expected '%s', got '%s'", utc, next.Time)
+				}
+			}
+		})
+	}
+	t.Run("Cancel", func(t *testing.T) {
+		dir := testinggo.MakeTempDir(t, "scheduled")
+		defer testinggo.UnmakeTempDir(t, dir)
+		transfers := main.NewFileScheduledTransfers(path.Join(dir, "scheduled-transfers.json"))
+		transfer, err := main.NewScheduledTransfer(time.Now(), "Alice", aliceKey, "Bob", 10, main.SCHEDULE_DAILY, time.Now().Add(time.Hour), 2)
+		testinggo.AssertNoError(t, err)
+		testinggo.AssertNoError(t, transfers.Add(transfer))
+		sessionstore := main.NewMemorySessionStore()
+		session, err := sessionstore.CreateSignInSession("Alice", aliceKey)
+		testinggo.AssertNoError(t, err)
+
+		request := makePostTokenTransferRequest(t, "/account/scheduled-transfers", &url.Values{
+			"cancel": {transfer.ID},
+		})
+		request.AddCookie(main.CreateSignInSessionCookie(session, time.Hour))
+		main.ScheduledTransfersHandler(sessionstore, transfers, clawbacks, MockFraudFlags{}, clawbacks.Aliases, node, tmplt)(httptest.NewRecorder(), request)
+
+		cancelled, err := transfers.Get(transfer.ID)
+		testinggo.AssertNoError(t, err)
+		if r := cancelled.Remaining(); r != 0 {
+			t.Errorf("Wrong remaining; expected '%d', got '%d'", 0, r)
+		}
+	})
+}
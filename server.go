@@ -34,6 +34,7 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -85,6 +86,13 @@ func (s *Server) Start(node *bcgo.Node) error {
 	// Create ledger
 	ledger := conveygo.NewLedger(node)
 
+	// Update ledger and monitor merchant reserve after each update
+	thresholds, err := ParseReserveThresholds(os.Getenv("RESERVE_LOW_THRESHOLD"), os.Getenv("RESERVE_CRITICAL_THRESHOLD"))
+	if err != nil {
+		return err
+	}
+	monitor := NewReserveMonitor(ledger, node.Alias, thresholds, nil)
+
 	// Open channels
 	aliases := aliasgo.OpenAliasChannel()
 	hours := conveygo.OpenHourChannel()
@@ -97,8 +105,10 @@ func (s *Server) Start(node *bcgo.Node) error {
 	invoices := conveygo.OpenInvoiceChannel()
 	registrations := conveygo.OpenRegistrationChannel()
 	subscriptions := conveygo.OpenSubscriptionChannel()
+	stripeEvents := OpenStripeEventChannel()
 	conversations := conveygo.OpenConversationChannel()
 	transactions := conveygo.OpenTransactionChannel()
+	memos := OpenTransferMemoChannel()
 
 	// Add ledger triggers
 	hours.AddTrigger(ledger.TriggerUpdate)
@@ -130,8 +140,10 @@ func (s *Server) Start(node *bcgo.Node) error {
 		invoices,
 		registrations,
 		subscriptions,
+		stripeEvents,
 		conversations,
 		transactions,
+		memos,
 	} {
 		// Add periodic validators
 		c.AddValidator(hourly)
@@ -179,9 +191,28 @@ func (s *Server) Start(node *bcgo.Node) error {
 		}
 	}
 
-	go ledger.Start()
-	ledger.TriggerUpdate()
-	defer ledger.Stop()
+	// Keep blocks which couldn't be pushed in an outbox, and retry them in the background
+	outbox := NewFileOutbox(path.Join(s.Root, "outbox.json"))
+
+	// Funnel all mining done by the server through a single miner per channel
+	miner := NewChannelMiner()
+	miner.Outbox = outbox
+
+	clawbacks := NewClawbacks(node, miner, s.Listener, ledger, aliases, charges, transactions)
+	if err := clawbacks.Update(); err != nil {
+		log.Println(err)
+	}
+
+	// Snapshot the ledger with each hourly validation block
+	history := NewLedgerHistoryRecorder(NewFileLedgerHistory(path.Join(s.Root, "ledger-history")), ledger, clawbacks, node.Alias, hours, days)
+	monitor.AddUpdateListener(func() {
+		if err := history.Record(); err != nil {
+			log.Println(err)
+		}
+	})
+
+	go monitor.Start()
+	defer monitor.Stop()
 
 	// Start Periodic Validation Chains
 	go hourly.Start(node, bcgo.THRESHOLD_PERIOD_HOUR, s.Listener)
@@ -232,23 +263,37 @@ func (s *Server) Start(node *bcgo.Node) error {
 		"html/template/channel-list.go.html",
 		"html/template/compose.go.html",
 		"html/template/conversation.go.html",
+		"html/template/economy.go.html",
 		// TODO(v3) "html/template/digest.go.html",
 		// TODO(v3) "html/template/email-digest.go.html",
+		"html/template/email-reserve-alert.go.html",
 		"html/template/email-verification.go.html",
 		"html/template/email-welcome.go.html",
+		"html/template/history.go.html",
+		"html/template/job.go.html",
 		"html/template/ledger.go.html",
+		"html/template/ledger-alias.go.html",
 		"html/template/listing.go.html",
 		"html/template/message.go.html",
 		"html/template/preview.go.html",
+		"html/template/purchases.go.html",
+		"html/template/receipt.go.html",
 		"html/template/recent.go.html",
+		"html/template/reserve.go.html",
 		"html/template/reply.go.html",
+		"html/template/scheduled-transfers.go.html",
 		"html/template/sign-in.go.html",
 		"html/template/sign-out.go.html",
 		"html/template/sign-up.go.html",
 		"html/template/sign-up-verification.go.html",
 		"html/template/token-purchase.go.html",
+		"html/template/token-purchase-confirmation.go.html",
 		// TODO(v3) "html/template/token-subscribe.go.html",
 		"html/template/token-transfer.go.html",
+		"html/template/token-transfer-confirmation.go.html",
+		"html/template/token-transfer-bulk.go.html",
+		"html/template/token-transfer-bulk-confirmation.go.html",
+		"html/template/transfers.go.html",
 		"html/template/yield.go.html")
 	if err != nil {
 		return err
@@ -280,91 +325,194 @@ func (s *Server) Start(node *bcgo.Node) error {
 		} else {
 			emailverifier = NewSmtpEmailVerifier(address, sender, templates.Lookup("email-verification.go.html"))
 			emailwelcomer = NewSmtpEmailWelcomer(address, sender, templates.Lookup("email-welcome.go.html"))
+			if recipients, ok := os.LookupEnv("RESERVE_ALERT_EMAIL"); ok {
+				monitor.SetAlerter(NewSmtpReserveAlerter(address, sender, strings.Split(recipients, ","), templates.Lookup("email-reserve-alert.go.html")))
+			}
 		}
 	}
 
-	var paymentprocessor PaymentProcessor
+	journal, err := NewFileEventJournal(path.Join(s.Root, "stripe-events"))
+	if err != nil {
+		return err
+	}
 
-	secretKey, ok := os.LookupEnv("STRIPE_SECRET_KEY")
+	recorder := NewStripeEventRecorder(node, miner, s.Listener, aliases, charges, invoices, registrations, subscriptions, stripeEvents, NewFileEventAuditLog(path.Join(s.Root, "stripe-audit")))
+
+	flags := NewFileFraudFlags(path.Join(s.Root, "fraud-flags.json"))
+
+	workers := 2
+	if w, ok := os.LookupEnv("MINING_WORKERS"); ok {
+		workers, err = strconv.Atoi(w)
+		if err != nil {
+			return err
+		}
+	}
+	pusher := NewOutboxPusher(outbox, node, miner, s.Listener)
+	go pusher.Start()
+	defer pusher.Stop()
+
+	queue := NewMiningQueue(node, workers)
+	queue.Outbox = outbox
+	queue.Start()
+	defer queue.Stop()
+
+	// Handle Stripe events in the mining queue so the webhook responds before Stripe times out, keeping them in an inbox until handled
+	events := NewStripeEventQueue(queue, NewFileEventInbox(path.Join(s.Root, "stripe-event-inbox.json")), NewStripeEventHandler(aliases, charges, transactions, node, miner, s.Listener, clawbacks, flags, journal, recorder), aliases, charges, invoices, registrations, subscriptions, stripeEvents, transactions)
+	go events.Start()
+	defer events.Stop()
+
+	scheduled := NewFileScheduledTransfers(path.Join(s.Root, "scheduled-transfers.json"))
+	scheduler := NewTransferScheduler(scheduled, clawbacks, flags, node, miner, s.Listener, transactions)
+	go scheduler.Start()
+	defer scheduler.Stop()
+
+	cataloguePath, ok := os.LookupEnv("BUNDLE_CATALOGUE")
 	if !ok {
-		log.Println("Missing STRIPE_SECRET_KEY")
-	} else {
-		publishableKey, ok := os.LookupEnv("STRIPE_PUBLISHABLE_KEY")
+		cataloguePath = path.Join(s.Root, "bundles.json")
+	}
+	catalogue, err := ReadBundleCatalogue(cataloguePath)
+	if err != nil {
+		return err
+	}
+
+	var paymentprocessor PaymentProcessor
+
+	switch processor := os.Getenv("PAYMENT_PROCESSOR"); processor {
+	case "", "stripe":
+		secretKey, ok := os.LookupEnv("STRIPE_SECRET_KEY")
 		if !ok {
-			log.Println("Missing STRIPE_PUBLISHABLE_KEY")
+			log.Println("Missing STRIPE_SECRET_KEY")
 		} else {
-			paymentprocessor = NewStripePaymentProcessor(secretKey, publishableKey, node, s.Listener)
+			publishableKey, ok := os.LookupEnv("STRIPE_PUBLISHABLE_KEY")
+			if !ok {
+				log.Println("Missing STRIPE_PUBLISHABLE_KEY")
+			} else {
+				paymentprocessor = NewStripePaymentProcessor(secretKey, publishableKey, node, s.Listener)
+			}
 		}
+	case "local":
+		// Keep payments in a local file for development without Stripe
+		paymentprocessor, err = NewLocalPaymentProcessor(path.Join(s.Root, "local-payments.json"), node.Alias, events.Handle)
+		if err != nil {
+			return err
+		}
+	default:
+		return errors.New(fmt.Sprintf(ERROR_UNRECOGNIZED_PAYMENT_PROCESSOR, processor))
 	}
 
 	// Serve Web Requests
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", netgo.StaticHandler("html/static"))
 	mux.HandleFunc("/alias", aliasservergo.AliasHandler(aliases, s.Cache, s.Network, templates.Lookup("alias.go.html")))
+	mux.HandleFunc("/alias/history", AliasHistoryHandler(node, templates.Lookup("history.go.html")))
 	mux.HandleFunc("/block", bcnetgo.BlockHandler(s.Cache, s.Network, templates.Lookup("block.go.html")))
 	mux.HandleFunc("/channel", bcnetgo.ChannelHandler(s.Cache, s.Network, templates.Lookup("channel.go.html")))
 	mux.HandleFunc("/channels", bcnetgo.ChannelListHandler(s.Cache, s.Network, templates.Lookup("channel-list.go.html"), node.GetChannels))
 	mux.HandleFunc("/keys", cryptogo.KeyShareHandler(make(cryptogo.KeyShareStore), 2*time.Minute))
-	mux.HandleFunc("/account", AccountHandler(sessionstore, ledger, templates.Lookup("account.go.html")))
+	mux.HandleFunc("/account", AccountHandler(sessionstore, datastore, paymentprocessor, ledger, clawbacks, flags, templates.Lookup("account.go.html")))
+	mux.HandleFunc("/account/history", HistoryHandler(sessionstore, node, memos, templates.Lookup("history.go.html")))
+	mux.HandleFunc("/account/purchases", PurchasesHandler(sessionstore, node, charges, templates.Lookup("purchases.go.html")))
+	mux.HandleFunc("/account/receipt", ReceiptHandler(sessionstore, node, charges, templates.Lookup("receipt.go.html")))
+	mux.HandleFunc("/account/scheduled-transfers", ScheduledTransfersHandler(sessionstore, scheduled, clawbacks, flags, aliases, node, templates.Lookup("scheduled-transfers.go.html")))
+	mux.HandleFunc("/account/transfers", TransfersHandler(sessionstore, node, transactions, memos, templates.Lookup("transfers.go.html")))
 	// TODO(v2) mux.HandleFunc("/account-export", AccountExportHandler(sessionstore, templates.Lookup("account-export.go.html")))
 	// TODO(v2) mux.HandleFunc("/account-import", AccountImportHandler(sessionstore, templates.Lookup("account-import.go.html")))
 	mux.HandleFunc("/add-payment-method", AddPaymentMethodHandler(sessionstore, datastore, paymentprocessor, templates.Lookup("add-payment-method.go.html")))
 	mux.HandleFunc("/best", BestHandler(sessionstore, datastore, templates.Lookup("best.go.html")))
 	mux.HandleFunc("/compose", ComposeHandler(sessionstore, datastore, templates.Lookup("compose.go.html")))
-	mux.HandleFunc("/conversation", ConversationHandler(sessionstore, datastore, templates.Lookup("conversation.go.html")))
+	mux.HandleFunc("/conversation", ConversationHandler(sessionstore, datastore, NewTips(node, datastore, transactions), templates.Lookup("conversation.go.html")))
 	// TODO(v3) mux.HandleFunc("/digest", )
+	mux.HandleFunc("/economy", EconomyHandler(ledger, clawbacks, node.Alias, history.History, templates.Lookup("economy.go.html")))
+	mux.HandleFunc("/economy.json", EconomyJSONHandler(ledger, clawbacks, node.Alias, history.History))
+	mux.HandleFunc("/job", JobHandler(sessionstore, queue, templates.Lookup("job.go.html")))
 	mux.HandleFunc("/ledger", LedgerHandler(ledger, templates.Lookup("ledger.go.html")))
+	mux.HandleFunc("/ledger.csv", LedgerCSVHandler(ledger))
+	mux.HandleFunc("/ledger.json", LedgerJSONHandler(ledger))
+	mux.HandleFunc("/ledger/alias", LedgerAliasHandler(ledger, node, templates.Lookup("ledger-alias.go.html")))
+	mux.HandleFunc("/ledger/history", LedgerHistoryHandler(history.History))
+	mux.HandleFunc("/ledger/history.svg", LedgerHistoryChartHandler(history.History))
 	mux.HandleFunc("/preview", PreviewHandler(sessionstore, datastore, ledger, templates.Lookup("preview.go.html")))
-	mux.HandleFunc("/publish", PublishHandler(sessionstore, datastore, ledger, templates.Lookup("publish.go.html")))
+	mux.HandleFunc("/publish", PublishHandler(sessionstore, datastore, clawbacks, miner, queue, templates.Lookup("publish.go.html")))
 	mux.HandleFunc("/recent", RecentHandler(sessionstore, datastore, templates.Lookup("recent.go.html")))
+	mux.HandleFunc("/reserve", ReserveHandler(monitor, templates.Lookup("reserve.go.html")))
 	mux.HandleFunc("/sign-in", SignInHandler(sessionstore, datastore, templates.Lookup("sign-in.go.html")))
 	mux.HandleFunc("/sign-out", SignOutHandler(sessionstore, templates.Lookup("sign-out.go.html")))
 	mux.HandleFunc("/sign-up", SignUpHandler(sessionstore, datastore, emailverifier, templates.Lookup("sign-up.go.html")))
 	mux.HandleFunc("/sign-up-verification", SignUpVerificationHandler(sessionstore, datastore, paymentprocessor, emailwelcomer, templates.Lookup("sign-up-verification.go.html")))
 
-	productId, ok := os.LookupEnv("PRODUCT_ID")
-	if !ok {
-		return errors.New("Missing PRODUCT_ID")
+	limits, err := ParsePurchaseLimits(os.Getenv("PURCHASE_ALIAS_DAILY_LIMIT"), os.Getenv("PURCHASE_CARD_DAILY_LIMIT"), os.Getenv("PURCHASE_COOLDOWN"))
+	if err != nil {
+		return err
+	}
+	promos := NewFilePromoStore(path.Join(s.Root, "promo-codes.json"))
+	limiter := NewPurchaseLimiter(limits)
+	// Count recent charges so restarting doesn't reset the limits
+	if charges, err := clawbacks.GetCharges(); err != nil {
+		log.Println(err)
+	} else {
+		limiter.Load(charges, time.Now())
 	}
 
-	productIds := strings.Split(productId, ",")
-	mux.HandleFunc("/token-purchase", TokenPurchaseHandler(sessionstore, datastore, paymentprocessor, ledger, node, templates.Lookup("token-purchase.go.html"), productIds))
+	mux.HandleFunc("/token-purchase", TokenPurchaseHandler(sessionstore, datastore, paymentprocessor, ledger, transactions, node, miner, s.Listener, templates.Lookup("token-purchase.go.html"), catalogue, promos, limiter, flags, queue))
+	mux.HandleFunc("/token-purchase-confirmation", TokenPurchaseConfirmationHandler(sessionstore, paymentprocessor, promos, limiter, templates.Lookup("token-purchase-confirmation.go.html")))
 	/* TODO(v3)
 	planId := os.Getenv("PLAN_ID")
 	if planId != "" {
 		mux.HandleFunc("/token-subscribe", TokenSubscriptionHandler(sessionstore, datastore, paymentprocessor, node, templates.Lookup("token-subscribe.go.html"), productId, planId))
 	}
 	*/
-	mux.HandleFunc("/token-transfer", TokenTransferHandler(sessionstore, datastore, ledger, aliases, transactions, node, s.Listener, templates.Lookup("token-transfer.go.html")))
-	mux.HandleFunc("/stripe-webhook", bcnetgo.StripeWebhookHandler(NewStripeEventHandler(aliases, charges, transactions, node, s.Listener)))
+	mux.HandleFunc("/token-transfer", TokenTransferHandler(sessionstore, datastore, datastore, clawbacks, flags, aliases, node, templates.Lookup("token-transfer.go.html")))
+	mux.HandleFunc("/token-transfer-confirmation", TokenTransferConfirmationHandler(sessionstore, clawbacks, flags, aliases, transactions, memos, node, miner, s.Listener, queue, templates.Lookup("token-transfer-confirmation.go.html")))
+	mux.HandleFunc("/token-transfer-bulk", BulkTransferHandler(sessionstore, clawbacks, flags, aliases, node, queue, templates.Lookup("token-transfer-bulk.go.html")))
+	mux.HandleFunc("/token-transfer-bulk-confirmation", BulkTransferConfirmationHandler(sessionstore, clawbacks, flags, aliases, transactions, node, miner, s.Listener, queue, templates.Lookup("token-transfer-bulk-confirmation.go.html")))
+	mux.HandleFunc("/stripe-webhook", bcnetgo.StripeWebhookHandler(events.Handle))
 
 	if bcgo.GetBooleanFlag("HTTPS") {
 		// Redirect HTTP Requests to HTTPS
 		go func() {
 			if err := http.ListenAndServe(":80", http.HandlerFunc(netgo.HTTPSRedirect(node.Alias, map[string]bool{
-				"/":                   true,
-				"/account":            true,
-				"/account-export":     true,
-				"/account-import":     true,
-				"/add-payment-method": true,
-				"/alias":              true,
-				"/best":               true,
-				"/block":              true,
-				"/channel":            true,
-				"/channels":           true,
-				"/compose":            true,
-				"/conversation":       true,
-				"/digest":             true,
-				"/keys":               true,
-				"/ledger":             true,
-				"/preview":            true,
-				"/recent":             true,
-				"/sign-in":            true,
-				"/sign-out":           true,
-				"/sign-up":            true,
-				"/token-purchase":     true,
-				"/token-subscribe":    true,
-				"/token-transfer":     true,
+				"/":                                 true,
+				"/account":                          true,
+				"/account-export":                   true,
+				"/account-import":                   true,
+				"/account/history":                  true,
+				"/account/purchases":                true,
+				"/account/receipt":                  true,
+				"/account/scheduled-transfers":      true,
+				"/account/transfers":                true,
+				"/add-payment-method":               true,
+				"/alias":                            true,
+				"/alias/history":                    true,
+				"/best":                             true,
+				"/block":                            true,
+				"/channel":                          true,
+				"/channels":                         true,
+				"/compose":                          true,
+				"/conversation":                     true,
+				"/digest":                           true,
+				"/economy":                          true,
+				"/economy.json":                     true,
+				"/job":                              true,
+				"/keys":                             true,
+				"/ledger":                           true,
+				"/ledger.csv":                       true,
+				"/ledger.json":                      true,
+				"/ledger/alias":                     true,
+				"/ledger/history":                   true,
+				"/ledger/history.svg":               true,
+				"/preview":                          true,
+				"/recent":                           true,
+				"/reserve":                          true,
+				"/sign-in":                          true,
+				"/sign-out":                         true,
+				"/sign-up":                          true,
+				"/token-purchase":                   true,
+				"/token-purchase-confirmation":      true,
+				"/token-subscribe":                  true,
+				"/token-transfer":                   true,
+				"/token-transfer-confirmation":      true,
+				"/token-transfer-bulk":              true,
+				"/token-transfer-bulk-confirmation": true,
 			}))); err != nil {
 				log.Fatal(err)
 			}
@@ -408,6 +556,37 @@ func (s *Server) Handle(args []string) {
 				log.Println(err)
 				return
 			}
+		case "audit":
+			// Replay chains from the cache only
+			node, err := bcgo.GetNode(s.Root, s.Cache, nil)
+			if err != nil {
+				log.Println(err)
+				os.Exit(1)
+			}
+			if err := HandleAudit(node, args[1:], os.Stdout); err != nil {
+				log.Println(err)
+				os.Exit(1)
+			}
+		case "fraud":
+			if err := HandleFraud(NewFileFraudFlags(path.Join(s.Root, "fraud-flags.json")), args[1:], os.Stdout); err != nil {
+				log.Println(err)
+				return
+			}
+		case "inbox":
+			if err := HandleInbox(NewFileEventInbox(path.Join(s.Root, "stripe-event-inbox.json")), args[1:], os.Stdout); err != nil {
+				log.Println(err)
+				return
+			}
+		case "outbox":
+			if err := HandleOutbox(NewFileOutbox(path.Join(s.Root, "outbox.json")), args[1:], os.Stdout); err != nil {
+				log.Println(err)
+				return
+			}
+		case "promo":
+			if err := HandlePromo(NewFilePromoStore(path.Join(s.Root, "promo-codes.json")), args[1:], os.Stdout); err != nil {
+				log.Println(err)
+				return
+			}
 		default:
 			log.Println("Cannot handle", args[0])
 		}
@@ -422,6 +601,21 @@ func PrintUsage(output io.Writer) {
 	fmt.Fprintln(output, "\tconveyserver init - initializes environment, generates key pair, and registers alias")
 	fmt.Fprintln(output)
 	fmt.Fprintln(output, "\tconveyserver start - starts the server")
+	fmt.Fprintln(output)
+	fmt.Fprintln(output, "\tconveyserver audit [url] - recomputes every balance from the chains in the cache and compares them with the live ledger of the server running at url, exiting non-zero on mismatch or error")
+	fmt.Fprintln(output, "\tconveyserver audit - without a url, only cross-checks the recomputed balances against the ledger library replaying the same chains")
+	fmt.Fprintln(output)
+	fmt.Fprintln(output, "\tconveyserver fraud - lists aliases frozen after fraud was reported")
+	fmt.Fprintln(output, "\tconveyserver fraud clear [alias] - unfreezes an alias")
+	fmt.Fprintln(output)
+	fmt.Fprintln(output, "\tconveyserver inbox - lists Stripe events which failed every attempt to handle them")
+	fmt.Fprintln(output)
+	fmt.Fprintln(output, "\tconveyserver outbox - lists channels with mined blocks waiting to be pushed to the network")
+	fmt.Fprintln(output)
+	fmt.Fprintln(output, "\tconveyserver promo - lists promo codes")
+	fmt.Fprintln(output, "\tconveyserver promo add discount [code] [percent] [limit] [expiry] - adds a code for a percentage off a token bundle, optionally limited to a number of redemptions and expiring on a date (YYYY-MM-DD)")
+	fmt.Fprintln(output, "\tconveyserver promo add grant [code] [quantity] [limit] [expiry] - adds a code for a quantity of free tokens, optionally limited to a number of redemptions and expiring on a date (YYYY-MM-DD)")
+	fmt.Fprintln(output, "\tconveyserver promo remove [code] - removes a promo code")
 }
 
 func PrintLegalese(output io.Writer) {
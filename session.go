@@ -98,10 +98,17 @@ func (s *SignUpSession) Validate() error {
 type SignInSession struct {
 	Alias             string
 	Key               *rsa.PrivateKey
+	Account           *AccountSession
 	AddPaymentMethod  *AddPaymentMethodSession
 	DraftContribution *DraftContributionSession
 	TokenPurchase     *TokenPurchaseSession
 	TokenTransfer     *TokenTransferSession
+	BulkTransfer      *BulkTransferSession
+	ScheduledTransfer *ScheduledTransferSession
+}
+
+type AccountSession struct {
+	Error string
 }
 
 type AddPaymentMethodSession struct {
@@ -121,12 +128,40 @@ type DraftContributionSession struct {
 }
 
 type TokenPurchaseSession struct {
-	Error   string
-	Product map[string]*Product
+	Error         string
+	Currency      string
+	PaymentIntent *PaymentIntent
+	Promo         string               // Code reserved for the payment, released if the payment fails
+	Reservation   *PurchaseReservation // Purchase counted towards the limits, released if the payment fails
 }
 
+// TokenTransferSession holds the transfer awaiting confirmation, a tip also holds the message being tipped.
 type TokenTransferSession struct {
-	Error string
+	Error        string
+	Recipient    string
+	Quantity     int64
+	Memo         string
+	Conversation string
+	Message      string
+}
+
+// BulkTransferSession holds the rows of a bulk transfer awaiting confirmation, and the job mining them once confirmed.
+type BulkTransferSession struct {
+	Error     string
+	Transfers string
+	Rows      []*BulkTransferRow
+	Total     int64
+	Job       string
+}
+
+// ScheduledTransferSession holds the transfer being scheduled.
+type ScheduledTransferSession struct {
+	Error       string
+	Recipient   string
+	Quantity    int64
+	Start       string
+	Schedule    string
+	Occurrences int
 }
 
 type SessionStore interface {
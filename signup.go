@@ -199,40 +199,33 @@ func SignUpVerificationHandler(sessions SessionStore, users conveygo.UserStore,
 							log.Println(err)
 							s.Error = err.Error()
 						} else {
-							// Register Customer with Payment Processor
-							customerId, err := payments.RegisterCustomer(s.Name, s.Email, s.Alias)
-							if err != nil {
+							// Register Customer with Payment Processor and BC
+							if err := registerCustomer(users, payments, s, key); err != nil {
 								log.Println(err)
 								s.Error = err.Error()
 							} else {
-								// Register Customer with BC
-								if err := users.RegisterCustomer(s.Alias, key, customerId); err != nil {
-									log.Println(err)
-									s.Error = err.Error()
-								} else {
-									if welcomer != nil {
-										if err := welcomer.WelcomeEmail(s.Alias, s.Email); err != nil {
-											log.Println(err)
-										}
+								if welcomer != nil {
+									if err := welcomer.WelcomeEmail(s.Alias, s.Email); err != nil {
+										log.Println(err)
 									}
-									// TODO(v1) Mine transaction into BC which moves welcome tokens from server to customer
-									/*
-									   transaction := &conveygo.Transaction{
-									       Sender:   merchant,
-									       Receiver: customer,
-									       Amount:   uint64(q),
-									   }
-									   log.Println("Transaction", transaction)
-									   if err := s.Node.MineProto(transactions, bcgo.THRESHOLD_G, s.Listener, nil, nil, transaction); err != nil {
-									       log.Println(err)
-									       return
-									   }
-									*/
-									// TODO(v3) Subscribe email to weely digest
-									// Success!
-									RedirectSignedUp(w, r)
-									return
 								}
+								// TODO(v1) Mine transaction into BC which moves welcome tokens from server to customer
+								/*
+								   transaction := &conveygo.Transaction{
+								       Sender:   merchant,
+								       Receiver: customer,
+								       Amount:   uint64(q),
+								   }
+								   log.Println("Transaction", transaction)
+								   if err := s.Node.MineProto(transactions, bcgo.THRESHOLD_G, s.Listener, nil, nil, transaction); err != nil {
+								       log.Println(err)
+								       return
+								   }
+								*/
+								// TODO(v3) Subscribe email to weely digest
+								// Success!
+								RedirectSignedUp(w, r)
+								return
 							}
 						}
 					}
@@ -243,3 +236,17 @@ func SignUpVerificationHandler(sessions SessionStore, users conveygo.UserStore,
 		}
 	}
 }
+
+// registerCustomer registers the alias as a customer of the payment processor, and records the customer in BC.
+// Without a payment processor the alias has no customer, which the account page already allows for.
+func registerCustomer(users conveygo.UserStore, payments PaymentProcessor, s *SignUpSession, key *rsa.PrivateKey) error {
+	if payments == nil {
+		log.Println("No payment processor, not registering customer for", s.Alias)
+		return nil
+	}
+	customerId, err := payments.RegisterCustomer(s.Name, s.Email, s.Alias)
+	if err != nil {
+		return err
+	}
+	return users.RegisterCustomer(s.Alias, key, customerId)
+}
@@ -370,6 +370,38 @@ func TestSignUpVerificationHandler(t *testing.T) {
 			t.Errorf("Wrong email; expected '%s', got '%s'", emailwelcomer.Email, email)
 		}
 	})
+	t.Run("POSTNoPaymentProcessor", func(t *testing.T) {
+		sessionstore := main.NewMemorySessionStore()
+		userstore := conveygo.NewMemoryStore()
+
+		id, err := sessionstore.CreateSignUpSession()
+		testinggo.AssertNoError(t, err)
+		session := sessionstore.GetSignUpSession(id)
+		session.Email = email
+		session.Alias = alias
+		session.Password = password
+		session.Name = alias
+		session.Challenge = "challenge1234"
+		cookie := main.CreateSignUpSessionCookie(id, sessionstore.GetSignUpSessionTimeout())
+
+		handler := main.SignUpVerificationHandler(sessionstore, userstore, nil, nil, makeSignUpTemplate(t))
+
+		data := &url.Values{}
+		data.Set("verification", "challenge1234")
+		request := makePostSignUpVerificationRequestForm(t, data)
+		request.AddCookie(cookie)
+		response := httptest.NewRecorder()
+		handler(response, request)
+		if response.Code != http.StatusFound {
+			t.Errorf("Wrong response code; expected '%d', got '%d'", http.StatusFound, response.Code)
+		}
+		if actual, expected := response.Header().Get("Location"), "/signed-up.html"; actual != expected {
+			t.Errorf("Wrong response; expected '%s', got '%s'", expected, actual)
+		}
+		if !userstore.HasKey(alias) {
+			t.Error("User was not added")
+		}
+	})
 }
 
 func getSignUpCookie(t *testing.T, handler func(http.ResponseWriter, *http.Request)) *http.Cookie {
@@ -121,3 +121,38 @@ func (v SmtpEmailWelcomer) WelcomeEmail(alias, email string) error {
 	}
 	return nil
 }
+
+type SmtpReserveAlerter struct {
+	Address    string
+	Sender     string
+	Recipients []string
+	Template   *template.Template
+}
+
+func NewSmtpReserveAlerter(address, sender string, recipients []string, template *template.Template) *SmtpReserveAlerter {
+	return &SmtpReserveAlerter{
+		Address:    address,
+		Sender:     sender,
+		Recipients: recipients,
+		Template:   template,
+	}
+}
+
+func (a SmtpReserveAlerter) AlertReserve(status *ReserveStatus) error {
+	log.Println("Alerting Reserve", status.Level)
+	for _, r := range a.Recipients {
+		data := struct {
+			From   string
+			To     string
+			Status *ReserveStatus
+		}{
+			From:   a.Sender,
+			To:     r,
+			Status: status,
+		}
+		if err := SetEmail(a.Address, a.Sender, r, a.Template, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
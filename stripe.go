@@ -18,25 +18,31 @@ package main
 
 import (
 	"crypto/rsa"
+	"errors"
+	"fmt"
 	"github.com/AletheiaWareLLC/aliasgo"
 	"github.com/AletheiaWareLLC/bcgo"
-	"github.com/AletheiaWareLLC/conveygo"
 	"github.com/AletheiaWareLLC/financego"
 	"github.com/stripe/stripe-go"
 	"github.com/stripe/stripe-go/customer"
 	"github.com/stripe/stripe-go/paymentintent"
 	"github.com/stripe/stripe-go/paymentmethod"
-	"github.com/stripe/stripe-go/product"
 	"github.com/stripe/stripe-go/setupintent"
 	"log"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
 	META_ALIAS_MERCHANT  = "merchant_alias"
 	META_ALIAS_CUSTOMER  = "customer_alias"
 	META_QUANTITY_TOKENS = "token_quantity"
-	META_BUNDLE_PRICE    = "bundle_price"
+	META_PRODUCT_ID      = "product_id"
+
+	STRIPE_EVENT_RETRY_PERIOD = time.Minute
+	STRIPE_EVENT_ATTEMPTS     = 60 // Attempts to handle an event before it is marked as failed
 )
 
 type StripePaymentProcessor struct {
@@ -94,6 +100,14 @@ func (s *StripePaymentProcessor) AddPaymentMethod(customerId, paymentMethodId st
 }
 
 func (s *StripePaymentProcessor) GetPaymentMethods(customerId string) ([]*PaymentMethod, error) {
+	c, err := customer.Get(customerId, nil)
+	if err != nil {
+		return nil, err
+	}
+	defaultId := ""
+	if c.InvoiceSettings != nil && c.InvoiceSettings.DefaultPaymentMethod != nil {
+		defaultId = c.InvoiceSettings.DefaultPaymentMethod.ID
+	}
 	params := &stripe.PaymentMethodListParams{
 		Customer: stripe.String(customerId),
 		Type:     stripe.String("card"),
@@ -103,13 +117,15 @@ func (s *StripePaymentProcessor) GetPaymentMethods(customerId string) ([]*Paymen
 	for iterator.Next() {
 		p := iterator.PaymentMethod()
 		methods = append(methods, &PaymentMethod{
+			Default: p.ID == defaultId,
 			Card: &PaymentMethodCard{
-				Brand:    string(p.Card.Brand),
-				Country:  p.Card.Country,
-				ExpMonth: p.Card.ExpMonth,
-				ExpYear:  p.Card.ExpYear,
-				Funding:  string(p.Card.Funding),
-				Last4:    p.Card.Last4,
+				Brand:       string(p.Card.Brand),
+				Country:     p.Card.Country,
+				ExpMonth:    p.Card.ExpMonth,
+				ExpYear:     p.Card.ExpYear,
+				Fingerprint: p.Card.Fingerprint,
+				Funding:     string(p.Card.Funding),
+				Last4:       p.Card.Last4,
 			},
 			ID: p.ID,
 			BillingDetails: &BillingDetails{
@@ -127,410 +143,457 @@ func (s *StripePaymentProcessor) GetPaymentMethods(customerId string) ([]*Paymen
 			},
 		})
 	}
+	if err := iterator.Err(); err != nil {
+		return nil, err
+	}
 	return methods, nil
 }
 
-func (s *StripePaymentProcessor) NewPaymentIntent(customerId, paymentMethodId, alias, description string, quantity, amount int64) (string, error) {
+// getPaymentMethod returns the payment method with the given ID, if it is attached to the given customer.
+func (s *StripePaymentProcessor) getPaymentMethod(customerId, paymentMethodId string) (*stripe.PaymentMethod, error) {
+	pm, err := paymentmethod.Get(paymentMethodId, nil)
+	if err != nil {
+		return nil, err
+	}
+	if pm.Customer == nil || pm.Customer.ID != customerId {
+		return nil, errors.New(fmt.Sprintf(ERROR_NO_SUCH_PAYMENT_METHOD, paymentMethodId))
+	}
+	return pm, nil
+}
+
+func (s *StripePaymentProcessor) DetachPaymentMethod(customerId, paymentMethodId string) error {
+	if _, err := s.getPaymentMethod(customerId, paymentMethodId); err != nil {
+		return err
+	}
+	pm, err := paymentmethod.Detach(paymentMethodId, &stripe.PaymentMethodDetachParams{})
+	if err != nil {
+		return err
+	}
+	log.Println("Stripe Payment Method Detached", pm.ID)
+	return nil
+}
+
+func (s *StripePaymentProcessor) SetDefaultPaymentMethod(customerId, paymentMethodId string) error {
+	if _, err := s.getPaymentMethod(customerId, paymentMethodId); err != nil {
+		return err
+	}
+	c, err := customer.Update(customerId, &stripe.CustomerParams{
+		InvoiceSettings: &stripe.CustomerInvoiceSettingsParams{
+			DefaultPaymentMethod: stripe.String(paymentMethodId),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	log.Println("Stripe Customer Default Payment Method", c.ID, paymentMethodId)
+	return nil
+}
+
+// NewPaymentIntent confirms a payment while the customer is on-session, so the payment can be authenticated if the card issuer requires it.
+func (s *StripePaymentProcessor) NewPaymentIntent(customerId, paymentMethodId, alias, productId, description, currency string, quantity, amount int64) (*PaymentIntent, error) {
 	params := &stripe.PaymentIntentParams{
 		Amount:        stripe.Int64(amount),
-		Currency:      stripe.String(string(stripe.CurrencyUSD)),
+		Currency:      stripe.String(currency),
 		Customer:      stripe.String(customerId),
 		PaymentMethod: stripe.String(paymentMethodId),
 		Description:   stripe.String(description),
 		Confirm:       stripe.Bool(true),
-		OffSession:    stripe.Bool(true),
 	}
 	params.AddMetadata(META_ALIAS_MERCHANT, s.Node.Alias)
 	params.AddMetadata(META_ALIAS_CUSTOMER, alias)
 	params.AddMetadata(META_QUANTITY_TOKENS, strconv.FormatInt(quantity, 10))
+	params.AddMetadata(META_PRODUCT_ID, productId)
 
 	c, err := paymentintent.New(params)
 	if err != nil {
-		return "", err
+		// Declined payments return an error which holds the failed intent
+		if e, ok := err.(*stripe.Error); ok && e.PaymentIntent != nil {
+			log.Println("Stripe Charge Failed", e.PaymentIntent.ID, e.Msg)
+			intent := newPaymentIntent(e.PaymentIntent)
+			intent.Error = e.Msg
+			return intent, nil
+		}
+		return nil, err
 	}
 	log.Println("Stripe Charge", c)
-	return c.ID, nil
+	return newPaymentIntent(c), nil
 }
 
-func (s *StripePaymentProcessor) GetProducts(productIds []string) (map[string]*Product, error) {
-	var ids []*string
-	for _, v := range productIds {
-		ids = append(ids, stripe.String(v))
+func (s *StripePaymentProcessor) GetPaymentIntent(paymentIntentId string) (*PaymentIntent, error) {
+	c, err := paymentintent.Get(paymentIntentId, nil)
+	if err != nil {
+		return nil, err
 	}
-	params := &stripe.ProductListParams{
-		Active: stripe.Bool(true),
-		IDs:    ids,
+	intent := newPaymentIntent(c)
+	if c.LastPaymentError != nil {
+		intent.Error = c.LastPaymentError.Msg
 	}
-	iterator := product.List(params)
-	products := make(map[string]*Product)
-	for iterator.Next() {
-		p := iterator.Product()
-		log.Println("ID", p.ID)
-		log.Println("Active", p.Active)
-		log.Println("Created", p.Created)
-		log.Println("Updated", p.Updated)
-		log.Println("Name", p.Name)
-		log.Println("Description", p.Description)
-		log.Println("Images", p.Images)
-		log.Println("Metadata", p.Metadata)
-		quantity, err := strconv.Atoi(p.Metadata[META_QUANTITY_TOKENS])
-		if err != nil {
-			return nil, err
+	return intent, nil
+}
+
+func newPaymentIntent(p *stripe.PaymentIntent) *PaymentIntent {
+	return &PaymentIntent{
+		ID:           p.ID,
+		Status:       string(p.Status),
+		ClientSecret: p.ClientSecret,
+	}
+}
+
+// StripeEventQueue handles Stripe events in the mining queue, so the webhook can respond without waiting for proof of work.
+// Each event is kept in the inbox until it has been handled, so events which fail, or arrive while the queue is full, are retried periodically.
+// Events which fail every attempt are marked as failed in the inbox, and are no longer retried.
+type StripeEventQueue struct {
+	Queue    *MiningQueue
+	Inbox    EventInbox
+	Handler  func(*bcgo.Node, *stripe.Event) error
+	Channels []*bcgo.Channel // Pushed once each event is handled
+	Attempts int
+	lock     sync.Mutex
+	queued   map[string]bool
+	stop     chan bool
+}
+
+func NewStripeEventQueue(queue *MiningQueue, inbox EventInbox, handler func(*bcgo.Node, *stripe.Event) error, channels ...*bcgo.Channel) *StripeEventQueue {
+	return &StripeEventQueue{
+		Queue:    queue,
+		Inbox:    inbox,
+		Handler:  handler,
+		Channels: channels,
+		Attempts: STRIPE_EVENT_ATTEMPTS,
+		queued:   make(map[string]bool),
+		stop:     make(chan bool),
+	}
+}
+
+// Handle keeps the given event in the inbox and queues it to be handled.
+func (q *StripeEventQueue) Handle(event *stripe.Event) {
+	if err := q.Inbox.Add(event); err != nil {
+		log.Println(err)
+	}
+	if err := q.enqueue(event); err != nil {
+		// Left in the inbox to be retried
+		log.Println("Stripe event", event.ID, err)
+	}
+}
+
+func (q *StripeEventQueue) enqueue(event *stripe.Event) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.queued[event.ID] {
+		return nil
+	}
+	if _, err := q.Queue.Enqueue("", "Stripe event "+event.ID, "", func(node *bcgo.Node) ([]*bcgo.Channel, []string, error) {
+		defer q.dequeue(event.ID)
+		if err := q.Handler(node, event); err != nil {
+			if err := q.Inbox.Retry(event.ID, err.Error(), q.Attempts); err != nil {
+				log.Println(err)
+			}
+			return nil, nil, err
+		}
+		if err := q.Inbox.Remove(event.ID); err != nil {
+			return nil, nil, err
 		}
-		price, err := strconv.Atoi(p.Metadata[META_BUNDLE_PRICE])
-		if err != nil {
-			return nil, err
+		return q.Channels, nil, nil
+	}); err != nil {
+		return err
+	}
+	q.queued[event.ID] = true
+	return nil
+}
+
+func (q *StripeEventQueue) dequeue(id string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	delete(q.queued, id)
+}
+
+func (q *StripeEventQueue) Start() {
+	// Retry the events left from before the server restarted
+	if err := q.Run(); err != nil {
+		log.Println(err)
+	}
+	ticker := time.NewTicker(STRIPE_EVENT_RETRY_PERIOD)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := q.Run(); err != nil {
+				log.Println(err)
+			}
+		case <-q.stop:
+			return
 		}
-		products[p.ID] = &Product{
-			ID:       p.ID,
-			Quantity: uint64(quantity),
-			Price:    uint64(price),
+	}
+}
+
+func (q *StripeEventQueue) Stop() {
+	close(q.stop)
+}
+
+// Run queues every event waiting in the inbox which isn't already queued.
+func (q *StripeEventQueue) Run() error {
+	events, err := q.Inbox.GetAll()
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		if err := q.enqueue(event); err != nil {
+			// Queue is full, try again next time
+			return err
 		}
 	}
-	return products, nil
+	return nil
 }
 
-func NewStripeEventHandler(aliases, charges, transactions *bcgo.Channel, node *bcgo.Node, listener bcgo.MiningListener) func(*stripe.Event) {
-	return func(event *stripe.Event) {
-		merchant := event.GetObjectValue("metadata", META_ALIAS_MERCHANT)
+// NewStripeEventHandler returns a function to handle Stripe events, mining with the given node.
+// Stripe retries webhooks which aren't acknowledged in time, so events are processed one at a time and are skipped if the journal shows they were already processed, or if the charge channel shows the charge was already credited.
+// Events which move tokens or report fraud are handled here, all other events are passed to the recorder.
+// An error is returned if the event wasn't fully handled, so it can be retried.
+func NewStripeEventHandler(aliases, charges, transactions *bcgo.Channel, node *bcgo.Node, miner *ChannelMiner, listener bcgo.MiningListener, clawbacks *Clawbacks, flags FraudFlags, journal EventJournal, recorder *StripeEventRecorder) func(*bcgo.Node, *stripe.Event) error {
+	var lock sync.Mutex
+	return func(offline *bcgo.Node, event *stripe.Event) error {
+		lock.Lock()
+		defer lock.Unlock()
+		if journal.IsProcessed(event.ID) {
+			log.Println("Event already processed", event.ID)
+			return nil
+		}
+		merchant := GetEventValue(event, "metadata", META_ALIAS_MERCHANT)
+		if merchant == "" && (strings.HasPrefix(event.Type, "charge.dispute.") || strings.HasPrefix(event.Type, "radar.early_fraud_warning.")) {
+			// Disputes and fraud warnings don't carry the metadata of the charge
+			if c, err := clawbacks.GetCharge(GetEventValue(event, "charge")); err != nil {
+				log.Println(err)
+			} else {
+				merchant = c.Charge.MerchantAlias
+			}
+		}
+		if merchant == "" {
+			// Other objects are identified by the registration of their customer
+			merchant = recorder.GetMerchant(event)
+		}
 		log.Println("Merchant", merchant)
-		if merchant == node.Alias {
-			switch event.Type {
-			case "account.updated":
-				// TODO mine event into BC
-			case "account.external_account.created":
-				// TODO mine event into BC
-			case "account.external_account.deleted":
-				// TODO mine event into BC
-			case "account.external_account.updated":
-				// TODO mine event into BC
-			case "balance.available":
-				// TODO mine event into BC
-			case "capability.updated":
-				// TODO mine event into BC
-			case "charge.captured":
-				// TODO mine event into BC
-			case "charge.expired":
-				// TODO mine event into BC
-			case "charge.failed":
-				// TODO mine event into BC
-			case "charge.pending":
-				// TODO mine event into BC
-			case "charge.refunded":
-				// TODO mine event into BC
-			case "charge.succeeded":
-				// TODO mine event into BC
-				customer := event.GetObjectValue("metadata", META_ALIAS_CUSTOMER)
-				quantity := event.GetObjectValue("metadata", META_QUANTITY_TOKENS)
-				amount := event.GetObjectValue("amount")
-				chargeId := event.GetObjectValue("id")
-				currency := event.GetObjectValue("currency")
-				description := event.GetObjectValue("description")
-				paymentId := event.GetObjectValue("payment_method")
-
-				log.Println("Customer", customer)
-				log.Println("Quantity", quantity)
-				log.Println("Amount", amount)
-				log.Println("ChargeId", chargeId)
-				log.Println("Currency", currency)
-				log.Println("Description", description)
-				log.Println("PaymentId", paymentId)
-
-				a, err := strconv.Atoi(amount)
-				if err != nil {
-					log.Println(err)
-					return
-				}
-				q, err := strconv.Atoi(quantity)
-				if err != nil {
-					log.Println(err)
-					return
-				}
+		if merchant == "" {
+			recorder.Audit(event, ERROR_UNRESOLVED_MERCHANT)
+			return journal.MarkProcessed(event.ID)
+		}
+		if merchant != node.Alias {
+			return nil
+		}
+		switch event.Type {
+		case "charge.refunded":
+			quantity := GetEventValue(event, "metadata", META_QUANTITY_TOKENS)
+			chargeId := GetEventValue(event, "id")
 
-				publicKey, err := aliasgo.GetPublicKey(aliases, node.Cache, node.Network, customer)
-				if err != nil {
-					log.Println(err)
-					return
-				}
+			log.Println("Quantity", quantity)
+			log.Println("ChargeId", chargeId)
+
+			q, err := strconv.ParseInt(quantity, 10, 64)
+			if err != nil {
+				return err
+			}
+			a, err := GetEventInt(event, "amount")
+			if err != nil {
+				return err
+			}
+			r, err := GetEventInt(event, "amount_refunded")
+			if err != nil {
+				return err
+			}
+
+			log.Println("Amount", a)
+			log.Println("Refunded", r)
+
+			original, err := clawbacks.GetCharge(chargeId)
+			if err != nil {
+				return err
+			}
 
-				charge := &financego.Charge{
-					MerchantAlias: merchant,
-					CustomerAlias: customer,
-					Processor:     financego.PaymentProcessor_STRIPE,
-					PaymentId:     paymentId,
-					ChargeId:      chargeId,
-					Amount:        int64(a),
-					Currency:      currency,
-					Description:   description,
+			// Amount refunded is cumulative, record only the amount refunded by this event
+			if err := clawbacks.Reverse(offline, chargeId, event.Type, original.Refunded-r, ReclaimQuantity(q, a, r)); err != nil {
+				return err
+			}
+		case "charge.succeeded":
+			customer := GetEventValue(event, "metadata", META_ALIAS_CUSTOMER)
+			quantity := GetEventValue(event, "metadata", META_QUANTITY_TOKENS)
+			productId := GetEventValue(event, "metadata", META_PRODUCT_ID)
+			chargeId := GetEventValue(event, "id")
+			currency := GetEventValue(event, "currency")
+			description := GetEventValue(event, "description")
+			paymentId := GetEventValue(event, "payment_method")
+
+			log.Println("Customer", customer)
+			log.Println("Quantity", quantity)
+			log.Println("ProductId", productId)
+			log.Println("ChargeId", chargeId)
+			log.Println("Currency", currency)
+			log.Println("Description", description)
+			log.Println("PaymentId", paymentId)
+
+			a, err := GetEventInt(event, "amount")
+			if err != nil {
+				return err
+			}
+			q, err := strconv.Atoi(quantity)
+			if err != nil {
+				return err
+			}
+
+			log.Println("Amount", a)
+
+			if err := clawbacks.Update(); err != nil {
+				return err
+			}
+			if original, err := clawbacks.GetCharge(chargeId); err == nil {
+				if original.Credited > 0 {
+					log.Println("Charge already credited", chargeId)
+					break
 				}
-				log.Println("Charge", charge)
-				if err := node.MineProto(charges, bcgo.THRESHOLD_G, listener, map[string]*rsa.PublicKey{
-					customer: publicKey,
-					merchant: &node.Key.PublicKey,
-				}, nil, charge); err != nil {
-					log.Println(err)
-					return
+				// Charge was mined but the transaction wasn't, credit the existing charge
+				if err := MineTransaction(offline, miner, listener, transactions, merchant, offline.Key, customer, uint64(q), []*bcgo.Reference{
+					original.Reference,
+				}); err != nil {
+					return err
 				}
+				break
+			}
 
-				transaction := &conveygo.Transaction{
-					Sender:   merchant,
-					Receiver: customer,
-					Amount:   uint64(q),
-				}
-				log.Println("Transaction", transaction)
-				if err := node.MineProto(transactions, bcgo.THRESHOLD_G, listener, nil, nil, transaction); err != nil {
-					log.Println(err)
-					return
+			publicKey, err := aliasgo.GetPublicKey(aliases, node.Cache, node.Network, customer)
+			if err != nil {
+				return err
+			}
+
+			charge := &financego.Charge{
+				MerchantAlias: merchant,
+				CustomerAlias: customer,
+				Processor:     financego.PaymentProcessor_STRIPE,
+				PaymentId:     paymentId,
+				ChargeId:      chargeId,
+				Amount:        a,
+				ProductId:     productId,
+				Currency:      currency,
+				Description:   description,
+			}
+			log.Println("Charge", charge)
+			reference, err := MineRecord(offline, miner, listener, charges, offline.Alias, offline.Key, map[string]*rsa.PublicKey{
+				customer: publicKey,
+				merchant: &node.Key.PublicKey,
+			}, nil, map[string]string{
+				META_QUANTITY_TOKENS: quantity,
+			}, charge)
+			if err != nil {
+				return err
+			}
+
+			// Reference the charge so the tokens can be reclaimed if the charge is refunded or disputed
+			if err := MineTransaction(offline, miner, listener, transactions, merchant, offline.Key, customer, uint64(q), []*bcgo.Reference{
+				reference,
+			}); err != nil {
+				return err
+			}
+
+			// Radar allowed the charge but considered it likely to be fraudulent
+			if GetEventValue(event, "outcome", "risk_level") == "highest" {
+				if err := flags.Flag(&FraudFlag{
+					Alias:    customer,
+					Reason:   FRAUD_HIGHEST_RISK,
+					ChargeId: chargeId,
+					EventId:  event.ID,
+					Time:     time.Now().UTC(),
+				}); err != nil {
+					return err
 				}
-			case "charge.updated":
-				// TODO mine event into BC
-			case "charge.dispute.closed":
-				// TODO mine event into BC
-			case "charge.dispute.created":
-				// TODO mine event into BC
-			case "charge.dispute.funds_reinstated":
-				// TODO mine event into BC
-			case "charge.dispute.funds_withdrawn":
-				// TODO mine event into BC
-			case "charge.dispute.updated":
-				// TODO mine event into BC
-			case "charge.refund.updated":
-				// TODO mine event into BC
-			case "checkout.session.completed":
-				// TODO mine event into BC
-			case "coupon.created":
-				// TODO mine event into BC
-			case "coupon.deleted":
-				// TODO mine event into BC
-			case "coupon.updated":
-				// TODO mine event into BC
-			case "credit_note.created":
-				// TODO mine event into BC
-			case "credit_note.updated":
-				// TODO mine event into BC
-			case "credit_note.voided":
-				// TODO mine event into BC
-			case "customer.created":
-				// TODO mine event into BC
-				customer := event.GetObjectValue("metadata", META_ALIAS_CUSTOMER)
-				log.Println("Customer", customer)
-			case "customer.deleted":
-				// TODO mine event into BC
-			case "customer.updated":
-				// TODO mine event into BC
-			case "customer.bank_account.deleted":
-				// TODO mine event into BC
-			case "customer.discount.created":
-				// TODO mine event into BC
-			case "customer.discount.deleted":
-				// TODO mine event into BC
-			case "customer.discount.updated":
-				// TODO mine event into BC
-			case "customer.source.created":
-				// TODO mine event into BC
-			case "customer.source.deleted":
-				// TODO mine event into BC
-			case "customer.source.expiring":
-				// TODO mine event into BC
-			case "customer.source.updated":
-				// TODO mine event into BC
-			case "customer.subscription.created":
-				// TODO mine event into BC
-			case "customer.subscription.deleted":
-				// TODO mine event into BC
-			case "customer.subscription.trial_will_end":
-				// TODO mine event into BC
-			case "customer.subscription.updated":
-				// TODO mine event into BC
-			case "customer.tax_id.created":
-				// TODO mine event into BC
-			case "customer.tax_id.deleted":
-				// TODO mine event into BC
-			case "customer.tax_id.updated":
-				// TODO mine event into BC
-			case "file.created":
-				// TODO mine event into BC
-			case "invoice.created":
-				// TODO mine event into BC
-			case "invoice.deleted":
-				// TODO mine event into BC
-			case "invoice.finalized":
-				// TODO mine event into BC
-			case "invoice.marked_uncollectible":
-				// TODO mine event into BC
-			case "invoice.payment_action_required":
-				// TODO mine event into BC
-			case "invoice.payment_failed":
-				// TODO mine event into BC
-			case "invoice.payment_succeeded":
-				// TODO mine event into BC
-			case "invoice.sent":
-				// TODO mine event into BC
-			case "invoice.upcoming":
-				// TODO mine event into BC
-			case "invoice.updated":
-				// TODO mine event into BC
-			case "invoice.voided":
-				// TODO mine event into BC
-			case "invoiceitem.created":
-				// TODO mine event into BC
-			case "invoiceitem.deleted":
-				// TODO mine event into BC
-			case "invoiceitem.updated":
-				// TODO mine event into BC
-			case "issuing_authorization.created":
-				// TODO mine event into BC
-			case "issuing_authorization.request":
-				// TODO mine event into BC
-			case "issuing_authorization.updated":
-				// TODO mine event into BC
-			case "issuing_card.created":
-				// TODO mine event into BC
-			case "issuing_card.updated":
-				// TODO mine event into BC
-			case "issuing_cardholder.created":
-				// TODO mine event into BC
-			case "issuing_cardholder.updated":
-				// TODO mine event into BC
-			case "issuing_dispute.created":
-				// TODO mine event into BC
-			case "issuing_dispute.updated":
-				// TODO mine event into BC
-			case "issuing_settlement.created":
-				// TODO mine event into BC
-			case "issuing_settlement.updated":
-				// TODO mine event into BC
-			case "issuing_transaction.created":
-				// TODO mine event into BC
-			case "issuing_transaction.updated":
-				// TODO mine event into BC
-			case "order.created":
-				// TODO mine event into BC
-			case "order.payment_failed":
-				// TODO mine event into BC
-			case "order.payment_succeeded":
-				// TODO mine event into BC
-			case "order.updated":
-				// TODO mine event into BC
-			case "order_return.created":
-				// TODO mine event into BC
-			case "payment_intent.amount_capturable_updated":
-				// TODO mine event into BC
-			case "payment_intent.created":
-				// TODO mine event into BC
-			case "payment_intent.payment_failed":
-				// TODO mine event into BC
-			case "payment_intent.succeeded":
-				// TODO mine event into BC
-			case "payment_method.attached":
-				// TODO mine event into BC
-			case "payment_method.card_automatically_updated":
-				// TODO mine event into BC
-			case "payment_method.detached":
-				// TODO mine event into BC
-			case "payment_method.updated":
-				// TODO mine event into BC
-			case "payout.canceled":
-				// TODO mine event into BC
-			case "payout.created":
-				// TODO mine event into BC
-			case "payout.failed":
-				// TODO mine event into BC
-			case "payout.paid":
-				// TODO mine event into BC
-			case "payout.updated":
-				// TODO mine event into BC
-			case "person.created":
-				// TODO mine event into BC
-			case "person.deleted":
-				// TODO mine event into BC
-			case "person.updated":
-				// TODO mine event into BC
-			case "plan.created":
-				// TODO mine event into BC
-			case "plan.deleted":
-				// TODO mine event into BC
-			case "plan.updated":
-				// TODO mine event into BC
-			case "product.created":
-				// TODO mine event into BC
-			case "product.deleted":
-				// TODO mine event into BC
-			case "product.updated":
-				// TODO mine event into BC
-			case "radar.early_fraud_warning.created":
-				// TODO mine event into BC
-			case "radar.early_fraud_warning.updated":
-				// TODO mine event into BC
-			case "recipient.created":
-				// TODO mine event into BC
-			case "recipient.deleted":
-				// TODO mine event into BC
-			case "recipient.updated":
-				// TODO mine event into BC
-			case "reporting.report_run.failed":
-				// TODO mine event into BC
-			case "reporting.report_run.succeeded":
-				// TODO mine event into BC
-			case "reporting.report_type.updated":
-				// TODO mine event into BC
-			case "review.closed":
-				// TODO mine event into BC
-			case "review.opened":
-				// TODO mine event into BC
-			case "setup_intent.created":
-				// TODO mine event into BC
-			case "setup_intent.setup_failed":
-				// TODO mine event into BC
-			case "setup_intent.succeeded":
-				// TODO mine event into BC
-			case "sigma.scheduled_query_run.created":
-				// TODO mine event into BC
-			case "sku.created":
-				// TODO mine event into BC
-			case "sku.deleted":
-				// TODO mine event into BC
-			case "sku.updated":
-				// TODO mine event into BC
-			case "source.canceled":
-				// TODO mine event into BC
-			case "source.chargeable":
-				// TODO mine event into BC
-			case "source.failed":
-				// TODO mine event into BC
-			case "source.mandate_notification":
-				// TODO mine event into BC
-			case "source.refund_attributes_required":
-				// TODO mine event into BC
-			case "source.transaction.created":
-				// TODO mine event into BC
-			case "source.transaction.updated":
-				// TODO mine event into BC
-			case "tax_rate.created":
-				// TODO mine event into BC
-			case "tax_rate.updated":
-				// TODO mine event into BC
-			case "topup.canceled":
-				// TODO mine event into BC
-			case "topup.created":
-				// TODO mine event into BC
-			case "topup.failed":
-				// TODO mine event into BC
-			case "topup.reversed":
-				// TODO mine event into BC
-			case "topup.succeeded":
-				// TODO mine event into BC
-			case "transfer.created":
-				// TODO mine event into BC
-			case "transfer.failed":
-				// TODO mine event into BC
-			case "transfer.paid":
-				// TODO mine event into BC
-			case "transfer.reversed":
-				// TODO mine event into BC
-			case "transfer.updated":
-				// TODO mine event into BC
+			}
+		case "charge.dispute.created":
+			// Reclaim the disputed tokens as soon as the dispute is opened
+			chargeId := GetEventValue(event, "charge")
+			a, err := GetEventInt(event, "amount")
+			if err != nil {
+				return err
+			}
+
+			log.Println("ChargeId", chargeId)
+			log.Println("Amount", a)
+
+			original, err := clawbacks.GetCharge(chargeId)
+			if err != nil {
+				return err
+			}
+
+			target := ReclaimQuantity(original.Quantity, original.Charge.Amount, a)
+			if target < original.Reversed {
+				target = original.Reversed
+			}
+			if err := clawbacks.Reverse(offline, chargeId, event.Type, 0, target); err != nil {
+				return err
+			}
+		case "charge.dispute.funds_reinstated":
+			// Dispute won, return the disputed tokens
+			chargeId := GetEventValue(event, "charge")
+			a, err := GetEventInt(event, "amount")
+			if err != nil {
+				return err
+			}
+
+			log.Println("ChargeId", chargeId)
+			log.Println("Amount", a)
+
+			original, err := clawbacks.GetCharge(chargeId)
+			if err != nil {
+				return err
+			}
+
+			target := original.Reversed - ReclaimQuantity(original.Quantity, original.Charge.Amount, a)
+			if err := clawbacks.Reverse(offline, chargeId, event.Type, a, target); err != nil {
+				return err
+			}
+		case "charge.dispute.funds_withdrawn":
+			// Tokens were reclaimed when the dispute was opened, record the withdrawal of funds
+			chargeId := GetEventValue(event, "charge")
+			a, err := GetEventInt(event, "amount")
+			if err != nil {
+				return err
+			}
+
+			log.Println("ChargeId", chargeId)
+			log.Println("Amount", a)
+
+			original, err := clawbacks.GetCharge(chargeId)
+			if err != nil {
+				return err
+			}
+
+			target := ReclaimQuantity(original.Quantity, original.Charge.Amount, a)
+			if target < original.Reversed {
+				target = original.Reversed
+			}
+			if err := clawbacks.Reverse(offline, chargeId, event.Type, -a, target); err != nil {
+				return err
+			}
+		case "radar.early_fraud_warning.created":
+			// The card issuer reported the charge as fraudulent, freeze the customer until investigated
+			chargeId := GetEventValue(event, "charge")
+
+			log.Println("ChargeId", chargeId)
+
+			original, err := clawbacks.GetCharge(chargeId)
+			if err != nil {
+				return err
+			}
+			if err := flags.Flag(&FraudFlag{
+				Alias:    original.Charge.CustomerAlias,
+				Reason:   FRAUD_EARLY_WARNING,
+				ChargeId: chargeId,
+				EventId:  event.ID,
+				Time:     time.Now().UTC(),
+			}); err != nil {
+				return err
+			}
+			recorder.Audit(event, FRAUD_EARLY_WARNING)
+		default:
+			if err := recorder.Record(offline, event, merchant); err != nil {
+				return err
 			}
 		}
+		return journal.MarkProcessed(event.ID)
 	}
 }
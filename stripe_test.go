@@ -17,8 +17,15 @@
 package main_test
 
 import (
+	"errors"
+	"fmt"
+	"github.com/AletheiaWareLLC/bcgo"
+	"github.com/AletheiaWareLLC/conveygo"
+	"github.com/AletheiaWareLLC/conveyservergo"
 	"github.com/AletheiaWareLLC/testinggo"
+	"github.com/stripe/stripe-go"
 	"net/http"
+	"path"
 	"testing"
 )
 
@@ -39,3 +46,250 @@ func makeGetStripeRequest(t *testing.T) *http.Request {
 	testinggo.AssertNoError(t, err)
 	return request
 }
+
+func TestStripeEventQueue(t *testing.T) {
+	node := makeNode(t, "Merchant", makeKey(t))
+	event := makeStripeEvent(t, `{"id":"evt_1","type":"balance.available","data":{"object":{"object":"balance"}}}`)
+	// handler fails the given number of times before succeeding
+	handler := func(failures int, calls *int) func(*bcgo.Node, *stripe.Event) error {
+		return func(n *bcgo.Node, e *stripe.Event) error {
+			*calls++
+			if n == node {
+				t.Errorf("Expected event to be handled with the queue's offline node")
+			}
+			if *calls <= failures {
+				return errors.New("Failed")
+			}
+			return nil
+		}
+	}
+	assertInbox := func(t *testing.T, inbox main.EventInbox, expected int) {
+		t.Helper()
+		events, err := inbox.GetAll()
+		testinggo.AssertNoError(t, err)
+		if len(events) != expected {
+			t.Errorf("Wrong number of events in inbox; expected '%d', got '%d'", expected, len(events))
+		}
+	}
+	t.Run("Handled", func(t *testing.T) {
+		dir := testinggo.MakeTempDir(t, "stripe")
+		defer testinggo.UnmakeTempDir(t, dir)
+		inbox := main.NewFileEventInbox(path.Join(dir, "inbox.json"))
+		calls := 0
+		events := main.NewStripeEventQueue(makeMiningQueue(t, node), inbox, handler(0, &calls))
+		events.Handle(event)
+		// Wait for the job to finish
+		events.Queue.Stop()
+		if calls != 1 {
+			t.Errorf("Wrong calls; expected '%d', got '%d'", 1, calls)
+		}
+		assertInbox(t, inbox, 0)
+	})
+	t.Run("Failed", func(t *testing.T) {
+		dir := testinggo.MakeTempDir(t, "stripe")
+		defer testinggo.UnmakeTempDir(t, dir)
+		inbox := main.NewFileEventInbox(path.Join(dir, "inbox.json"))
+		calls := 0
+		events := main.NewStripeEventQueue(makeMiningQueue(t, node), inbox, handler(1, &calls))
+		events.Handle(event)
+		events.Queue.Stop()
+		// Kept for retry
+		assertInbox(t, inbox, 1)
+
+		events.Queue = makeMiningQueue(t, node)
+		testinggo.AssertNoError(t, events.Run())
+		events.Queue.Stop()
+		if calls != 2 {
+			t.Errorf("Wrong calls; expected '%d', got '%d'", 2, calls)
+		}
+		assertInbox(t, inbox, 0)
+	})
+	t.Run("GaveUp", func(t *testing.T) {
+		dir := testinggo.MakeTempDir(t, "stripe")
+		defer testinggo.UnmakeTempDir(t, dir)
+		inbox := main.NewFileEventInbox(path.Join(dir, "inbox.json"))
+		calls := 0
+		events := main.NewStripeEventQueue(makeMiningQueue(t, node), inbox, handler(5, &calls))
+		events.Attempts = 2
+		events.Handle(event)
+		events.Queue.Stop()
+		for i := 0; i < 2; i++ {
+			events.Queue = makeMiningQueue(t, node)
+			testinggo.AssertNoError(t, events.Run())
+			events.Queue.Stop()
+		}
+		// Not retried once failed
+		if calls != 2 {
+			t.Errorf("Wrong calls; expected '%d', got '%d'", 2, calls)
+		}
+		assertInbox(t, inbox, 0)
+		failed, err := inbox.GetFailed()
+		testinggo.AssertNoError(t, err)
+		if len(failed) != 1 {
+			t.Errorf("Wrong number of failed events; expected '%d', got '%d'", 1, len(failed))
+		}
+	})
+	t.Run("QueueFull", func(t *testing.T) {
+		dir := testinggo.MakeTempDir(t, "stripe")
+		defer testinggo.UnmakeTempDir(t, dir)
+		inbox := main.NewFileEventInbox(path.Join(dir, "inbox.json"))
+		calls := 0
+		queue := main.NewMiningQueue(node, 1)
+		for i := 0; i < main.JOB_QUEUE_SIZE; i++ {
+			_, err := queue.Enqueue("", "Filler", "", func(node *bcgo.Node) ([]*bcgo.Channel, []string, error) {
+				return nil, nil, nil
+			})
+			testinggo.AssertNoError(t, err)
+		}
+		events := main.NewStripeEventQueue(queue, inbox, handler(0, &calls))
+		events.Handle(event)
+		// Not handled on the webhook's goroutine
+		if calls != 0 {
+			t.Errorf("Wrong calls; expected '%d', got '%d'", 0, calls)
+		}
+		assertInbox(t, inbox, 1)
+		queue.Start()
+		queue.Stop()
+
+		events.Queue = makeMiningQueue(t, node)
+		testinggo.AssertNoError(t, events.Run())
+		events.Queue.Stop()
+		if calls != 1 {
+			t.Errorf("Wrong calls; expected '%d', got '%d'", 1, calls)
+		}
+		assertInbox(t, inbox, 0)
+	})
+}
+
+func makeChargeSucceededEvent(t *testing.T, eventId, merchant, customer, chargeId string, amount, quantity int64) *stripe.Event {
+	t.Helper()
+	return makeStripeEvent(t, fmt.Sprintf(`{"id":"%s","type":"charge.succeeded","data":{"object":{"id":"%s","object":"charge","amount":%d,"currency":"usd","metadata":{"%s":"%s","%s":"%s","%s":"%d"}}}}`, eventId, chargeId, amount, main.META_ALIAS_MERCHANT, merchant, main.META_ALIAS_CUSTOMER, customer, main.META_QUANTITY_TOKENS, quantity))
+}
+
+func makeStripeEventHandler(t *testing.T, clawbacks *main.Clawbacks, dir string) func(*bcgo.Node, *stripe.Event) error {
+	t.Helper()
+	recorder := makeStripeEventRecorder(t, clawbacks, dir)
+	return main.NewStripeEventHandler(clawbacks.Aliases, clawbacks.Charges, clawbacks.Transactions, clawbacks.Node, clawbacks.Miner, nil, clawbacks, main.NewFileFraudFlags(path.Join(dir, "fraud-flags.json")), makeEventJournal(t, dir), recorder)
+}
+
+func TestStripeEventHandler(t *testing.T) {
+	merchant := "Merchant"
+	merchantKey := makeKey(t)
+	customer := "Alice"
+	customerKey := makeKey(t)
+	setup := func(t *testing.T) *main.Clawbacks {
+		t.Helper()
+		node := makeNode(t, merchant, merchantKey)
+		clawbacks := makeClawbacks(t, conveygo.NewLedger(node))
+		makeAlias(t, node, clawbacks.Aliases, customer, customerKey)
+		return clawbacks
+	}
+	assertCredited := func(t *testing.T, clawbacks *main.Clawbacks, expected uint64) {
+		t.Helper()
+		updateLedger(t, clawbacks)
+		if b := clawbacks.Ledger.Bought[customer]; b != expected {
+			t.Errorf("Wrong bought; expected '%d', got '%d'", expected, b)
+		}
+		charge, err := clawbacks.GetCharge("ch_1")
+		testinggo.AssertNoError(t, err)
+		if charge.Credited != int64(expected) {
+			t.Errorf("Wrong credited; expected '%d', got '%d'", expected, charge.Credited)
+		}
+	}
+	t.Run("ChargeSucceeded", func(t *testing.T) {
+		dir := testinggo.MakeTempDir(t, "stripe")
+		defer testinggo.UnmakeTempDir(t, dir)
+		clawbacks := setup(t)
+		handler := makeStripeEventHandler(t, clawbacks, dir)
+		testinggo.AssertNoError(t, handler(clawbacks.Node, makeChargeSucceededEvent(t, "evt_1", merchant, customer, "ch_1", 500, 100)))
+		assertCredited(t, clawbacks, 100)
+	})
+	t.Run("ChargeSucceeded_Duplicate", func(t *testing.T) {
+		dir := testinggo.MakeTempDir(t, "stripe")
+		defer testinggo.UnmakeTempDir(t, dir)
+		clawbacks := setup(t)
+		handler := makeStripeEventHandler(t, clawbacks, dir)
+		event := makeChargeSucceededEvent(t, "evt_1", merchant, customer, "ch_1", 500, 100)
+		testinggo.AssertNoError(t, handler(clawbacks.Node, event))
+		testinggo.AssertNoError(t, handler(clawbacks.Node, event))
+		assertCredited(t, clawbacks, 100)
+	})
+	t.Run("ChargeSucceeded_DuplicateCharge", func(t *testing.T) {
+		dir := testinggo.MakeTempDir(t, "stripe")
+		defer testinggo.UnmakeTempDir(t, dir)
+		clawbacks := setup(t)
+		handler := makeStripeEventHandler(t, clawbacks, dir)
+		testinggo.AssertNoError(t, handler(clawbacks.Node, makeChargeSucceededEvent(t, "evt_1", merchant, customer, "ch_1", 500, 100)))
+		// Journal is lost, charge channel still shows the charge was credited
+		lost := testinggo.MakeTempDir(t, "stripe")
+		defer testinggo.UnmakeTempDir(t, lost)
+		handler = makeStripeEventHandler(t, clawbacks, lost)
+		testinggo.AssertNoError(t, handler(clawbacks.Node, makeChargeSucceededEvent(t, "evt_2", merchant, customer, "ch_1", 500, 100)))
+		assertCredited(t, clawbacks, 100)
+	})
+	assertFlagged := func(t *testing.T, dir, reason string) {
+		t.Helper()
+		flag, err := main.NewFileFraudFlags(path.Join(dir, "fraud-flags.json")).GetFlag(customer)
+		testinggo.AssertNoError(t, err)
+		if flag == nil {
+			t.Fatalf("Expected %s to be flagged", customer)
+		}
+		if flag.Reason != reason {
+			t.Errorf("Wrong reason; expected '%s', got '%s'", reason, flag.Reason)
+		}
+		if flag.ChargeId != "ch_1" {
+			t.Errorf("Wrong charge; expected '%s', got '%s'", "ch_1", flag.ChargeId)
+		}
+	}
+	t.Run("ChargeSucceeded_HighestRisk", func(t *testing.T) {
+		dir := testinggo.MakeTempDir(t, "stripe")
+		defer testinggo.UnmakeTempDir(t, dir)
+		clawbacks := setup(t)
+		handler := makeStripeEventHandler(t, clawbacks, dir)
+		testinggo.AssertNoError(t, handler(clawbacks.Node, makeStripeEvent(t, fmt.Sprintf(`{"id":"evt_1","type":"charge.succeeded","data":{"object":{"id":"ch_1","object":"charge","amount":500,"currency":"usd","outcome":{"risk_level":"highest"},"metadata":{"%s":"%s","%s":"%s","%s":"100"}}}}`, main.META_ALIAS_MERCHANT, merchant, main.META_ALIAS_CUSTOMER, customer, main.META_QUANTITY_TOKENS))))
+		assertCredited(t, clawbacks, 100)
+		assertFlagged(t, dir, main.FRAUD_HIGHEST_RISK)
+	})
+	t.Run("EarlyFraudWarning", func(t *testing.T) {
+		dir := testinggo.MakeTempDir(t, "stripe")
+		defer testinggo.UnmakeTempDir(t, dir)
+		clawbacks := setup(t)
+		handler := makeStripeEventHandler(t, clawbacks, dir)
+		testinggo.AssertNoError(t, handler(clawbacks.Node, makeChargeSucceededEvent(t, "evt_1", merchant, customer, "ch_1", 500, 100)))
+		flag, err := main.NewFileFraudFlags(path.Join(dir, "fraud-flags.json")).GetFlag(customer)
+		testinggo.AssertNoError(t, err)
+		if flag != nil {
+			t.Fatalf("Expected no flag, got '%s'", flag)
+		}
+		testinggo.AssertNoError(t, handler(clawbacks.Node, makeStripeEvent(t, `{"id":"evt_2","type":"radar.early_fraud_warning.created","data":{"object":{"id":"issfr_1","object":"radar.early_fraud_warning","charge":"ch_1","fraud_type":"misc"}}}`)))
+		assertFlagged(t, dir, main.FRAUD_EARLY_WARNING)
+	})
+	t.Run("Unmapped", func(t *testing.T) {
+		dir := testinggo.MakeTempDir(t, "stripe")
+		defer testinggo.UnmakeTempDir(t, dir)
+		clawbacks := setup(t)
+		handler := makeStripeEventHandler(t, clawbacks, dir)
+		testinggo.AssertNoError(t, handler(clawbacks.Node, makeStripeEvent(t, `{"id":"evt_1","type":"charge.captured","data":{"object":{"id":"ch_1","metadata":{"`+main.META_ALIAS_MERCHANT+`":"`+merchant+`"}}}}`)))
+		entries := readAuditLog(t, dir)
+		if len(entries) != 1 {
+			t.Fatalf("Wrong number of audit entries; expected '%d', got '%d'", 1, len(entries))
+		}
+		if entries[0].Reason != main.ERROR_UNMAPPED_EVENT {
+			t.Errorf("Wrong reason; expected '%s', got '%s'", main.ERROR_UNMAPPED_EVENT, entries[0].Reason)
+		}
+	})
+	t.Run("UnresolvedMerchant", func(t *testing.T) {
+		dir := testinggo.MakeTempDir(t, "stripe")
+		defer testinggo.UnmakeTempDir(t, dir)
+		clawbacks := setup(t)
+		handler := makeStripeEventHandler(t, clawbacks, dir)
+		testinggo.AssertNoError(t, handler(clawbacks.Node, makeStripeEvent(t, `{"id":"evt_1","type":"balance.available","data":{"object":{"object":"balance"}}}`)))
+		entries := readAuditLog(t, dir)
+		if len(entries) != 1 {
+			t.Fatalf("Wrong number of audit entries; expected '%d', got '%d'", 1, len(entries))
+		}
+		if entries[0].Reason != main.ERROR_UNRESOLVED_MERCHANT {
+			t.Errorf("Wrong reason; expected '%s', got '%s'", main.ERROR_UNRESOLVED_MERCHANT, entries[0].Reason)
+		}
+	})
+}
@@ -0,0 +1,367 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"github.com/AletheiaWareLLC/aliasgo"
+	"github.com/AletheiaWareLLC/bcgo"
+	"github.com/AletheiaWareLLC/conveygo"
+	"github.com/AletheiaWareLLC/financego"
+	"github.com/golang/protobuf/proto"
+	"github.com/stripe/stripe-go"
+	"log"
+	"strconv"
+	"strings"
+)
+
+const (
+	// STRIPE_EVENT_SCHEMA is the version of the mapping from Stripe events to records, increment it whenever a mapping changes.
+	STRIPE_EVENT_SCHEMA = 1
+
+	META_STRIPE_EVENT = "stripe_event"
+
+	CONVEY_STRIPE_EVENT = "Convey-Stripe-Event" // financego.Registration Chain of Stripe events which don't register a customer
+
+	ERROR_NO_SUCH_CUSTOMER     = "No such customer: %s"
+	ERROR_INVALID_EVENT_META   = "Invalid event meta: %s"
+	ERROR_UNMAPPED_EVENT       = "Unmapped event"
+	ERROR_UNRESOLVED_CUSTOMER  = "Unresolved customer"
+	ERROR_UNRESOLVED_MERCHANT  = "Unresolved merchant"
+	ERROR_UNRECOGNIZED_CHANNEL = "Unrecognized channel: %s"
+)
+
+// StripeEventMapping maps a Stripe event onto a record in one of the finance channels.
+type StripeEventMapping struct {
+	// Channel is the name of the channel the record is mined into
+	Channel string
+	// Customer is the key of the object field holding the Stripe customer ID
+	Customer string
+	// Message creates the record payload from the event
+	Message func(event *stripe.Event, merchant, customer string) proto.Message
+}
+
+func OpenStripeEventChannel() *bcgo.Channel {
+	return bcgo.OpenPoWChannel(CONVEY_STRIPE_EVENT, bcgo.THRESHOLD_G)
+}
+
+// StripeEventMappings maps each recorded Stripe event type onto a channel.
+// Events which also move tokens, such as charges and disputes, are handled separately by the Stripe event handler.
+// The newest registration of an alias is trusted to hold its customer ID, so deleted customers and payment methods are recorded in their own channel.
+var StripeEventMappings = map[string]*StripeEventMapping{
+	"customer.created":                          {conveygo.CONVEY_REGISTRATION, "id", customerRegistration},
+	"customer.deleted":                          {CONVEY_STRIPE_EVENT, "id", customerRegistration},
+	"customer.updated":                          {conveygo.CONVEY_REGISTRATION, "id", customerRegistration},
+	"customer.subscription.created":             {conveygo.CONVEY_SUBSCRIPTION, "customer", customerSubscription},
+	"customer.subscription.deleted":             {conveygo.CONVEY_SUBSCRIPTION, "customer", customerSubscription},
+	"customer.subscription.trial_will_end":      {conveygo.CONVEY_SUBSCRIPTION, "customer", customerSubscription},
+	"customer.subscription.updated":             {conveygo.CONVEY_SUBSCRIPTION, "customer", customerSubscription},
+	"invoice.created":                           {conveygo.CONVEY_INVOICE, "customer", invoice},
+	"invoice.deleted":                           {conveygo.CONVEY_INVOICE, "customer", invoice},
+	"invoice.finalized":                         {conveygo.CONVEY_INVOICE, "customer", invoice},
+	"invoice.marked_uncollectible":              {conveygo.CONVEY_INVOICE, "customer", invoice},
+	"invoice.payment_action_required":           {conveygo.CONVEY_INVOICE, "customer", invoice},
+	"invoice.payment_failed":                    {conveygo.CONVEY_INVOICE, "customer", invoice},
+	"invoice.payment_succeeded":                 {conveygo.CONVEY_INVOICE, "customer", invoice},
+	"invoice.sent":                              {conveygo.CONVEY_INVOICE, "customer", invoice},
+	"invoice.updated":                           {conveygo.CONVEY_INVOICE, "customer", invoice},
+	"invoice.voided":                            {conveygo.CONVEY_INVOICE, "customer", invoice},
+	"payment_intent.amount_capturable_updated":  {conveygo.CONVEY_CHARGE, "customer", paymentIntentCharge},
+	"payment_intent.canceled":                   {conveygo.CONVEY_CHARGE, "customer", paymentIntentCharge},
+	"payment_intent.created":                    {conveygo.CONVEY_CHARGE, "customer", paymentIntentCharge},
+	"payment_intent.payment_failed":             {conveygo.CONVEY_CHARGE, "customer", paymentIntentCharge},
+	"payment_intent.succeeded":                  {conveygo.CONVEY_CHARGE, "customer", paymentIntentCharge},
+	"payment_method.attached":                   {CONVEY_STRIPE_EVENT, "customer", paymentMethodRegistration},
+	"payment_method.card_automatically_updated": {CONVEY_STRIPE_EVENT, "customer", paymentMethodRegistration},
+	"payment_method.detached":                   {CONVEY_STRIPE_EVENT, "customer", paymentMethodRegistration},
+	"payment_method.updated":                    {CONVEY_STRIPE_EVENT, "customer", paymentMethodRegistration},
+}
+
+func customerRegistration(event *stripe.Event, merchant, customer string) proto.Message {
+	return &financego.Registration{
+		MerchantAlias: merchant,
+		CustomerAlias: customer,
+		Processor:     financego.PaymentProcessor_STRIPE,
+		CustomerId:    GetEventValue(event, "id"),
+	}
+}
+
+func customerSubscription(event *stripe.Event, merchant, customer string) proto.Message {
+	return &financego.Subscription{
+		MerchantAlias:  merchant,
+		CustomerAlias:  customer,
+		Processor:      financego.PaymentProcessor_STRIPE,
+		CustomerId:     GetEventValue(event, "customer"),
+		PaymentId:      GetEventValue(event, "default_payment_method"),
+		ProductId:      GetEventValue(event, "plan", "product"),
+		PlanId:         GetEventValue(event, "plan", "id"),
+		SubscriptionId: GetEventValue(event, "id"),
+	}
+}
+
+func invoice(event *stripe.Event, merchant, customer string) proto.Message {
+	due, _ := GetEventInt(event, "amount_due")
+	paid, _ := GetEventInt(event, "amount_paid")
+	remaining, _ := GetEventInt(event, "amount_remaining")
+	return &financego.Invoice{
+		MerchantAlias:   merchant,
+		CustomerAlias:   customer,
+		Processor:       financego.PaymentProcessor_STRIPE,
+		CustomerId:      GetEventValue(event, "customer"),
+		PaymentId:       GetEventValue(event, "payment_intent"),
+		InvoiceId:       GetEventValue(event, "id"),
+		InvoiceUrl:      GetEventValue(event, "hosted_invoice_url"),
+		Currency:        GetEventValue(event, "currency"),
+		Number:          GetEventValue(event, "number"),
+		AmountDue:       due,
+		AmountPaid:      paid,
+		AmountRemaining: remaining,
+	}
+}
+
+func paymentIntentCharge(event *stripe.Event, merchant, customer string) proto.Message {
+	amount, _ := GetEventInt(event, "amount")
+	return &financego.Charge{
+		MerchantAlias: merchant,
+		CustomerAlias: customer,
+		Processor:     financego.PaymentProcessor_STRIPE,
+		CustomerId:    GetEventValue(event, "customer"),
+		PaymentId:     GetEventValue(event, "payment_method"),
+		ChargeId:      GetEventValue(event, "id"),
+		Amount:        amount,
+		InvoiceId:     GetEventValue(event, "invoice"),
+		Currency:      GetEventValue(event, "currency"),
+		Description:   GetEventValue(event, "description"),
+	}
+}
+
+func paymentMethodRegistration(event *stripe.Event, merchant, customer string) proto.Message {
+	customerId := GetEventValue(event, "customer")
+	if customerId == "" {
+		// Detached payment methods no longer have a customer
+		customerId = GetEventPreviousValue(event, "customer")
+	}
+	return &financego.Registration{
+		MerchantAlias: merchant,
+		CustomerAlias: customer,
+		Processor:     financego.PaymentProcessor_STRIPE,
+		CustomerId:    customerId,
+		PaymentId:     GetEventValue(event, "id"),
+	}
+}
+
+// StripeEventMeta returns the record meta identifying the type and schema of a recorded event.
+func StripeEventMeta(eventType string) map[string]string {
+	return map[string]string{
+		META_STRIPE_EVENT: fmt.Sprintf("%d/%s", STRIPE_EVENT_SCHEMA, eventType),
+	}
+}
+
+// ParseStripeEventMeta returns the schema and type of a recorded event from the value of its META_STRIPE_EVENT entry.
+func ParseStripeEventMeta(value string) (int, string, error) {
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 {
+		return 0, "", errors.New(fmt.Sprintf(ERROR_INVALID_EVENT_META, value))
+	}
+	schema, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, "", err
+	}
+	return schema, parts[1], nil
+}
+
+// GetEventValue returns the value of the event object field with the given keys, or an empty string if the field does not exist.
+// Unlike stripe.Event.GetObjectValue it does not panic on missing fields, and formats whole numbers without an exponent.
+func GetEventValue(event *stripe.Event, keys ...string) string {
+	if event.Data == nil {
+		return ""
+	}
+	return getEventValue(event.Data.Object, keys)
+}
+
+// GetEventPreviousValue returns the previous value of the event object field with the given keys, or an empty string if the field did not change.
+func GetEventPreviousValue(event *stripe.Event, keys ...string) string {
+	if event.Data == nil {
+		return ""
+	}
+	return getEventValue(event.Data.PreviousAttributes, keys)
+}
+
+// GetEventInt returns the integer value of the event object field with the given keys.
+func GetEventInt(event *stripe.Event, keys ...string) (int64, error) {
+	return strconv.ParseInt(GetEventValue(event, keys...), 10, 64)
+}
+
+func getEventValue(m map[string]interface{}, keys []string) string {
+	var node interface{} = m
+	for _, key := range keys {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			node = n[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(n) {
+				return ""
+			}
+			node = n[i]
+		default:
+			return ""
+		}
+	}
+	switch n := node.(type) {
+	case nil:
+		return ""
+	case float64:
+		// JSON numbers are decoded as float64, which %v would format with an exponent
+		return strconv.FormatFloat(n, 'f', -1, 64)
+	case map[string]interface{}, []interface{}:
+		return ""
+	default:
+		return fmt.Sprintf("%v", n)
+	}
+}
+
+// StripeEventRecorder mines Stripe events into the finance channels according to the event mappings, and audits any events it cannot record.
+type StripeEventRecorder struct {
+	Node          *bcgo.Node
+	Miner         *ChannelMiner
+	Listener      bcgo.MiningListener
+	Aliases       *bcgo.Channel
+	Registrations *bcgo.Channel
+	Channels      map[string]*bcgo.Channel
+	Mappings      map[string]*StripeEventMapping
+	AuditLog      EventAuditLog
+}
+
+func NewStripeEventRecorder(node *bcgo.Node, miner *ChannelMiner, listener bcgo.MiningListener, aliases, charges, invoices, registrations, subscriptions, events *bcgo.Channel, audit EventAuditLog) *StripeEventRecorder {
+	return &StripeEventRecorder{
+		Node:          node,
+		Miner:         miner,
+		Listener:      listener,
+		Aliases:       aliases,
+		Registrations: registrations,
+		Channels: map[string]*bcgo.Channel{
+			charges.Name:       charges,
+			invoices.Name:      invoices,
+			registrations.Name: registrations,
+			subscriptions.Name: subscriptions,
+			events.Name:        events,
+		},
+		Mappings: StripeEventMappings,
+		AuditLog: audit,
+	}
+}
+
+// Audit writes the event to the audit log with the reason it was not recorded.
+func (r *StripeEventRecorder) Audit(event *stripe.Event, reason string) {
+	log.Println("Auditing event", event.ID, event.Type, reason)
+	if err := r.AuditLog.AuditEvent(event, reason); err != nil {
+		log.Println(err)
+	}
+}
+
+// GetRegistration returns the newest registration of the given Stripe customer ID.
+func (r *StripeEventRecorder) GetRegistration(customerId string) (*financego.Registration, error) {
+	if customerId == "" {
+		return nil, errors.New(fmt.Sprintf(ERROR_NO_SUCH_CUSTOMER, customerId))
+	}
+	var registration *financego.Registration
+	if err := bcgo.Read(r.Registrations.Name, r.Registrations.Head, nil, r.Node.Cache, r.Node.Network, r.Node.Alias, r.Node.Key, nil, func(entry *bcgo.BlockEntry, key, data []byte) error {
+		g := &financego.Registration{}
+		if err := proto.Unmarshal(data, g); err != nil {
+			return err
+		}
+		if g.CustomerId == customerId {
+			registration = g
+			return bcgo.StopIterationError{}
+		}
+		return nil
+	}); err != nil {
+		switch err.(type) {
+		case bcgo.StopIterationError:
+			// Do nothing
+			break
+		default:
+			return nil, err
+		}
+	}
+	if registration == nil {
+		return nil, errors.New(fmt.Sprintf(ERROR_NO_SUCH_CUSTOMER, customerId))
+	}
+	return registration, nil
+}
+
+// GetMerchant returns the merchant of the customer referenced by the event, or an empty string if the event is unmapped or the customer is unregistered.
+func (r *StripeEventRecorder) GetMerchant(event *stripe.Event) string {
+	mapping, ok := r.Mappings[event.Type]
+	if !ok {
+		return ""
+	}
+	registration, err := r.GetRegistration(r.getCustomerId(event, mapping))
+	if err != nil {
+		return ""
+	}
+	return registration.MerchantAlias
+}
+
+func (r *StripeEventRecorder) getCustomerId(event *stripe.Event, mapping *StripeEventMapping) string {
+	customerId := GetEventValue(event, mapping.Customer)
+	if customerId == "" {
+		customerId = GetEventPreviousValue(event, mapping.Customer)
+	}
+	return customerId
+}
+
+// Record mines the event with the given node into the channel it is mapped onto, or audits the event if it is unmapped.
+func (r *StripeEventRecorder) Record(node *bcgo.Node, event *stripe.Event, merchant string) error {
+	mapping, ok := r.Mappings[event.Type]
+	if !ok {
+		r.Audit(event, ERROR_UNMAPPED_EVENT)
+		return nil
+	}
+	channel, ok := r.Channels[mapping.Channel]
+	if !ok {
+		return errors.New(fmt.Sprintf(ERROR_UNRECOGNIZED_CHANNEL, mapping.Channel))
+	}
+
+	customer := GetEventValue(event, "metadata", META_ALIAS_CUSTOMER)
+	if customer == "" {
+		if registration, err := r.GetRegistration(r.getCustomerId(event, mapping)); err == nil {
+			customer = registration.CustomerAlias
+		}
+	}
+	if customer == "" {
+		r.Audit(event, ERROR_UNRESOLVED_CUSTOMER)
+		return nil
+	}
+	log.Println("Customer", customer)
+
+	publicKey, err := aliasgo.GetPublicKey(r.Aliases, r.Node.Cache, r.Node.Network, customer)
+	if err != nil {
+		return err
+	}
+
+	message := mapping.Message(event, merchant, customer)
+	log.Println("Message", message)
+	_, err = MineRecord(node, r.Miner, r.Listener, channel, node.Alias, node.Key, map[string]*rsa.PublicKey{
+		customer: publicKey,
+		merchant: &node.Key.PublicKey,
+	}, nil, StripeEventMeta(event.Type), message)
+	return err
+}
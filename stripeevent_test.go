@@ -0,0 +1,216 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main_test
+
+import (
+	"encoding/json"
+	"github.com/AletheiaWareLLC/bcgo"
+	"github.com/AletheiaWareLLC/conveygo"
+	"github.com/AletheiaWareLLC/conveyservergo"
+	"github.com/AletheiaWareLLC/financego"
+	"github.com/AletheiaWareLLC/testinggo"
+	"github.com/golang/protobuf/proto"
+	"github.com/stripe/stripe-go"
+	"path"
+	"testing"
+)
+
+func makeStripeEvent(t *testing.T, data string) *stripe.Event {
+	t.Helper()
+	event := &stripe.Event{}
+	testinggo.AssertNoError(t, json.Unmarshal([]byte(data), event))
+	return event
+}
+
+func makeStripeEventRecorder(t *testing.T, clawbacks *main.Clawbacks, dir string) *main.StripeEventRecorder {
+	t.Helper()
+	return main.NewStripeEventRecorder(clawbacks.Node, clawbacks.Miner, nil, clawbacks.Aliases, clawbacks.Charges, conveygo.OpenInvoiceChannel(), conveygo.OpenRegistrationChannel(), conveygo.OpenSubscriptionChannel(), main.OpenStripeEventChannel(), main.NewFileEventAuditLog(path.Join(dir, "audit")))
+}
+
+func readAuditLog(t *testing.T, dir string) []*main.AuditEntry {
+	t.Helper()
+	entries, err := main.ReadAuditLog(path.Join(dir, "audit"))
+	testinggo.AssertNoError(t, err)
+	return entries
+}
+
+func TestGetEventValue(t *testing.T) {
+	event := makeStripeEvent(t, `{"id":"evt_1","type":"invoice.created","data":{"object":{"id":"in_1","amount_due":1000000,"customer":null,"metadata":{},"lines":{"data":[{"id":"il_1"}]}}}}`)
+	for name, tt := range map[string]struct {
+		keys     []string
+		expected string
+	}{
+		"String":       {[]string{"id"}, "in_1"},
+		"LargeInteger": {[]string{"amount_due"}, "1000000"},
+		"Null":         {[]string{"customer"}, ""},
+		"Missing":      {[]string{"description"}, ""},
+		"MissingMeta":  {[]string{"metadata", main.META_ALIAS_CUSTOMER}, ""},
+		"MissingNest":  {[]string{"plan", "id"}, ""},
+		"Slice":        {[]string{"lines", "data", "0", "id"}, "il_1"},
+		"SliceBounds":  {[]string{"lines", "data", "1", "id"}, ""},
+		"Object":       {[]string{"lines"}, ""},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if v := main.GetEventValue(event, tt.keys...); v != tt.expected {
+				t.Errorf("Wrong value; expected '%s', got '%s'", tt.expected, v)
+			}
+		})
+	}
+	t.Run("Int", func(t *testing.T) {
+		v, err := main.GetEventInt(event, "amount_due")
+		testinggo.AssertNoError(t, err)
+		if v != 1000000 {
+			t.Errorf("Wrong value; expected '%d', got '%d'", 1000000, v)
+		}
+	})
+}
+
+func TestStripeEventMeta(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		meta := main.StripeEventMeta("invoice.created")
+		schema, eventType, err := main.ParseStripeEventMeta(meta[main.META_STRIPE_EVENT])
+		testinggo.AssertNoError(t, err)
+		if schema != main.STRIPE_EVENT_SCHEMA {
+			t.Errorf("Wrong schema; expected '%d', got '%d'", main.STRIPE_EVENT_SCHEMA, schema)
+		}
+		if eventType != "invoice.created" {
+			t.Errorf("Wrong type; expected '%s', got '%s'", "invoice.created", eventType)
+		}
+	})
+	t.Run("Invalid", func(t *testing.T) {
+		_, _, err := main.ParseStripeEventMeta("invoice.created")
+		testinggo.AssertError(t, "Invalid event meta: invoice.created", err)
+	})
+}
+
+func TestStripeEventRecorder(t *testing.T) {
+	merchant := "Merchant"
+	merchantKey := makeKey(t)
+	customer := "Alice"
+	customerKey := makeKey(t)
+	setup := func(t *testing.T, dir string) (*main.Clawbacks, *main.StripeEventRecorder) {
+		t.Helper()
+		node := makeNode(t, merchant, merchantKey)
+		clawbacks := makeClawbacks(t, conveygo.NewLedger(node))
+		makeAlias(t, node, clawbacks.Aliases, customer, customerKey)
+		return clawbacks, makeStripeEventRecorder(t, clawbacks, dir)
+	}
+	readRecords := func(t *testing.T, channel *bcgo.Channel, node *bcgo.Node) []*bcgo.Record {
+		t.Helper()
+		var records []*bcgo.Record
+		testinggo.AssertNoError(t, bcgo.Iterate(channel.Name, channel.Head, nil, node.Cache, nil, func(h []byte, b *bcgo.Block) error {
+			for _, e := range b.Entry {
+				records = append(records, e.Record)
+			}
+			return nil
+		}))
+		return records
+	}
+	t.Run("Mapped", func(t *testing.T) {
+		dir := testinggo.MakeTempDir(t, "recorder")
+		defer testinggo.UnmakeTempDir(t, dir)
+		clawbacks, recorder := setup(t, dir)
+		event := makeStripeEvent(t, `{"id":"evt_1","type":"payment_intent.succeeded","data":{"object":{"id":"pi_1","amount":500,"currency":"usd","customer":"cus_1","metadata":{"`+main.META_ALIAS_MERCHANT+`":"`+merchant+`","`+main.META_ALIAS_CUSTOMER+`":"`+customer+`"}}}}`)
+		testinggo.AssertNoError(t, recorder.Record(recorder.Node, event, merchant))
+		records := readRecords(t, clawbacks.Charges, clawbacks.Node)
+		if len(records) != 1 {
+			t.Fatalf("Wrong number of records; expected '%d', got '%d'", 1, len(records))
+		}
+		schema, eventType, err := main.ParseStripeEventMeta(records[0].Meta[main.META_STRIPE_EVENT])
+		testinggo.AssertNoError(t, err)
+		if schema != main.STRIPE_EVENT_SCHEMA {
+			t.Errorf("Wrong schema; expected '%d', got '%d'", main.STRIPE_EVENT_SCHEMA, schema)
+		}
+		if eventType != event.Type {
+			t.Errorf("Wrong type; expected '%s', got '%s'", event.Type, eventType)
+		}
+		testinggo.AssertNoError(t, bcgo.Read(clawbacks.Charges.Name, clawbacks.Charges.Head, nil, clawbacks.Node.Cache, nil, customer, customerKey, nil, func(entry *bcgo.BlockEntry, key, data []byte) error {
+			charge := &financego.Charge{}
+			testinggo.AssertNoError(t, proto.Unmarshal(data, charge))
+			if charge.ChargeId != "pi_1" {
+				t.Errorf("Wrong charge ID; expected '%s', got '%s'", "pi_1", charge.ChargeId)
+			}
+			if charge.Amount != 500 {
+				t.Errorf("Wrong amount; expected '%d', got '%d'", 500, charge.Amount)
+			}
+			return nil
+		}))
+		// Recorded events don't buy tokens
+		_, err = clawbacks.GetCharge("pi_1")
+		testinggo.AssertError(t, "No such charge: pi_1", err)
+		if entries := readAuditLog(t, dir); len(entries) != 0 {
+			t.Errorf("Wrong number of audit entries; expected '%d', got '%d'", 0, len(entries))
+		}
+	})
+	t.Run("Registered", func(t *testing.T) {
+		dir := testinggo.MakeTempDir(t, "recorder")
+		defer testinggo.UnmakeTempDir(t, dir)
+		clawbacks, recorder := setup(t, dir)
+		testinggo.AssertNoError(t, recorder.Record(recorder.Node, makeStripeEvent(t, `{"id":"evt_1","type":"customer.created","data":{"object":{"id":"cus_1","metadata":{"`+main.META_ALIAS_MERCHANT+`":"`+merchant+`","`+main.META_ALIAS_CUSTOMER+`":"`+customer+`"}}}}`), merchant))
+		// Payment methods don't carry metadata, the customer is found by their registration
+		event := makeStripeEvent(t, `{"id":"evt_2","type":"payment_method.attached","data":{"object":{"id":"pm_1","customer":"cus_1","metadata":{}}}}`)
+		if m := recorder.GetMerchant(event); m != merchant {
+			t.Errorf("Wrong merchant; expected '%s', got '%s'", merchant, m)
+		}
+		testinggo.AssertNoError(t, recorder.Record(recorder.Node, event, merchant))
+		// Deleting the customer doesn't replace their registration
+		testinggo.AssertNoError(t, recorder.Record(recorder.Node, makeStripeEvent(t, `{"id":"evt_3","type":"customer.deleted","data":{"object":{"id":"cus_1","metadata":{"`+main.META_ALIAS_MERCHANT+`":"`+merchant+`","`+main.META_ALIAS_CUSTOMER+`":"`+customer+`"}}}}`), merchant))
+		if records := readRecords(t, recorder.Registrations, clawbacks.Node); len(records) != 1 {
+			t.Errorf("Wrong number of registration records; expected '%d', got '%d'", 1, len(records))
+		}
+		if records := readRecords(t, recorder.Channels[main.CONVEY_STRIPE_EVENT], clawbacks.Node); len(records) != 2 {
+			t.Errorf("Wrong number of event records; expected '%d', got '%d'", 2, len(records))
+		}
+		registration, err := recorder.GetRegistration("cus_1")
+		testinggo.AssertNoError(t, err)
+		if registration.CustomerAlias != customer {
+			t.Errorf("Wrong customer; expected '%s', got '%s'", customer, registration.CustomerAlias)
+		}
+	})
+	t.Run("Unmapped", func(t *testing.T) {
+		dir := testinggo.MakeTempDir(t, "recorder")
+		defer testinggo.UnmakeTempDir(t, dir)
+		clawbacks, recorder := setup(t, dir)
+		testinggo.AssertNoError(t, recorder.Record(recorder.Node, makeStripeEvent(t, `{"id":"evt_1","type":"payout.paid","data":{"object":{"id":"po_1"}}}`), merchant))
+		if records := readRecords(t, clawbacks.Charges, clawbacks.Node); len(records) != 0 {
+			t.Errorf("Wrong number of records; expected '%d', got '%d'", 0, len(records))
+		}
+		entries := readAuditLog(t, dir)
+		if len(entries) != 1 {
+			t.Fatalf("Wrong number of audit entries; expected '%d', got '%d'", 1, len(entries))
+		}
+		if entries[0].ID != "evt_1" {
+			t.Errorf("Wrong ID; expected '%s', got '%s'", "evt_1", entries[0].ID)
+		}
+		if entries[0].Reason != main.ERROR_UNMAPPED_EVENT {
+			t.Errorf("Wrong reason; expected '%s', got '%s'", main.ERROR_UNMAPPED_EVENT, entries[0].Reason)
+		}
+	})
+	t.Run("UnresolvedCustomer", func(t *testing.T) {
+		dir := testinggo.MakeTempDir(t, "recorder")
+		defer testinggo.UnmakeTempDir(t, dir)
+		_, recorder := setup(t, dir)
+		testinggo.AssertNoError(t, recorder.Record(recorder.Node, makeStripeEvent(t, `{"id":"evt_1","type":"invoice.created","data":{"object":{"id":"in_1","customer":"cus_2"}}}`), merchant))
+		entries := readAuditLog(t, dir)
+		if len(entries) != 1 {
+			t.Fatalf("Wrong number of audit entries; expected '%d', got '%d'", 1, len(entries))
+		}
+		if entries[0].Reason != main.ERROR_UNRESOLVED_CUSTOMER {
+			t.Errorf("Wrong reason; expected '%s', got '%s'", main.ERROR_UNRESOLVED_CUSTOMER, entries[0].Reason)
+		}
+	})
+}
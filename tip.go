@@ -0,0 +1,214 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/AletheiaWareLLC/bcgo"
+	"github.com/AletheiaWareLLC/conveygo"
+	"github.com/golang/protobuf/proto"
+	"strings"
+	"sync"
+)
+
+const (
+	ERROR_NO_SUCH_MESSAGE = "No such message: %s"
+	ERROR_TIP_NOT_AUTHOR  = "Tips go to the author of the message: %s"
+	ERROR_TIP_OWN_MESSAGE = "Can't tip your own message"
+)
+
+// GetMessageAuthor returns the author of the given message, identified by the base64 encoded hashes of its conversation and record.
+func GetMessageAuthor(messages conveygo.MessageStore, conversation, message string) (string, error) {
+	conversationHash, err := base64.RawURLEncoding.DecodeString(conversation)
+	if err != nil {
+		return "", err
+	}
+	messageHash, err := base64.RawURLEncoding.DecodeString(message)
+	if err != nil {
+		return "", err
+	}
+	author, err := messageAuthor(messages, conversationHash, messageHash)
+	if err != nil {
+		return "", err
+	}
+	if author == "" {
+		return "", errors.New(fmt.Sprintf(ERROR_NO_SUCH_MESSAGE, message))
+	}
+	return author, nil
+}
+
+// messageAuthor returns the author of the given message, or an empty string if there is no such message.
+func messageAuthor(messages conveygo.MessageStore, conversation, message []byte) (string, error) {
+	var author string
+	if err := messages.GetMessage(conversation, message, func(hash []byte, timestamp uint64, a string, cost uint64, m *conveygo.Message) error {
+		author = a
+		return nil
+	}); err != nil {
+		return "", err
+	}
+	return author, nil
+}
+
+// TipReference returns a reference to the given message, for the transaction which tips its author.
+func TipReference(conversation, message string) (*bcgo.Reference, error) {
+	messageHash, err := base64.RawURLEncoding.DecodeString(message)
+	if err != nil {
+		return nil, err
+	}
+	return &bcgo.Reference{
+		ChannelName: conveygo.CONVEY_PREFIX_MESSAGE + conversation,
+		RecordHash:  messageHash,
+	}, nil
+}
+
+// Tips indexes the tokens tipped to each message, processing only the transactions mined since it was last updated.
+// A transaction is a tip if it references a message and its receiver is the author of the message.
+type Tips struct {
+	Node         *bcgo.Node
+	Messages     conveygo.MessageStore
+	Transactions *bcgo.Channel
+	Processed    map[string]bool              // Block Hash -> Processed Flag
+	Totals       map[string]map[string]uint64 // Message Channel Name -> Message Record Hash -> Tokens Tipped
+	Authors      map[string]map[string]string // Message Channel Name -> Message Record Hash -> Author Alias
+	lock         sync.Mutex
+}
+
+func NewTips(node *bcgo.Node, messages conveygo.MessageStore, transactions *bcgo.Channel) *Tips {
+	return &Tips{
+		Node:         node,
+		Messages:     messages,
+		Transactions: transactions,
+		Processed:    make(map[string]bool),
+		Totals:       make(map[string]map[string]uint64),
+		Authors:      make(map[string]map[string]string),
+	}
+}
+
+// Update processes any new transactions which tip a message.
+func (t *Tips) Update() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.update()
+}
+
+func (t *Tips) update() error {
+	// Collect unprocessed blocks so a failure part way leaves them to be processed next time
+	var hashes [][]byte
+	var blocks []*bcgo.Block
+	if err := bcgo.Iterate(t.Transactions.Name, t.Transactions.Head, nil, t.Node.Cache, t.Node.Network, func(h []byte, b *bcgo.Block) error {
+		if t.Processed[base64.RawURLEncoding.EncodeToString(h)] {
+			return bcgo.StopIterationError{}
+		}
+		hashes = append(hashes, h)
+		blocks = append(blocks, b)
+		return nil
+	}); err != nil {
+		switch err.(type) {
+		case bcgo.StopIterationError:
+			// Do nothing
+			break
+		default:
+			return err
+		}
+	}
+	for i := len(blocks) - 1; i >= 0; i-- {
+		// Accumulate the block's tips, and only add them once the whole block is processed, so a failure part way doesn't count them twice
+		tips := make(map[string]map[string]uint64)
+		for _, entry := range blocks[i].Entry {
+			for _, r := range entry.Record.Reference {
+				if !strings.HasPrefix(r.ChannelName, conveygo.CONVEY_PREFIX_MESSAGE) {
+					continue
+				}
+				transaction := &conveygo.Transaction{}
+				if err := proto.Unmarshal(entry.Record.Payload, transaction); err != nil {
+					return err
+				}
+				message := base64.RawURLEncoding.EncodeToString(r.RecordHash)
+				author, err := t.author(r.ChannelName, message, r.RecordHash)
+				if err != nil {
+					return err
+				}
+				if author == "" || transaction.Receiver != author {
+					continue
+				}
+				totals, ok := tips[r.ChannelName]
+				if !ok {
+					totals = make(map[string]uint64)
+					tips[r.ChannelName] = totals
+				}
+				totals[message] += transaction.Amount
+			}
+		}
+		for channel, ts := range tips {
+			totals, ok := t.Totals[channel]
+			if !ok {
+				totals = make(map[string]uint64)
+				t.Totals[channel] = totals
+			}
+			for message, amount := range ts {
+				totals[message] += amount
+			}
+		}
+		t.Processed[base64.RawURLEncoding.EncodeToString(hashes[i])] = true
+	}
+	return nil
+}
+
+// author returns the author of the given message in the given message channel, or an empty string if there is no such message.
+func (t *Tips) author(channel, message string, hash []byte) (string, error) {
+	authors, ok := t.Authors[channel]
+	if !ok {
+		authors = make(map[string]string)
+		t.Authors[channel] = authors
+	}
+	if author, ok := authors[message]; ok {
+		return author, nil
+	}
+	conversation, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(channel, conveygo.CONVEY_PREFIX_MESSAGE))
+	if err != nil {
+		return "", err
+	}
+	author, err := messageAuthor(t.Messages, conversation, hash)
+	if err != nil {
+		if err.Error() == fmt.Sprintf(conveygo.ERROR_NO_SUCH_CONVERSATION, base64.RawURLEncoding.EncodeToString(conversation)) {
+			// Not a message this server knows of, yet
+			return "", nil
+		}
+		return "", err
+	}
+	if author != "" {
+		// Messages can arrive later, so only remember those found
+		authors[message] = author
+	}
+	return author, nil
+}
+
+// GetTips returns the total tokens tipped to each message in the given conversation, keyed by the base64 encoded message hash.
+func (t *Tips) GetTips(conversation string) (map[string]uint64, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if err := t.update(); err != nil {
+		return nil, err
+	}
+	tips := make(map[string]uint64)
+	for k, v := range t.Totals[conveygo.CONVEY_PREFIX_MESSAGE+conversation] {
+		tips[k] = v
+	}
+	return tips, nil
+}
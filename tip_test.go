@@ -0,0 +1,211 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main_test
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"github.com/AletheiaWareLLC/bcgo"
+	"github.com/AletheiaWareLLC/conveygo"
+	"github.com/AletheiaWareLLC/conveyservergo"
+	"github.com/AletheiaWareLLC/cryptogo"
+	"github.com/AletheiaWareLLC/testinggo"
+	"html/template"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func makeTipConversation(t *testing.T, author string) (conveygo.MessageStore, string, string) {
+	t.Helper()
+	key := makeKey(t)
+	node := makeNode(t, "Merchant", makeKey(t))
+	node.AddChannel(conveygo.OpenConversationChannel())
+	// MemoryStore doesn't record authors, so mine the conversation as the server would
+	datastore := &conveygo.BCStore{
+		Node: node,
+	}
+	conversationHash, conversationRecord, err := conveygo.ProtoToRecord(author, key, 0, &conveygo.Conversation{
+		Topic: "Test123",
+	})
+	testinggo.AssertNoError(t, err)
+	messageHash, messageRecord, err := conveygo.ProtoToRecord(author, key, 0, &conveygo.Message{
+		Content: []byte("Foo"),
+		Type:    conveygo.MediaType_TEXT_PLAIN,
+	})
+	testinggo.AssertNoError(t, err)
+	testinggo.AssertNoError(t, datastore.NewConversation(conversationHash, conversationRecord, messageHash, messageRecord))
+	return datastore, base64.RawURLEncoding.EncodeToString(conversationHash), base64.RawURLEncoding.EncodeToString(messageHash)
+}
+
+func TestGetMessageAuthor(t *testing.T) {
+	datastore, conversation, message := makeTipConversation(t, "Bob")
+	t.Run("Exists", func(t *testing.T) {
+		author, err := main.GetMessageAuthor(datastore, conversation, message)
+		testinggo.AssertNoError(t, err)
+		if author != "Bob" {
+			t.Errorf("Wrong author; expected '%s', got '%s'", "Bob", author)
+		}
+	})
+	t.Run("NotExists", func(t *testing.T) {
+		_, err := main.GetMessageAuthor(datastore, conversation, conversation)
+		testinggo.AssertError(t, "No such message: "+conversation, err)
+	})
+}
+
+func TestGetTips(t *testing.T) {
+	aliceKey := makeKey(t)
+	bobKey := makeKey(t)
+	node := makeNode(t, "Merchant", makeKey(t))
+	clawbacks := makeClawbacks(t, conveygo.NewLedger(node))
+	memos := main.OpenTransferMemoChannel()
+	datastore, conversation, message := makeTipConversation(t, "Bob")
+
+	reference, err := main.TipReference(conversation, message)
+	testinggo.AssertNoError(t, err)
+	if reference.ChannelName != conveygo.CONVEY_PREFIX_MESSAGE+conversation {
+		t.Errorf("Wrong channel; expected '%s', got '%s'", conveygo.CONVEY_PREFIX_MESSAGE+conversation, reference.ChannelName)
+	}
+
+	testinggo.AssertNoError(t, main.MineTransfer(node, clawbacks.Miner, nil, clawbacks.Transactions, memos, "Alice", aliceKey, "Bob", &bobKey.PublicKey, 10, "", nil))
+	testinggo.AssertNoError(t, main.MineTransfer(node, clawbacks.Miner, nil, clawbacks.Transactions, memos, "Alice", aliceKey, "Bob", &bobKey.PublicKey, 3, "", []*bcgo.Reference{reference}))
+	testinggo.AssertNoError(t, main.MineTransfer(node, clawbacks.Miner, nil, clawbacks.Transactions, memos, "Alice", aliceKey, "Bob", &bobKey.PublicKey, 2, "Nice", []*bcgo.Reference{reference}))
+	// Transfers to anyone other than the author aren't tips
+	testinggo.AssertNoError(t, main.MineTransfer(node, clawbacks.Miner, nil, clawbacks.Transactions, memos, "Alice", aliceKey, "Charlie", &makeKey(t).PublicKey, 7, "", []*bcgo.Reference{reference}))
+	// Nor are references to unknown conversations
+	unknown, err := main.TipReference(message, message)
+	testinggo.AssertNoError(t, err)
+	testinggo.AssertNoError(t, main.MineTransfer(node, clawbacks.Miner, nil, clawbacks.Transactions, memos, "Alice", aliceKey, "Bob", &bobKey.PublicKey, 6, "", []*bcgo.Reference{unknown}))
+
+	tips := main.NewTips(node, datastore, clawbacks.Transactions)
+	totals, err := tips.GetTips(conversation)
+	testinggo.AssertNoError(t, err)
+	if len(totals) != 1 {
+		t.Fatalf("Wrong number of tips; expected '%d', got '%d'", 1, len(totals))
+	}
+	if totals[message] != 5 {
+		t.Errorf("Wrong tips; expected '%d', got '%d'", 5, totals[message])
+	}
+
+	// Only new transactions are processed
+	testinggo.AssertNoError(t, main.MineTransfer(node, clawbacks.Miner, nil, clawbacks.Transactions, memos, "Alice", aliceKey, "Bob", &bobKey.PublicKey, 4, "", []*bcgo.Reference{reference}))
+	totals, err = tips.GetTips(conversation)
+	testinggo.AssertNoError(t, err)
+	if totals[message] != 9 {
+		t.Errorf("Wrong tips; expected '%d', got '%d'", 9, totals[message])
+	}
+
+	// Other conversations have no tips
+	totals, err = tips.GetTips(message)
+	testinggo.AssertNoError(t, err)
+	if len(totals) != 0 {
+		t.Errorf("Wrong number of tips; expected '%d', got '%d'", 0, len(totals))
+	}
+
+	// A block which fails part way isn't counted until it can be processed in full
+	tipHash, tip, err := conveygo.ProtoToRecord("Alice", aliceKey, 0, &conveygo.Transaction{Sender: "Alice", Receiver: "Bob", Amount: 8})
+	testinggo.AssertNoError(t, err)
+	tip.Reference = []*bcgo.Reference{reference}
+	block := &bcgo.Block{
+		ChannelName: clawbacks.Transactions.Name,
+		Previous:    clawbacks.Transactions.Head,
+		Entry: []*bcgo.BlockEntry{
+			{RecordHash: tipHash, Record: tip},
+			{RecordHash: []byte("invalid"), Record: &bcgo.Record{Creator: "Alice", Payload: []byte("invalid"), Reference: []*bcgo.Reference{reference}}},
+		},
+	}
+	blockHash, err := cryptogo.HashProtobuf(block)
+	testinggo.AssertNoError(t, err)
+	testinggo.AssertNoError(t, node.Cache.PutBlock(blockHash, block))
+	clawbacks.Transactions.Head = blockHash
+	for i := 0; i < 2; i++ {
+		_, err = tips.GetTips(conversation)
+		if err == nil {
+			t.Fatal("Expected error")
+		}
+		if total := tips.Totals[reference.ChannelName][message]; total != 9 {
+			t.Errorf("Wrong tips; expected '%d', got '%d'", 9, total)
+		}
+	}
+}
+
+func TestTokenTransferHandler_Tip(t *testing.T) {
+	aliceKey := makeKey(t)
+	bobKey := makeKey(t)
+	node := makeNode(t, "Merchant", makeKey(t))
+	clawbacks := makeClawbacks(t, conveygo.NewLedger(node))
+	makeAlias(t, node, clawbacks.Aliases, "Alice", aliceKey)
+	makeAlias(t, node, clawbacks.Aliases, "Bob", bobKey)
+	clawbacks.Ledger.Earned["Alice"] = 100
+	clawbacks.Ledger.Earned["Bob"] = 100
+	keys := map[string]*rsa.PrivateKey{
+		"Alice": aliceKey,
+		"Bob":   bobKey,
+	}
+	tmplt, err := template.New("").Parse(`{{ .Recipient }}:{{ .Conversation }}:{{ .Message }}`)
+	testinggo.AssertNoError(t, err)
+
+	for name, tt := range map[string]struct {
+		sender           string
+		recipient        string
+		expectedLocation string
+		expectedError    string
+	}{
+		"Author":    {"Alice", "Bob", "/token-transfer-confirmation", ""},
+		"NotAuthor": {"Alice", "Alice", "/token-transfer", "Tips go to the author of the message: Bob"},
+		"Own":       {"Bob", "Bob", "/token-transfer", main.ERROR_TIP_OWN_MESSAGE},
+	} {
+		t.Run(name, func(t *testing.T) {
+			datastore, conversation, message := makeTipConversation(t, "Bob")
+			sessionstore := main.NewMemorySessionStore()
+			session, err := sessionstore.CreateSignInSession(tt.sender, keys[tt.sender])
+			testinggo.AssertNoError(t, err)
+			cookie := main.CreateSignInSessionCookie(session, time.Hour)
+			handler := main.TokenTransferHandler(sessionstore, makeMockUserStore(t, ""), datastore, clawbacks, MockFraudFlags{}, clawbacks.Aliases, node, tmplt)
+
+			request := httptest.NewRequest("GET", "/token-transfer?conversation="+conversation+"&message="+message, nil)
+			request.AddCookie(cookie)
+			response := httptest.NewRecorder()
+			handler(response, request)
+
+			if expected := "Bob:" + conversation + ":" + message; response.Body.String() != expected {
+				t.Errorf("Wrong response; expected '%s', got '%s'", expected, response.Body.String())
+			}
+
+			s := sessionstore.GetSignInSession(session).TokenTransfer
+			if s.Recipient != "Bob" {
+				t.Errorf("Wrong recipient; expected '%s', got '%s'", "Bob", s.Recipient)
+			}
+
+			request = makePostTokenTransferRequest(t, "/token-transfer", &url.Values{
+				"quantity":  {"5"},
+				"recipient": {tt.recipient},
+			})
+			request.AddCookie(cookie)
+			response = httptest.NewRecorder()
+			handler(response, request)
+
+			if l := response.Header().Get("Location"); l != tt.expectedLocation {
+				t.Errorf("Wrong location; expected '%s', got '%s'", tt.expectedLocation, l)
+			}
+			if s.Error != tt.expectedError {
+				t.Errorf("Wrong error; expected '%s', got '%s'", tt.expectedError, s.Error)
+			}
+		})
+	}
+}
@@ -18,6 +18,8 @@ package main
 
 import (
 	"crypto/rsa"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"github.com/AletheiaWareLLC/aliasgo"
 	"github.com/AletheiaWareLLC/bcgo"
@@ -26,18 +28,10 @@ import (
 	"html/template"
 	"log"
 	"net/http"
-	"sort"
 	"strconv"
+	"time"
 )
 
-/* Token Bundles:
-- 25 tokens for 50c ($0.02 each)
-- 100 tokens for $1 ($0.01 each)
-- 1250 tokens for $10 ($0.008 each)
-- 20000 tokens for $100 ($0.005 each)
-- 1000000 tokens for $1000 ($0.001 each)
-*/
-
 const (
 	ERROR_INVALID_TOKEN_QUANTITY      = "Invalid token quantity: %d"
 	ERROR_NO_SUCH_ALIAS               = "No such alias: %s"
@@ -46,19 +40,25 @@ const (
 )
 
 type TokenPurchaseTemplate struct {
-	Error         string
-	TokenBundle   []*TokenBundle
-	PaymentMethod []*PaymentMethod
+	Error                    string
+	Currency                 string
+	Currencies               []string
+	TokenBundle              []*TokenBundle
+	PaymentMethod            []*PaymentMethod
+	DefaultPaymentMethod     string
+	Unavailable              bool // Some bundles are hidden as the reserve is too low
+	PaymentMethodUnavailable bool // Saved payment methods couldn't be loaded from the processor
 }
 
 type TokenBundle struct {
 	ID        string
+	Name      string
 	Quantity  uint64
 	Price     string
 	UnitPrice string
 }
 
-func TokenPurchaseHandler(sessions SessionStore, users conveygo.UserStore, payments PaymentProcessor, ledger *conveygo.Ledger, node *bcgo.Node, template *template.Template, productIds []string) func(w http.ResponseWriter, r *http.Request) {
+func TokenPurchaseHandler(sessions SessionStore, users conveygo.UserStore, payments PaymentProcessor, ledger *conveygo.Ledger, transactions *bcgo.Channel, node *bcgo.Node, miner *ChannelMiner, listener bcgo.MiningListener, template *template.Template, catalogue *BundleCatalogue, promos PromoStore, limiter *PurchaseLimiter, flags FraudFlags, queue *MiningQueue) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		log.Println(r.RemoteAddr, r.Proto, r.Method, r.Host, r.URL.Path, r.Header)
 		// If not signed in, redirect to sign in page
@@ -84,37 +84,46 @@ func TokenPurchaseHandler(sessions SessionStore, users conveygo.UserStore, payme
 				s := session.TokenPurchase
 				switch r.Method {
 				case "GET":
-					s.Product, err = payments.GetProducts(productIds)
-					if err != nil {
-						log.Println(err)
-						http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
-						return
+					now := time.Now()
+					currencies := catalogue.GetActiveCurrencies(now)
+					// Use the selected currency, else the last used, else the default for the user's locale
+					if c := r.FormValue("currency"); c != "" {
+						s.Currency = c
+					}
+					if s.Currency == "" {
+						s.Currency = DefaultCurrency(r.Header.Get("Accept-Language"), currencies)
 					}
 					data := &TokenPurchaseTemplate{
-						Error: s.Error,
+						Error:      s.Error,
+						Currency:   s.Currency,
+						Currencies: currencies,
 					}
-					for _, p := range s.Product {
-						if p.Quantity <= uint64(available) {
-							price := float64(p.Price)
-							unit := price / float64(p.Quantity)
+					for _, b := range catalogue.GetActiveBundles(now) {
+						p, ok := b.Prices[s.Currency]
+						if !ok {
+							continue
+						}
+						if int64(b.Quantity) > available {
+							// Hide bundles the reserve can't fill until it is replenished
+							data.Unavailable = true
+						} else {
 							data.TokenBundle = append(data.TokenBundle, &TokenBundle{
-								ID:        p.ID,
-								Quantity:  p.Quantity,
-								Price:     fmt.Sprintf("$%.2f", price/100),
-								UnitPrice: fmt.Sprintf("$%s", strconv.FormatFloat(unit/100, 'f', -1, 64)),
+								ID:        b.ID,
+								Name:      b.Name,
+								Quantity:  b.Quantity,
+								Price:     PriceToString(s.Currency, p),
+								UnitPrice: UnitPriceToString(s.Currency, float64(p)/float64(b.Quantity)),
 							})
 						}
 					}
-					sort.Slice(data.TokenBundle, func(i, j int) bool {
-						return data.TokenBundle[i].Quantity < data.TokenBundle[j].Quantity
-					})
 					if registration != nil {
-						data.PaymentMethod, err = payments.GetPaymentMethods(registration.CustomerId)
+						// Show the catalogue even if the processor is slow or down
+						data.PaymentMethod, err = GetPaymentMethodsWithin(payments, registration.CustomerId, PAYMENT_METHODS_TIMEOUT)
 						if err != nil {
 							log.Println(err)
-							http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
-							return
+							data.PaymentMethodUnavailable = true
 						}
+						data.DefaultPaymentMethod = GetDefaultPaymentMethod(data.PaymentMethod)
 					}
 					if err := template.Execute(w, data); err != nil {
 						log.Println(err)
@@ -125,26 +134,249 @@ func TokenPurchaseHandler(sessions SessionStore, users conveygo.UserStore, payme
 					s.Error = ""
 					productId := r.FormValue("product")
 					paymentMethodId := r.FormValue("payment-method")
+					currency := r.FormValue("currency")
+					now := time.Now()
+
+					if IsFlagged(flags, session.Alias) {
+						s.Error = ERROR_ACCOUNT_FLAGGED
+						RedirectTokenPurchase(w, r)
+						return
+					}
 
-					product, ok := s.Product[productId]
+					var promo *PromoCode
+					if code := r.FormValue("promo"); code != "" {
+						promo, err = promos.GetPromoCode(code)
+						if err == nil {
+							err = promo.Check(session.Alias, now)
+						}
+						if err != nil {
+							s.Error = err.Error()
+							RedirectTokenPurchase(w, r)
+							return
+						}
+						if promo.Type == PROMO_GRANT {
+							if promo.Quantity > uint64(available) {
+								s.Error = fmt.Sprintf(ERROR_NOT_ENOUGH_TOKENS_AVAILABLE, promo.Quantity, available)
+								RedirectTokenPurchase(w, r)
+								return
+							}
+							// Reserve the code before queueing the grant so parallel requests can't use it beyond its limit
+							if _, err := promos.Redeem(promo.Code, session.Alias, now); err != nil {
+								s.Error = err.Error()
+								RedirectTokenPurchase(w, r)
+								return
+							}
+							// Grant tokens just as a purchase credits them
+							alias, code, quantity := session.Alias, promo.Code, promo.Quantity
+							job, err := queue.Enqueue(alias, fmt.Sprintf("Grant %d tokens", quantity), "/purchased.html", func(node *bcgo.Node) ([]*bcgo.Channel, []string, error) {
+								if err := MineTransaction(node, miner, listener, transactions, node.Alias, node.Key, alias, quantity, nil); err != nil {
+									ReleasePromoCode(promos, code, alias)
+									return nil, nil, err
+								}
+								return []*bcgo.Channel{transactions}, nil, nil
+							})
+							if err != nil {
+								log.Println(err)
+								ReleasePromoCode(promos, code, alias)
+								http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+								return
+							}
+							RedirectJob(w, r, job.ID)
+							return
+						}
+					}
+
+					bundle, err := catalogue.GetBundle(productId, now)
+					if err != nil {
+						s.Error = err.Error()
+						RedirectTokenPurchase(w, r)
+						return
+					}
+					price, ok := bundle.Prices[currency]
 					if !ok {
-						s.Error = fmt.Sprintf(ERROR_NO_SUCH_PRODUCT, productId)
+						s.Error = fmt.Sprintf(ERROR_UNSUPPORTED_CURRENCY, currency)
 						RedirectTokenPurchase(w, r)
 						return
 					}
-					if product.Quantity > uint64(available) {
-						s.Error = fmt.Sprintf(ERROR_NOT_ENOUGH_TOKENS_AVAILABLE, product.Quantity, available)
+					if bundle.Quantity > uint64(available) {
+						s.Error = fmt.Sprintf(ERROR_NOT_ENOUGH_TOKENS_AVAILABLE, bundle.Quantity, available)
 						RedirectTokenPurchase(w, r)
 						return
 					}
 
-					_, err := payments.NewPaymentIntent(registration.CustomerId, paymentMethodId, session.Alias, fmt.Sprintf("%d Convey Tokens", product.Quantity), int64(product.Quantity), int64(product.Price))
+					// Identify the card across customers so the card limit can't be avoided by signing up again
+					methods, err := payments.GetPaymentMethods(registration.CustomerId)
 					if err != nil {
 						log.Println(err)
 						http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 						return
 					}
-					RedirectPurchased(w, r)
+					card := ""
+					for _, m := range methods {
+						if m.ID == paymentMethodId {
+							card = m.ID
+							if m.Card != nil && m.Card.Fingerprint != "" {
+								card = m.Card.Fingerprint
+							}
+							break
+						}
+					}
+					if card == "" {
+						s.Error = fmt.Sprintf(ERROR_NO_SUCH_PAYMENT_METHOD, paymentMethodId)
+						RedirectTokenPurchase(w, r)
+						return
+					}
+
+					amount := int64(price)
+					description := bundle.Name
+					if promo != nil {
+						amount = promo.Discount(amount)
+						description = fmt.Sprintf("%s (%s)", bundle.Name, promo.Code)
+					}
+
+					// Count the purchase towards the limits before charging so parallel purchases can't exceed them
+					reservation, err := limiter.Reserve(session.Alias, card, paymentMethodId, currency, amount, now)
+					if err != nil {
+						s.Error = err.Error()
+						RedirectTokenPurchase(w, r)
+						return
+					}
+					s.Reservation = reservation
+					s.Promo = ""
+					if promo != nil {
+						// Reserve the code before charging so parallel purchases can't use it beyond its limit
+						if _, err := promos.Redeem(promo.Code, session.Alias, now); err != nil {
+							limiter.Release(reservation)
+							s.Reservation = nil
+							s.Error = err.Error()
+							RedirectTokenPurchase(w, r)
+							return
+						}
+						s.Promo = promo.Code
+					}
+
+					intent, err := payments.NewPaymentIntent(registration.CustomerId, paymentMethodId, session.Alias, bundle.ProductId, description, currency, int64(bundle.Quantity), amount)
+					if err != nil {
+						log.Println(err)
+						ReleasePurchase(promos, limiter, session.Alias, s)
+						http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+						return
+					}
+					s.PaymentIntent = intent
+					ReleaseFailedPurchase(promos, limiter, session.Alias, s)
+					RedirectPaymentIntent(w, r, s)
+					return
+				default:
+					log.Println("Unsupported method", r.Method)
+				}
+			}
+		}
+		RedirectSignIn(w, r)
+	}
+}
+
+// ReleasePromoCode frees a promo code reserved for a purchase which failed.
+func ReleasePromoCode(promos PromoStore, code, alias string) {
+	if code == "" {
+		return
+	}
+	if err := promos.Release(code, alias); err != nil {
+		log.Println(err)
+	}
+}
+
+// ReleasePurchase frees the promo code and the limits reserved for the session's payment.
+func ReleasePurchase(promos PromoStore, limiter *PurchaseLimiter, alias string, s *TokenPurchaseSession) {
+	ReleasePromoCode(promos, s.Promo, alias)
+	if s.Reservation != nil {
+		limiter.Release(s.Reservation)
+	}
+	s.Promo = ""
+	s.Reservation = nil
+}
+
+// ReleaseFailedPurchase frees the promo code and the limits reserved for the session's payment once the payment has failed.
+func ReleaseFailedPurchase(promos PromoStore, limiter *PurchaseLimiter, alias string, s *TokenPurchaseSession) {
+	switch s.PaymentIntent.Status {
+	case PAYMENT_INTENT_PROCESSING, PAYMENT_INTENT_REQUIRES_ACTION:
+		// Still pending
+	case PAYMENT_INTENT_SUCCEEDED:
+		// Keep the reservations
+		s.Promo = ""
+		s.Reservation = nil
+	default:
+		ReleasePurchase(promos, limiter, alias, s)
+	}
+}
+
+// RedirectPaymentIntent redirects to the page for the state of the session's payment.
+func RedirectPaymentIntent(w http.ResponseWriter, r *http.Request, s *TokenPurchaseSession) {
+	switch s.PaymentIntent.Status {
+	case PAYMENT_INTENT_SUCCEEDED:
+		s.PaymentIntent = nil
+		RedirectPurchased(w, r)
+	case PAYMENT_INTENT_PROCESSING, PAYMENT_INTENT_REQUIRES_ACTION:
+		RedirectTokenPurchaseConfirmation(w, r)
+	default:
+		s.Error = fmt.Sprintf(ERROR_PAYMENT_FAILED, s.PaymentIntent.Error)
+		s.PaymentIntent = nil
+		RedirectTokenPurchase(w, r)
+	}
+}
+
+type TokenPurchaseConfirmationTemplate struct {
+	PublishableKey string
+	ClientSecret   string
+	Status         string
+}
+
+// TokenPurchaseConfirmationHandler completes authentication of a payment on-session, and shows the payment as pending until it succeeds or fails.
+func TokenPurchaseConfirmationHandler(sessions SessionStore, payments PaymentProcessor, promos PromoStore, limiter *PurchaseLimiter, template *template.Template) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println(r.RemoteAddr, r.Proto, r.Method, r.Host, r.URL.Path, r.Header)
+		// If not signed in, redirect to sign in page
+		cookie, err := GetSignInSessionCookie(r)
+		if err == nil {
+			session := sessions.GetSignInSession(cookie.Value)
+			if session != nil {
+				id, err := sessions.RefreshSignInSession(session)
+				if err == nil {
+					http.SetCookie(w, CreateSignInSessionCookie(id, sessions.GetSignInSessionTimeout()))
+				}
+				s := session.TokenPurchase
+				if s == nil || s.PaymentIntent == nil {
+					RedirectTokenPurchase(w, r)
+					return
+				}
+				// Refresh the state of the payment
+				intent, err := payments.GetPaymentIntent(s.PaymentIntent.ID)
+				if err != nil {
+					log.Println(err)
+					http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+					return
+				}
+				s.PaymentIntent = intent
+				ReleaseFailedPurchase(promos, limiter, session.Alias, s)
+				switch r.Method {
+				case "GET":
+					switch intent.Status {
+					case PAYMENT_INTENT_PROCESSING, PAYMENT_INTENT_REQUIRES_ACTION:
+						data := &TokenPurchaseConfirmationTemplate{
+							PublishableKey: payments.GetPublishableKey(),
+							ClientSecret:   intent.ClientSecret,
+							Status:         intent.Status,
+						}
+						if err := template.Execute(w, data); err != nil {
+							log.Println(err)
+							http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+						}
+					default:
+						RedirectPaymentIntent(w, r, s)
+					}
+					return
+				case "POST":
+					// Authentication completed or abandoned
+					RedirectPaymentIntent(w, r, s)
 					return
 				default:
 					log.Println("Unsupported method", r.Method)
@@ -185,11 +417,19 @@ func TokenSubscriptionHandler(sessions SessionStore, users conveygo.UserStore, p
 }
 
 type TokenTransferTemplate struct {
-	Error     string
-	Available int64
+	Error        string
+	Available    int64
+	Recipient    string
+	Quantity     int64
+	Memo         string
+	MaximumMemo  int
+	Conversation string
+	Message      string
 }
 
-func TokenTransferHandler(sessions SessionStore, users conveygo.UserStore, ledger *conveygo.Ledger, aliases, transactions *bcgo.Channel, node *bcgo.Node, listener bcgo.MiningListener, template *template.Template) func(w http.ResponseWriter, r *http.Request) {
+// TokenTransferHandler checks the transfer entered by the user, and holds it in the session until it is confirmed.
+// A tip is started by giving the conversation and message in the request, the transfer is filled in with the author of the message.
+func TokenTransferHandler(sessions SessionStore, users conveygo.UserStore, messages conveygo.MessageStore, clawbacks *Clawbacks, flags FraudFlags, aliases *bcgo.Channel, node *bcgo.Node, template *template.Template) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		log.Println(r.RemoteAddr, r.Proto, r.Method, r.Host, r.URL.Path, r.Header)
 		// If not signed in, redirect to sign in page
@@ -201,16 +441,43 @@ func TokenTransferHandler(sessions SessionStore, users conveygo.UserStore, ledge
 				if err == nil {
 					http.SetCookie(w, CreateSignInSessionCookie(id, sessions.GetSignInSessionTimeout()))
 				}
-				available := ledger.GetBalance(session.Alias)
+				available := clawbacks.Balance(session.Alias)
 				if session.TokenTransfer == nil {
 					session.TokenTransfer = &TokenTransferSession{}
 				}
 				s := session.TokenTransfer
 				switch r.Method {
 				case "GET":
+					if r.FormValue("cancel") != "" {
+						s = &TokenTransferSession{}
+						session.TokenTransfer = s
+					}
+					if conversation, message := r.FormValue("conversation"), r.FormValue("message"); conversation != "" && message != "" {
+						s = &TokenTransferSession{
+							Conversation: conversation,
+							Message:      message,
+						}
+						session.TokenTransfer = s
+						author, err := GetMessageAuthor(messages, conversation, message)
+						if err != nil {
+							log.Println(err)
+							http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+							return
+						}
+						s.Recipient = author
+					}
 					data := &TokenTransferTemplate{
-						Error:     s.Error,
-						Available: available,
+						Error:        s.Error,
+						Available:    available,
+						Recipient:    s.Recipient,
+						Quantity:     s.Quantity,
+						Memo:         s.Memo,
+						MaximumMemo:  MAXIMUM_MEMO_LENGTH,
+						Conversation: s.Conversation,
+						Message:      s.Message,
+					}
+					if data.Quantity <= 0 {
+						data.Quantity = 1
 					}
 					if err := template.Execute(w, data); err != nil {
 						log.Println(err)
@@ -219,27 +486,21 @@ func TokenTransferHandler(sessions SessionStore, users conveygo.UserStore, ledge
 					return
 				case "POST":
 					s.Error = ""
-					quantity := r.FormValue("quantity")
-					recipient := r.FormValue("recipient")
+					s.Recipient = r.FormValue("recipient")
+					s.Memo = r.FormValue("memo")
 
-					q, err := strconv.Atoi(quantity)
+					q, err := strconv.Atoi(r.FormValue("quantity"))
 					if err != nil {
 						s.Error = err.Error()
-					} else if q <= 0 {
-						s.Error = fmt.Sprintf(ERROR_INVALID_TOKEN_QUANTITY, q)
-					} else if int64(q) > available {
-						s.Error = fmt.Sprintf(ERROR_NOT_ENOUGH_TOKENS_AVAILABLE, q, available)
 					} else {
-						_, err := aliasgo.GetPublicKey(aliases, node.Cache, node.Network, recipient)
-						if err != nil {
-							s.Error = fmt.Sprintf(ERROR_NO_SUCH_ALIAS, recipient)
+						s.Quantity = int64(q)
+						if _, err := CheckTokenTransfer(clawbacks, flags, aliases, node, session.Alias, s.Recipient, s.Quantity, s.Memo); err != nil {
+							s.Error = err.Error()
+						} else if err := checkTip(messages, session.Alias, s); err != nil {
+							s.Error = err.Error()
 						} else {
-							if err := MineTransaction(node, listener, transactions, session.Alias, session.Key, recipient, uint64(q)); err != nil {
-								s.Error = err.Error()
-							} else {
-								RedirectTransfered(w, r)
-								return
-							}
+							RedirectTokenTransferConfirmation(w, r)
+							return
 						}
 					}
 					RedirectTokenTransfer(w, r)
@@ -253,35 +514,188 @@ func TokenTransferHandler(sessions SessionStore, users conveygo.UserStore, ledge
 	}
 }
 
-func MineTransaction(node *bcgo.Node, listener bcgo.MiningListener, transactions *bcgo.Channel, senderAlias string, senderKey *rsa.PrivateKey, recipient string, amount uint64) error {
-	transaction := &conveygo.Transaction{
-		Sender:   senderAlias,
-		Receiver: recipient,
-		Amount:   amount,
+// checkTip ensures a tip goes to the author of the message being tipped.
+func checkTip(messages conveygo.MessageStore, sender string, s *TokenTransferSession) error {
+	if s.Message == "" {
+		return nil
 	}
-	log.Println("Transaction", transaction)
-
-	data, err := proto.Marshal(transaction)
+	author, err := GetMessageAuthor(messages, s.Conversation, s.Message)
 	if err != nil {
 		return err
 	}
+	if author != s.Recipient {
+		return errors.New(fmt.Sprintf(ERROR_TIP_NOT_AUTHOR, author))
+	}
+	if author == sender {
+		return errors.New(ERROR_TIP_OWN_MESSAGE)
+	}
+	return nil
+}
 
-	_, record, err := bcgo.CreateRecord(bcgo.Timestamp(), senderAlias, senderKey, nil, nil, data)
+type TokenTransferConfirmationTemplate struct {
+	Error              string
+	Available          int64
+	Remaining          int64
+	Recipient          string
+	RecipientTimestamp string
+	RecipientPublicKey string
+	Quantity           int64
+	Memo               string
+	Conversation       string
+	Message            string
+}
+
+// TokenTransferConfirmationHandler shows the recipient and quantity of the transfer held in the session, and mines the transaction once the user confirms.
+func TokenTransferConfirmationHandler(sessions SessionStore, clawbacks *Clawbacks, flags FraudFlags, aliases, transactions, memos *bcgo.Channel, node *bcgo.Node, miner *ChannelMiner, listener bcgo.MiningListener, queue *MiningQueue, template *template.Template) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println(r.RemoteAddr, r.Proto, r.Method, r.Host, r.URL.Path, r.Header)
+		// If not signed in, redirect to sign in page
+		cookie, err := GetSignInSessionCookie(r)
+		if err == nil {
+			session := sessions.GetSignInSession(cookie.Value)
+			if session != nil {
+				id, err := sessions.RefreshSignInSession(session)
+				if err == nil {
+					http.SetCookie(w, CreateSignInSessionCookie(id, sessions.GetSignInSessionTimeout()))
+				}
+				s := session.TokenTransfer
+				if s == nil || s.Recipient == "" {
+					// Nothing to confirm
+					RedirectTokenTransfer(w, r)
+					return
+				}
+				switch r.Method {
+				case "GET":
+					available := clawbacks.Balance(session.Alias)
+					data := &TokenTransferConfirmationTemplate{
+						Error:        s.Error,
+						Available:    available,
+						Remaining:    available - s.Quantity,
+						Recipient:    s.Recipient,
+						Quantity:     s.Quantity,
+						Memo:         s.Memo,
+						Conversation: s.Conversation,
+						Message:      s.Message,
+					}
+					record, a, err := aliasgo.GetRecord(aliases, node.Cache, node.Network, s.Recipient)
+					if err != nil {
+						log.Println(err)
+						s.Error = fmt.Sprintf(ERROR_NO_SUCH_ALIAS, s.Recipient)
+						RedirectTokenTransfer(w, r)
+						return
+					}
+					data.RecipientTimestamp = bcgo.TimestampToString(record.Timestamp)
+					data.RecipientPublicKey = base64.RawURLEncoding.EncodeToString(a.PublicKey)
+					if err := template.Execute(w, data); err != nil {
+						log.Println(err)
+						http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+					}
+					return
+				case "POST":
+					s.Error = ""
+					// Check again as the balance may have changed since the transfer was entered
+					recipientKey, err := CheckTokenTransfer(clawbacks, flags, aliases, node, session.Alias, s.Recipient, s.Quantity, s.Memo)
+					if err != nil {
+						s.Error = err.Error()
+					} else if references, err := transferReferences(s); err != nil {
+						s.Error = err.Error()
+					} else if job, err := queue.Enqueue(session.Alias, fmt.Sprintf("Transfer %d tokens to %s", s.Quantity, s.Recipient), "/transfered.html", transferJob(clawbacks, miner, listener, transactions, memos, session, s, recipientKey, references)); err != nil {
+						s.Error = err.Error()
+					} else {
+						session.TokenTransfer = nil
+						RedirectJob(w, r, job.ID)
+						return
+					}
+					RedirectTokenTransfer(w, r)
+					return
+				default:
+					log.Println("Unsupported method", r.Method)
+				}
+			}
+		}
+		RedirectSignIn(w, r)
+	}
+}
+
+// transferJob returns any reclaimed tokens, then mines the transfer held in the session.
+func transferJob(clawbacks *Clawbacks, miner *ChannelMiner, listener bcgo.MiningListener, transactions, memos *bcgo.Channel, session *SignInSession, s *TokenTransferSession, recipientKey *rsa.PublicKey, references []*bcgo.Reference) JobFunc {
+	sender, key, recipient, quantity, memo := session.Alias, session.Key, s.Recipient, uint64(s.Quantity), s.Memo
+	return func(node *bcgo.Node) ([]*bcgo.Channel, []string, error) {
+		if err := clawbacks.Settle(node, sender, key); err != nil {
+			return nil, nil, err
+		}
+		if err := MineTransfer(node, miner, listener, transactions, memos, sender, key, recipient, recipientKey, quantity, memo, references); err != nil {
+			return nil, nil, err
+		}
+		return []*bcgo.Channel{transactions, memos}, nil, nil
+	}
+}
+
+// transferReferences returns the message referenced by a tip.
+func transferReferences(s *TokenTransferSession) ([]*bcgo.Reference, error) {
+	if s.Message == "" {
+		return nil, nil
+	}
+	reference, err := TipReference(s.Conversation, s.Message)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	log.Println("Record", record)
+	return []*bcgo.Reference{reference}, nil
+}
 
-	if _, err := bcgo.WriteRecord(transactions.Name, node.Cache, record); err != nil {
-		return err
+// CheckTokenTransfer returns the public key of the recipient if the sender can transfer the given quantity of tokens to them.
+func CheckTokenTransfer(clawbacks *Clawbacks, flags FraudFlags, aliases *bcgo.Channel, node *bcgo.Node, sender, recipient string, quantity int64, memo string) (*rsa.PublicKey, error) {
+	available := clawbacks.Balance(sender)
+	if IsFlagged(flags, sender) {
+		return nil, errors.New(ERROR_ACCOUNT_FLAGGED)
+	}
+	if available < 0 {
+		return nil, errors.New(fmt.Sprintf(ERROR_ACCOUNT_FROZEN, available))
+	}
+	if quantity <= 0 {
+		return nil, errors.New(fmt.Sprintf(ERROR_INVALID_TOKEN_QUANTITY, quantity))
+	}
+	if quantity > available {
+		return nil, errors.New(fmt.Sprintf(ERROR_NOT_ENOUGH_TOKENS_AVAILABLE, quantity, available))
+	}
+	if err := ValidateMemo(memo); err != nil {
+		return nil, err
 	}
+	key, err := aliasgo.GetPublicKey(aliases, node.Cache, node.Network, recipient)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf(ERROR_NO_SUCH_ALIAS, recipient))
+	}
+	return key, nil
+}
 
-	if _, _, err := node.Mine(transactions, bcgo.THRESHOLD_G, listener); err != nil {
+func MineTransaction(node *bcgo.Node, miner *ChannelMiner, listener bcgo.MiningListener, transactions *bcgo.Channel, senderAlias string, senderKey *rsa.PrivateKey, recipient string, amount uint64, references []*bcgo.Reference) error {
+	record, err := SignTransaction(bcgo.Timestamp(), senderAlias, senderKey, recipient, amount, references)
+	if err != nil {
 		return err
 	}
-
-	if err := transactions.Push(node.Cache, node.Network); err != nil {
+	if _, err := MineSignedRecord(node, miner, listener, transactions, record); err != nil {
 		return err
 	}
 	return nil
 }
+
+// SignTransaction creates a record of a transaction from the sender to the recipient, signed by the sender, which can be mined later without the sender's key.
+func SignTransaction(timestamp uint64, senderAlias string, senderKey *rsa.PrivateKey, recipient string, amount uint64, references []*bcgo.Reference) (*bcgo.Record, error) {
+	transaction := &conveygo.Transaction{
+		Sender:   senderAlias,
+		Receiver: recipient,
+		Amount:   amount,
+	}
+	log.Println("Transaction", transaction)
+
+	data, err := proto.Marshal(transaction)
+	if err != nil {
+		return nil, err
+	}
+
+	_, record, err := bcgo.CreateRecord(timestamp, senderAlias, senderKey, nil, references, data)
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
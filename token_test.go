@@ -0,0 +1,544 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"github.com/AletheiaWareLLC/bcgo"
+	"github.com/AletheiaWareLLC/conveygo"
+	"github.com/AletheiaWareLLC/conveyservergo"
+	"github.com/AletheiaWareLLC/testinggo"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func makeTokenPurchaseConfirmationTemplate(t *testing.T) *template.Template {
+	t.Helper()
+	tmplt, err := template.New("").Parse(`{{ .ClientSecret }}{{ .Status }}`)
+	testinggo.AssertNoError(t, err)
+	return tmplt
+}
+
+func makeTokenPurchaseTemplate(t *testing.T) *template.Template {
+	t.Helper()
+	tmplt, err := template.New("").Parse(`{{ .Error }}{{ .Currency }}:{{ range .TokenBundle }}{{ .ID }}:{{ .Name }}:{{ .Price }};{{ end }}{{ if .Unavailable }}unavailable{{ end }}{{ if .PaymentMethodUnavailable }}methods unavailable{{ end }}`)
+	testinggo.AssertNoError(t, err)
+	return tmplt
+}
+
+func TestTokenPurchaseHandler(t *testing.T) {
+	alias := "Alice"
+	key, err := rsa.GenerateKey(rand.Reader, 4096)
+	if err != nil {
+		t.Error("Could not generate key:", err)
+	}
+	catalogue := &main.BundleCatalogue{
+		Version: main.BUNDLE_CATALOGUE_VERSION,
+		Bundle: []*main.Bundle{
+			{ID: "large", ProductId: "prod_2", Name: "Large", Quantity: 1250, Prices: map[string]uint64{"usd": 1000, "jpy": 1000}},
+			{ID: "small", ProductId: "prod_1", Name: "Small", Quantity: 100, Prices: map[string]uint64{"usd": 100}},
+			{ID: "expired", ProductId: "prod_3", Name: "Expired", Quantity: 200, Prices: map[string]uint64{"usd": 100}, End: time.Now().AddDate(0, 0, -1)},
+		},
+	}
+	for name, tt := range map[string]struct {
+		available uint64
+		query     string
+		language  string
+		err       error
+		expected  string
+	}{
+		"GETAll":          {10000, "", "", nil, "usd:small:Small:$1.00;large:Large:$10.00;"},
+		"GETLimited":      {1000, "", "", nil, "usd:small:Small:$1.00;unavailable"},
+		"GETCurrency":     {10000, "?currency=jpy", "", nil, "jpy:large:Large:¥1000;"},
+		"GETLocale":       {10000, "", "ja-JP,ja;q=0.9", nil, "jpy:large:Large:¥1000;"},
+		"GETProcessorErr": {10000, "", "", errors.New("Processor down"), "usd:small:Small:$1.00;large:Large:$10.00;methods unavailable"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			sessionstore := main.NewMemorySessionStore()
+			session, err := sessionstore.CreateSignInSession(alias, key)
+			testinggo.AssertNoError(t, err)
+
+			node := &bcgo.Node{Alias: "Merchant"}
+			ledger := conveygo.NewLedger(node)
+			ledger.Earned[node.Alias] = tt.available
+
+			request, err := http.NewRequest("GET", "/token-purchase"+tt.query, nil)
+			testinggo.AssertNoError(t, err)
+			request.Header.Set("Accept-Language", tt.language)
+			request.AddCookie(main.CreateSignInSessionCookie(session, time.Hour))
+			response := httptest.NewRecorder()
+
+			payments := makeMockPaymentProcessor(t).(*MockPaymentProcessor)
+			payments.Error = tt.err
+			handler := main.TokenPurchaseHandler(sessionstore, makeMockUserStore(t, "cus_1"), payments, ledger, nil, node, main.NewChannelMiner(), nil, makeTokenPurchaseTemplate(t), catalogue, nil, nil, nil, nil)
+			handler(response, request)
+
+			if response.Code != http.StatusOK {
+				t.Errorf("Wrong response code; expected '%d', got '%d'", http.StatusOK, response.Code)
+			}
+			if actual := response.Body.String(); actual != tt.expected {
+				t.Errorf("Wrong response; expected '%s', got '%s'", tt.expected, actual)
+			}
+		})
+	}
+}
+
+func TestTokenPurchaseHandler_Promo(t *testing.T) {
+	merchantKey := makeKey(t)
+	aliceKey := makeKey(t)
+	catalogue := &main.BundleCatalogue{
+		Version: main.BUNDLE_CATALOGUE_VERSION,
+		Bundle: []*main.Bundle{
+			{ID: "small", ProductId: "prod_1", Name: "Small", Quantity: 100, Prices: map[string]uint64{"usd": 100}},
+		},
+	}
+	for name, tt := range map[string]struct {
+		code             string
+		redeemed         bool
+		status           string
+		expectedLocation string
+		expectedError    string
+		expectedBalance  int64
+		expectedAmount   int64
+		expectedRedeemed bool
+	}{
+		"Grant":            {"grant50", false, main.PAYMENT_INTENT_SUCCEEDED, "/purchased.html", "", 50, 0, true},
+		"GrantRedeemed":    {"GRANT50", true, main.PAYMENT_INTENT_SUCCEEDED, "/token-purchase", "Promo code already redeemed: GRANT50", 0, 0, true},
+		"Discount":         {"SAVE20", false, main.PAYMENT_INTENT_SUCCEEDED, "/purchased.html", "", 0, 80, true},
+		"DiscountPending":  {"SAVE20", false, main.PAYMENT_INTENT_REQUIRES_ACTION, "/token-purchase-confirmation", "", 0, 80, true},
+		"DiscountDeclined": {"SAVE20", false, main.PAYMENT_INTENT_REQUIRES_PAYMENT_METHOD, "/token-purchase", "Payment failed: Your card was declined.", 0, 80, false},
+		"DiscountRedeemed": {"SAVE20", true, main.PAYMENT_INTENT_SUCCEEDED, "/token-purchase", "Promo code already redeemed: SAVE20", 0, 0, true},
+		"Unknown":          {"FOO", false, main.PAYMENT_INTENT_SUCCEEDED, "/token-purchase", "No such promo code: FOO", 0, 0, false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := testinggo.MakeTempDir(t, "promo")
+			defer testinggo.UnmakeTempDir(t, dir)
+			promos := main.NewFilePromoStore(path.Join(dir, "promo-codes.json"))
+			testinggo.AssertNoError(t, promos.AddPromoCode(&main.PromoCode{Code: "GRANT50", Type: main.PROMO_GRANT, Quantity: 50}))
+			testinggo.AssertNoError(t, promos.AddPromoCode(&main.PromoCode{Code: "SAVE20", Type: main.PROMO_DISCOUNT, Percent: 20}))
+			if tt.redeemed {
+				_, err := promos.Redeem(tt.code, "Alice", time.Now())
+				testinggo.AssertNoError(t, err)
+			}
+
+			node := makeNode(t, "Merchant", merchantKey)
+			clawbacks := makeClawbacks(t, conveygo.NewLedger(node))
+			makeAlias(t, node, clawbacks.Aliases, "Alice", aliceKey)
+			clawbacks.Ledger.Earned[node.Alias] = 1000
+
+			sessionstore := main.NewMemorySessionStore()
+			session, err := sessionstore.CreateSignInSession("Alice", aliceKey)
+			testinggo.AssertNoError(t, err)
+
+			payments := &MockPaymentProcessor{
+				PaymentMethods: []*main.PaymentMethod{
+					{ID: "pm_1"},
+				},
+				PaymentIntent: &main.PaymentIntent{
+					ID:     "pi_1",
+					Status: tt.status,
+					Error:  main.ERROR_CARD_DECLINED,
+				},
+			}
+
+			request := makePostTokenPurchaseRequest(t, &url.Values{
+				"product":        {"small"},
+				"payment-method": {"pm_1"},
+				"currency":       {"usd"},
+				"promo":          {tt.code},
+			})
+			request.AddCookie(main.CreateSignInSessionCookie(session, time.Hour))
+			response := httptest.NewRecorder()
+
+			queue := makeMiningQueue(t, node)
+			defer queue.Stop()
+
+			handler := main.TokenPurchaseHandler(sessionstore, makeMockUserStore(t, "cus_1"), payments, clawbacks.Ledger, clawbacks.Transactions, node, clawbacks.Miner, nil, makeTokenPurchaseTemplate(t), catalogue, promos, main.NewPurchaseLimiter(&main.PurchaseLimits{}), MockFraudFlags{}, queue)
+			handler(response, request)
+
+			// Grants are mined by the queue, which redirects once done
+			if l := followJob(t, queue, response.Header().Get("Location")); l != tt.expectedLocation {
+				t.Errorf("Wrong location; expected '%s', got '%s'", tt.expectedLocation, l)
+			}
+			if e := sessionstore.GetSignInSession(session).TokenPurchase.Error; e != tt.expectedError {
+				t.Errorf("Wrong error; expected '%s', got '%s'", tt.expectedError, e)
+			}
+			updateLedger(t, clawbacks)
+			if b := clawbacks.Ledger.GetBalance("Alice"); b != tt.expectedBalance {
+				t.Errorf("Wrong balance; expected '%d', got '%d'", tt.expectedBalance, b)
+			}
+			if payments.Amount != tt.expectedAmount {
+				t.Errorf("Wrong amount; expected '%d', got '%d'", tt.expectedAmount, payments.Amount)
+			}
+			if code, err := promos.GetPromoCode(tt.code); err == nil {
+				if _, ok := code.Redeemed["Alice"]; ok != tt.expectedRedeemed {
+					t.Errorf("Wrong redeemed; expected '%t', got '%t'", tt.expectedRedeemed, ok)
+				}
+			}
+		})
+	}
+}
+
+func TestTokenPurchaseHandler_Limits(t *testing.T) {
+	merchantKey := makeKey(t)
+	aliceKey := makeKey(t)
+	catalogue := &main.BundleCatalogue{
+		Version: main.BUNDLE_CATALOGUE_VERSION,
+		Bundle: []*main.Bundle{
+			{ID: "small", ProductId: "prod_1", Name: "Small", Quantity: 100, Prices: map[string]uint64{"usd": 100}},
+		},
+	}
+	for name, tt := range map[string]struct {
+		limits           *main.PurchaseLimits
+		flags            MockFraudFlags
+		status           string
+		purchases        int
+		expectedLocation string
+		expectedError    string
+	}{
+		"Allowed":       {&main.PurchaseLimits{AliasDaily: map[string]int64{"usd": 200}}, MockFraudFlags{}, main.PAYMENT_INTENT_SUCCEEDED, 2, "/purchased.html", ""},
+		"Limited":       {&main.PurchaseLimits{AliasDaily: map[string]int64{"usd": 200}}, MockFraudFlags{}, main.PAYMENT_INTENT_SUCCEEDED, 3, "/token-purchase", "Daily purchase limit reached: 2.00 USD of 2.00 USD spent in the last day"},
+		"OtherCurrency": {&main.PurchaseLimits{AliasDaily: map[string]int64{"eur": 100}}, MockFraudFlags{}, main.PAYMENT_INTENT_SUCCEEDED, 3, "/purchased.html", ""},
+		"CardUsed":      {&main.PurchaseLimits{CardDaily: map[string]int64{"usd": 100}}, MockFraudFlags{}, main.PAYMENT_INTENT_SUCCEEDED, 2, "/token-purchase", "Daily purchase limit reached for this card: 1.00 USD of 1.00 USD spent in the last day"},
+		"Declined":      {&main.PurchaseLimits{AliasDaily: map[string]int64{"usd": 100}}, MockFraudFlags{}, main.PAYMENT_INTENT_REQUIRES_PAYMENT_METHOD, 3, "/token-purchase", "Payment failed: Your card was declined."},
+		"Flagged": {&main.PurchaseLimits{}, MockFraudFlags{
+			"Alice": &main.FraudFlag{Alias: "Alice", Reason: main.FRAUD_EARLY_WARNING},
+		}, main.PAYMENT_INTENT_SUCCEEDED, 1, "/token-purchase", main.ERROR_ACCOUNT_FLAGGED},
+	} {
+		t.Run(name, func(t *testing.T) {
+			node := makeNode(t, "Merchant", merchantKey)
+			clawbacks := makeClawbacks(t, conveygo.NewLedger(node))
+			makeAlias(t, node, clawbacks.Aliases, "Alice", aliceKey)
+			clawbacks.Ledger.Earned[node.Alias] = 1000
+
+			sessionstore := main.NewMemorySessionStore()
+			session, err := sessionstore.CreateSignInSession("Alice", aliceKey)
+			testinggo.AssertNoError(t, err)
+
+			payments := &MockPaymentProcessor{
+				PaymentMethods: []*main.PaymentMethod{
+					{ID: "pm_1", Card: &main.PaymentMethodCard{Fingerprint: "card_1"}},
+				},
+				PaymentIntent: &main.PaymentIntent{
+					ID:     "pi_1",
+					Status: tt.status,
+					Error:  main.ERROR_CARD_DECLINED,
+				},
+			}
+
+			handler := main.TokenPurchaseHandler(sessionstore, makeMockUserStore(t, "cus_1"), payments, clawbacks.Ledger, clawbacks.Transactions, node, clawbacks.Miner, nil, makeTokenPurchaseTemplate(t), catalogue, nil, main.NewPurchaseLimiter(tt.limits), tt.flags, nil)
+
+			var response *httptest.ResponseRecorder
+			for i := 0; i < tt.purchases; i++ {
+				request := makePostTokenPurchaseRequest(t, &url.Values{
+					"product":        {"small"},
+					"payment-method": {"pm_1"},
+					"currency":       {"usd"},
+				})
+				request.AddCookie(main.CreateSignInSessionCookie(session, time.Hour))
+				response = httptest.NewRecorder()
+				handler(response, request)
+			}
+
+			if l := response.Header().Get("Location"); l != tt.expectedLocation {
+				t.Errorf("Wrong location; expected '%s', got '%s'", tt.expectedLocation, l)
+			}
+			if e := sessionstore.GetSignInSession(session).TokenPurchase.Error; e != tt.expectedError {
+				t.Errorf("Wrong error; expected '%s', got '%s'", tt.expectedError, e)
+			}
+		})
+	}
+}
+
+func makePostTokenPurchaseRequest(t *testing.T, values *url.Values) *http.Request {
+	t.Helper()
+	request, err := http.NewRequest("POST", "/token-purchase", strings.NewReader(values.Encode()))
+	testinggo.AssertNoError(t, err)
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	return request
+}
+
+func TestTokenPurchaseConfirmationHandler(t *testing.T) {
+	alias := "Alice"
+	key, err := rsa.GenerateKey(rand.Reader, 4096)
+	if err != nil {
+		t.Error("Could not generate key:", err)
+	}
+	for name, tt := range map[string]struct {
+		method           string
+		status           string
+		expectedCode     int
+		expectedBody     string
+		expectedError    string
+		expectedRedeemed bool
+	}{
+		"GETRequiresAction": {"GET", main.PAYMENT_INTENT_REQUIRES_ACTION, http.StatusOK, "secret" + main.PAYMENT_INTENT_REQUIRES_ACTION, "", true},
+		"GETProcessing":     {"GET", main.PAYMENT_INTENT_PROCESSING, http.StatusOK, "secret" + main.PAYMENT_INTENT_PROCESSING, "", true},
+		"GETSucceeded":      {"GET", main.PAYMENT_INTENT_SUCCEEDED, http.StatusFound, "<a href=\"/purchased.html\">Found</a>.\n\n", "", true},
+		"POSTSucceeded":     {"POST", main.PAYMENT_INTENT_SUCCEEDED, http.StatusFound, "", "", true},
+		"POSTFailed":        {"POST", main.PAYMENT_INTENT_REQUIRES_PAYMENT_METHOD, http.StatusFound, "", "Payment failed: Your card was declined.", false},
+		"POSTCanceled":      {"POST", main.PAYMENT_INTENT_CANCELED, http.StatusFound, "", "Payment failed: Your card was declined.", false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := testinggo.MakeTempDir(t, "promo")
+			defer testinggo.UnmakeTempDir(t, dir)
+			promos := main.NewFilePromoStore(path.Join(dir, "promo-codes.json"))
+			testinggo.AssertNoError(t, promos.AddPromoCode(&main.PromoCode{Code: "SAVE20", Type: main.PROMO_DISCOUNT, Percent: 20}))
+			_, err := promos.Redeem("SAVE20", alias, time.Now())
+			testinggo.AssertNoError(t, err)
+
+			sessionstore := main.NewMemorySessionStore()
+			session, err := sessionstore.CreateSignInSession(alias, key)
+			testinggo.AssertNoError(t, err)
+			sessionstore.GetSignInSession(session).TokenPurchase = &main.TokenPurchaseSession{
+				PaymentIntent: &main.PaymentIntent{
+					ID: "pi_1",
+				},
+				Promo: "SAVE20",
+			}
+
+			payments := &MockPaymentProcessor{
+				PaymentIntent: &main.PaymentIntent{
+					ID:           "pi_1",
+					Status:       tt.status,
+					ClientSecret: "secret",
+					Error:        main.ERROR_CARD_DECLINED,
+				},
+			}
+
+			request, err := http.NewRequest(tt.method, "/token-purchase-confirmation", nil)
+			testinggo.AssertNoError(t, err)
+			request.AddCookie(main.CreateSignInSessionCookie(session, time.Hour))
+			response := httptest.NewRecorder()
+
+			handler := main.TokenPurchaseConfirmationHandler(sessionstore, payments, promos, main.NewPurchaseLimiter(&main.PurchaseLimits{}), makeTokenPurchaseConfirmationTemplate(t))
+			handler(response, request)
+
+			if response.Code != tt.expectedCode {
+				t.Errorf("Wrong response code; expected '%d', got '%d'", tt.expectedCode, response.Code)
+			}
+			if tt.expectedBody != "" {
+				if actual := response.Body.String(); actual != tt.expectedBody {
+					t.Errorf("Wrong response; expected '%s', got '%s'", tt.expectedBody, actual)
+				}
+			}
+			if e := sessionstore.GetSignInSession(session).TokenPurchase.Error; e != tt.expectedError {
+				t.Errorf("Wrong error; expected '%s', got '%s'", tt.expectedError, e)
+			}
+			code, err := promos.GetPromoCode("SAVE20")
+			testinggo.AssertNoError(t, err)
+			if _, ok := code.Redeemed[alias]; ok != tt.expectedRedeemed {
+				t.Errorf("Wrong redeemed; expected '%t', got '%t'", tt.expectedRedeemed, ok)
+			}
+		})
+	}
+	t.Run("GETNoPaymentIntent", func(t *testing.T) {
+		// Redirect to Token Purchase page
+		sessionstore := main.NewMemorySessionStore()
+		session, err := sessionstore.CreateSignInSession(alias, key)
+		testinggo.AssertNoError(t, err)
+
+		request, err := http.NewRequest("GET", "/token-purchase-confirmation", nil)
+		testinggo.AssertNoError(t, err)
+		request.AddCookie(main.CreateSignInSessionCookie(session, time.Hour))
+		response := httptest.NewRecorder()
+
+		handler := main.TokenPurchaseConfirmationHandler(sessionstore, makeMockPaymentProcessor(t), nil, nil, makeTokenPurchaseConfirmationTemplate(t))
+		handler(response, request)
+
+		if response.Code != http.StatusFound {
+			t.Errorf("Wrong response code; expected '%d', got '%d'", http.StatusFound, response.Code)
+		}
+		if l := response.Header().Get("Location"); l != "/token-purchase" {
+			t.Errorf("Wrong location; expected '%s', got '%s'", "/token-purchase", l)
+		}
+	})
+}
+
+func TestTokenTransferHandler(t *testing.T) {
+	aliceKey := makeKey(t)
+	bobKey := makeKey(t)
+	node := makeNode(t, "Merchant", makeKey(t))
+	clawbacks := makeClawbacks(t, conveygo.NewLedger(node))
+	makeAlias(t, node, clawbacks.Aliases, "Bob", bobKey)
+	clawbacks.Ledger.Earned["Alice"] = 100
+
+	for name, tt := range map[string]struct {
+		quantity         string
+		recipient        string
+		memo             string
+		flags            MockFraudFlags
+		expectedLocation string
+		expectedError    string
+	}{
+		"Valid":        {"10", "Bob", "Lunch", MockFraudFlags{}, "/token-transfer-confirmation", ""},
+		"NotANumber":   {"ten", "Bob", "", MockFraudFlags{}, "/token-transfer", `strconv.Atoi: parsing "ten": invalid syntax`},
+		"Zero":         {"0", "Bob", "", MockFraudFlags{}, "/token-transfer", "Invalid token quantity: 0"},
+		"TooMany":      {"101", "Bob", "", MockFraudFlags{}, "/token-transfer", "Not enough tokens available: 101 requested, 100 available"},
+		"UnknownAlias": {"10", "Bobb", "", MockFraudFlags{}, "/token-transfer", "No such alias: Bobb"},
+		"MemoTooLong":  {"10", "Bob", strings.Repeat("a", 300), MockFraudFlags{}, "/token-transfer", "Memo too long: 300 characters, maximum 256"},
+		"Flagged":      {"10", "Bob", "", MockFraudFlags{"Alice": &main.FraudFlag{Alias: "Alice"}}, "/token-transfer", main.ERROR_ACCOUNT_FLAGGED},
+	} {
+		t.Run(name, func(t *testing.T) {
+			sessionstore := main.NewMemorySessionStore()
+			session, err := sessionstore.CreateSignInSession("Alice", aliceKey)
+			testinggo.AssertNoError(t, err)
+
+			request := makePostTokenTransferRequest(t, "/token-transfer", &url.Values{
+				"quantity":  {tt.quantity},
+				"recipient": {tt.recipient},
+				"memo":      {tt.memo},
+			})
+			request.AddCookie(main.CreateSignInSessionCookie(session, time.Hour))
+			response := httptest.NewRecorder()
+
+			main.TokenTransferHandler(sessionstore, makeMockUserStore(t, ""), conveygo.NewMemoryStore(), clawbacks, tt.flags, clawbacks.Aliases, node, nil)(response, request)
+
+			if l := response.Header().Get("Location"); l != tt.expectedLocation {
+				t.Errorf("Wrong location; expected '%s', got '%s'", tt.expectedLocation, l)
+			}
+			s := sessionstore.GetSignInSession(session).TokenTransfer
+			if s.Error != tt.expectedError {
+				t.Errorf("Wrong error; expected '%s', got '%s'", tt.expectedError, s.Error)
+			}
+			if s.Recipient != tt.recipient {
+				t.Errorf("Wrong recipient; expected '%s', got '%s'", tt.recipient, s.Recipient)
+			}
+		})
+	}
+}
+
+func makePostTokenTransferRequest(t *testing.T, path string, values *url.Values) *http.Request {
+	t.Helper()
+	request, err := http.NewRequest("POST", path, strings.NewReader(values.Encode()))
+	testinggo.AssertNoError(t, err)
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	return request
+}
+
+func TestTokenTransferConfirmationHandler(t *testing.T) {
+	aliceKey := makeKey(t)
+	bobKey := makeKey(t)
+	tmplt, err := template.New("").Parse(`{{ .Recipient }}:{{ .RecipientTimestamp }}:{{ .Quantity }}:{{ .Memo }}:{{ .Remaining }}`)
+	testinggo.AssertNoError(t, err)
+	setup := func(t *testing.T) (*main.Clawbacks, *bcgo.Channel, main.SessionStore, string) {
+		t.Helper()
+		node := makeNode(t, "Merchant", makeKey(t))
+		clawbacks := makeClawbacks(t, conveygo.NewLedger(node))
+		makeAlias(t, node, clawbacks.Aliases, "Bob", bobKey)
+		clawbacks.Ledger.Earned["Alice"] = 100
+		sessionstore := main.NewMemorySessionStore()
+		session, err := sessionstore.CreateSignInSession("Alice", aliceKey)
+		testinggo.AssertNoError(t, err)
+		return clawbacks, main.OpenTransferMemoChannel(), sessionstore, session
+	}
+	t.Run("GETNothingPending", func(t *testing.T) {
+		clawbacks, memos, sessionstore, session := setup(t)
+		queue := makeMiningQueue(t, clawbacks.Node)
+		defer queue.Stop()
+		request, err := http.NewRequest("GET", "/token-transfer-confirmation", nil)
+		testinggo.AssertNoError(t, err)
+		request.AddCookie(main.CreateSignInSessionCookie(session, time.Hour))
+		response := httptest.NewRecorder()
+		main.TokenTransferConfirmationHandler(sessionstore, clawbacks, MockFraudFlags{}, clawbacks.Aliases, clawbacks.Transactions, memos, clawbacks.Node, clawbacks.Miner, nil, queue, tmplt)(response, request)
+		if l := response.Header().Get("Location"); l != "/token-transfer" {
+			t.Errorf("Wrong location; expected '%s', got '%s'", "/token-transfer", l)
+		}
+	})
+	t.Run("GET", func(t *testing.T) {
+		clawbacks, memos, sessionstore, session := setup(t)
+		queue := makeMiningQueue(t, clawbacks.Node)
+		defer queue.Stop()
+		sessionstore.GetSignInSession(session).TokenTransfer = &main.TokenTransferSession{
+			Recipient: "Bob",
+			Quantity:  10,
+			Memo:      "Lunch",
+		}
+		request, err := http.NewRequest("GET", "/token-transfer-confirmation", nil)
+		testinggo.AssertNoError(t, err)
+		request.AddCookie(main.CreateSignInSessionCookie(session, time.Hour))
+		response := httptest.NewRecorder()
+		main.TokenTransferConfirmationHandler(sessionstore, clawbacks, MockFraudFlags{}, clawbacks.Aliases, clawbacks.Transactions, memos, clawbacks.Node, clawbacks.Miner, nil, queue, tmplt)(response, request)
+		if response.Code != http.StatusOK {
+			t.Errorf("Wrong response code; expected '%d', got '%d'", http.StatusOK, response.Code)
+		}
+		body := response.Body.String()
+		if !strings.HasPrefix(body, "Bob:") || !strings.HasSuffix(body, ":10:Lunch:90") {
+			t.Errorf("Wrong response; got '%s'", body)
+		}
+	})
+	t.Run("POST", func(t *testing.T) {
+		clawbacks, memos, sessionstore, session := setup(t)
+		queue := makeMiningQueue(t, clawbacks.Node)
+		defer queue.Stop()
+		sessionstore.GetSignInSession(session).TokenTransfer = &main.TokenTransferSession{
+			Recipient: "Bob",
+			Quantity:  10,
+			Memo:      "Lunch",
+		}
+		request := makePostTokenTransferRequest(t, "/token-transfer-confirmation", &url.Values{})
+		request.AddCookie(main.CreateSignInSessionCookie(session, time.Hour))
+		response := httptest.NewRecorder()
+		main.TokenTransferConfirmationHandler(sessionstore, clawbacks, MockFraudFlags{}, clawbacks.Aliases, clawbacks.Transactions, memos, clawbacks.Node, clawbacks.Miner, nil, queue, tmplt)(response, request)
+		if l := followJob(t, queue, response.Header().Get("Location")); l != "/transfered.html" {
+			t.Errorf("Wrong location; expected '%s', got '%s'", "/transfered.html", l)
+		}
+		if s := sessionstore.GetSignInSession(session).TokenTransfer; s != nil {
+			t.Errorf("Expected transfer to be cleared, got '%v'", s)
+		}
+		transfers, err := main.GetTransfers(clawbacks.Node, clawbacks.Transactions, memos, "Bob", bobKey)
+		testinggo.AssertNoError(t, err)
+		if len(transfers) != 1 {
+			t.Fatalf("Wrong number of transfers; expected '%d', got '%d'", 1, len(transfers))
+		}
+		if transfers[0].Amount != 10 {
+			t.Errorf("Wrong amount; expected '%d', got '%d'", 10, transfers[0].Amount)
+		}
+		if transfers[0].Memo != "Lunch" {
+			t.Errorf("Wrong memo; expected '%s', got '%s'", "Lunch", transfers[0].Memo)
+		}
+	})
+	t.Run("POSTBalanceChanged", func(t *testing.T) {
+		clawbacks, memos, sessionstore, session := setup(t)
+		queue := makeMiningQueue(t, clawbacks.Node)
+		defer queue.Stop()
+		sessionstore.GetSignInSession(session).TokenTransfer = &main.TokenTransferSession{
+			Recipient: "Bob",
+			Quantity:  10,
+		}
+		clawbacks.Ledger.Spent["Alice"] = 95
+		request := makePostTokenTransferRequest(t, "/token-transfer-confirmation", &url.Values{})
+		request.AddCookie(main.CreateSignInSessionCookie(session, time.Hour))
+		response := httptest.NewRecorder()
+		main.TokenTransferConfirmationHandler(sessionstore, clawbacks, MockFraudFlags{}, clawbacks.Aliases, clawbacks.Transactions, memos, clawbacks.Node, clawbacks.Miner, nil, queue, tmplt)(response, request)
+		if l := response.Header().Get("Location"); l != "/token-transfer" {
+			t.Errorf("Wrong location; expected '%s', got '%s'", "/token-transfer", l)
+		}
+		expected := "Not enough tokens available: 10 requested, 5 available"
+		if e := sessionstore.GetSignInSession(session).TokenTransfer.Error; e != expected {
+			t.Errorf("Wrong error; expected '%s', got '%s'", expected, e)
+		}
+	})
+}
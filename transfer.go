@@ -0,0 +1,213 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/AletheiaWareLLC/bcgo"
+	"github.com/AletheiaWareLLC/conveygo"
+	"github.com/golang/protobuf/proto"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"unicode/utf8"
+)
+
+const (
+	CONVEY_TRANSFER_MEMO = "Convey-Transfer-Memo" // conveygo.Message Chain, encrypted to sender and receiver, referencing a transaction
+
+	ERROR_MEMO_TOO_LONG = "Memo too long: %d characters, maximum %d"
+
+	MAXIMUM_MEMO_LENGTH = 256
+)
+
+func OpenTransferMemoChannel() *bcgo.Channel {
+	return bcgo.OpenPoWChannel(CONVEY_TRANSFER_MEMO, bcgo.THRESHOLD_G)
+}
+
+func ValidateMemo(memo string) error {
+	if l := utf8.RuneCountInString(memo); l > MAXIMUM_MEMO_LENGTH {
+		return errors.New(fmt.Sprintf(ERROR_MEMO_TOO_LONG, l, MAXIMUM_MEMO_LENGTH))
+	}
+	return nil
+}
+
+// MineTransfer mines a transaction of the given amount from the sender to the recipient with the given references, and if given, mines the memo into the memo channel encrypted so only the sender and recipient can read it.
+// The memo is mined after the transaction, so once the transaction is mined a failure to mine the memo is logged rather than failing the transfer.
+func MineTransfer(node *bcgo.Node, miner *ChannelMiner, listener bcgo.MiningListener, transactions, memos *bcgo.Channel, senderAlias string, senderKey *rsa.PrivateKey, recipient string, recipientKey *rsa.PublicKey, amount uint64, memo string, references []*bcgo.Reference) error {
+	transaction := &conveygo.Transaction{
+		Sender:   senderAlias,
+		Receiver: recipient,
+		Amount:   amount,
+	}
+	log.Println("Transaction", transaction)
+
+	reference, err := MineRecord(node, miner, listener, transactions, senderAlias, senderKey, nil, references, nil, transaction)
+	if err != nil {
+		return err
+	}
+	if memo == "" {
+		return nil
+	}
+
+	message := &conveygo.Message{
+		Content: []byte(memo),
+		Type:    conveygo.MediaType_TEXT_PLAIN,
+	}
+	access := map[string]*rsa.PublicKey{
+		senderAlias: &senderKey.PublicKey,
+		recipient:   recipientKey,
+	}
+	if _, err := MineRecord(node, miner, listener, memos, senderAlias, senderKey, access, []*bcgo.Reference{reference}, nil, message); err != nil {
+		log.Println("Transferred without memo", err)
+	}
+	return nil
+}
+
+// Transfer is a transaction sent or received by an alias.
+type Transfer struct {
+	Hash      string // Transaction Record Hash
+	Timestamp uint64
+	Sender    string
+	Receiver  string
+	Amount    uint64
+	Memo      string
+}
+
+// GetTransferMemos returns the memos the given alias can read, keyed by the record hash of their transaction.
+func GetTransferMemos(node *bcgo.Node, memos *bcgo.Channel, alias string, key *rsa.PrivateKey) (map[string]string, error) {
+	results := make(map[string]string)
+	if err := bcgo.Read(memos.Name, memos.Head, nil, node.Cache, node.Network, alias, key, nil, func(entry *bcgo.BlockEntry, key, payload []byte) error {
+		message := &conveygo.Message{}
+		if err := proto.Unmarshal(payload, message); err != nil {
+			return err
+		}
+		for _, r := range entry.Record.Reference {
+			if r.ChannelName == conveygo.CONVEY_TRANSACTION {
+				results[base64.RawURLEncoding.EncodeToString(r.RecordHash)] = string(message.Content)
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// GetTransfers returns the transactions sent or received by the given alias, newest first, along with their memos.
+func GetTransfers(node *bcgo.Node, transactions, memos *bcgo.Channel, alias string, key *rsa.PrivateKey) ([]*Transfer, error) {
+	m, err := GetTransferMemos(node, memos, alias, key)
+	if err != nil {
+		return nil, err
+	}
+	var results []*Transfer
+	if err := bcgo.Iterate(transactions.Name, transactions.Head, nil, node.Cache, node.Network, func(h []byte, b *bcgo.Block) error {
+		for _, entry := range b.Entry {
+			transaction := &conveygo.Transaction{}
+			if err := proto.Unmarshal(entry.Record.Payload, transaction); err != nil {
+				return err
+			}
+			if transaction.Sender != alias && transaction.Receiver != alias {
+				continue
+			}
+			hash := base64.RawURLEncoding.EncodeToString(entry.RecordHash)
+			results = append(results, &Transfer{
+				Hash:      hash,
+				Timestamp: entry.Record.Timestamp,
+				Sender:    transaction.Sender,
+				Receiver:  transaction.Receiver,
+				Amount:    transaction.Amount,
+				Memo:      m[hash],
+			})
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Timestamp > results[j].Timestamp
+	})
+	return results, nil
+}
+
+type TransferTemplate struct {
+	Hash      string
+	Timestamp string
+	Sender    string
+	Receiver  string
+	Amount    uint64
+	Sent      bool
+	Memo      string
+}
+
+type TransfersTemplate struct {
+	Alias    string
+	Transfer []*TransferTemplate
+}
+
+func TransfersHandler(sessions SessionStore, node *bcgo.Node, transactions, memos *bcgo.Channel, template *template.Template) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println(r.RemoteAddr, r.Proto, r.Method, r.Host, r.URL.Path, r.Header)
+		// If not signed in, redirect to sign in page
+		cookie, err := GetSignInSessionCookie(r)
+		if err == nil {
+			session := sessions.GetSignInSession(cookie.Value)
+			if session != nil {
+				id, err := sessions.RefreshSignInSession(session)
+				if err == nil {
+					http.SetCookie(w, CreateSignInSessionCookie(id, sessions.GetSignInSessionTimeout()))
+				}
+				switch r.Method {
+				case "GET":
+					transfers, err := GetTransfers(node, transactions, memos, session.Alias, session.Key)
+					if err != nil {
+						log.Println(err)
+						http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+						return
+					}
+					data := &TransfersTemplate{
+						Alias: session.Alias,
+					}
+					for _, t := range transfers {
+						data.Transfer = append(data.Transfer, &TransferTemplate{
+							Hash:      t.Hash,
+							Timestamp: bcgo.TimestampToString(t.Timestamp),
+							Sender:    t.Sender,
+							Receiver:  t.Receiver,
+							Amount:    t.Amount,
+							Sent:      t.Sender == session.Alias,
+							Memo:      t.Memo,
+						})
+					}
+					if err := template.Execute(w, data); err != nil {
+						log.Println(err)
+						http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+						return
+					}
+					return
+				default:
+					log.Println("Unsupported method", r.Method)
+				}
+			}
+		}
+		RedirectSignIn(w, r)
+	}
+}
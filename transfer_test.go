@@ -0,0 +1,159 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main_test
+
+import (
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"github.com/AletheiaWareLLC/bcgo"
+	"github.com/AletheiaWareLLC/conveygo"
+	"github.com/AletheiaWareLLC/conveyservergo"
+	"github.com/AletheiaWareLLC/testinggo"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateMemo(t *testing.T) {
+	for name, tt := range map[string]struct {
+		memo          string
+		expectedError string
+	}{
+		"Empty":   {"", ""},
+		"Short":   {"Thanks for lunch", ""},
+		"Maximum": {strings.Repeat("é", main.MAXIMUM_MEMO_LENGTH), ""},
+		"TooLong": {strings.Repeat("a", main.MAXIMUM_MEMO_LENGTH+1), "Memo too long: 257 characters, maximum 256"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := main.ValidateMemo(tt.memo)
+			if tt.expectedError == "" {
+				testinggo.AssertNoError(t, err)
+			} else {
+				testinggo.AssertError(t, tt.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestGetTransfers(t *testing.T) {
+	aliceKey := makeKey(t)
+	bobKey := makeKey(t)
+	charlieKey := makeKey(t)
+	node := makeNode(t, "Merchant", makeKey(t))
+	clawbacks := makeClawbacks(t, conveygo.NewLedger(node))
+	memos := main.OpenTransferMemoChannel()
+
+	testinggo.AssertNoError(t, main.MineTransfer(node, clawbacks.Miner, nil, clawbacks.Transactions, memos, "Alice", aliceKey, "Bob", &bobKey.PublicKey, 10, "Lunch", nil))
+	testinggo.AssertNoError(t, main.MineTransfer(node, clawbacks.Miner, nil, clawbacks.Transactions, memos, "Bob", bobKey, "Charlie", &charlieKey.PublicKey, 5, "", nil))
+
+	for name, tt := range map[string]struct {
+		key      *rsa.PrivateKey
+		expected []string
+	}{
+		"Alice":   {aliceKey, []string{"Alice>Bob:10:Lunch"}},
+		"Bob":     {bobKey, []string{"Bob>Charlie:5:", "Alice>Bob:10:Lunch"}},
+		"Charlie": {charlieKey, []string{"Bob>Charlie:5:"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			transfers, err := main.GetTransfers(node, clawbacks.Transactions, memos, name, tt.key)
+			testinggo.AssertNoError(t, err)
+			if len(transfers) != len(tt.expected) {
+				t.Fatalf("Wrong number of transfers; expected '%d', got '%d'", len(tt.expected), len(transfers))
+			}
+			for i, e := range tt.expected {
+				tr := transfers[i]
+				if a := fmt.Sprintf("%s>%s:%d:%s", tr.Sender, tr.Receiver, tr.Amount, tr.Memo); a != e {
+					t.Errorf("Wrong transfer; expected '%s', got '%s'", e, a)
+				}
+			}
+		})
+	}
+}
+
+// FailingValidator rejects every block.
+type FailingValidator struct{}
+
+func (v FailingValidator) Validate(channel *bcgo.Channel, cache bcgo.Cache, network bcgo.Network, hash []byte, block *bcgo.Block) error {
+	return errors.New("Rejected")
+}
+
+func TestMineTransfer_MemoFailed(t *testing.T) {
+	aliceKey := makeKey(t)
+	bobKey := makeKey(t)
+	node := makeNode(t, "Merchant", makeKey(t))
+	clawbacks := makeClawbacks(t, conveygo.NewLedger(node))
+	memos := main.OpenTransferMemoChannel()
+	memos.AddValidator(FailingValidator{})
+
+	// Transfer succeeds even though the memo can't be mined
+	testinggo.AssertNoError(t, main.MineTransfer(node, clawbacks.Miner, nil, clawbacks.Transactions, memos, "Alice", aliceKey, "Bob", &bobKey.PublicKey, 10, "Lunch", nil))
+	if memos.Head != nil {
+		t.Errorf("Expected no memo to be mined")
+	}
+	transfers, err := main.GetTransfers(node, clawbacks.Transactions, memos, "Bob", bobKey)
+	testinggo.AssertNoError(t, err)
+	if len(transfers) != 1 {
+		t.Fatalf("Wrong number of transfers; expected '%d', got '%d'", 1, len(transfers))
+	}
+	if m := transfers[0].Memo; m != "" {
+		t.Errorf("Wrong memo; expected '%s', got '%s'", "", m)
+	}
+}
+
+func TestTransfersHandler(t *testing.T) {
+	aliceKey := makeKey(t)
+	bobKey := makeKey(t)
+	node := makeNode(t, "Merchant", makeKey(t))
+	clawbacks := makeClawbacks(t, conveygo.NewLedger(node))
+	memos := main.OpenTransferMemoChannel()
+	testinggo.AssertNoError(t, main.MineTransfer(node, clawbacks.Miner, nil, clawbacks.Transactions, memos, "Alice", aliceKey, "Bob", &bobKey.PublicKey, 10, "Lunch", nil))
+
+	tmplt, err := template.New("").Parse(`{{ .Alias }}:{{ range .Transfer }}{{ .Sender }}>{{ .Receiver }}:{{ .Amount }}:{{ .Sent }}:{{ .Memo }};{{ end }}`)
+	testinggo.AssertNoError(t, err)
+
+	for name, tt := range map[string]struct {
+		key      *rsa.PrivateKey
+		expected string
+	}{
+		"Alice": {aliceKey, "Alice:Alice>Bob:10:true:Lunch;"},
+		"Bob":   {bobKey, "Bob:Alice>Bob:10:false:Lunch;"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			sessionstore := main.NewMemorySessionStore()
+			session, err := sessionstore.CreateSignInSession(name, tt.key)
+			testinggo.AssertNoError(t, err)
+
+			request, err := http.NewRequest("GET", "/account/transfers", nil)
+			testinggo.AssertNoError(t, err)
+			request.AddCookie(main.CreateSignInSessionCookie(session, time.Hour))
+			response := httptest.NewRecorder()
+
+			main.TransfersHandler(sessionstore, node, clawbacks.Transactions, memos, tmplt)(response, request)
+
+			if response.Code != http.StatusOK {
+				t.Errorf("Wrong response code; expected '%d', got '%d'", http.StatusOK, response.Code)
+			}
+			if actual := response.Body.String(); actual != tt.expected {
+				t.Errorf("Wrong response; expected '%s', got '%s'", tt.expected, actual)
+			}
+		})
+	}
+}
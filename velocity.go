@@ -0,0 +1,195 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ERROR_ALIAS_PURCHASE_LIMIT   = "Daily purchase limit reached: %s of %s spent in the last day"
+	ERROR_CARD_PURCHASE_LIMIT    = "Daily purchase limit reached for this card: %s of %s spent in the last day"
+	ERROR_PURCHASE_COOLDOWN      = "Too many purchases, try again in %s"
+	ERROR_INVALID_PURCHASE_LIMIT = "Invalid purchase limit: %s, expected currency:amount"
+)
+
+// PurchaseLimits caps the amount charged in a day to each alias and to each card, and sets the time between purchases by an alias.
+// Caps are in the smallest unit of each currency, and each currency is capped separately, a currency without a cap is unlimited.
+type PurchaseLimits struct {
+	AliasDaily map[string]int64 // Currency -> Amount
+	CardDaily  map[string]int64 // Currency -> Amount
+	Cooldown   time.Duration
+}
+
+// ParsePurchaseLimits parses the given daily caps, each a comma separated list of currency:amount, and cooldown duration, empty values are unlimited.
+func ParsePurchaseLimits(aliasDaily, cardDaily, cooldown string) (*PurchaseLimits, error) {
+	limits := &PurchaseLimits{}
+	var err error
+	if limits.AliasDaily, err = parsePurchaseLimit(aliasDaily); err != nil {
+		return nil, err
+	}
+	if limits.CardDaily, err = parsePurchaseLimit(cardDaily); err != nil {
+		return nil, err
+	}
+	if cooldown != "" {
+		if limits.Cooldown, err = time.ParseDuration(cooldown); err != nil {
+			return nil, err
+		}
+	}
+	return limits, nil
+}
+
+func parsePurchaseLimit(value string) (map[string]int64, error) {
+	limit := make(map[string]int64)
+	if value == "" {
+		return limit, nil
+	}
+	for _, l := range strings.Split(value, ",") {
+		parts := strings.Split(l, ":")
+		if len(parts) != 2 {
+			return nil, errors.New(fmt.Sprintf(ERROR_INVALID_PURCHASE_LIMIT, l))
+		}
+		currency := strings.ToLower(strings.TrimSpace(parts[0]))
+		amount, err := strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 64)
+		if currency == "" || err != nil || amount < 0 {
+			return nil, errors.New(fmt.Sprintf(ERROR_INVALID_PURCHASE_LIMIT, l))
+		}
+		limit[currency] = amount
+	}
+	return limit, nil
+}
+
+// PurchaseReservation is a purchase counted towards the limits while its payment is made.
+type PurchaseReservation struct {
+	Alias         string
+	Card          string // Identifies the card across customers, empty for charges loaded from the chain
+	PaymentMethod string
+	Currency      string
+	Amount        int64
+	Time          time.Time
+}
+
+// PurchaseLimiter remembers the purchases made in the last day and checks new purchases against the limits.
+// Purchases are held in memory, and loaded from the charges when the server starts so a restart doesn't reset the limits.
+type PurchaseLimiter struct {
+	Limits    *PurchaseLimits
+	purchases []*PurchaseReservation
+	lock      sync.Mutex
+}
+
+func NewPurchaseLimiter(limits *PurchaseLimits) *PurchaseLimiter {
+	return &PurchaseLimiter{
+		Limits: limits,
+	}
+}
+
+// Load counts the given charges made in the day before the given time towards the limits.
+// Charges only record the payment method, so they count towards the card limit of purchases with the same payment method.
+func (l *PurchaseLimiter) Load(charges []*ChargeRecord, now time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, c := range charges {
+		if c.Reference == nil || c.Charge == nil {
+			continue
+		}
+		l.purchases = append(l.purchases, &PurchaseReservation{
+			Alias:         c.Charge.CustomerAlias,
+			PaymentMethod: c.Charge.PaymentId,
+			Currency:      c.Charge.Currency,
+			Amount:        c.Charge.Amount,
+			Time:          time.Unix(0, int64(c.Reference.Timestamp)),
+		})
+	}
+	// Keep purchases in the order they were made so the oldest can be pruned
+	sort.SliceStable(l.purchases, func(i, j int) bool {
+		return l.purchases[i].Time.Before(l.purchases[j].Time)
+	})
+	l.prune(now)
+}
+
+// prune forgets purchases made over a day before the given time.
+func (l *PurchaseLimiter) prune(now time.Time) {
+	cutoff := now.Add(-24 * time.Hour)
+	i := 0
+	for i < len(l.purchases) && !l.purchases[i].Time.After(cutoff) {
+		i++
+	}
+	l.purchases = l.purchases[i:]
+}
+
+// Reserve counts the given alias being charged the given amount of the given currency with the given card and payment method at the given time towards the limits, or returns an error if the purchase would exceed them.
+// The limits are checked and the purchase counted under one lock so concurrent purchases can't exceed the limits together.
+func (l *PurchaseLimiter) Reserve(alias, card, method, currency string, amount int64, now time.Time) (*PurchaseReservation, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.prune(now)
+	var byAlias, byCard int64
+	var last time.Time
+	for _, p := range l.purchases {
+		if p.Alias == alias {
+			last = p.Time
+		}
+		if p.Currency != currency {
+			continue
+		}
+		if p.Alias == alias {
+			byAlias += p.Amount
+		}
+		if (p.Card != "" && p.Card == card) || (p.PaymentMethod != "" && p.PaymentMethod == method) {
+			byCard += p.Amount
+		}
+	}
+	if l.Limits.Cooldown > 0 && !last.IsZero() {
+		if wait := last.Add(l.Limits.Cooldown).Sub(now); wait > 0 {
+			return nil, errors.New(fmt.Sprintf(ERROR_PURCHASE_COOLDOWN, wait.Round(time.Second)))
+		}
+	}
+	if limit := l.Limits.AliasDaily[currency]; limit > 0 && byAlias+amount > limit {
+		return nil, errors.New(fmt.Sprintf(ERROR_ALIAS_PURCHASE_LIMIT, AmountToString(currency, byAlias), AmountToString(currency, limit)))
+	}
+	if limit := l.Limits.CardDaily[currency]; limit > 0 && byCard+amount > limit {
+		return nil, errors.New(fmt.Sprintf(ERROR_CARD_PURCHASE_LIMIT, AmountToString(currency, byCard), AmountToString(currency, limit)))
+	}
+	r := &PurchaseReservation{
+		Alias:         alias,
+		Card:          card,
+		PaymentMethod: method,
+		Currency:      currency,
+		Amount:        amount,
+		Time:          now,
+	}
+	l.purchases = append(l.purchases, r)
+	return r, nil
+}
+
+// Release stops counting the given reservation towards the limits, so a declined payment doesn't use up the caps.
+func (l *PurchaseLimiter) Release(reservation *PurchaseReservation) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for i, p := range l.purchases {
+		if p == reservation {
+			l.purchases = append(l.purchases[:i], l.purchases[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,163 @@
+/*
+ * Copyright 2020 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main_test
+
+import (
+	"github.com/AletheiaWareLLC/bcgo"
+	"github.com/AletheiaWareLLC/conveyservergo"
+	"github.com/AletheiaWareLLC/financego"
+	"github.com/AletheiaWareLLC/testinggo"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParsePurchaseLimits(t *testing.T) {
+	t.Run("Empty", func(t *testing.T) {
+		limits, err := main.ParsePurchaseLimits("", "", "")
+		testinggo.AssertNoError(t, err)
+		if len(limits.AliasDaily) != 0 || len(limits.CardDaily) != 0 || limits.Cooldown != 0 {
+			t.Errorf("Expected no limits, got '%v'", limits)
+		}
+	})
+	t.Run("Limits", func(t *testing.T) {
+		limits, err := main.ParsePurchaseLimits("usd:1000, JPY:100000", "usd:2000", "1m")
+		testinggo.AssertNoError(t, err)
+		if l := limits.AliasDaily["usd"]; l != 1000 {
+			t.Errorf("Wrong alias limit; expected '%d', got '%d'", 1000, l)
+		}
+		if l := limits.AliasDaily["jpy"]; l != 100000 {
+			t.Errorf("Wrong alias limit; expected '%d', got '%d'", 100000, l)
+		}
+		if l := limits.CardDaily["usd"]; l != 2000 {
+			t.Errorf("Wrong card limit; expected '%d', got '%d'", 2000, l)
+		}
+		if l := limits.CardDaily["jpy"]; l != 0 {
+			t.Errorf("Wrong card limit; expected '%d', got '%d'", 0, l)
+		}
+		if limits.Cooldown != time.Minute {
+			t.Errorf("Wrong cooldown; expected '%s', got '%s'", time.Minute, limits.Cooldown)
+		}
+	})
+	for name, tt := range map[string]struct {
+		aliasDaily, cooldown string
+		expectedError        string
+	}{
+		"NoCurrency": {"1000", "", "Invalid purchase limit: 1000, expected currency:amount"},
+		"NotANumber": {"usd:lots", "", "Invalid purchase limit: usd:lots, expected currency:amount"},
+		"Negative":   {"usd:-1", "", "Invalid purchase limit: usd:-1, expected currency:amount"},
+		"Cooldown":   {"", "soon", `time: invalid duration "soon"`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := main.ParsePurchaseLimits(tt.aliasDaily, "", tt.cooldown)
+			testinggo.AssertError(t, tt.expectedError, err)
+		})
+	}
+}
+
+func TestPurchaseLimiter(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	usd := func(amount int64) map[string]int64 {
+		return map[string]int64{"usd": amount}
+	}
+	for name, tt := range map[string]struct {
+		limits        *main.PurchaseLimits
+		alias, card   string
+		currency      string
+		amount        int64
+		time          time.Time
+		expectedError string
+	}{
+		"Unlimited":     {&main.PurchaseLimits{}, "Alice", "card_1", "usd", 1000000, now, ""},
+		"UnderAlias":    {&main.PurchaseLimits{AliasDaily: usd(2000)}, "Alice", "card_2", "usd", 1000, now, ""},
+		"OverAlias":     {&main.PurchaseLimits{AliasDaily: usd(2000)}, "Alice", "card_2", "usd", 1001, now, "Daily purchase limit reached: 10.00 USD of 20.00 USD spent in the last day"},
+		"OtherAlias":    {&main.PurchaseLimits{AliasDaily: usd(2000)}, "Bob", "card_2", "usd", 2000, now, ""},
+		"OverCard":      {&main.PurchaseLimits{CardDaily: usd(1500)}, "Bob", "card_1", "usd", 1000, now, "Daily purchase limit reached for this card: 10.00 USD of 15.00 USD spent in the last day"},
+		"OtherCurrency": {&main.PurchaseLimits{AliasDaily: map[string]int64{"usd": 1000, "jpy": 2000}}, "Alice", "card_1", "jpy", 2000, now, ""},
+		"OverCurrency":  {&main.PurchaseLimits{AliasDaily: map[string]int64{"usd": 1000, "jpy": 2000}}, "Alice", "card_1", "jpy", 2001, now, "Daily purchase limit reached: 0 JPY of 2000 JPY spent in the last day"},
+		"Uncapped":      {&main.PurchaseLimits{AliasDaily: usd(1000)}, "Alice", "card_1", "eur", 1000000, now, ""},
+		"NextDay":       {&main.PurchaseLimits{AliasDaily: usd(1000), CardDaily: usd(1000)}, "Alice", "card_1", "usd", 1000, now.Add(24 * time.Hour), ""},
+		"Cooldown":      {&main.PurchaseLimits{Cooldown: time.Hour}, "Alice", "card_2", "eur", 1, now, "Too many purchases, try again in 30m0s"},
+		"AfterCooldown": {&main.PurchaseLimits{Cooldown: time.Hour}, "Alice", "card_2", "usd", 1, now.Add(30 * time.Minute), ""},
+	} {
+		t.Run(name, func(t *testing.T) {
+			limiter := main.NewPurchaseLimiter(tt.limits)
+			// Alice was charged 10 USD with card_1 half an hour ago
+			_, err := limiter.Reserve("Alice", "card_1", "pm_1", "usd", 1000, now.Add(-30*time.Minute))
+			testinggo.AssertNoError(t, err)
+			_, err = limiter.Reserve(tt.alias, tt.card, "pm_"+tt.alias+"_"+tt.card, tt.currency, tt.amount, tt.time)
+			if tt.expectedError == "" {
+				testinggo.AssertNoError(t, err)
+			} else {
+				testinggo.AssertError(t, tt.expectedError, err)
+			}
+		})
+	}
+	t.Run("Release", func(t *testing.T) {
+		limiter := main.NewPurchaseLimiter(&main.PurchaseLimits{AliasDaily: usd(100)})
+		reservation, err := limiter.Reserve("Alice", "card_1", "pm_1", "usd", 100, now)
+		testinggo.AssertNoError(t, err)
+		_, err = limiter.Reserve("Alice", "card_1", "pm_1", "usd", 100, now)
+		testinggo.AssertError(t, "Daily purchase limit reached: 1.00 USD of 1.00 USD spent in the last day", err)
+		limiter.Release(reservation)
+		_, err = limiter.Reserve("Alice", "card_1", "pm_1", "usd", 100, now)
+		testinggo.AssertNoError(t, err)
+	})
+	t.Run("Load", func(t *testing.T) {
+		// Charges from before a restart still count towards the limits
+		limiter := main.NewPurchaseLimiter(&main.PurchaseLimits{AliasDaily: usd(1000), CardDaily: usd(1500)})
+		charge := func(alias, method string, amount int64, time time.Time) *main.ChargeRecord {
+			return &main.ChargeRecord{
+				Reference: &bcgo.Reference{Timestamp: uint64(time.UnixNano())},
+				Charge:    &financego.Charge{CustomerAlias: alias, PaymentId: method, Amount: amount, Currency: "usd"},
+			}
+		}
+		limiter.Load([]*main.ChargeRecord{
+			charge("Bob", "pm_1", 700, now.Add(-time.Hour)),
+			charge("Alice", "pm_1", 600, now.Add(-2*time.Hour)),
+			charge("Alice", "pm_2", 5000, now.Add(-25*time.Hour)),
+		}, now)
+		_, err := limiter.Reserve("Alice", "card_2", "pm_2", "usd", 500, now)
+		testinggo.AssertError(t, "Daily purchase limit reached: 6.00 USD of 10.00 USD spent in the last day", err)
+		_, err = limiter.Reserve("Charlie", "card_1", "pm_1", "usd", 300, now)
+		testinggo.AssertError(t, "Daily purchase limit reached for this card: 13.00 USD of 15.00 USD spent in the last day", err)
+		_, err = limiter.Reserve("Alice", "card_2", "pm_2", "usd", 400, now)
+		testinggo.AssertNoError(t, err)
+	})
+	t.Run("Parallel", func(t *testing.T) {
+		// Only one of many concurrent purchases fits under the cap
+		limiter := main.NewPurchaseLimiter(&main.PurchaseLimits{AliasDaily: usd(100)})
+		var wg sync.WaitGroup
+		var lock sync.Mutex
+		reserved := 0
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := limiter.Reserve("Alice", "card_1", "pm_1", "usd", 100, now); err == nil {
+					lock.Lock()
+					reserved++
+					lock.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		if reserved != 1 {
+			t.Errorf("Wrong reservations; expected '%d', got '%d'", 1, reserved)
+		}
+	})
+}